@@ -1,32 +1,226 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/crenshaw-dev/argocd-executor-plugin/internal"
 )
 
 func main() {
-	agentToken, err := os.ReadFile("/var/run/argo/token")
+	configFile := flag.String("config", os.Getenv("PLUGIN_CONFIG_FILE"), "path to a YAML or JSON file with the plugin's settings, which environment variables override. Defaults to $PLUGIN_CONFIG_FILE")
+	printSchema := flag.Bool("print-schema", false, "print the JSON schema of the plugin spec and exit")
+	flag.Parse()
+	if *printSchema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(argocd.Schema())
+		if err != nil {
+			panic(err.Error())
+		}
+		return
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		panic(err.Error())
+	}
+	startupConfig := config.Startup
+	agentTokenFile := startupConfig.AgentTokenFile
+	agentToken, err := os.ReadFile(agentTokenFile)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	client, err := apiclient.NewClient(&apiclient.ClientOptions{
-		// TODO: make this configurable by passing a root CA.
-		Insecure: true,
-	})
+	reloadAPIClient := func() (apiclient.Client, error) {
+		return newAPIClient(startupConfig)
+	}
+	opts := []argocd.ApiExecutorOption{
+		argocd.WithExecutorConfig(config.Executor),
+		argocd.WithLogger(argocd.NewLogger(startupConfig.LogLevel)),
+	}
+	if startupConfig.AuthTokenFile != "" {
+		opts = append(opts, argocd.WithAPIClientReloader(reloadAPIClient))
+	}
+	// Propagate trace context to the Argo CD API server, so that its spans join the plugin's traces.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracerProvider, err := newTracerProvider(context.Background())
 	if err != nil {
-		panic(fmt.Sprintf("failed to initialize Argo CD API client: %s", err))
+		panic(err.Error())
 	}
-	executor := argocd.NewApiExecutor(client, string(agentToken))
-	http.HandleFunc("/api/v1/template.execute", argocd.ArgocdPlugin(&executor))
-	err = http.ListenAndServe(":3000", nil)
+	if tracerProvider != nil {
+		otel.SetTracerProvider(tracerProvider)
+	}
+	metrics, err := argocd.NewMetrics(prometheus.DefaultRegisterer)
 	if err != nil {
+		panic(fmt.Sprintf("failed to register metrics: %s", err))
+	}
+	opts = append(opts, argocd.WithMetrics(metrics))
+	// The API client is created by Connect, which retries until Argo CD is reachable. Until then, /readyz fails.
+	executor := argocd.NewApiExecutor(nil, strings.TrimSpace(string(agentToken)), opts...)
+	go func() {
+		err := executor.Connect(context.Background(), reloadAPIClient, startupConfig.ConnectRetryLimit, startupConfig.ConnectBackoff)
+		if err != nil && !errors.Is(err, argocd.ErrShuttingDown) {
+			panic(err.Error())
+		}
+	}()
+	go executor.WatchAgentToken(context.Background(), agentTokenFile, startupConfig.AgentTokenReloadInterval)
+	if *configFile != "" {
+		go watchConfigReloads(&executor, *configFile, startupConfig.ReloadDrain)
+	}
+	http.HandleFunc("/api/v1/template.execute", argocd.ArgocdPlugin(&executor))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", argocd.Healthz)
+	http.HandleFunc("/readyz", argocd.Readyz(&executor))
+	http.HandleFunc("/schema", argocd.SchemaHandler)
+	server := &http.Server{Addr: startupConfig.Addr}
+	if startupConfig.TLSCertFile != "" {
+		server.TLSConfig, err = argocd.NewTLSConfig(startupConfig.TLSCertFile, startupConfig.TLSKeyFile, startupConfig.TLSMinVersion)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server, &executor, tracerProvider, startupConfig.DrainTimeout)
+		close(stopped)
+	}()
+	if server.TLSConfig != nil {
+		// The certificate is already loaded into the TLS config.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err.Error())
 	}
+	<-stopped
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT, then refuses new requests with 503 Service Unavailable, waits up to
+// drainTimeout for in-flight actions to finish, stops the server, and flushes the spans which haven't been exported.
+func shutdownOnSignal(server *http.Server, executor *argocd.ApiExecutor, tracerProvider *sdktrace.TracerProvider, drainTimeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Printf("received %s, waiting up to %s for in-flight actions to finish", sig, drainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	err := executor.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutting down anyway: %s", err)
+	}
+	// In-flight actions are done or abandoned. Give their responses a moment to be written before closing connections.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("failed to stop the server gracefully: %s", err)
+	}
+	if tracerProvider != nil {
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = tracerProvider.Shutdown(ctx)
+		if err != nil {
+			log.Printf("failed to export the remaining spans: %s", err)
+		}
+	}
+}
+
+// newTracerProvider returns a tracer provider which exports spans over OTLP/gRPC, or nil if neither
+// OTEL_EXPORTER_OTLP_ENDPOINT nor OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter reads the rest of its
+// settings, like headers and TLS, from the standard OTEL_EXPORTER_OTLP_* environment variables, and the service name
+// and resource attributes come from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)), nil
+}
+
+// loadConfig reads the config file, if there is one, applies the environment variables on top, and validates the
+// result.
+func loadConfig(configFile string) (argocd.PluginConfig, error) {
+	var configYAML []byte
+	if configFile != "" {
+		var err error
+		configYAML, err = os.ReadFile(configFile)
+		if err != nil {
+			return argocd.PluginConfig{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	config, err := argocd.LoadPluginConfig(string(configYAML), os.Getenv)
+	if err != nil {
+		return argocd.PluginConfig{}, fmt.Errorf("failed to load config: %w", err)
+	}
+	return config, nil
+}
+
+// newAPIClient builds an Argo CD API client. If the config has an auth token file, the auth token is read from it, so
+// that a rotated token is picked up whenever the client is rebuilt. Otherwise, the client reads ARGOCD_AUTH_TOKEN.
+func newAPIClient(config argocd.StartupConfig) (apiclient.Client, error) {
+	opts := &apiclient.ClientOptions{
+		ServerAddr:      config.Server,
+		Insecure:        config.Insecure,
+		PlainText:       config.PlainText,
+		GRPCWeb:         config.GRPCWeb,
+		GRPCWebRootPath: config.GRPCWebRootPath,
+	}
+	if tokenFile := config.AuthTokenFile; tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth token file: %w", err)
+		}
+		opts.AuthToken = strings.TrimSpace(string(token))
+	}
+	return apiclient.NewClient(opts)
+}
+
+// reloadConfig reads the config file and applies its executor section to the executor.
+func reloadConfig(executor *argocd.ApiExecutor, configFile string, drain bool) error {
+	configYAML, err := os.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	err = executor.ReloadConfig(string(configYAML), os.Getenv, drain)
+	if err != nil {
+		return fmt.Errorf("failed to load config file: %w", err)
+	}
+	return nil
+}
+
+// watchConfigReloads reloads the config file whenever the process receives SIGHUP. An invalid config is logged and
+// ignored, keeping the current one.
+func watchConfigReloads(executor *argocd.ApiExecutor, configFile string, drain bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := reloadConfig(executor, configFile, drain)
+		if err != nil {
+			log.Printf("keeping the current config: %s", err)
+			continue
+		}
+		log.Printf("reloaded config from %s", configFile)
+	}
 }
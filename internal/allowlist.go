@@ -0,0 +1,97 @@
+package argocd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// errNotAllowed is returned by actions which target apps the plugin's allowlist doesn't allow.
+var errNotAllowed = errors.New("not allowed by the plugin's allowlist")
+
+// AllowRule matches apps by their name, namespace, and project. Empty fields match anything.
+type AllowRule struct {
+	// Name is a glob matching the app's name, like `payments-*`.
+	Name string `yaml:"name,omitempty"`
+	// Namespace is the namespace the app is installed in.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Project is the app's project.
+	Project string `yaml:"project,omitempty"`
+}
+
+// Allowlist restricts the apps the plugin may act on, independently of the Argo CD token's permissions. An app is
+// allowed if it matches any of the rules. An empty allowlist allows every app.
+type Allowlist []AllowRule
+
+// ParseAllowlist parses a YAML list of rules, like `[{name: payments-*, project: payments}, {namespace: previews}]`.
+func ParseAllowlist(allowlistYAML string) (Allowlist, error) {
+	var allowlist Allowlist
+	err := yaml.Unmarshal([]byte(allowlistYAML), &allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal allowlist: %w", err)
+	}
+	for i, rule := range allowlist {
+		if rule == (AllowRule{}) {
+			return nil, fmt.Errorf("allowlist rule %d must set name, namespace, or project", i)
+		}
+		if _, err := path.Match(rule.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid name glob %q in allowlist rule %d: %w", rule.Name, i, err)
+		}
+	}
+	return allowlist, nil
+}
+
+// matches returns true if the app matches every non-empty field of the rule. Name globs were validated when the
+// allowlist was parsed.
+func (r AllowRule) matches(name, namespace, project string) bool {
+	nameMatches, _ := path.Match(r.Name, name)
+	return (r.Name == "" || nameMatches) &&
+		(r.Namespace == "" || r.Namespace == namespace) &&
+		(r.Project == "" || r.Project == project)
+}
+
+// allows returns true if the app matches any of the rules, or if there are none.
+func (l Allowlist) allows(name, namespace, project string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, rule := range l {
+		if rule.matches(name, namespace, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAllowed returns an error wrapping errNotAllowed if the action targets an app which the allowlist doesn't allow.
+// The targets must have been resolved with their named apps fetched, to know their namespaces and projects. An app
+// which doesn't exist is checked with the namespace it was given, if any, and no project, so rules which require a
+// project don't allow it. List and version actions don't target apps, so they're always allowed.
+func checkAllowed(action AppActionSpec, targets actionTargets, allowlist Allowlist) error {
+	if len(allowlist) == 0 {
+		return nil
+	}
+	if action.Create != nil {
+		app, err := readApplication(*action.Create)
+		if err != nil {
+			return err
+		}
+		if !allowlist.allows(app.Name, app.Namespace, app.Spec.Project) {
+			return fmt.Errorf("%w: app %q in project %q", errNotAllowed, appKey(App{Name: app.Name, Namespace: app.Namespace}), app.Spec.Project)
+		}
+	}
+	for _, app := range targets.all() {
+		if !app.found {
+			if !allowlist.allows(app.Name, app.Namespace, "") {
+				return fmt.Errorf("%w: app %q", errNotAllowed, appKey(app.App))
+			}
+			continue
+		}
+		if !allowlist.allows(app.Name, app.Namespace, app.project) {
+			return fmt.Errorf("%w: app %q in project %q", errNotAllowed, appKey(app.App), app.project)
+		}
+	}
+	return nil
+}
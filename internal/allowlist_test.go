@@ -0,0 +1,98 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	t.Parallel()
+
+	allowlist, err := ParseAllowlist("- name: payments-*\n  project: payments\n- namespace: previews\n")
+	require.NoError(t, err)
+	assert.Equal(t, Allowlist{{Name: "payments-*", Project: "payments"}, {Namespace: "previews"}}, allowlist)
+
+	_, err = ParseAllowlist("- {}\n")
+	require.ErrorContains(t, err, "allowlist rule 0 must set name, namespace, or project")
+
+	_, err = ParseAllowlist("- name: '['\n")
+	require.ErrorContains(t, err, `invalid name glob "["`)
+
+	_, err = ParseAllowlist("name: payments-*\n")
+	require.ErrorContains(t, err, "failed to unmarshal allowlist")
+}
+
+func Test_checkAllowed(t *testing.T) {
+	t.Parallel()
+
+	allowlist := Allowlist{{Name: "payments-*", Project: "payments"}, {Namespace: "previews"}}
+	newAllowlistFakes := func() *fakeAppClient {
+		return &fakeAppClient{apps: map[string]*v1alpha1.Application{
+			"payments-api": {ObjectMeta: metav1.ObjectMeta{Name: "payments-api", Namespace: "argocd"}, Spec: v1alpha1.ApplicationSpec{Project: "payments"}},
+			"payments-old": {ObjectMeta: metav1.ObjectMeta{Name: "payments-old", Namespace: "argocd"}, Spec: v1alpha1.ApplicationSpec{Project: "legacy"}},
+			"search":       {ObjectMeta: metav1.ObjectMeta{Name: "search", Namespace: "argocd"}, Spec: v1alpha1.ApplicationSpec{Project: "search"}},
+			"preview-1":    {ObjectMeta: metav1.ObjectMeta{Name: "preview-1", Namespace: "previews", Labels: map[string]string{"team": "search"}}, Spec: v1alpha1.ApplicationSpec{Project: "search"}},
+		}}
+	}
+
+	testCases := []struct {
+		name     string
+		action   AppActionSpec
+		expected string
+	}{
+		{"allowed sync", AppActionSpec{Sync: &SyncAction{Apps: "[{name: payments-api}, {name: preview-1, namespace: previews}]"}}, ""},
+		{"allowed diff", AppActionSpec{Diff: &DiffAction{App: App{Name: "payments-api"}}}, ""},
+		{"wrong project", AppActionSpec{Sync: &SyncAction{Apps: "[{name: payments-api}, {name: payments-old}]"}}, `not allowed by the plugin's allowlist: app "argocd/payments-old" in project "legacy"`},
+		{"wrong name", AppActionSpec{Diff: &DiffAction{App: App{Name: "search"}}}, `app "argocd/search" in project "search"`},
+		{"selected app", AppActionSpec{Sync: &SyncAction{Selector: "team=search"}}, ""},
+		{"missing app", AppActionSpec{Refresh: &RefreshAction{App: App{Name: "payments-new"}}}, `not allowed by the plugin's allowlist: app "payments-new"`},
+		{"missing app in an allowed namespace", AppActionSpec{Refresh: &RefreshAction{App: App{Name: "preview-2", Namespace: "previews"}}}, ""},
+		{"list", AppActionSpec{List: &ListAction{}}, ""},
+		{"create", AppActionSpec{Create: &CreateAction{Application: "metadata: {name: payments-web}\nspec: {project: payments}\n"}}, ""},
+		{"denied create", AppActionSpec{Create: &CreateAction{Application: "metadata: {name: payments-web}\nspec: {project: search}\n"}}, `app "payments-web" in project "search"`},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			targets, err := resolveTargets(context.Background(), testCase.action, true, newAllowlistFakes())
+			require.NoError(t, err)
+			err = checkAllowed(testCase.action, targets, allowlist)
+			if testCase.expected == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, testCase.expected)
+			assert.ErrorIs(t, err, errNotAllowed)
+		})
+	}
+
+	t.Run("empty allowlist", func(t *testing.T) {
+		t.Parallel()
+		err := checkAllowed(AppActionSpec{Diff: &DiffAction{App: App{Name: "search"}}}, actionTargets{named: []targetApp{{App: App{Name: "search"}}}}, nil)
+		require.NoError(t, err)
+	})
+}
+
+func TestApiExecutor_Execute_allowlist(t *testing.T) {
+	t.Parallel()
+
+	client, appClient := newTestFakes(t, nil, nil)
+	e := NewApiExecutor(client, "token", WithAllowlist(Allowlist{{Project: "payments"}}))
+	reply := e.Execute(executor.ExecuteTemplateArgs{
+		Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(`{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)}}},
+	})
+	assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+	assert.Contains(t, reply.Node.Message, `not allowed by the plugin's allowlist: app "argocd/my-app"`)
+	assert.Equal(t, "Unauthorized", parameter(t, reply, "errorCategory"))
+	assert.Empty(t, appClient.syncRequests)
+	assert.NotContains(t, appClient.calls, "List", "named apps are fetched rather than listed")
+}
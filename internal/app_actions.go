@@ -0,0 +1,249 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"k8s.io/utils/pointer"
+)
+
+// rollbackApp rolls the app back to the deployment described by the action and returns the revision it was rolled back
+// to.
+func rollbackApp(ctx context.Context, action RollbackAction, timeout string, appClient application.ApplicationServiceClient) (string, error) {
+	if errs := action.validate(); len(errs) > 0 {
+		return "", errs
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	app, err := appClient.Get(ctx, &application.ApplicationQuery{
+		Name:         pointer.String(action.Name),
+		AppNamespace: pointer.String(action.Namespace),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get app %q: %w", action.Name, err)
+	}
+	entry, err := rollbackTarget(app.Status.History, action)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the deployment of app %q to roll back to: %w", action.Name, err)
+	}
+	_, err = appClient.Rollback(ctx, &application.ApplicationRollbackRequest{
+		Name:         pointer.String(action.Name),
+		AppNamespace: pointer.String(action.Namespace),
+		Id:           pointer.Int64(entry.ID),
+		Prune:        pointer.Bool(action.Prune),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to roll back app %q to deployment %d: %w", action.Name, entry.ID, err)
+	}
+	return entry.Revision, nil
+}
+
+// rollbackTarget returns the entry of the deployment history which the action rolls back to.
+func rollbackTarget(history v1alpha1.RevisionHistories, action RollbackAction) (v1alpha1.RevisionHistory, error) {
+	switch {
+	case action.ID != 0:
+		for _, entry := range history {
+			if entry.ID == action.ID {
+				return entry, nil
+			}
+		}
+		return v1alpha1.RevisionHistory{}, fmt.Errorf("no deployment with id %d in the app's history", action.ID)
+	case action.Revision != "":
+		// The history is ordered from oldest to newest.
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Revision == action.Revision {
+				return history[i], nil
+			}
+		}
+		return v1alpha1.RevisionHistory{}, fmt.Errorf("revision %q was never deployed, according to the app's history", action.Revision)
+	}
+	if len(history) < 2 {
+		return v1alpha1.RevisionHistory{}, errors.New("the app has no deployment before the current one")
+	}
+	return history[len(history)-2], nil
+}
+
+// terminateOperation terminates the app's running operation. It returns false if no operation was running.
+func terminateOperation(ctx context.Context, action TerminateAction, timeout string, appClient application.ApplicationServiceClient) (bool, error) {
+	if action.Name == "" {
+		return false, errors.New("app name is required")
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return false, fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	// The server checks for a running operation itself, so rather than getting the app first, which would race with
+	// the operation finishing, its answer is used.
+	_, err = appClient.TerminateOperation(ctx, &application.OperationTerminateRequest{
+		Name:         pointer.String(action.Name),
+		AppNamespace: pointer.String(action.Namespace),
+	})
+	if isNoOperationError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to terminate operation of app %q: %w", action.Name, err)
+	}
+	return true, nil
+}
+
+// refreshApp refreshes the app from git and returns the revision it refreshed to.
+func refreshApp(ctx context.Context, action RefreshAction, timeout string, appClient application.ApplicationServiceClient) (string, error) {
+	if action.Name == "" {
+		return "", errors.New("app name is required")
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	// The server waits for the refresh to finish before returning the app, so its sync status is up to date.
+	app, err := appClient.Get(ctx, &application.ApplicationQuery{
+		Name:         pointer.String(action.Name),
+		AppNamespace: pointer.String(action.Namespace),
+		Refresh:      getRefreshType(true, action.Hard),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh app %q: %w", action.Name, err)
+	}
+	return app.Status.Sync.Revision, nil
+}
+
+// defaultDeleteTimeout bounds how long a delete action waits for the app to be gone if the action has no timeout.
+const defaultDeleteTimeout = 5 * time.Minute
+
+// deleteApp deletes the app and returns a message saying so. If requested, it waits for the app to be gone before
+// returning.
+func deleteApp(ctx context.Context, action DeleteAction, timeout string, appClient application.ApplicationServiceClient) (string, error) {
+	if errs := action.validate(); len(errs) > 0 {
+		return "", errs
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	request := &application.ApplicationDeleteRequest{
+		Name:         pointer.String(action.Name),
+		AppNamespace: pointer.String(action.Namespace),
+		Cascade:      pointer.Bool(action.Cascade),
+	}
+	if action.PropagationPolicy != "" {
+		request.PropagationPolicy = pointer.String(action.PropagationPolicy)
+	}
+	_, err = appClient.Delete(ctx, request)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete app %q: %w", action.Name, err)
+	}
+	if !action.Wait {
+		return fmt.Sprintf("requested deletion of app %q", action.Name), nil
+	}
+	if timeout == "" {
+		var cancelWait func()
+		ctx, cancelWait = context.WithTimeout(ctx, defaultDeleteTimeout)
+		defer cancelWait()
+	}
+	err = waitForDeletion(ctx, action.App, appClient)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("deleted app %q", action.Name), nil
+}
+
+// waitForDeletion polls the app until it's gone or ctx is done.
+func waitForDeletion(ctx context.Context, app App, appClient application.ApplicationServiceClient) error {
+	for {
+		_, err := appClient.Get(ctx, &application.ApplicationQuery{Name: pointer.String(app.Name), AppNamespace: pointer.String(app.Namespace)})
+		if isNotFoundError(err) {
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("failed to get app %q: %w", app.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("app %q was not deleted before the timeout: %w", app.Name, ctx.Err())
+		case <-time.After(appPollInterval):
+		}
+	}
+}
+
+// defaultWaitForSyncTimeout bounds how long a wait-for-sync action waits if the action has no timeout.
+const defaultWaitForSyncTimeout = 30 * time.Minute
+
+// waitResult is the output of a wait-for-sync action.
+type waitResult struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	// Phase is the phase the operation ended in. It's empty if the app has never had an operation.
+	Phase    string `json:"phase,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// waitForSync polls the app until it has no running operation, and returns the result of its last operation. It fails
+// if that operation failed, or if the timeout expires first.
+func waitForSync(ctx context.Context, action WaitAction, timeout string, appClient application.ApplicationServiceClient) (waitResult, error) {
+	result := waitResult{Name: action.Name, Namespace: action.Namespace}
+	if action.Name == "" {
+		return result, errors.New("app name is required")
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return result, fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	if timeout == "" {
+		var cancelWait func()
+		ctx, cancelWait = context.WithTimeout(ctx, defaultWaitForSyncTimeout)
+		defer cancelWait()
+	}
+	phase := "pending"
+	for {
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         pointer.String(action.Name),
+			AppNamespace: pointer.String(action.Namespace),
+		})
+		if err != nil && ctx.Err() != nil {
+			return result, fmt.Errorf("timed out waiting for the operation of app %q to finish (phase %q)", action.Name, phase)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to get app %q: %w", action.Name, err)
+		}
+		state := current.Status.OperationState
+		if state != nil {
+			phase = string(state.Phase)
+		}
+		// The operation field is set until the controller picks the operation up, before it has any state.
+		running := current.Operation != nil || state != nil && !state.Phase.Completed()
+		if !running {
+			result.Revision = current.Status.Sync.Revision
+			if state == nil {
+				return result, nil
+			}
+			result.Phase = string(state.Phase)
+			result.Message = state.Message
+			if state.SyncResult != nil {
+				result.Revision = state.SyncResult.Revision
+			}
+			if !state.Phase.Successful() {
+				return result, fmt.Errorf("sync of app %q to revision %q %s: %s", action.Name, result.Revision, strings.ToLower(result.Phase), result.Message)
+			}
+			return result, nil
+		}
+		select {
+		case <-ctx.Done():
+			return result, fmt.Errorf("timed out waiting for the operation of app %q to finish (phase %q)", action.Name, phase)
+		case <-time.After(appPollInterval):
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	synccommon "github.com/argoproj/gitops-engine/pkg/sync/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_waitForSync(t *testing.T) {
+	appPollInterval = time.Millisecond
+	newApp := func(phase synccommon.OperationPhase, revision string) *v1alpha1.Application {
+		app := &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "my-app", Namespace: "argocd"}}
+		app.Status.OperationState = &v1alpha1.OperationState{Phase: phase, Message: "boom", SyncResult: &v1alpha1.SyncOperationResult{Revision: revision}}
+		if !phase.Completed() {
+			app.Operation = &v1alpha1.Operation{Sync: &v1alpha1.SyncOperation{}}
+		}
+		return app
+	}
+
+	t.Run("succeeded", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.getResponses = []*v1alpha1.Application{newApp(synccommon.OperationRunning, "abc123")}
+		appClient.apps["my-app"] = newApp(synccommon.OperationSucceeded, "abc123")
+		result, err := waitForSync(context.Background(), WaitAction{App: App{Name: "my-app", Namespace: "argocd"}}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, waitResult{Name: "my-app", Namespace: "argocd", Phase: "Succeeded", Revision: "abc123", Message: "boom"}, result)
+		assert.Equal(t, []string{"Get", "Get"}, appClient.calls)
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"] = newApp(synccommon.OperationFailed, "abc123")
+		result, err := waitForSync(context.Background(), WaitAction{App: App{Name: "my-app"}}, "", appClient)
+		require.EqualError(t, err, `sync of app "my-app" to revision "abc123" failed: boom`)
+		assert.Equal(t, "Failed", result.Phase)
+	})
+
+	t.Run("no operation", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+		result, err := waitForSync(context.Background(), WaitAction{App: App{Name: "my-app"}}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, waitResult{Name: "my-app", Revision: "abc123"}, result)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"] = newApp(synccommon.OperationRunning, "")
+		_, err := waitForSync(context.Background(), WaitAction{App: App{Name: "my-app"}}, "20ms", appClient)
+		require.ErrorContains(t, err, `timed out waiting for the operation of app "my-app" to finish (phase "Running")`)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := waitForSync(context.Background(), WaitAction{}, "", &fakeAppClient{})
+		require.ErrorContains(t, err, "app name is required")
+	})
+}
+
+func Test_rollbackApp(t *testing.T) {
+	t.Parallel()
+
+	newRollbackFakes := func(t *testing.T) *fakeAppClient {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.History = v1alpha1.RevisionHistories{
+			{ID: 1, Revision: "aaa"},
+			{ID: 2, Revision: "bbb"},
+			{ID: 3, Revision: "aaa"},
+			{ID: 4, Revision: "ccc"},
+		}
+		return appClient
+	}
+	testCases := []struct {
+		name             string
+		action           RollbackAction
+		expectedID       int64
+		expectedRevision string
+	}{
+		{"previous deployment", RollbackAction{}, 3, "aaa"},
+		{"id", RollbackAction{ID: 2}, 2, "bbb"},
+		{"revision deployed several times", RollbackAction{Revision: "aaa"}, 3, "aaa"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			appClient := newRollbackFakes(t)
+			testCase.action.App = App{Name: "my-app", Namespace: "argocd"}
+			revision, err := rollbackApp(context.Background(), testCase.action, "", appClient)
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expectedRevision, revision)
+			require.Len(t, appClient.rollbackRequests, 1)
+			assert.Equal(t, testCase.expectedID, appClient.rollbackRequests[0].GetId())
+			assert.Equal(t, "argocd", appClient.rollbackRequests[0].GetAppNamespace())
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		appClient := newRollbackFakes(t)
+		_, err := rollbackApp(context.Background(), RollbackAction{App: App{Name: "my-app"}, ID: 9}, "", appClient)
+		require.ErrorContains(t, err, "no deployment with id 9")
+		_, err = rollbackApp(context.Background(), RollbackAction{App: App{Name: "my-app"}, Revision: "ddd"}, "", appClient)
+		require.ErrorContains(t, err, `revision "ddd" was never deployed`)
+		_, err = rollbackApp(context.Background(), RollbackAction{App: App{Name: "my-app"}, ID: 1, Revision: "aaa"}, "", appClient)
+		require.ErrorContains(t, err, "only one of id and revision")
+		_, err = rollbackApp(context.Background(), RollbackAction{}, "", appClient)
+		require.ErrorContains(t, err, "app name is required")
+		assert.Empty(t, appClient.rollbackRequests)
+
+		appClient.apps["my-app"].Status.History = appClient.apps["my-app"].Status.History[:1]
+		_, err = rollbackApp(context.Background(), RollbackAction{App: App{Name: "my-app"}}, "", appClient)
+		require.ErrorContains(t, err, "no deployment before the current one")
+	})
+}
+
+func Test_terminateOperation(t *testing.T) {
+	t.Parallel()
+
+	t.Run("running operation", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Operation = &v1alpha1.Operation{Sync: &v1alpha1.SyncOperation{}}
+		terminated, err := terminateOperation(context.Background(), TerminateAction{App: App{Name: "my-app"}}, "", appClient)
+		require.NoError(t, err)
+		assert.True(t, terminated)
+		assert.Nil(t, appClient.apps["my-app"].Operation)
+	})
+
+	t.Run("no operation", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		terminated, err := terminateOperation(context.Background(), TerminateAction{App: App{Name: "my-app"}}, "", appClient)
+		require.NoError(t, err)
+		assert.False(t, terminated)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		_, err := terminateOperation(context.Background(), TerminateAction{App: App{Name: "missing"}}, "", appClient)
+		require.ErrorContains(t, err, `failed to terminate operation of app "missing"`)
+		_, err = terminateOperation(context.Background(), TerminateAction{}, "", appClient)
+		require.ErrorContains(t, err, "app name is required")
+	})
+
+	t.Run("output", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Operation = &v1alpha1.Operation{Sync: &v1alpha1.SyncOperation{}}
+		reply := execute(t, client, `{"argocd": {"app": {"terminate": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "terminated the running operation", *reply.Node.Outputs.Result)
+		assert.Equal(t, "true", parameter(t, reply, "terminated"))
+
+		reply = execute(t, client, `{"argocd": {"app": {"terminate": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, "no operation was running", *reply.Node.Outputs.Result)
+		assert.Equal(t, "false", parameter(t, reply, "terminated"))
+	})
+}
+
+func Test_refreshApp(t *testing.T) {
+	t.Parallel()
+
+	for _, hard := range []bool{false, true} {
+		hard := hard
+		t.Run(fmt.Sprintf("hard %t", hard), func(t *testing.T) {
+			t.Parallel()
+			_, appClient := newTestFakes(t, nil, nil)
+			appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+			revision, err := refreshApp(context.Background(), RefreshAction{App: App{Name: "my-app", Namespace: "argocd"}, Hard: hard}, "", appClient)
+			require.NoError(t, err)
+			assert.Equal(t, "abc123", revision)
+			require.Len(t, appClient.getQueries, 1)
+			assert.Equal(t, "argocd", appClient.getQueries[0].GetAppNamespace())
+			assert.Equal(t, getRefreshType(true, hard), appClient.getQueries[0].Refresh)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		_, err := refreshApp(context.Background(), RefreshAction{App: App{Name: "missing"}}, "", appClient)
+		require.ErrorContains(t, err, `failed to refresh app "missing"`)
+		_, err = refreshApp(context.Background(), RefreshAction{}, "", appClient)
+		require.ErrorContains(t, err, "app name is required")
+	})
+}
+
+func Test_deleteApp(t *testing.T) {
+	appPollInterval = time.Millisecond
+	newDeleteFakes := func() *fakeAppClient {
+		return &fakeAppClient{apps: map[string]*v1alpha1.Application{
+			"preview-123": {ObjectMeta: metav1.ObjectMeta{Name: "preview-123", Namespace: "argocd"}},
+		}}
+	}
+
+	t.Run("without waiting", func(t *testing.T) {
+		appClient := newDeleteFakes()
+		out, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "preview-123", Namespace: "argocd"}}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, `requested deletion of app "preview-123"`, out)
+		assert.Equal(t, []string{"Delete"}, appClient.calls)
+		require.Len(t, appClient.deleteRequests, 1)
+		assert.Equal(t, "argocd", appClient.deleteRequests[0].GetAppNamespace())
+		assert.False(t, appClient.deleteRequests[0].GetCascade())
+		assert.Nil(t, appClient.deleteRequests[0].PropagationPolicy)
+	})
+
+	t.Run("cascade", func(t *testing.T) {
+		appClient := newDeleteFakes()
+		_, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "preview-123"}, Cascade: true, PropagationPolicy: "background"}, "", appClient)
+		require.NoError(t, err)
+		require.Len(t, appClient.deleteRequests, 1)
+		assert.True(t, appClient.deleteRequests[0].GetCascade())
+		assert.Equal(t, "background", appClient.deleteRequests[0].GetPropagationPolicy())
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		appClient := newDeleteFakes()
+		// The app is still there, being deleted, the first time it's checked.
+		appClient.getResponses = []*v1alpha1.Application{{ObjectMeta: metav1.ObjectMeta{Name: "preview-123"}}}
+		out, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "preview-123"}, Cascade: true, Wait: true}, "10s", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, `deleted app "preview-123"`, out)
+		assert.Equal(t, []string{"Delete", "Get", "Get"}, appClient.calls)
+	})
+
+	t.Run("wait timeout", func(t *testing.T) {
+		appClient := newDeleteFakes()
+		for i := 0; i < 1000; i++ {
+			appClient.getResponses = append(appClient.getResponses, &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "preview-123"}})
+		}
+		_, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "preview-123"}, Wait: true}, "20ms", appClient)
+		require.ErrorContains(t, err, `app "preview-123" was not deleted before the timeout`)
+	})
+
+	t.Run("missing app", func(t *testing.T) {
+		_, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "missing"}}, "", newDeleteFakes())
+		require.ErrorContains(t, err, `failed to delete app "missing"`)
+		assert.Equal(t, errorCategoryNotFound, categorizeError(err))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		appClient := newDeleteFakes()
+		_, err := deleteApp(context.Background(), DeleteAction{App: App{Name: "preview-123"}, PropagationPolicy: "orphan"}, "", appClient)
+		require.ErrorContains(t, err, `unknown propagation policy "orphan"`)
+		require.ErrorContains(t, err, "propagationPolicy requires cascade")
+		assert.Empty(t, appClient.calls)
+	})
+}
@@ -2,255 +2,2271 @@ package argocd
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/argoproj/argo-cd/v2/common"
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
 	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	argorepoclient "github.com/argoproj/argo-cd/v2/reposerver/apiclient"
 	argodiff "github.com/argoproj/argo-cd/v2/util/argo/diff"
-	"github.com/argoproj/argo-cd/v2/util/io"
 	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
 	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	synccommon "github.com/argoproj/gitops-engine/pkg/sync/common"
 	"github.com/argoproj/gitops-engine/pkg/sync/hook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/utils/pointer"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
 )
 
+// DefaultMaxSyncApps is the default maximum number of apps a single sync action may target.
+const DefaultMaxSyncApps = 500
+
 type ApiExecutor struct {
-	apiClient  apiclient.Client
-	agentToken string
+	apiClient *apiClientHolder
+	// agentToken is the token requests must carry. It's replaced when the token file is reloaded.
+	agentToken *tokenHolder
+	// reloadAPIClient, if set, builds a new API client with a freshly-read auth token.
+	reloadAPIClient func() (apiclient.Client, error)
+	// config holds the settings which can be reloaded while the plugin is running.
+	config *configHolder
+	logger Logger
+	// metrics, if set, records the actions which are run.
+	metrics *Metrics
+	// tracerProvider creates the spans actions are traced with.
+	tracerProvider trace.TracerProvider
+	// requests tracks the requests being handled, so that Shutdown can wait for them.
+	requests *requestTracker
+	// circuit fails Argo CD API calls right away while the API server is degraded.
+	circuit *circuitBreaker
+}
+
+// ApiExecutorOption configures optional ApiExecutor settings.
+type ApiExecutorOption func(*ApiExecutor)
+
+// WithMaxSyncApps sets the maximum number of apps a single sync action may target. Zero or less means no limit.
+func WithMaxSyncApps(maxSyncApps int) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.MaxSyncApps = maxSyncApps
+	}
+}
+
+// WithAPIClientReloader sets a function which builds a new API client with a freshly-read auth token. If the Argo CD
+// API rejects the current token, for example because it was rotated, the client is rebuilt and the action is retried
+// once.
+func WithAPIClientReloader(reload func() (apiclient.Client, error)) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.reloadAPIClient = reload
+	}
+}
+
+// WithMaxDiffOutputBytes sets the default cap on the size of a diff action's output and of the manifests a sync action
+// records. Zero or less means no limit.
+func WithMaxDiffOutputBytes(maxBytes int) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.MaxDiffOutputBytes = maxBytes
+	}
+}
+
+// WithCircuitBreaker configures the circuit breaker around Argo CD API calls. By default, it's disabled.
+func WithCircuitBreaker(config CircuitBreakerConfig) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.CircuitBreaker = config
+	}
+}
+
+// WithValueFileDir sets the directory which values with the file source are read from. By default, values can't be read
+// from files.
+func WithValueFileDir(dir string) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.ValueFileDir = dir
+	}
+}
+
+// WithOutputBaseDir sets the directory which actions' output directories, like a diff action's outputDir, are created
+// under. By default, actions can't write files.
+func WithOutputBaseDir(dir string) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.OutputBaseDir = dir
+	}
+}
+
+// WithRetryPolicy sets the policy deciding which failed Argo CD API calls are retried. Defaults to DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.RetryPolicy = policy
+	}
+}
+
+// WithLogger sets the logger used for the executor's messages. Defaults to logging info and above to stderr.
+func WithLogger(logger Logger) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.logger = logger
+	}
+}
+
+// WithMetrics sets the metrics which record the actions the executor runs. By default, no metrics are recorded.
+func WithMetrics(metrics *Metrics) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.metrics = metrics
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer actions are traced with. Defaults to the global tracer provider,
+// which records nothing unless one is registered.
+func WithTracerProvider(provider trace.TracerProvider) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.tracerProvider = provider
+	}
+}
+
+// WithDefaultTimeout sets the timeout of actions which don't set their own and don't get one from the defaults. Zero or
+// less means no timeout.
+func WithDefaultTimeout(timeout time.Duration) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.DefaultTimeout = timeout
+	}
+}
+
+// WithDefaults sets the defaults applied to actions which don't set their own timeout or concurrency.
+func WithDefaults(defaults DefaultsConfig) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.Defaults = defaults
+	}
+}
+
+// WithAllowlist restricts the apps actions may target, independently of the Argo CD token's permissions.
+func WithAllowlist(allowlist Allowlist) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config.Allowlist = allowlist
+	}
+}
+
+// WithExecutorConfig sets all of the executor's reloadable settings at once, for example from a PluginConfig.
+func WithExecutorConfig(config ExecutorConfig) ApiExecutorOption {
+	return func(e *ApiExecutor) {
+		e.config.config = config
+	}
+}
+
+func NewApiExecutor(apiClient apiclient.Client, agentToken string, opts ...ApiExecutorOption) ApiExecutor {
+	e := ApiExecutor{
+		apiClient:      &apiClientHolder{client: apiClient},
+		agentToken:     &tokenHolder{token: agentToken},
+		config:         &configHolder{config: DefaultExecutorConfig()},
+		logger:         NewLogger(LogLevelInfo),
+		tracerProvider: otel.GetTracerProvider(),
+		requests:       &requestTracker{},
+		circuit:        &circuitBreaker{},
+	}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	e.circuit.metrics = e.metrics
+	return e
+}
+
+// Authorize checks that the request carries the agent token as a bearer token. The token is compared in constant time,
+// so that response times don't leak how much of it a guess got right.
+func (e *ApiExecutor) Authorize(req *http.Request) error {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return errors.New("missing Authorization header")
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return errors.New("malformed Authorization header: expected a bearer token")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(e.agentToken.get())) != 1 {
+		return errors.New("invalid agent token")
+	}
+	return nil
+}
+
+// Execute runs the action in the template. See ExecuteContext.
+func (e *ApiExecutor) Execute(args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply {
+	return e.ExecuteContext(context.Background(), args)
+}
+
+// ExecuteContext runs the action in the template. Cancelling ctx, for example because the workflow controller closed
+// the request, cancels the action's Argo CD API calls and fails the action.
+func (e *ApiExecutor) ExecuteContext(ctx context.Context, args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply {
+	requestID := newRequestID()
+	logger := e.logger.With("requestID", requestID, "template", args.Template.Name)
+	pluginJSON, err := args.Template.Plugin.MarshalJSON()
+	if err != nil {
+		err = fmt.Errorf("failed to marshal plugin to JSON from workflow spec: %w", err)
+		logger.Errorf("%s", err)
+		return errorResponse(err)
+	}
+
+	plugin := &PluginSpec{}
+	err = json.Unmarshal(pluginJSON, plugin)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal plugin JSON to plugin struct: %w", err)
+		logger.Errorf("%s", err)
+		return errorResponse(err)
+	}
+
+	if plugin.ArgoCD == nil {
+		logger.Debugf("unsupported plugin type")
+		return executor.ExecuteTemplateReply{} // unsupported plugin
+	}
+
+	logger = logger.With(actionLogFields(*plugin.ArgoCD)...)
+	ctx, span := e.tracerProvider.Tracer(tracerName).Start(ctx, "Execute",
+		trace.WithAttributes(attrTemplateName.String(args.Template.Name), attrRequestID.String(requestID)))
+	defer span.End()
+	ctx = contextWithLogger(ctx, logger)
+	ctx = contextWithAuditInfo(ctx, newAuditInfo(args.Workflow, plugin.ArgoCD.Identity))
+	result, err := e.runAction(ctx, *plugin.ArgoCD)
+	if err != nil {
+		recordSpanError(span, err)
+		// Errors are only logged here, once, with the request's fields.
+		logger.Errorf("action failed: %s", err)
+		progress := result.progress
+		if progress == "" {
+			progress = "0/1"
+		}
+		reply := failedResponse(progress, fmt.Errorf("action failed: %w", err))
+		if plugin.ArgoCD.FailureMessage != "" {
+			reply.Node.Message = nodeMessage(plugin.ArgoCD.FailureMessage, *plugin.ArgoCD, result, err)
+		}
+		// The action's own parameters are output too, so that workflows can tell, for example, that a sync window blocked
+		// the sync.
+		reply.Node.Outputs = &wfv1.Outputs{Parameters: append(result.parameters, exitCodeParameter(result, err), errorCategoryParameter(err), warningsParameter(result.warnings))}
+		if result.output != "" {
+			// For example, a sync which failed for some apps outputs the results of all of them.
+			reply.Node.Outputs.Result = pointer.String(result.output)
+		}
+		return reply
+	}
+
+	message := "Action completed"
+	if plugin.ArgoCD.SuccessMessage != "" {
+		message = nodeMessage(plugin.ArgoCD.SuccessMessage, *plugin.ArgoCD, result, nil)
+	}
+	if len(result.warnings) > 0 {
+		message += " with warnings: " + strings.Join(result.warnings, "; ")
+		for _, warning := range result.warnings {
+			logger.Warnf("%s", warning)
+		}
+	}
+	progress := result.progress
+	if progress == "" {
+		progress = "1/1"
+	}
+	return executor.ExecuteTemplateReply{
+		Node: &wfv1.NodeResult{
+			Phase:    wfv1.NodeSucceeded,
+			Message:  message,
+			Progress: progress,
+			Outputs: &wfv1.Outputs{
+				Result:     pointer.String(result.output),
+				Parameters: append(result.parameters, exitCodeParameter(result, nil), errorCategoryParameter(nil), warningsParameter(result.warnings)),
+			},
+		},
+	}
+}
+
+// Exit codes summarize an action's outcome in the `exitCode` output parameter, for workflows ported from CLI-based
+// pipelines which branch on exit codes.
+const (
+	// exitCodeSuccess means the action succeeded and, for a diff, found no changes.
+	exitCodeSuccess = 0
+	// exitCodeDiffFound means the action succeeded and its diff found changes.
+	exitCodeDiffFound = 1
+	// exitCodePartialFailure means the action failed for some of its apps but succeeded for others. It's also set when
+	// the node succeeds because the action allows partial success.
+	exitCodePartialFailure = 2
+	// exitCodeFailure means the action failed.
+	exitCodeFailure = 3
+)
+
+// exitCodeParameter returns the `exitCode` output parameter for an action's outcome.
+func exitCodeParameter(result actionResult, err error) wfv1.Parameter {
+	code := exitCodeSuccess
+	var partial partialError
+	switch {
+	case errors.As(err, &partial), err == nil && result.partialFailure:
+		code = exitCodePartialFailure
+	case errors.Is(err, errDiffFound):
+		code = exitCodeDiffFound
+	case err != nil:
+		code = exitCodeFailure
+	case result.changesFound:
+		code = exitCodeDiffFound
+	}
+	return wfv1.Parameter{Name: "exitCode", Value: wfv1.AnyStringPtr(code)}
+}
+
+// errorCategoryParameter returns the `errorCategory` output parameter, which says why the action failed, like NotFound
+// or Transient, so that workflows can decide whether to retry it. It's empty if the action succeeded.
+func errorCategoryParameter(err error) wfv1.Parameter {
+	var category errorCategory
+	if err != nil {
+		category = categorizeError(err)
+	}
+	return wfv1.Parameter{Name: "errorCategory", Value: wfv1.AnyStringPtr(string(category))}
+}
+
+// warningsParameter returns the `warnings` output parameter, a JSON list of the action's non-fatal issues. It's always
+// set, even to an empty list, so that workflows can read it without checking whether it exists.
+func warningsParameter(warnings []string) wfv1.Parameter {
+	if warnings == nil {
+		warnings = []string{}
+	}
+	// Marshaling a string slice can't fail.
+	out, _ := json.Marshal(warnings)
+	return wfv1.Parameter{Name: "warnings", Value: wfv1.AnyStringPtr(string(out))}
+}
+
+// actionResult holds everything an action produces for the node's outputs.
+type actionResult struct {
+	output     string
+	parameters []wfv1.Parameter
+	// changesFound is true if the action's diff found changes.
+	changesFound bool
+	// partialFailure is true if the action failed for some of its apps, but the node succeeds anyway because the action
+	// allows partial success.
+	partialFailure bool
+	// warnings are non-fatal issues, which are reported in the node's message and the `warnings` output parameter
+	// without failing the node.
+	warnings []string
+	// progress is the node's final progress. Defaults to 1/1 on success and 0/1 on failure. The plugin only replies
+	// once the action is done, so progress can't be reported while it runs.
+	progress wfv1.Progress
+	// apps, if set, are the apps the action acted on, for the node's message. Otherwise, they're read from the action.
+	apps []string
+}
+
+// runAction validates and runs the given action and returns outputs or errors, if any. If the API rejects the auth
+// token and a reloader is configured, the token is reloaded and the whole action is retried once.
+func (e *ApiExecutor) runAction(ctx context.Context, action ActionSpec) (result actionResult, err error) {
+	actionType := actionTypeLabel(action)
+	ctx, span := startSpan(ctx, "runAction", trace.WithAttributes(attrActionType.String(actionType)))
+	defer func(start time.Time) {
+		e.metrics.observe(actionType, start, err)
+		endSpan(span, err)
+	}(time.Now())
+	action, err = resolveValueFiles(action, e.config.get().ValueFileDir)
+	if err != nil {
+		return result, err
+	}
+	err = action.Validate()
+	if err != nil {
+		return result, fmt.Errorf("invalid action: %w", err)
+	}
+	if action.ValidateOnly {
+		result.output = "action is valid"
+		return result, nil
+	}
+	e.config.inFlight.RLock()
+	defer e.config.inFlight.RUnlock()
+	config := e.config.get()
+	result, err = e.runActionWithClient(ctx, config, action)
+	if err == nil || !isAuthError(err) {
+		return result, err
+	}
+	if e.reloadAPIClient == nil {
+		return result, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	e.loggerFrom(ctx).Warnf("Argo CD API rejected the auth token, reloading it and retrying the action: %v", err)
+	client, reloadErr := e.reloadAPIClient()
+	if reloadErr != nil {
+		return result, fmt.Errorf("%w: failed to reload API client: %v", ErrAuthFailed, reloadErr)
+	}
+	e.apiClient.set(client)
+	result, err = e.runActionWithClient(ctx, config, action)
+	if err != nil && isAuthError(err) {
+		return result, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	return result, err
+}
+
+// runActionWithClient runs the given action, which runAction has validated, using the current API client and the given
+// config.
+func (e *ApiExecutor) runActionWithClient(ctx context.Context, config ExecutorConfig, action ActionSpec) (result actionResult, err error) {
+	var timings *phaseTimings
+	if action.IncludeTimings {
+		timings = newPhaseTimings()
+		defer func() {
+			if err != nil {
+				return
+			}
+			param, paramErr := timings.parameter()
+			if paramErr != nil {
+				err = fmt.Errorf("failed to marshal timings: %w", paramErr)
+				return
+			}
+			result.parameters = append(result.parameters, param)
+		}()
+	}
+
+	stop := timings.track("clientInit")
+	clients, release, err := e.apiClient.acquire()
+	if err != nil {
+		return result, err
+	}
+	defer release()
+	defer func() {
+		if isUnavailableError(err) {
+			e.apiClient.invalidate(clients)
+		}
+	}()
+	stop()
+
+	// Each attempt gets its own span and passes through the circuit breaker, so that retries are visible in traces and
+	// stop as soon as the circuit opens.
+	retryingClient := &retryingAppClient{ApplicationServiceClient: &circuitAppClient{ApplicationServiceClient: &tracingAppClient{clients.appClient}, breaker: e.circuit, config: config.CircuitBreaker}, policy: config.RetryPolicy}
+	if action.App != nil && action.App.Sync != nil && action.App.Sync.Retry != nil {
+		writePolicy, err := action.App.Sync.Retry.policy(config.RetryPolicy)
+		if err != nil {
+			return result, fmt.Errorf("invalid sync retry strategy: %w", err)
+		}
+		retryingClient.writePolicy = &writePolicy
+	}
+	if action.App != nil && action.App.SetRevision != nil && action.App.SetRevision.Retry != nil {
+		writePolicy, err := action.App.SetRevision.Retry.policy(config.RetryPolicy)
+		if err != nil {
+			return result, fmt.Errorf("invalid setRevision retry strategy: %w", err)
+		}
+		retryingClient.writePolicy = &writePolicy
+	}
+	var appClient application.ApplicationServiceClient = retryingClient
+	var settingsClient settings.SettingsServiceClient = &retryingSettingsClient{SettingsServiceClient: &circuitSettingsClient{SettingsServiceClient: &tracingSettingsClient{clients.settingsClient}, breaker: e.circuit, config: config.CircuitBreaker}, policy: config.RetryPolicy}
+	var versionClient version.VersionServiceClient = &retryingVersionClient{VersionServiceClient: &circuitVersionClient{VersionServiceClient: &tracingVersionClient{clients.versionClient}, breaker: e.circuit, config: config.CircuitBreaker}, policy: config.RetryPolicy}
+
+	// The named apps are only fetched if their projects are needed, but a sync action's selected apps are always listed,
+	// since the sync needs them too. Only the action's own timeout applies, since the defaults depend on the apps.
+	getNamed := len(config.Allowlist) > 0 || (len(config.Defaults.Projects) > 0 && needsDefaults(action))
+	targetsCtx, cancel, err := durationStringToContext(ctx, action.Timeout)
+	if err != nil {
+		return result, fmt.Errorf("failed get action context: %w", err)
+	}
+	stop = timings.track("list")
+	targets, err := resolveTargets(targetsCtx, *action.App, getNamed, appClient)
+	stop()
+	cancel()
+	if err != nil {
+		return result, err
+	}
+	action = applyDefaults(action, targets, config.Defaults)
+	action, err = resolveOutputDirs(action, config.OutputBaseDir)
+	if err != nil {
+		return result, err
+	}
+	if action.Timeout == "" && config.DefaultTimeout > 0 {
+		action.Timeout = config.DefaultTimeout.String()
+	}
+	err = checkAllowed(*action.App, targets, config.Allowlist)
+	if err != nil {
+		return result, err
+	}
+
+	if action.App.Sync != nil || action.App.Diff != nil {
+		// The server version is only recorded to help debug compatibility issues, so it doesn't fail the action.
+		serverVersion, err := serverVersionParameter(ctx, action.Timeout, versionClient)
+		if err != nil {
+			result.warnings = append(result.warnings, err.Error())
+		} else {
+			result.parameters = append(result.parameters, serverVersion)
+		}
+	}
+	if action.App.Version != nil {
+		versions, out, err := getVersions(ctx, action.Timeout, versionClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to get versions: %w", err)
+		}
+		result.output = out
+		result.parameters = append(result.parameters,
+			wfv1.Parameter{Name: "serverVersion", Value: wfv1.AnyStringPtr(versions.Server.Version)},
+			wfv1.Parameter{Name: "pluginVersion", Value: wfv1.AnyStringPtr(versions.Plugin.Version)})
+	}
+	if action.App.List != nil {
+		result.output, err = listApps(ctx, *action.App.List, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to list apps: %w", err)
+		}
+	}
+	if action.App.SetRevision != nil {
+		result.output, err = setRevision(ctx, *action.App.SetRevision, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to set revision: %w", err)
+		}
+	}
+	if action.App.Create != nil {
+		created, err := createApp(ctx, *action.App.Create, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to create app: %w", err)
+		}
+		result.output = created.Name
+		result.parameters = append(result.parameters,
+			wfv1.Parameter{Name: "name", Value: wfv1.AnyStringPtr(created.Name)},
+			wfv1.Parameter{Name: "namespace", Value: wfv1.AnyStringPtr(created.Namespace)})
+	}
+	if action.App.Delete != nil {
+		result.output, err = deleteApp(ctx, *action.App.Delete, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to delete app: %w", err)
+		}
+	}
+	if action.App.Rollback != nil {
+		result.output, err = rollbackApp(ctx, *action.App.Rollback, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to roll back app: %w", err)
+		}
+	}
+	if action.App.Terminate != nil {
+		terminated, err := terminateOperation(ctx, *action.App.Terminate, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to terminate operation: %w", err)
+		}
+		result.output = "no operation was running"
+		if terminated {
+			result.output = "terminated the running operation"
+		}
+		result.parameters = append(result.parameters, wfv1.Parameter{Name: "terminated", Value: wfv1.AnyStringPtr(terminated)})
+	}
+	if action.App.Refresh != nil {
+		result.output, err = refreshApp(ctx, *action.App.Refresh, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to refresh app: %w", err)
+		}
+	}
+	if action.App.WaitForSync != nil {
+		waitResult, err := waitForSync(ctx, *action.App.WaitForSync, action.Timeout, appClient)
+		if err != nil {
+			return result, fmt.Errorf("failed to wait for sync: %w", err)
+		}
+		out, err := json.Marshal(waitResult)
+		if err != nil {
+			return result, fmt.Errorf("failed to marshal wait result: %w", err)
+		}
+		result.output = string(out)
+	}
+
+	var diffed diffResult
+	// When both are requested, the diff must run first so that it records the state before the sync applies it.
+	if action.App.Diff != nil {
+		maxOutputBytes := action.App.Diff.MaxOutputBytes
+		if maxOutputBytes == 0 {
+			maxOutputBytes = config.MaxDiffOutputBytes
+		}
+		var diff diffResult
+		if action.App.Diff.Apps != "" {
+			diff, err = diffApps(ctx, *action.App.Diff, action.Timeout, appClient, settingsClient, timings)
+		} else {
+			diff, err = diffApp(ctx, *action.App.Diff, action.Timeout, appClient, settingsClient, timings)
+		}
+		// The parameter is set even if the diff failed, so that a workflow can branch on an app which doesn't exist yet,
+		// for example to create it.
+		result.parameters = append(result.parameters, wfv1.Parameter{Name: "appNotFound", Value: wfv1.AnyStringPtr(isAppNotFoundError(err))})
+		if err != nil && action.App.Diff.Apps != "" {
+			// The output covers the apps which were diffed.
+			result.output, _ = truncateDiff(ctx, diff.diff, *action.App.Diff, maxOutputBytes)
+			return result, fmt.Errorf("failed to diff apps: %w", err)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to diff app: %w", err)
+		}
+		// The hash and the counts cover the whole diff, even if the output is truncated.
+		var truncated bool
+		result.output, truncated = truncateDiff(ctx, diff.diff, *action.App.Diff, maxOutputBytes)
+		result.parameters = append(result.parameters, wfv1.Parameter{Name: "diffTruncated", Value: wfv1.AnyStringPtr(truncated)})
+		diffed = diff
+		result.parameters = append(result.parameters, diff.stats.parameters()...)
+		if action.App.Diff.Canonical {
+			result.parameters = append(result.parameters, wfv1.Parameter{Name: "diffHash", Value: wfv1.AnyStringPtr(diff.hash)})
+		}
+		result.changesFound = diff.stats.Changed > 0
+		result.parameters = append(result.parameters, wfv1.Parameter{Name: "outOfSync", Value: wfv1.AnyStringPtr(result.changesFound)})
+		result.warnings = append(result.warnings, diff.warnings...)
+		if action.App.Diff.OutputDir != "" {
+			// The files are written in full, but their contents are capped like the diff.
+			contents, truncated, err := fileContents(diff.files, maxOutputBytes)
+			if err != nil {
+				return result, fmt.Errorf("failed to marshal diff files: %w", err)
+			}
+			result.parameters = append(result.parameters,
+				wfv1.Parameter{Name: "diffFiles", Value: wfv1.AnyStringPtr(contents)},
+				wfv1.Parameter{Name: "diffFilesTruncated", Value: wfv1.AnyStringPtr(truncated)},
+			)
+		}
+		if action.App.Diff.FailOnDiff && result.changesFound {
+			return result, fmt.Errorf("%w: %s", errDiffFound, diff.stats.summary())
+		}
+	}
+	if action.App.Sync != nil {
+		if action.App.VerifyRevision {
+			err = verifyRevision(ctx, action.App.Diff.App, diffed, action.Timeout, appClient)
+			if err != nil {
+				return result, err
+			}
+		}
+		// Recorded manifests are capped like diffs unless the action sets its own cap.
+		if action.App.Sync.MaxManifestsBytes == 0 {
+			syncAction := *action.App.Sync
+			syncAction.MaxManifestsBytes = config.MaxDiffOutputBytes
+			action.App.Sync = &syncAction
+		}
+		syncResults, syncErr := syncAppsParallel(ctx, *action.App.Sync, targets.selected, action.Timeout, config.MaxSyncApps, appClient, timings)
+		if syncResults != nil {
+			result.progress = syncProgress(syncResults)
+			result.apps = make([]string, len(syncResults))
+			for i, syncResult := range syncResults {
+				result.apps[i] = appKey(App{Name: syncResult.Name, Namespace: syncResult.Namespace})
+			}
+		}
+		for _, syncResult := range syncResults {
+			if syncResult.Warning != "" {
+				result.warnings = append(result.warnings, fmt.Sprintf("app %q: %s", syncResult.Name, syncResult.Warning))
+			}
+		}
+		if syncResults != nil && len(syncResults) == 0 {
+			result.warnings = append(result.warnings, fmt.Sprintf("no apps are owned by ApplicationSet %q, so nothing was synced", action.App.Sync.ApplicationSet))
+		}
+		result.parameters = append(result.parameters, wfv1.Parameter{Name: "blockedBySyncWindow", Value: wfv1.AnyStringPtr(blockedBySyncWindow(syncResults))})
+		// A single app's revision is also a parameter, so that later steps can reference what was deployed.
+		if len(syncResults) == 1 {
+			result.parameters = append(result.parameters, wfv1.Parameter{Name: "revision", Value: wfv1.AnyStringPtr(syncResults[0].Revision)})
+		}
+		if action.App.Sync.ManifestsOutputDir != "" {
+			params, err := manifestsParameters(syncResults, action.App.Sync.MaxManifestsBytes)
+			if err != nil {
+				return result, err
+			}
+			result.parameters = append(result.parameters, params...)
+		}
+		// The results are output even if some apps failed, so that it's clear which ones succeeded. A diff-then-sync
+		// action always keeps the diff as its result, even an empty one, so its results are the `syncResults` output
+		// parameter instead.
+		if syncResults != nil {
+			out, err := json.Marshal(syncResults)
+			if err != nil {
+				return result, fmt.Errorf("failed to marshal sync results: %w", err)
+			}
+			if action.App.DiffThenSync {
+				result.parameters = append(result.parameters, wfv1.Parameter{Name: "syncResults", Value: wfv1.AnyStringPtr(string(out))})
+			} else {
+				result.output = string(out)
+			}
+		}
+		var partial partialError
+		if errors.As(syncErr, &partial) {
+			failed := failedSyncApps(syncResults)
+			syncErr = fmt.Errorf("failed to sync %d of %d apps (%s): %w", len(failed), len(syncResults), strings.Join(failed, ", "), syncErr)
+			if action.App.Sync.AllowPartialSuccess {
+				result.warnings = append(result.warnings, syncErr.Error())
+				result.partialFailure = true
+				return result, nil
+			}
+			return result, syncErr
+		}
+		if syncErr != nil {
+			return result, fmt.Errorf("failed to sync apps: %w", syncErr)
+		}
+	}
+	return result, err
+}
+
+// failedSyncApps returns the names of the apps which failed to sync, as namespace/name if they have a namespace.
+func failedSyncApps(results []appSyncResult) []string {
+	var failed []string
+	for _, result := range results {
+		if result.Error != "" {
+			failed = append(failed, appKey(App{Name: result.Name, Namespace: result.Namespace}))
+		}
+	}
+	return failed
+}
+
+// blockedBySyncWindow returns true if a sync window didn't allow any of the apps to be synced.
+func blockedBySyncWindow(results []appSyncResult) bool {
+	for _, result := range results {
+		if result.BlockedBySyncWindow {
+			return true
+		}
+	}
+	return false
+}
+
+// syncProgress returns the number of apps which were synced successfully out of the total, as the node's progress.
+func syncProgress(results []appSyncResult) wfv1.Progress {
+	succeeded := 0
+	for _, result := range results {
+		if result.Error == "" {
+			succeeded++
+		}
+	}
+	return wfv1.Progress(fmt.Sprintf("%d/%d", succeeded, len(results)))
+}
+
+// verifyRevision checks that the revision which was diffed, which may be the diff's fallback revision, still resolves
+// to the same revision, so that a diff-then-sync action doesn't apply a state other than the one which was reviewed.
+func verifyRevision(ctx context.Context, app App, diff diffResult, timeout string, appClient application.ApplicationServiceClient) error {
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	res, err := getTargetManifests(ctx, app, diff.requestedRevision, appClient)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the current target revision: %w", err)
+	}
+	if res.Revision != diff.revision {
+		return fmt.Errorf("state changed since diff: app %q now targets revision %q, but the diff was of revision %q", app.Name, res.Revision, diff.revision)
+	}
+	return nil
+}
+
+// appActionTypes returns the names of the action types set on app.
+func appActionTypes(app AppActionSpec) []string {
+	var actionTypes []string
+	if app.Sync != nil {
+		actionTypes = append(actionTypes, "sync")
+	}
+	if app.Diff != nil {
+		actionTypes = append(actionTypes, "diff")
+	}
+	if app.List != nil {
+		actionTypes = append(actionTypes, "list")
+	}
+	if app.SetRevision != nil {
+		actionTypes = append(actionTypes, "setRevision")
+	}
+	if app.Create != nil {
+		actionTypes = append(actionTypes, "create")
+	}
+	if app.Delete != nil {
+		actionTypes = append(actionTypes, "delete")
+	}
+	if app.Rollback != nil {
+		actionTypes = append(actionTypes, "rollback")
+	}
+	if app.Terminate != nil {
+		actionTypes = append(actionTypes, "terminate")
+	}
+	if app.Refresh != nil {
+		actionTypes = append(actionTypes, "refresh")
+	}
+	if app.WaitForSync != nil {
+		actionTypes = append(actionTypes, "waitForSync")
+	}
+	if app.Version != nil {
+		actionTypes = append(actionTypes, "version")
+	}
+	return actionTypes
+}
+
+// appSummary is the output of a list action for a single app.
+type appSummary struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace,omitempty"`
+	Project      string `json:"project,omitempty"`
+	SyncStatus   string `json:"syncStatus,omitempty"`
+	HealthStatus string `json:"healthStatus,omitempty"`
+}
+
+// listApps lists the apps matching the action's filters and returns them as a JSON array.
+func listApps(ctx context.Context, action ListAction, timeout string, appClient application.ApplicationServiceClient) (string, error) {
+	if errs := action.validate(); len(errs) > 0 {
+		return "", errs
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	query := &application.ApplicationQuery{Projects: action.Projects}
+	if action.Selector != "" {
+		query.Selector = pointer.String(action.Selector)
+	}
+	if action.Namespace != "" {
+		query.AppNamespace = pointer.String(action.Namespace)
+	}
+	list, err := appClient.List(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to list applications: %w", err)
+	}
+	summaries := make([]appSummary, 0, len(list.Items))
+	for _, app := range list.Items {
+		summaries = append(summaries, appSummary{
+			Name:         app.Name,
+			Namespace:    app.Namespace,
+			Project:      app.Spec.Project,
+			SyncStatus:   string(app.Status.Sync.Status),
+			HealthStatus: string(app.Status.Health.Status),
+		})
+	}
+	// The API doesn't support paging, so sort to make paging by offset stable between calls.
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Namespace != summaries[j].Namespace {
+			return summaries[i].Namespace < summaries[j].Namespace
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	if action.Offset >= len(summaries) {
+		summaries = summaries[:0]
+	} else {
+		summaries = summaries[action.Offset:]
+	}
+	if action.Limit > 0 && action.Limit < len(summaries) {
+		summaries = summaries[:action.Limit]
+	}
+	out, err := json.Marshal(summaries)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal apps: %w", err)
+	}
+	return string(out), nil
+}
+
+// setRevisionRetries is the number of times a set-revision action retries a patch which conflicted with a concurrent
+// update.
+const setRevisionRetries = 3
+
+// setRevisionRetryBackoff is how long a set-revision action waits before retrying a conflicting patch.
+var setRevisionRetryBackoff = 500 * time.Millisecond
+
+// setRevision patches the app's target revision without syncing it and returns the new target revision.
+func setRevision(ctx context.Context, action SetRevisionAction, timeout string, appClient application.ApplicationServiceClient) (string, error) {
+	if errs := action.validate(); len(errs) > 0 {
+		return "", errs
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"targetRevision": action.Revision},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	for attempt := 0; ; attempt++ {
+		var app *v1alpha1.Application
+		app, err = appClient.Patch(ctx, &application.ApplicationPatchRequest{
+			Name:         pointer.String(action.Name),
+			AppNamespace: pointer.String(action.Namespace),
+			Patch:        pointer.String(string(patch)),
+			PatchType:    pointer.String("merge"),
+		})
+		if err == nil {
+			return app.Spec.Source.TargetRevision, nil
+		}
+		if attempt >= setRevisionRetries || !isConflictError(err) {
+			return "", fmt.Errorf("failed to patch app %q: %w", action.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("failed to patch app %q: %w", action.Name, ctx.Err())
+		case <-time.After(setRevisionRetryBackoff):
+		}
+	}
+}
+
+// defaultReconcileTimeout bounds how long a create action waits for the first reconciliation if the action has no
+// timeout.
+const defaultReconcileTimeout = 5 * time.Minute
+
+// appPollInterval is how often the plugin gets an app while waiting for it to reach some state.
+var appPollInterval = 2 * time.Second
+
+// syncWindowPollInterval is how often the plugin retries the sync of an app which a sync window blocks. Windows are
+// scheduled by the minute, so there's no point retrying more often.
+var syncWindowPollInterval = 30 * time.Second
+
+// createApp creates the app described by the action, or updates it if the action upserts, and returns its name and
+// namespace. If requested, it waits for the app's first reconciliation before returning.
+func createApp(ctx context.Context, action CreateAction, timeout string, appClient application.ApplicationServiceClient) (App, error) {
+	app, err := readApplication(action)
+	if err != nil {
+		return App{}, err
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return App{}, fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	created, err := appClient.Create(ctx, &application.ApplicationCreateRequest{Application: app, Upsert: pointer.Bool(action.Upsert)})
+	if err != nil {
+		return App{}, fmt.Errorf("failed to create app %q: %w", app.Name, err)
+	}
+	if action.WaitForReconcile {
+		if timeout == "" {
+			var cancelWait func()
+			ctx, cancelWait = context.WithTimeout(ctx, defaultReconcileTimeout)
+			defer cancelWait()
+		}
+		err = waitForReconcile(ctx, App{Name: created.Name, Namespace: created.Namespace}, appClient)
+		if err != nil {
+			return App{}, err
+		}
+	}
+	return App{Name: created.Name, Namespace: created.Namespace}, nil
+}
+
+// isReconciled returns true once the controller has compared the app to its source for the first time.
+func isReconciled(app *v1alpha1.Application) bool {
+	return app.Status.ReconciledAt != nil && app.Status.Sync.Status != "" && app.Status.Sync.Status != v1alpha1.SyncStatusCodeUnknown
+}
+
+// waitForReconcile polls the app until it has been reconciled or ctx is done.
+func waitForReconcile(ctx context.Context, app App, appClient application.ApplicationServiceClient) error {
+	for {
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{Name: pointer.String(app.Name), AppNamespace: pointer.String(app.Namespace)})
+		if err != nil {
+			return fmt.Errorf("failed to get app %q: %w", app.Name, err)
+		}
+		if isReconciled(current) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			msg := fmt.Sprintf("app %q was not reconciled before the timeout (sync status %q)", app.Name, current.Status.Sync.Status)
+			for _, condition := range current.Status.Conditions {
+				msg += fmt.Sprintf("; %s: %s", condition.Type, condition.Message)
+			}
+			return errors.New(msg)
+		case <-time.After(appPollInterval):
+		}
+	}
+}
+
+// appSyncResult describes the state of a single app after its sync was requested.
+type appSyncResult struct {
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace,omitempty"`
+	Phase     string       `json:"phase,omitempty"`
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	// Message is the dry-run operation's message.
+	Message string `json:"message,omitempty"`
+	// Resources are the results of a dry-run sync for each of the app's resources.
+	Resources []resourceResult `json:"resources,omitempty"`
+	// Pruned lists the resources a dry-run sync with prune would delete.
+	Pruned []ResourceRef `json:"pruned,omitempty"`
+	// Automated is the app's automated sync policy, if it has one and the action checked for it.
+	Automated *v1alpha1.SyncPolicyAutomated `json:"automated,omitempty"`
+	// Skipped is true if the sync was skipped because of the app's automated sync policy or error conditions.
+	Skipped bool `json:"skipped,omitempty"`
+	// Warning describes a potential problem with the sync.
+	Warning string `json:"warning,omitempty"`
+	// Revision is the revision the app was synced to. If the action read the sync operation's state, it's the revision
+	// the operation resolved, like a commit SHA. Otherwise, it's the one the app's recorded manifests were rendered from
+	// or whose signature was verified, or the requested revision or the one the app was last compared to when the sync
+	// was requested.
+	Revision string `json:"revision,omitempty"`
+	// Health is the app's health status once the action stopped waiting for it to become healthy.
+	Health string `json:"health,omitempty"`
+	// Children are the final statuses of the app's child apps and their descendants, if the action waited for them.
+	Children []childAppResult `json:"children,omitempty"`
+	// BlockedBySyncWindow is true if a sync window didn't allow the app to be synced.
+	BlockedBySyncWindow bool `json:"blockedBySyncWindow,omitempty"`
+	// Error is why the action failed for the app, if it did.
+	Error string `json:"error,omitempty"`
+	// manifests is the app's manifests file, if the action recorded it.
+	manifests *appManifests
+}
+
+// String returns the resource as group/kind/namespace/name.
+func (r ResourceRef) String() string {
+	return strings.Join([]string{r.Group, r.Kind, r.Namespace, r.Name}, "/")
+}
+
+// matches returns true if the resource matches every non-empty field of the matcher.
+func (m ResourceMatcher) matches(r ResourceRef) bool {
+	return (m.Group == "" || m.Group == r.Group) &&
+		(m.Kind == "" || m.Kind == r.Kind) &&
+		(m.Namespace == "" || m.Namespace == r.Namespace) &&
+		(m.Name == "" || m.Name == r.Name)
+}
+
+// defaultMaxConcurrency is the number of apps a sync action syncs at once if neither the action nor the plugin's
+// defaults set it. It keeps large actions from overwhelming the API server.
+const defaultMaxConcurrency = 10
+
+// syncAppsParallel loops over the apps in a SyncAction, and the selected apps which selectApps listed for it, and syncs
+// them in parallel, at most action.MaxConcurrency at a time. It waits for all responses and then aggregates any errors.
+// If maxApps is positive, actions targeting more apps than that are rejected. A result is returned for each app, in the
+// order the apps were listed, even if some of them failed. A dry run waits for each app's operation to complete so that
+// what it would change can be reported, and fails for apps whose dry run failed. Every API call uses the action's
+// context, so when it times out or is cancelled, in-flight calls return and the workers exit before this function does.
+func syncAppsParallel(ctx context.Context, action SyncAction, selected []targetApp, timeout string, maxApps int, appClient application.ApplicationServiceClient, timings *phaseTimings) (results []appSyncResult, err error) {
+	ctx, span := startSpan(ctx, "syncAppsParallel")
+	defer func() {
+		endSpan(span, err)
+	}()
+	apps, err := readApps(action)
+	if err != nil {
+		return nil, err
+	}
+	options, err := readSyncOptions(action)
+	if err != nil {
+		return nil, err
+	}
+	options = mergeSyncOptions(options, flagSyncOptions(action))
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	if errs := action.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	workers := action.MaxConcurrency
+	if workers == 0 {
+		workers = defaultMaxConcurrency
+	}
+	if workers <= 0 {
+		// Without a worker, no app would be synced and the action would still succeed.
+		return nil, fmt.Errorf("maxConcurrency must be positive, got %d", workers)
+	}
+	if action.Selector != "" || action.ApplicationSet != "" {
+		apps = appendSelectedApps(apps, selected)
+		if len(apps) == 0 && action.ApplicationSet != "" {
+			// An ApplicationSet may legitimately generate no apps, for example before any clusters match its generator.
+			return []appSyncResult{}, nil
+		}
+		if len(apps) == 0 {
+			return nil, fmt.Errorf("no apps to sync: no apps match selector %q", action.Selector)
+		}
+	}
+	if maxApps > 0 && len(apps) > maxApps {
+		return nil, fmt.Errorf("sync action targets %d apps, which exceeds the limit of %d; split the apps into multiple sync actions", len(apps), maxApps)
+	}
+	span.SetAttributes(attribute.Int("argocd.sync.apps", len(apps)))
+	results = make([]appSyncResult, len(apps))
+	// Operation start times are only stored with second precision.
+	requestedAt := metav1.NewTime(time.Now().Truncate(time.Second))
+	if workers > len(apps) {
+		workers = len(apps)
+	}
+	indexes := make(chan int, len(apps))
+	for i := range apps {
+		indexes <- i
+	}
+	close(indexes)
+	wg := sync.WaitGroup{}
+	errChan := make(chan error, len(apps))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				result, err := syncApp(ctx, apps[i], action, options, requestedAt, appClient, timings)
+				if err != nil {
+					result.Error = err.Error()
+					errChan <- err
+				}
+				// Each app is synced by exactly one worker, which writes only its index, so no locking is needed.
+				results[i] = result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errChan)
+	}()
+	var syncErrors multiError
+	for err := range errChan {
+		syncErrors = append(syncErrors, err)
+	}
+	failed := len(syncErrors)
+	syncErrors = combineUnhealthyErrors(syncErrors)
+	if failed > 0 && failed < len(apps) {
+		return results, partialError{syncErrors}
+	}
+	if len(syncErrors) > 0 {
+		return results, syncErrors
+	}
+	return results, nil
+}
+
+// selectApps lists the apps a sync action selects by label or ApplicationSet, along with their projects, sorted by
+// namespace and name. An app selected both ways is only listed once.
+func selectApps(ctx context.Context, action SyncAction, appClient application.ApplicationServiceClient) ([]targetApp, error) {
+	var apps []targetApp
+	if action.Selector != "" {
+		selected, err := listSelectedApps(ctx, action.Selector, appClient)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, selected...)
+	}
+	if action.ApplicationSet != "" {
+		generated, err := listApplicationSetApps(ctx, action.ApplicationSet, appClient)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range generated {
+			if !containsApp(apps, app.App) {
+				apps = append(apps, app)
+			}
+		}
+	}
+	sortApps(apps)
+	return apps, nil
+}
+
+// listSelectedApps lists the apps matching the label selector, sorted by namespace and name.
+func listSelectedApps(ctx context.Context, selector string, appClient application.ApplicationServiceClient) ([]targetApp, error) {
+	list, err := appClient.List(ctx, &application.ApplicationQuery{Selector: pointer.String(selector)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list apps matching selector %q: %w", selector, err)
+	}
+	apps := make([]targetApp, 0, len(list.Items))
+	for _, item := range list.Items {
+		apps = append(apps, foundTargetApp(item))
+	}
+	sortApps(apps)
+	return apps, nil
+}
+
+// applicationSetKind is the kind of the owner references ApplicationSets set on the apps they generate.
+const applicationSetKind = "ApplicationSet"
+
+// listApplicationSetApps lists the apps owned by the named ApplicationSet, sorted by namespace and name. The API can't
+// filter apps by owner, so every app is listed.
+func listApplicationSetApps(ctx context.Context, applicationSet string, appClient application.ApplicationServiceClient) ([]targetApp, error) {
+	list, err := appClient.List(ctx, &application.ApplicationQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list apps of ApplicationSet %q: %w", applicationSet, err)
+	}
+	var apps []targetApp
+	for _, item := range list.Items {
+		for _, owner := range item.OwnerReferences {
+			// Some Argo CD versions register the kind as "Applicationset", so the kind is matched case-insensitively.
+			if strings.EqualFold(owner.Kind, applicationSetKind) && owner.Name == applicationSet {
+				apps = append(apps, foundTargetApp(item))
+				break
+			}
+		}
+	}
+	sortApps(apps)
+	return apps, nil
+}
+
+// sortApps sorts apps by namespace and name.
+func sortApps(apps []targetApp) {
+	sort.Slice(apps, func(i, j int) bool {
+		if apps[i].Namespace != apps[j].Namespace {
+			return apps[i].Namespace < apps[j].Namespace
+		}
+		return apps[i].Name < apps[j].Name
+	})
+}
+
+// containsApp returns true if apps includes app.
+func containsApp(apps []targetApp, app App) bool {
+	for _, existing := range apps {
+		if existing.App == app {
+			return true
+		}
+	}
+	return false
+}
+
+// appendSelectedApps appends the selected apps which aren't already listed. A listed app without a namespace matches a
+// selected app with the same name in any namespace, since it refers to the app in the API server's namespace.
+func appendSelectedApps(listed []SyncApp, selected []targetApp) []SyncApp {
+	apps := listed
+	for _, app := range selected {
+		duplicate := false
+		for _, existing := range listed {
+			if existing.Name == app.Name && (existing.Namespace == "" || existing.Namespace == app.Namespace) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			apps = append(apps, SyncApp{App: app.App})
+		}
+	}
+	return apps
+}
+
+// syncApp syncs a single app as described by the action and returns what the action requested to know about it.
+func syncApp(ctx context.Context, app SyncApp, action SyncAction, options []string, requestedAt metav1.Time, appClient application.ApplicationServiceClient, timings *phaseTimings) (result appSyncResult, err error) {
+	ctx, span := startSpan(ctx, "syncApp", appAttributes(app.App))
+	defer func() {
+		endSpan(span, err)
+	}()
+	result = appSyncResult{Name: app.Name, Namespace: app.Namespace}
+	revision := app.Revision
+	if revision == "" {
+		revision = action.Revision
+	}
+	var retryStrategy *v1alpha1.RetryStrategy
+	if action.AutomatedSyncPolicy != "" || checksErrorConditions(action.ErrorConditionPolicy) || action.VerifySignature || action.UseAppRetry {
+		stop := timings.track("get")
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         pointer.String(app.Name),
+			AppNamespace: pointer.String(app.Namespace),
+		})
+		stop()
+		if err != nil {
+			return result, fmt.Errorf("failed to get app %q: %w", app.Name, err)
+		}
+		skipReason, err := checkErrorConditions(current, action.ErrorConditionPolicy)
+		if err != nil {
+			return result, err
+		}
+		if skipReason != "" {
+			result.Skipped = true
+			result.Warning = skipReason
+			return result, nil
+		}
+		if action.AutomatedSyncPolicy != "" && current.Spec.SyncPolicy != nil && current.Spec.SyncPolicy.Automated != nil {
+			result.Automated = current.Spec.SyncPolicy.Automated.DeepCopy()
+			switch action.AutomatedSyncPolicy {
+			case AutomatedSyncPolicySkip:
+				result.Skipped = true
+				result.Warning = "app has automated sync enabled, so it was skipped"
+				return result, nil
+			case AutomatedSyncPolicyWarn:
+				result.Warning = fmt.Sprintf("app has automated sync enabled (selfHeal: %t), so the controller may override this sync", result.Automated.SelfHeal)
+			}
+		}
+		if action.UseAppRetry && current.Spec.SyncPolicy != nil {
+			retryStrategy = current.Spec.SyncPolicy.Retry
+		}
+		if action.VerifySignature {
+			stop = timings.track("verifySignature")
+			result.Revision, err = verifySignature(ctx, current, revision, appClient)
+			stop()
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	request := &application.ApplicationSyncRequest{
+		Name:          pointer.String(app.Name),
+		AppNamespace:  pointer.String(app.Namespace),
+		Revision:      pointer.String(revision),
+		SyncOptions:   &application.SyncOptions{Items: mergeSyncOptions(options, app.Options)},
+		DryRun:        pointer.Bool(action.DryRun),
+		Prune:         pointer.Bool(action.Prune),
+		Resources:     syncOperationResources(action.Resources),
+		RetryStrategy: retryStrategy,
+		Infos:         auditInfoFrom(ctx).operationInfos(),
+	}
+	stop := timings.track("syncRPC")
+	synced, err := appClient.Sync(ctx, request)
+	stop()
+	for err != nil && action.WaitForSyncWindow && isSyncWindowError(err) {
+		stop = timings.track("syncWindowWait")
+		select {
+		case <-ctx.Done():
+			stop()
+			result.BlockedBySyncWindow = true
+			return result, fmt.Errorf("failed to sync app %q: %w, and no window allowed it before the timeout", app.Name, errBlockedBySyncWindow)
+		case <-time.After(syncWindowPollInterval):
+		}
+		stop()
+		stop = timings.track("syncRPC")
+		synced, err = appClient.Sync(ctx, request)
+		stop()
+	}
+	if err != nil && isSyncWindowError(err) {
+		result.BlockedBySyncWindow = true
+		return result, fmt.Errorf("failed to sync app %q: %w", app.Name, errBlockedBySyncWindow)
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to sync app %q: %w", app.Name, err)
+	}
+	if result.Revision == "" {
+		result.Revision = revision
+	}
+	if result.Revision == "" {
+		result.Revision = synced.Status.Sync.Revision
+	}
+	if action.ManifestsOutputDir != "" {
+		stop = timings.track("getManifests")
+		manifests, err := writeAppManifests(ctx, action.ManifestsOutputDir, app.App, revision, action.MaxManifestsBytes, appClient)
+		stop()
+		if err != nil {
+			return result, fmt.Errorf("failed to record manifests of app %q: %w", app.Name, err)
+		}
+		result.Revision = manifests.revision
+		result.manifests = &manifests
+	}
+	if action.DryRun {
+		stop = timings.track("operationWait")
+		state, err := waitForDryRunOperation(ctx, app.App, requestedAt, appClient)
+		stop()
+		if err != nil {
+			return result, err
+		}
+		result.Phase = string(state.Phase)
+		result.StartedAt = state.StartedAt.DeepCopy()
+		result.Message = state.Message
+		result.Resources = resourceResults(state)
+		if resolved := operationRevision(state, requestedAt); resolved != "" {
+			result.Revision = resolved
+		}
+		if !state.Phase.Successful() {
+			return result, fmt.Errorf("dry-run sync of app %q %s: %s", app.Name, strings.ToLower(string(state.Phase)), state.Message)
+		}
+		if !action.Prune {
+			return result, nil
+		}
+		result.Pruned = prunedResources(state)
+		if unexpected := unexpectedPrunes(result.Pruned, action.PruneAllowlist); len(unexpected) > 0 {
+			return result, fmt.Errorf("app %q would prune resources which are not in the prune allowlist: %s", app.Name, strings.Join(unexpected, ", "))
+		}
+	} else if action.WaitForHealth {
+		stop = timings.track("healthWait")
+		current, err := waitForHealth(ctx, app.App, action.HealthTimeout, requestedAt, appClient)
+		stop()
+		if current != nil {
+			result.Health = string(current.Status.Health.Status)
+			if state := current.Status.OperationState; state != nil {
+				result.Phase = string(state.Phase)
+				result.StartedAt = state.StartedAt.DeepCopy()
+				if resolved := operationRevision(state, requestedAt); resolved != "" {
+					result.Revision = resolved
+				}
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+		if action.SyncChildApps {
+			stop = timings.track("childAppsWait")
+			result.Children, err = waitForChildApps(ctx, app.App, action.HealthTimeout, requestedAt, appClient)
+			stop()
+			if err != nil {
+				return result, fmt.Errorf("child apps of app %q aren't synced and healthy: %w", app.Name, err)
+			}
+		}
+	} else if action.IncludeOperationState {
+		stop = timings.track("get")
+		state, err := getOperationState(ctx, app.App, appClient)
+		stop()
+		if err != nil {
+			return result, fmt.Errorf("failed to get operation state for app %q: %w", app.Name, err)
+		}
+		if state != nil {
+			result.Phase = string(state.Phase)
+			result.StartedAt = state.StartedAt.DeepCopy()
+			if resolved := operationRevision(state, requestedAt); resolved != "" {
+				result.Revision = resolved
+			}
+		}
+	}
+	return result, nil
+}
+
+// operationRevision returns the revision the operation resolved and synced, like the commit SHA a branch pointed to, if
+// the operation started no earlier than requestedAt and has resolved it. Otherwise, it returns an empty string.
+func operationRevision(state *v1alpha1.OperationState, requestedAt metav1.Time) string {
+	if state.SyncResult == nil || state.StartedAt.Before(&requestedAt) {
+		return ""
+	}
+	return state.SyncResult.Revision
+}
+
+// syncOperationResources converts the resources to sync into their API form. No resources syncs the whole app.
+func syncOperationResources(resources []ResourceRef) []*v1alpha1.SyncOperationResource {
+	var converted []*v1alpha1.SyncOperationResource
+	for _, res := range resources {
+		converted = append(converted, &v1alpha1.SyncOperationResource{Group: res.Group, Kind: res.Kind, Namespace: res.Namespace, Name: res.Name})
+	}
+	return converted
+}
+
+// waitForHealth polls the app until the sync operation requested at requestedAt has completed and the app is healthy,
+// and returns the app as last seen. It fails right away if the operation fails, and with an unhealthyError if the
+// timeout or the context expires first.
+func waitForHealth(ctx context.Context, app App, timeout string, requestedAt metav1.Time, appClient application.ApplicationServiceClient) (*v1alpha1.Application, error) {
+	if timeout != "" {
+		// The timeout was validated before any app was synced.
+		duration, _ := time.ParseDuration(timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	var last *v1alpha1.Application
+	phase := "not started"
+	for {
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         pointer.String(app.Name),
+			AppNamespace: pointer.String(app.Namespace),
+		})
+		if err != nil && ctx.Err() != nil && last != nil {
+			// The request was cut short by the timeout, so report what was last seen.
+			return last, unhealthyError{app: app.Name, health: string(last.Status.Health.Status), phase: phase}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get app %q: %w", app.Name, err)
+		}
+		last = current
+		state := current.Status.OperationState
+		if state != nil && !state.StartedAt.Before(&requestedAt) {
+			phase = string(state.Phase)
+			if state.Phase.Completed() && !state.Phase.Successful() {
+				return current, fmt.Errorf("sync of app %q %s: %s", app.Name, strings.ToLower(phase), state.Message)
+			}
+			if state.Phase.Successful() && current.Status.Health.Status == health.HealthStatusHealthy {
+				return current, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return current, unhealthyError{app: app.Name, health: string(current.Status.Health.Status), phase: phase}
+		case <-time.After(appPollInterval):
+		}
+	}
+}
+
+// childAppResult is the final status of a child app of an app of apps.
+type childAppResult struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	// Parent is the app which manages this app's Application resource, as {namespace}/{name}.
+	Parent string `json:"parent"`
+	Sync   string `json:"sync,omitempty"`
+	Health string `json:"health,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// waitForChildApps waits for each app whose Application resource is managed by the parent app, and then for each of
+// their own child apps, to be synced and healthy. Each app is only waited for once, so that cycles, like an app which
+// manages its own Application, don't recurse forever. The children of apps which fail aren't waited for.
+func waitForChildApps(ctx context.Context, parent App, timeout string, requestedAt metav1.Time, appClient application.ApplicationServiceClient) ([]childAppResult, error) {
+	var results []childAppResult
+	var errs multiError
+	visited := map[string]bool{appKey(parent): true}
+	queue := []App{parent}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		children, err := childApps(ctx, current, appClient)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, child := range children {
+			if visited[appKey(child)] {
+				continue
+			}
+			visited[appKey(child)] = true
+			result := childAppResult{Name: child.Name, Namespace: child.Namespace, Parent: appKey(current)}
+			last, err := waitForChildApp(ctx, child, timeout, requestedAt, appClient)
+			if last != nil {
+				result.Sync = string(last.Status.Sync.Status)
+				result.Health = string(last.Status.Health.Status)
+			}
+			if err != nil {
+				result.Error = err.Error()
+				errs = append(errs, err)
+			} else {
+				queue = append(queue, child)
+			}
+			results = append(results, result)
+		}
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// childApps returns the apps whose Application resources are managed by the given app.
+func childApps(ctx context.Context, app App, appClient application.ApplicationServiceClient) ([]App, error) {
+	gvk := v1alpha1.ApplicationSchemaGroupVersionKind
+	resources, err := appClient.ManagedResources(ctx, &application.ResourcesQuery{
+		ApplicationName: pointer.String(app.Name),
+		AppNamespace:    pointer.String(app.Namespace),
+		Group:           pointer.String(gvk.Group),
+		Kind:            pointer.String(gvk.Kind),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get child apps of app %q: %w", app.Name, err)
+	}
+	var children []App
+	for _, res := range resources.Items {
+		if res.Group == gvk.Group && res.Kind == gvk.Kind {
+			children = append(children, App{Name: res.Name, Namespace: res.Namespace})
+		}
+	}
+	return children, nil
+}
+
+// waitForChildApp polls a child app until it's synced and healthy and has no running operation, and returns the app as
+// last seen. It fails right away if a sync operation which started after requestedAt fails.
+func waitForChildApp(ctx context.Context, app App, timeout string, requestedAt metav1.Time, appClient application.ApplicationServiceClient) (*v1alpha1.Application, error) {
+	if timeout != "" {
+		// The timeout was validated before any app was synced.
+		duration, _ := time.ParseDuration(timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	var last *v1alpha1.Application
+	for {
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         pointer.String(app.Name),
+			AppNamespace: pointer.String(app.Namespace),
+		})
+		if err != nil && ctx.Err() != nil && last != nil {
+			current = last
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get child app %q: %w", app.Name, err)
+		} else {
+			last = current
+			state := current.Status.OperationState
+			if state != nil && !state.StartedAt.Before(&requestedAt) && state.Phase.Completed() && !state.Phase.Successful() {
+				return current, fmt.Errorf("sync of child app %q %s: %s", app.Name, strings.ToLower(string(state.Phase)), state.Message)
+			}
+			if current.Status.Sync.Status == v1alpha1.SyncStatusCodeSynced && current.Status.Health.Status == health.HealthStatusHealthy &&
+				(state == nil || state.Phase.Completed()) {
+				return current, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return current, fmt.Errorf("timed out waiting for child app %q to become synced and healthy (sync: %s, health: %s)",
+				app.Name, current.Status.Sync.Status, current.Status.Health.Status)
+		case <-time.After(appPollInterval):
+		}
+	}
 }
 
-func NewApiExecutor(apiClient apiclient.Client, agentToken string) ApiExecutor {
-	return ApiExecutor{apiClient: apiClient, agentToken: agentToken}
+// goodSignaturePrefix starts the signature info the repo server reports for revisions with a good signature from an
+// allowed key. Other results are "Bad signature from ...", "Invalid signature from ...", "UNKNOWN signature: ..." and
+// "Revision is not signed.".
+const goodSignaturePrefix = "Good signature"
+
+// verifySignature returns the revision a sync applies if it has a good signature, and an error describing why not
+// otherwise. That's the given revision if it's set, and otherwise the app's target revision, the one it was last
+// compared to.
+func verifySignature(ctx context.Context, app *v1alpha1.Application, revision string, appClient application.ApplicationServiceClient) (string, error) {
+	if revision == "" {
+		revision = app.Status.Sync.Revision
+	}
+	if revision == "" {
+		return "", fmt.Errorf("refusing to sync app %q: its target revision is not known yet, so its signature can't be verified", app.Name)
+	}
+	metadata, err := appClient.RevisionMetadata(ctx, &application.RevisionMetadataQuery{
+		Name:         pointer.String(app.Name),
+		AppNamespace: pointer.String(app.Namespace),
+		Revision:     pointer.String(revision),
+	})
+	if err != nil {
+		return revision, fmt.Errorf("failed to get metadata of revision %q of app %q to verify its signature: %w", revision, app.Name, err)
+	}
+	switch {
+	case metadata.SignatureInfo == "":
+		return revision, fmt.Errorf("refusing to sync app %q: no signature information for revision %q; GnuPG verification must be enabled in Argo CD", app.Name, revision)
+	case !strings.HasPrefix(metadata.SignatureInfo, goodSignaturePrefix):
+		return revision, fmt.Errorf("refusing to sync app %q: revision %q is not verified: %s", app.Name, revision, metadata.SignatureInfo)
+	}
+	return revision, nil
 }
 
-func (e *ApiExecutor) Authorize(req *http.Request) error {
-	auth := req.Header.Get("Authorization")
-	if auth != "Bearer "+e.agentToken {
-		return fmt.Errorf("invalid agent token")
+func (p ErrorConditionPolicy) validate() error {
+	switch p {
+	case "", ErrorConditionPolicyProceed, ErrorConditionPolicyFail, ErrorConditionPolicySkip:
+		return nil
 	}
-	return nil
+	return fmt.Errorf("unknown error condition policy %q (must be proceed, fail, or skip)", p)
 }
 
-func (e *ApiExecutor) Execute(args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply {
-	pluginJSON, err := args.Template.Plugin.MarshalJSON()
-	if err != nil {
-		err = fmt.Errorf("failed to marshal plugin to JSON from workflow spec: %w", err)
-		log.Println(err.Error())
-		return errorResponse(err)
+func (f DiffOutputFormat) validate() error {
+	switch f {
+	case "", DiffOutputFormatText, DiffOutputFormatJSON:
+		return nil
 	}
+	return fmt.Errorf("unknown output format %q (must be text or json)", f)
+}
 
-	plugin := &PluginSpec{}
-	err = json.Unmarshal(pluginJSON, plugin)
+// checksErrorConditions returns true if the policy requires getting the app to check its conditions.
+func checksErrorConditions(policy ErrorConditionPolicy) bool {
+	return policy == ErrorConditionPolicyFail || policy == ErrorConditionPolicySkip
+}
+
+// checkErrorConditions applies the policy to the app's error conditions. It returns an error if the policy is to fail,
+// and the conditions' messages if the policy is to skip the app.
+func checkErrorConditions(app *v1alpha1.Application, policy ErrorConditionPolicy) (skipReason string, err error) {
+	err = policy.validate()
 	if err != nil {
-		err = fmt.Errorf("failed to unmarshal plugin JSON to plugin struct: %w", err)
-		log.Println(err.Error())
-		return errorResponse(err)
+		return "", err
+	}
+	var messages []string
+	for _, condition := range app.Status.Conditions {
+		if condition.IsError() {
+			messages = append(messages, fmt.Sprintf("%s: %s", condition.Type, condition.Message))
+		}
+	}
+	if len(messages) == 0 {
+		return "", nil
 	}
+	msg := fmt.Sprintf("app %q has error conditions: %s", app.Name, strings.Join(messages, "; "))
+	switch policy {
+	case ErrorConditionPolicyFail:
+		return "", errors.New(msg)
+	case ErrorConditionPolicySkip:
+		return msg, nil
+	}
+	return "", nil
+}
 
-	if plugin.ArgoCD == nil {
-		log.Println("unsupported plugin type")
-		return executor.ExecuteTemplateReply{} // unsupported plugin
+// flagSyncOptions returns the sync options enabled by the action's flags, like ServerSideApply.
+func flagSyncOptions(action SyncAction) []string {
+	var options []string
+	if action.ServerSideApply {
+		options = append(options, "ServerSideApply=true")
+	}
+	if action.Replace {
+		options = append(options, "Replace=true")
 	}
+	return options
+}
 
-	output, err := e.runAction(*plugin.ArgoCD)
-	if err != nil {
-		return failedResponse(wfv1.Progress(fmt.Sprintf("0/1")), fmt.Errorf("action failed: %w", err))
+// mergeSyncOptions returns the action-level options with the app-level options applied on top. Options are
+// `key=value` pairs, and an app-level option replaces an action-level option with the same key. Duplicate options are
+// dropped.
+func mergeSyncOptions(actionOptions, appOptions []string) []string {
+	if len(appOptions) == 0 {
+		return actionOptions
+	}
+	key := func(option string) string {
+		return strings.SplitN(option, "=", 2)[0]
+	}
+	overridden := make(map[string]bool)
+	for _, option := range appOptions {
+		overridden[key(option)] = true
+	}
+	all := make([]string, 0, len(actionOptions)+len(appOptions))
+	all = append(all, actionOptions...)
+	all = append(all, appOptions...)
+	var merged []string
+	seen := make(map[string]bool)
+	for _, option := range all {
+		if seen[option] {
+			continue
+		}
+		seen[option] = true
+		if overridden[key(option)] && !containsString(appOptions, option) {
+			continue
+		}
+		merged = append(merged, option)
+	}
+	return merged
+}
+
+// UnmarshalYAML accepts either a list of `key=value` pairs, like `[Prune=true]`, or a map, like `{Prune: true}`, whose
+// entries are converted to `key=value` pairs in the order they're written.
+func (o *SyncOptions) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var options []string
+		err := node.Decode(&options)
+		if err != nil {
+			return err
+		}
+		*o = options
+		return nil
+	case yaml.MappingNode:
+		options := make(SyncOptions, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Kind != yaml.ScalarNode {
+				return fmt.Errorf("sync option %d must have a single value, like `Prune: true`, but got %s", i/2, yamlKindName(value))
+			}
+			options = append(options, key.Value+"="+value.Value)
+		}
+		*o = options
+		return nil
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			*o = nil
+			return nil
+		}
 	}
+	return fmt.Errorf("sync options must be a list, like `[Prune=true]`, or a map, like `{Prune: true}`, but got %s", yamlKindName(node))
+}
 
-	return executor.ExecuteTemplateReply{
-		Node: &wfv1.NodeResult{
-			Phase:    wfv1.NodeSucceeded,
-			Message:  "Action completed",
-			Progress: "1/1",
-			Outputs: &wfv1.Outputs{
-				Result: pointer.String(output),
-			},
-		},
+// readApps reads and unmarshals the apps listed by a sync action. An action which only selects apps by label or
+// ApplicationSet lists none.
+func readApps(action SyncAction) ([]SyncApp, error) {
+	if action.Apps == "" && (action.Selector != "" || action.ApplicationSet != "") {
+		return nil, nil
 	}
+	return parseApps(action.Apps, action.AppsSource, "sync")
 }
 
-// runAction runs the given action and returns outputs or errors, if any.
-func (e *ApiExecutor) runAction(action ActionSpec) (out string, err error) {
-	closer, appClient, err := e.apiClient.NewApplicationClient()
+// readDiffApps reads and unmarshals the apps targeted by a diff action's Apps list.
+func readDiffApps(action DiffAction) ([]App, error) {
+	syncApps, err := parseApps(action.Apps, action.AppsSource, "diff")
 	if err != nil {
-		return "", fmt.Errorf("failed to initialize Application API client: %w", err)
+		return nil, err
 	}
-	defer io.Close(closer)
+	apps := make([]App, len(syncApps))
+	for i, app := range syncApps {
+		apps[i] = app.App
+	}
+	return apps, nil
+}
 
-	closer, settingsClient, err := e.apiClient.NewSettingsClient()
+// parseApps reads and unmarshals a YAML list of apps, which an action of the given type (like sync) targets.
+func parseApps(value string, source ValueSource, actionType string) ([]SyncApp, error) {
+	appsYAML, err := readValue(value, source)
 	if err != nil {
-		return "", fmt.Errorf("failed to initialize Application API client: %w", err)
+		return nil, fmt.Errorf("failed to read apps: %w", err)
 	}
-	defer io.Close(closer)
+	var node yaml.Node
+	err = yaml.Unmarshal(appsYAML, &node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal apps: %w", redactYAMLError(err))
+	}
+	if len(node.Content) == 0 {
+		return nil, fmt.Errorf("no apps to %s: apps must be a YAML list of apps, like `[{name: my-app}]`", actionType)
+	}
+	list := node.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("apps must be a YAML list of apps, like `[{name: my-app}]`, but got %s", yamlKindName(list))
+	}
+	if len(list.Content) == 0 {
+		return nil, fmt.Errorf("no apps to %s: the apps list is empty", actionType)
+	}
+	for i, item := range list.Content {
+		if item.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("app %d must be an object, like `{name: my-app}`, but got %s", i, yamlKindName(item))
+		}
+	}
+	var apps []SyncApp
+	err = list.Decode(&apps)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal apps: %w", redactYAMLError(err))
+	}
+	for i, app := range apps {
+		if app.Name == "" {
+			return nil, fmt.Errorf("app %d has no name", i)
+		}
+	}
+	return apps, nil
+}
 
-	if action.App == nil {
-		return "", errors.New("action is missing a valid action type (i.e. an 'app' block)")
+// yamlKindName describes the kind of a YAML node for error messages.
+func yamlKindName(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.ScalarNode:
+		return "a single value"
+	}
+	return "an unsupported value"
+}
+
+// yamlValuePattern matches the values yaml.v3 quotes in its type errors, like `my-app` in "cannot unmarshal !!str
+// `my-app` into []string".
+var yamlValuePattern = regexp.MustCompile("`[^`]*`")
+
+// redactYAMLError removes the values quoted in err if it's a YAML type error, since the YAML may have been read from a
+// file whose contents shouldn't end up in the node's message.
+func redactYAMLError(err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
 	}
-	if action.App.Sync != nil && action.App.Diff != nil {
-		return "", errors.New("action has multiple types of action defined (both sync and diff)")
+	redacted := make([]string, len(typeErr.Errors))
+	for i, message := range typeErr.Errors {
+		redacted[i] = yamlValuePattern.ReplaceAllString(message, "a value")
 	}
-	if action.App.Sync == nil && action.App.Diff == nil {
-		return "", errors.New("app action has no action type specified (must be sync or diff)")
+	return &yaml.TypeError{Errors: redacted}
+}
+
+// getOperationState gets the app's current operation state, if it has one.
+func getOperationState(ctx context.Context, app App, appClient application.ApplicationServiceClient) (*v1alpha1.OperationState, error) {
+	current, err := appClient.Get(ctx, &application.ApplicationQuery{
+		Name:         pointer.String(app.Name),
+		AppNamespace: pointer.String(app.Namespace),
+	})
+	if err != nil {
+		return nil, err
 	}
+	return current.Status.OperationState, nil
+}
 
-	if action.App.Sync != nil {
-		err = syncAppsParallel(*action.App.Sync, action.Timeout, appClient)
+// waitForDryRunOperation polls the app until a dry-run sync operation started no earlier than requestedAt completes,
+// and returns its state.
+func waitForDryRunOperation(ctx context.Context, app App, requestedAt metav1.Time, appClient application.ApplicationServiceClient) (*v1alpha1.OperationState, error) {
+	for {
+		current, err := appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         pointer.String(app.Name),
+			AppNamespace: pointer.String(app.Namespace),
+		})
 		if err != nil {
-			return "", fmt.Errorf("failed to sync apps: %w", err)
+			return nil, fmt.Errorf("failed to get app %q: %w", app.Name, err)
+		}
+		state := current.Status.OperationState
+		if state != nil && state.Phase.Completed() && state.Operation.Sync != nil && state.Operation.Sync.DryRun && !state.StartedAt.Before(&requestedAt) {
+			return state, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dry-run sync of app %q did not complete before the timeout", app.Name)
+		case <-time.After(appPollInterval):
 		}
 	}
-	if action.App.Diff != nil {
-		out, err = diffApp(*action.App.Diff, action.Timeout, appClient, settingsClient)
-		if err != nil {
-			return "", fmt.Errorf("failed to diff app: %w", err)
+}
+
+// resourceResult is the result of syncing a single resource.
+type resourceResult struct {
+	ResourceRef
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// resourceResults returns the operation's result for each resource.
+func resourceResults(state *v1alpha1.OperationState) []resourceResult {
+	if state.SyncResult == nil {
+		return nil
+	}
+	results := make([]resourceResult, len(state.SyncResult.Resources))
+	for i, res := range state.SyncResult.Resources {
+		results[i] = resourceResult{
+			ResourceRef: ResourceRef{Group: res.Group, Kind: res.Kind, Namespace: res.Namespace, Name: res.Name},
+			Status:      string(res.Status),
+			Message:     res.Message,
 		}
 	}
-	return out, err
+	return results
 }
 
-// syncAppsParallel loops over the apps in a SyncAction and syncs them in parallel. It waits for all responses and then
-// aggregates any errors.
-func syncAppsParallel(action SyncAction, timeout string, appClient application.ApplicationServiceClient) error {
-	var apps []App
-	err := yaml.Unmarshal([]byte(action.Apps), &apps)
+// prunedResources returns the resources which the operation pruned (or, for a dry run, would have pruned).
+func prunedResources(state *v1alpha1.OperationState) []ResourceRef {
+	if state.SyncResult == nil {
+		return nil
+	}
+	var pruned []ResourceRef
+	for _, res := range state.SyncResult.Resources {
+		if res.Status == synccommon.ResultCodePruned {
+			pruned = append(pruned, ResourceRef{Group: res.Group, Kind: res.Kind, Namespace: res.Namespace, Name: res.Name})
+		}
+	}
+	return pruned
+}
+
+// unexpectedPrunes returns the pruned resources which don't match any of the allowlist's matchers. An empty allowlist
+// allows everything.
+func unexpectedPrunes(pruned []ResourceRef, allowlist []ResourceMatcher) []string {
+	if len(allowlist) == 0 {
+		return nil
+	}
+	var unexpected []string
+	for _, res := range pruned {
+		allowed := false
+		for _, matcher := range allowlist {
+			if matcher.matches(res) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			unexpected = append(unexpected, res.String())
+		}
+	}
+	return unexpected
+}
+
+// diffStats counts what happened to the resources inspected by a diff.
+type diffStats struct {
+	// Inspected is the number of resources considered for the diff.
+	Inspected int
+	// SkippedHooks is the number of hook resources, which are never diffed.
+	SkippedHooks int
+	// Unchanged is the number of resources with no diff once ignoreDifferences and normalizers were applied.
+	Unchanged int
+	// Changed is the number of resources which were modified, added, or removed.
+	Changed int
+	// Modified, Added, and Removed break Changed down into resources which exist in both the live and target states,
+	// resources which are only in the target state, and resources which are only live.
+	Modified int
+	Added    int
+	Removed  int
+}
+
+// parameters returns the stats as output parameters.
+func (s diffStats) parameters() []wfv1.Parameter {
+	return []wfv1.Parameter{
+		{Name: "resourcesInspected", Value: wfv1.AnyStringPtr(s.Inspected)},
+		{Name: "resourcesSkippedHooks", Value: wfv1.AnyStringPtr(s.SkippedHooks)},
+		{Name: "resourcesUnchanged", Value: wfv1.AnyStringPtr(s.Unchanged)},
+		{Name: "resourcesChanged", Value: wfv1.AnyStringPtr(s.Changed)},
+	}
+}
+
+// appKey identifies an app in the combined output of an action targeting several apps: its name, prefixed with its
+// namespace if one is set.
+func appKey(app App) string {
+	if app.Namespace == "" {
+		return app.Name
+	}
+	return app.Namespace + "/" + app.Name
+}
+
+// diffApps diffs each of the apps in the action's Apps list, combining their outputs. The text output is each app's
+// diff under a header naming it, and the JSON output is an object mapping each app to its diff. Every app is diffed
+// even if some fail, and the errors are combined; the output then covers the apps which succeeded.
+func diffApps(ctx context.Context, action DiffAction, timeout string, appClient application.ApplicationServiceClient, settingsClient settings.SettingsServiceClient, timings *phaseTimings) (result diffResult, err error) {
+	if action.App.Name != "" {
+		return result, errors.New("a diff action may set app or apps, but not both")
+	}
+	if action.Resource != nil {
+		return result, errors.New("resource can't be combined with apps, since it names a resource of a single app")
+	}
+	err = action.OutputFormat.validate()
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal apps: %w", err)
+		return result, err
 	}
-	var options []string
-	err = yaml.Unmarshal([]byte(action.Options), &options)
+	apps, err := readDiffApps(action)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal options: %w", err)
+		return result, err
 	}
-	ctx, cancel, err := durationStringToContext(timeout)
+	// The timeout covers diffing all the apps, not each one.
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
 	if err != nil {
-		return fmt.Errorf("failed get action context: %w", err)
+		return result, fmt.Errorf("failed get action context: %w", err)
 	}
 	defer cancel()
-	wg := sync.WaitGroup{}
-	errChan := make(chan error, len(action.Apps))
+
+	jsonOutput := action.OutputFormat == DiffOutputFormatJSON
+	jsonDiffs := make(map[string]json.RawMessage)
+	var textDiffs []string
+	var diffErrors multiError
 	for _, app := range apps {
-		app := app
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			_, err := appClient.Sync(ctx, &application.ApplicationSyncRequest{
-				Name:         pointer.String(app.Name),
-				AppNamespace: pointer.String(app.Namespace),
-				SyncOptions:  &application.SyncOptions{Items: options},
-			})
-			if err != nil {
-				errChan <- fmt.Errorf("failed to sync app %q: %w", app.Name, err)
+		key := appKey(app)
+		appAction := action
+		appAction.App = app
+		appAction.Apps = ""
+		appDir := sanitizePathSegment(app.Name)
+		if app.Namespace != "" {
+			appDir = filepath.Join(sanitizePathSegment(app.Namespace), appDir)
+		}
+		if action.OutputDir != "" {
+			appAction.OutputDir = filepath.Join(action.OutputDir, appDir)
+		}
+		appResult, err := diffApp(ctx, appAction, "", appClient, settingsClient, timings)
+		if err != nil {
+			diffErrors = append(diffErrors, fmt.Errorf("failed to diff app %q: %w", key, err))
+			continue
+		}
+		result.stats.Inspected += appResult.stats.Inspected
+		result.stats.SkippedHooks += appResult.stats.SkippedHooks
+		result.stats.Unchanged += appResult.stats.Unchanged
+		result.stats.Changed += appResult.stats.Changed
+		result.stats.Modified += appResult.stats.Modified
+		result.stats.Added += appResult.stats.Added
+		result.stats.Removed += appResult.stats.Removed
+		for _, warning := range appResult.warnings {
+			result.warnings = append(result.warnings, fmt.Sprintf("app %q: %s", key, warning))
+		}
+		for path, contents := range appResult.files {
+			if result.files == nil {
+				result.files = make(map[string]string)
 			}
-		}()
+			result.files[filepath.Join(appDir, path)] = contents
+		}
+		if jsonOutput {
+			jsonDiffs[key] = json.RawMessage(appResult.diff)
+		} else if appResult.diff != "" {
+			textDiffs = append(textDiffs, fmt.Sprintf("===== app %s =====\n%s", key, appResult.diff))
+		}
 	}
-	go func() {
-		wg.Wait()
-		close(errChan)
-	}()
-	var syncErrors []string
-	for err := range errChan {
-		syncErrors = append(syncErrors, err.Error())
+	if jsonOutput {
+		// Map keys are marshaled in sorted order, so the output is stable.
+		out, err := json.Marshal(jsonDiffs)
+		if err != nil {
+			return result, fmt.Errorf("failed to marshal diffs: %w", err)
+		}
+		result.diff = string(out)
+	} else {
+		result.diff = strings.Join(textDiffs, "\n")
 	}
-	if len(syncErrors) > 0 {
-		return errors.New(strings.Join(syncErrors, ", "))
+	if action.Canonical {
+		result.hash = diffHash(result.diff)
+	}
+	if len(diffErrors) > 0 && len(diffErrors) < len(apps) {
+		return result, partialError{diffErrors}
+	}
+	if len(diffErrors) > 0 {
+		return result, diffErrors
+	}
+	return result, nil
+}
+
+// summary describes the changed resources, like `2 resources modified, 1 added, 0 removed`.
+func (s diffStats) summary() string {
+	noun := "resources"
+	if s.Modified == 1 {
+		noun = "resource"
+	}
+	return fmt.Sprintf("%d %s modified, %d added, %d removed", s.Modified, noun, s.Added, s.Removed)
+}
+
+// diffSummary is the summary of a JSON diff.
+type diffSummary struct {
+	Modified int `json:"modified"`
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+}
+
+// jsonDiff is a JSON diff's output.
+type jsonDiff struct {
+	Summary   diffSummary    `json:"summary"`
+	Resources []resourceDiff `json:"resources"`
+	// OmittedResources is the number of resources left out of Resources to fit the output size cap. The summary still
+	// counts them.
+	OmittedResources int `json:"omittedResources,omitempty"`
+}
+
+// diffResult is the output of diffApp.
+type diffResult struct {
+	diff  string
+	stats diffStats
+	// revision is the resolved revision of the target state which was diffed.
+	revision string
+	// requestedRevision is the revision the target state was rendered from before it was resolved: the action's
+	// revision, its fallback revision if that was diffed instead, or empty for the app's target revision.
+	requestedRevision string
+	// warnings describe anything which makes the diff less reliable than usual.
+	warnings []string
+	// hash is the SHA-256 of a canonical diff. It's only set for canonical diffs.
+	hash string
+	// files maps the paths, relative to the action's OutputDir, of the diff files which were written to their contents.
+	files map[string]string
+}
+
+// defaultSettings returns the Argo CD settings a best-effort diff falls back to when the settings API is unavailable.
+// They match a default Argo CD installation: apps are tracked by the app.kubernetes.io/instance label, and there are no
+// resource overrides.
+func defaultSettings() *settings.Settings {
+	return &settings.Settings{
+		AppLabelKey:    common.LabelKeyAppInstance,
+		TrackingMethod: "label",
 	}
-	return nil
 }
 
-func diffApp(action DiffAction, timeout string, appClient application.ApplicationServiceClient, settingsClient settings.SettingsServiceClient) (string, error) {
-	ctx, cancel, err := durationStringToContext(timeout)
+func diffApp(ctx context.Context, action DiffAction, timeout string, appClient application.ApplicationServiceClient, settingsClient settings.SettingsServiceClient, timings *phaseTimings) (result diffResult, err error) {
+	ctx, span := startSpan(ctx, "diffApp", appAttributes(action.App))
+	defer func() {
+		endSpan(span, err)
+	}()
+	normalizers, err := newNormalizers(action.Normalizers)
 	if err != nil {
-		return "", fmt.Errorf("failed get action context: %w", err)
+		return result, fmt.Errorf("failed to parse normalizers: %w", err)
+	}
+	if action.Resource != nil && (action.Resource.Kind == "" || action.Resource.Name == "") {
+		return result, errors.New("resource must set kind and name")
+	}
+	if _, err := path.Match(action.NameGlob, ""); err != nil {
+		return result, fmt.Errorf("invalid nameGlob %q: %w", action.NameGlob, err)
+	}
+	if action.FallbackRevision != "" && action.Revision == "" {
+		return result, errors.New("fallbackRevision requires revision")
+	}
+	err = action.OutputFormat.validate()
+	if err != nil {
+		return result, err
+	}
+	var maxAge time.Duration
+	if action.RefreshIfOlderThan != "" {
+		maxAge, err = time.ParseDuration(action.RefreshIfOlderThan)
+		if err != nil {
+			return result, fmt.Errorf("failed to parse refreshIfOlderThan: %w", err)
+		}
+	}
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return result, fmt.Errorf("failed get action context: %w", err)
 	}
 	defer cancel()
-	app, err := appClient.Get(context.Background(), &application.ApplicationQuery{Name: &action.App.Name, Refresh: getRefreshType(action.Refresh, action.HardRefresh)})
+	refresh := getRefreshType(action.Refresh, action.HardRefresh)
+	if action.RefreshIfOlderThan != "" {
+		// The app is got without refreshing it first, to check when it was last reconciled.
+		refresh = nil
+	}
+	stop := timings.track("get")
+	app, err := appClient.Get(ctx, &application.ApplicationQuery{
+		Name:         &action.App.Name,
+		AppNamespace: pointer.String(action.App.Namespace),
+		Refresh:      refresh,
+	})
+	stop()
+	if err != nil && isNotFoundError(err) {
+		return result, appNotFoundError{app: appKey(action.App), err: err}
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to get application: %w", err)
+	}
+	if action.RefreshIfOlderThan != "" && isStale(app, maxAge) {
+		stop = timings.track("refresh")
+		app, err = appClient.Get(ctx, &application.ApplicationQuery{
+			Name:         &action.App.Name,
+			AppNamespace: pointer.String(action.App.Namespace),
+			Refresh:      getRefreshType(true, action.HardRefresh),
+		})
+		stop()
+		if err != nil {
+			return result, fmt.Errorf("failed to refresh application: %w", err)
+		}
+	}
+	skipReason, err := checkErrorConditions(app, action.ErrorConditionPolicy)
 	if err != nil {
-		return "", fmt.Errorf("failed to get application: %w", err)
+		return result, err
+	}
+	if skipReason != "" {
+		result.warnings = append(result.warnings, "skipped diff: "+skipReason)
+		if action.OutputFormat == DiffOutputFormatJSON {
+			// A skipped app has no resources to report, but the output must still be a JSON diff.
+			out, err := json.Marshal(jsonDiff{Resources: []resourceDiff{}})
+			if err != nil {
+				return result, fmt.Errorf("failed to marshal diff: %w", err)
+			}
+			result.diff = string(out)
+		}
+		return result, nil
+	}
+	stop = timings.track("managedResources")
+	resourcesQuery := &application.ResourcesQuery{ApplicationName: &action.App.Name, AppNamespace: pointer.String(action.App.Namespace)}
+	if action.Resource != nil {
+		// The server filters the managed resources, so only the focused resource's live state is sent back.
+		resourcesQuery.Group = pointer.String(action.Resource.Group)
+		resourcesQuery.Kind = pointer.String(action.Resource.Kind)
+		resourcesQuery.Namespace = pointer.String(action.Resource.Namespace)
+		resourcesQuery.Name = pointer.String(action.Resource.Name)
 	}
-	resources, err := appClient.ManagedResources(context.Background(), &application.ResourcesQuery{ApplicationName: &action.App.Name})
+	resources, err := appClient.ManagedResources(ctx, resourcesQuery)
+	stop()
 	if err != nil {
-		return "", fmt.Errorf("failed to get managed resources for app: %w", err)
+		return result, fmt.Errorf("failed to get managed resources for app: %w", err)
 	}
 	liveObjs, err := liveObjects(resources.Items)
 	if err != nil {
-		return "", fmt.Errorf("failed to get live objects: %w", err)
+		return result, fmt.Errorf("failed to get live objects: %w", err)
 	}
 
-	res, err := appClient.GetManifests(ctx, &application.ApplicationManifestQuery{
-		Name:         pointer.String(action.App.Name),
-		AppNamespace: pointer.String(action.App.Namespace),
-		Revision:     pointer.String(action.Revision),
-	})
+	stop = timings.track("getManifests")
+	result.requestedRevision = action.Revision
+	res, err := getTargetManifests(ctx, action.App, action.Revision, appClient)
+	if err != nil && action.FallbackRevision != "" && isRevisionNotFoundError(err) {
+		result.warnings = append(result.warnings, fmt.Sprintf("revision %q doesn't exist, so fallback revision %q was diffed instead", action.Revision, action.FallbackRevision))
+		result.requestedRevision = action.FallbackRevision
+		res, err = getTargetManifests(ctx, action.App, action.FallbackRevision, appClient)
+	}
+	stop()
 	if err != nil {
-		return "", fmt.Errorf("failed to diff app: %w", err)
+		return result, fmt.Errorf("failed to diff app: %w", err)
 	}
+	result.revision = res.Revision
 
 	var unstructureds []*unstructured.Unstructured
 	for _, manifest := range res.Manifests {
 		obj, err := v1alpha1.UnmarshalToUnstructured(manifest)
 		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal manifest to unstructured: %w", err)
+			return result, fmt.Errorf("failed to unmarshal manifest to unstructured: %w", err)
 		}
 		unstructureds = append(unstructureds, obj)
 	}
-	groupedObjs, err := groupObjsByKey(unstructureds, liveObjs, app.Spec.Destination.Namespace)
+	destinationNamespace := app.Spec.Destination.Namespace
+	if action.DestinationNamespace != "" {
+		destinationNamespace = action.DestinationNamespace
+	}
+	groupedObjs, err := groupObjsByKey(unstructureds, liveObjs, destinationNamespace, action.Resource, action.IncludeHooks)
 	if err != nil {
-		return "", fmt.Errorf("failed to group objects by key: %w", err)
+		return result, fmt.Errorf("failed to group objects by key: %w", err)
 	}
 
-	argoSettings, err := settingsClient.Get(context.Background(), &settings.SettingsQuery{})
-	if err != nil {
-		return "", fmt.Errorf("failed to get argo settings: %w", err)
+	stop = timings.track("settings")
+	argoSettings, err := settingsClient.Get(ctx, &settings.SettingsQuery{})
+	stop()
+	if err != nil && action.BestEffortSettings {
+		warning := fmt.Sprintf("failed to get argo settings, so the diff uses default settings and ignores resource overrides: %v", err)
+		result.warnings = append(result.warnings, warning)
+		argoSettings = defaultSettings()
+	} else if err != nil {
+		return result, fmt.Errorf("failed to get argo settings: %w", err)
 	}
 
 	items, err := groupObjsForDiff(resources, groupedObjs, []objKeyLiveTarget{}, argoSettings, action.App.Name)
 	if err != nil {
-		return "", fmt.Errorf("failed to group objects for diff: %w", err)
+		return result, fmt.Errorf("failed to group objects for diff: %w", err)
+	}
+	if action.Resource != nil {
+		items, err = focusItems(items, *action.Resource, action.App.Name)
+		if err != nil {
+			return result, err
+		}
 	}
+	items = filterItems(items, action)
 
-	diff := ""
+	defer timings.track("diffCompute")()
+	jsonOutput := action.OutputFormat == DiffOutputFormatJSON
+	// The items come back in no particular order, so they're sorted for the same diff to be output the same way each time.
+	sortObjKeyLiveTargets(items)
+	if action.Canonical {
+		defer func() {
+			result.hash = diffHash(result.diff)
+		}()
+	}
+	var resourceDiffs []resourceDiff
 	for _, item := range items {
-		if item.target != nil && hook.IsHook(item.target) || item.live != nil && hook.IsHook(item.live) {
+		result.stats.Inspected++
+		if !action.IncludeHooks && (item.target != nil && hook.IsHook(item.target) || item.live != nil && hook.IsHook(item.live)) {
+			result.stats.SkippedHooks++
 			continue
 		}
-		overrides := make(map[string]v1alpha1.ResourceOverride)
-		for k := range argoSettings.ResourceOverrides {
-			val := argoSettings.ResourceOverrides[k]
-			overrides[k] = *val
+		err = normalize(item.live, normalizers)
+		if err != nil {
+			return result, fmt.Errorf("failed to normalize live state of %s: %w", item.key.String(), err)
+		}
+		err = normalize(item.target, normalizers)
+		if err != nil {
+			return result, fmt.Errorf("failed to normalize target state of %s: %w", item.key.String(), err)
+		}
+		if action.StripDefaults {
+			stripDefaults(item.live, item.target)
 		}
-
-		// TODO remove hardcoded IgnoreAggregatedRoles and retrieve the
-		// compareOptions in the protobuf
-		ignoreAggregatedRoles := false
-		diffConfig, err := argodiff.NewDiffConfigBuilder().
-			WithDiffSettings(app.Spec.IgnoreDifferences, overrides, ignoreAggregatedRoles).
-			WithTracking(argoSettings.AppLabelKey, argoSettings.TrackingMethod).
-			WithNoCache().
-			Build()
+		diffConfig, err := buildDiffConfig(app, argoSettings, action)
 		if err != nil {
-			return "", fmt.Errorf("failed to build diff config: %w", err)
+			return result, fmt.Errorf("failed to build diff config: %w", err)
 		}
 
 		diffRes, err := argodiff.StateDiff(item.live, item.target, diffConfig)
 		if err != nil {
-			return "", fmt.Errorf("failed to build state diff: %w", err)
+			return result, fmt.Errorf("failed to build state diff: %w", err)
 		}
 
 		if diffRes.Modified || item.target == nil || item.live == nil {
-			fmt.Println("diffRes.Modified", diffRes.Modified)
-
 			var live *unstructured.Unstructured
 			var target *unstructured.Unstructured
 			if item.target != nil && item.live != nil {
@@ -258,35 +2274,211 @@ func diffApp(action DiffAction, timeout string, appClient application.Applicatio
 				live = item.live
 				err = json.Unmarshal(diffRes.PredictedLive, target)
 				if err != nil {
-					return "", fmt.Errorf("failed to unmarshal predicted live: %w", err)
+					return result, fmt.Errorf("failed to unmarshal predicted live: %w", err)
 				}
 			} else {
 				live = item.live
 				target = item.target
 			}
 
-			newDiff, err := GetDiff(live, target)
+			newDiff, err := GetDiff(ctx, live, target)
+			if err != nil {
+				return result, fmt.Errorf("failed to get diff: %w", err)
+			}
+			if action.OutputDir != "" {
+				err = writeResourceDiff(action.OutputDir, item.key, newDiff)
+				if err != nil {
+					return result, fmt.Errorf("failed to write diff for %s: %w", item.key.String(), err)
+				}
+				if result.files == nil {
+					result.files = make(map[string]string)
+				}
+				result.files[resourceDiffPath(item.key)] = newDiff
+			}
+			if jsonOutput {
+				resourceDiffs = append(resourceDiffs, newResourceDiff(item.key, true, newDiff))
+			} else if action.Canonical {
+				result.diff += canonicalResourceDiff(item.key, newDiff)
+			} else {
+				result.diff += newDiff
+			}
+			result.stats.Changed++
+			switch {
+			case item.live == nil:
+				result.stats.Added++
+			case item.target == nil:
+				result.stats.Removed++
+			default:
+				result.stats.Modified++
+			}
+		} else {
+			if jsonOutput {
+				resourceDiffs = append(resourceDiffs, newResourceDiff(item.key, false, ""))
+			}
+			result.stats.Unchanged++
+		}
+	}
+
+	if jsonOutput {
+		if resourceDiffs == nil {
+			resourceDiffs = []resourceDiff{}
+		}
+		out, err := json.Marshal(jsonDiff{
+			Summary:   diffSummary{Modified: result.stats.Modified, Added: result.stats.Added, Removed: result.stats.Removed},
+			Resources: resourceDiffs,
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to marshal diff: %w", err)
+		}
+		result.diff = string(out)
+	} else if result.stats.Changed > 0 {
+		// An empty diff still means there are no changes, so the summary is only added when there are some.
+		result.diff = strings.TrimRight(result.diff, "\n") + "\n" + result.stats.summary() + "\n"
+	}
+
+	return result, nil
+}
+
+// getTargetManifests generates the app's manifests at revision, or at its target revision if revision is empty.
+// The query can't override the app's source parameters, so diffs always render the app's source as it's saved.
+func getTargetManifests(ctx context.Context, app App, revision string, appClient application.ApplicationServiceClient) (*argorepoclient.ManifestResponse, error) {
+	res, err := appClient.GetManifests(ctx, &application.ApplicationManifestQuery{
+		Name:         pointer.String(app.Name),
+		AppNamespace: pointer.String(app.Namespace),
+		Revision:     optionalRevision(revision),
+	})
+	if err != nil && revision != "" && isRevisionNotFoundError(err) {
+		return nil, fmt.Errorf("revision %q doesn't exist in the repo of app %q: %w", revision, app.Name, err)
+	}
+	return res, err
+}
+
+// isStale returns true if the app was last reconciled longer ago than maxAge, or never.
+func isStale(app *v1alpha1.Application, maxAge time.Duration) bool {
+	return app.Status.ReconciledAt == nil || time.Since(app.Status.ReconciledAt.Time) > maxAge
+}
+
+// buildDiffConfig builds the diff config for an app from the server's settings, so that the diff matches the one the
+// server computes.
+func buildDiffConfig(app *v1alpha1.Application, argoSettings *settings.Settings, action DiffAction) (argodiff.DiffConfig, error) {
+	overrides := make(map[string]v1alpha1.ResourceOverride)
+	for k := range argoSettings.ResourceOverrides {
+		val := argoSettings.ResourceOverrides[k]
+		overrides[k] = *val
+	}
+	// The server applies its `ignoreResourceStatusField` compare option to the resource overrides it returns, so that
+	// one is picked up here. The settings API doesn't expose the rest of `resource.compareoptions`, so
+	// ignoreAggregatedRoles has to be passed in by the user to match the server.
+	// System-level ignoreDifferences, including those for all kinds, are among the overrides, the latter under `*/*`.
+	// Projects have no ignoreDifferences of their own, so the app's and the system's are all the server uses.
+	return argodiff.NewDiffConfigBuilder().
+		WithDiffSettings(app.Spec.IgnoreDifferences, overrides, action.IgnoreAggregatedRoles).
+		WithTracking(argoSettings.AppLabelKey, argoSettings.TrackingMethod).
+		WithNoCache().
+		Build()
+}
+
+// resolveValueFiles returns a copy of action whose values with the file source are replaced by the contents of their
+// files, read from dir, so that they're only read once and can be validated like inline values.
+func resolveValueFiles(action ActionSpec, dir string) (ActionSpec, error) {
+	if action.App == nil {
+		return action, nil
+	}
+	app := *action.App
+	if app.Sync != nil && (app.Sync.AppsSource == ValueSourceFile || app.Sync.OptionsSource == ValueSourceFile) {
+		sync := *app.Sync
+		var err error
+		if sync.AppsSource == ValueSourceFile {
+			sync.Apps, err = readValueFile(sync.Apps, dir)
+			if err != nil {
+				return action, fmt.Errorf("failed to read apps: %w", err)
+			}
+			sync.AppsSource = ValueSourceInline
+		}
+		if sync.OptionsSource == ValueSourceFile {
+			sync.Options, err = readValueFile(sync.Options, dir)
 			if err != nil {
-				return "", fmt.Errorf("failed to get diff: %w", err)
+				return action, fmt.Errorf("failed to read options: %w", err)
 			}
-			diff += newDiff
+			sync.OptionsSource = ValueSourceInline
 		}
+		app.Sync = &sync
+	}
+	if app.Diff != nil && app.Diff.AppsSource == ValueSourceFile {
+		diff := *app.Diff
+		var err error
+		diff.Apps, err = readValueFile(diff.Apps, dir)
+		if err != nil {
+			return action, fmt.Errorf("failed to read apps: %w", err)
+		}
+		diff.AppsSource = ValueSourceInline
+		app.Diff = &diff
+	}
+	action.App = &app
+	return action, nil
+}
+
+// readValueFile reads the file at path, which must be inside dir. A relative path is relative to dir. Symlinks are
+// followed before checking, so that they can't lead out of dir.
+func readValueFile(path string, dir string) (string, error) {
+	if dir == "" {
+		return "", errors.New("values can't be read from files, since no value file directory is configured")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the value file directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve file %q: %w", path, err)
+	}
+	rel, err := filepath.Rel(resolvedDir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %q is outside of the value file directory", path)
 	}
+	contents, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %q: %w", path, err)
+	}
+	return string(contents), nil
+}
 
-	return diff, nil
+// readValue returns the raw YAML for a field, decoding it according to source. An empty source is treated as inline.
+// Values with the file source must have been resolved by resolveValueFiles.
+func readValue(value string, source ValueSource) ([]byte, error) {
+	switch source {
+	case "", ValueSourceInline:
+		return []byte(value), nil
+	case ValueSourceBase64:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 value: %w", err)
+		}
+		return decoded, nil
+	case ValueSourceFile:
+		return nil, errors.New("values read from a file must be resolved before they're parsed")
+	default:
+		return nil, fmt.Errorf("unsupported value source %q (must be %q, %q, or %q)", source, ValueSourceInline, ValueSourceBase64, ValueSourceFile)
+	}
 }
 
-// durationStringToContext parses a duration string and returns a context and cancel function. If timeout is empty, the
-// context is context.Background().
-func durationStringToContext(timeout string) (ctx context.Context, cancel func(), err error) {
-	ctx = context.Background()
+// durationStringToContext parses a duration string and returns a child context of parent which times out after it,
+// and its cancel function. If timeout is empty, zero, or negative, the context is parent.
+func durationStringToContext(parent context.Context, timeout string) (ctx context.Context, cancel func(), err error) {
+	ctx = parent
 	cancel = func() {}
 	if timeout != "" {
 		duration, err := time.ParseDuration(timeout)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to parse timeout: %w", err)
 		}
-		ctx, cancel = context.WithTimeout(ctx, duration)
+		// A zero or negative timeout means no timeout, so that an action can opt out of the default timeout.
+		if duration > 0 {
+			ctx, cancel = context.WithTimeout(ctx, duration)
+		}
 	}
 	return ctx, cancel, nil
 }
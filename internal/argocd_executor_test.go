@@ -2,31 +2,3067 @@ package argocd
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	argorepoclient "github.com/argoproj/argo-cd/v2/reposerver/apiclient"
+	argoio "github.com/argoproj/argo-cd/v2/util/io"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/argoproj/gitops-engine/pkg/health"
+	synccommon "github.com/argoproj/gitops-engine/pkg/sync/common"
+	"github.com/argoproj/gitops-engine/pkg/utils/kube"
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/pointer"
 )
 
 func Test_durationStringToContext(t *testing.T) {
 	t.Parallel()
 
 	t.Run("empty", func(t *testing.T) {
-		ctx, cancel, err := durationStringToContext("")
+		ctx, cancel, err := durationStringToContext(context.Background(), "")
 		require.NoError(t, err)
 		t.Cleanup(cancel)
 		assert.Equal(t, context.Background(), ctx)
 	})
 
 	t.Run("invalid", func(t *testing.T) {
-		_, _, err := durationStringToContext("invalid")
+		_, _, err := durationStringToContext(context.Background(), "invalid")
 		require.Error(t, err)
 	})
 
 	t.Run("valid", func(t *testing.T) {
-		ctx, cancel, err := durationStringToContext("1s")
+		ctx, cancel, err := durationStringToContext(context.Background(), "1s")
 		require.NoError(t, err)
 		t.Cleanup(cancel)
 		assert.NotEqual(t, context.Background(), ctx)
 	})
+
+	t.Run("zero or negative", func(t *testing.T) {
+		for _, timeout := range []string{"0", "0s", "-1m"} {
+			ctx, cancel, err := durationStringToContext(context.Background(), timeout)
+			require.NoError(t, err, timeout)
+			t.Cleanup(cancel)
+			assert.Equal(t, context.Background(), ctx, "%s must mean no timeout", timeout)
+		}
+	})
+}
+
+func TestApiExecutor_runAction_defaultTimeout(t *testing.T) {
+	t.Parallel()
+
+	newHangingExecutor := func(t *testing.T, defaultTimeout time.Duration) ApiExecutor {
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.hang = true
+		return NewApiExecutor(client, "", WithDefaultTimeout(defaultTimeout), WithRetryPolicy(RetryPolicy{}))
+	}
+	refresh := func(timeout string) ActionSpec {
+		return ActionSpec{Timeout: timeout, App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app"}}}}
+	}
+
+	t.Run("applies when the action has no timeout", func(t *testing.T) {
+		t.Parallel()
+		e := newHangingExecutor(t, 20*time.Millisecond)
+		_, err := e.runAction(context.Background(), refresh(""))
+		require.Error(t, err)
+		assert.Equal(t, codes.DeadlineExceeded, grpcCode(err))
+	})
+
+	t.Run("defaults take precedence", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.hang = true
+		e := NewApiExecutor(client, "", WithDefaultTimeout(time.Hour), WithRetryPolicy(RetryPolicy{}),
+			WithDefaults(DefaultsConfig{ActionDefaults: ActionDefaults{Timeout: "20ms"}}))
+		_, err := e.runAction(context.Background(), refresh(""))
+		require.Error(t, err)
+		assert.Equal(t, codes.DeadlineExceeded, grpcCode(err))
+	})
+
+	t.Run("the action's timeout wins", func(t *testing.T) {
+		t.Parallel()
+		e := newHangingExecutor(t, time.Hour)
+		start := time.Now()
+		_, err := e.runAction(context.Background(), refresh("20ms"))
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), time.Minute)
+	})
+
+	t.Run("invalid action timeout", func(t *testing.T) {
+		t.Parallel()
+		e := newHangingExecutor(t, time.Hour)
+		_, err := e.runAction(context.Background(), refresh("soon"))
+		require.ErrorContains(t, err, "failed to parse timeout")
+	})
+}
+
+func TestApiExecutor_ExecuteContext_cancelled(t *testing.T) {
+	t.Parallel()
+
+	for name, pluginJSON := range map[string]string{
+		"diff": `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`,
+		"sync": `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "automatedSyncPolicy": "warn"}}}}`,
+	} {
+		pluginJSON := pluginJSON
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			appClient.hang = true
+			e := NewApiExecutor(client, "token", WithRetryPolicy(RetryPolicy{}))
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			reply := e.ExecuteContext(ctx, executor.ExecuteTemplateArgs{
+				Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+			})
+			assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+			assert.Contains(t, reply.Node.Message, "context canceled")
+			assert.Empty(t, appClient.syncRequests)
+		})
+	}
+}
+
+func TestApiExecutor_Authorize(t *testing.T) {
+	t.Parallel()
+
+	e := NewApiExecutor(&fakeApiClient{}, "secret")
+	testCases := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{"valid", "Bearer secret", ""},
+		{"invalid", "Bearer wrong", "invalid agent token"},
+		{"prefix of the token", "Bearer secre", "invalid agent token"},
+		{"empty token", "Bearer ", "invalid agent token"},
+		{"missing header", "", "missing Authorization header"},
+		{"missing prefix", "secret", "malformed Authorization header"},
+		{"other scheme", "Basic c2VjcmV0", "malformed Authorization header"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/template.execute", nil)
+			if testCase.header != "" {
+				req.Header.Set("Authorization", testCase.header)
+			}
+			err := e.Authorize(req)
+			if testCase.expected == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, testCase.expected)
+			}
+		})
+	}
+}
+
+func Test_readValue(t *testing.T) {
+	t.Parallel()
+
+	apps := "- name: my-app\n"
+
+	t.Run("inline", func(t *testing.T) {
+		out, err := readValue(apps, "")
+		require.NoError(t, err)
+		assert.Equal(t, apps, string(out))
+
+		out, err = readValue(apps, ValueSourceInline)
+		require.NoError(t, err)
+		assert.Equal(t, apps, string(out))
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		out, err := readValue(base64.StdEncoding.EncodeToString([]byte(apps)), ValueSourceBase64)
+		require.NoError(t, err)
+		assert.Equal(t, apps, string(out))
+	})
+
+	t.Run("invalid base64", func(t *testing.T) {
+		_, err := readValue("not base64!", ValueSourceBase64)
+		require.Error(t, err)
+	})
+
+	t.Run("unresolved file", func(t *testing.T) {
+		_, err := readValue("apps.yaml", ValueSourceFile)
+		require.Error(t, err)
+	})
+
+	t.Run("unsupported source", func(t *testing.T) {
+		_, err := readValue(apps, "s3")
+		require.Error(t, err)
+	})
+}
+
+func Test_readValueFile(t *testing.T) {
+	t.Parallel()
+
+	apps := "- name: my-app\n"
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "apps.yaml"), []byte(apps), 0o600))
+	outside := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(outside, []byte("secret"), 0o600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+
+	t.Run("absolute path", func(t *testing.T) {
+		out, err := readValueFile(filepath.Join(dir, "apps.yaml"), dir)
+		require.NoError(t, err)
+		assert.Equal(t, apps, out)
+	})
+
+	t.Run("relative path", func(t *testing.T) {
+		out, err := readValueFile("apps.yaml", dir)
+		require.NoError(t, err)
+		assert.Equal(t, apps, out)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := readValueFile("missing.yaml", dir)
+		require.Error(t, err)
+	})
+
+	t.Run("no directory configured", func(t *testing.T) {
+		_, err := readValueFile(filepath.Join(dir, "apps.yaml"), "")
+		require.ErrorContains(t, err, "no value file directory is configured")
+	})
+
+	t.Run("outside of the directory", func(t *testing.T) {
+		for _, path := range []string{outside, "../" + filepath.Base(filepath.Dir(outside)) + "/token", "link"} {
+			_, err := readValueFile(path, dir)
+			require.ErrorContains(t, err, "is outside of the value file directory", path)
+			assert.NotContains(t, err.Error(), "secret")
+		}
+	})
+}
+
+func TestApiExecutor_Execute_valueFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "apps.yaml"), []byte("[{name: my-app, namespace: argocd}]"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.yaml"), []byte("hunter2"), 0o600))
+	run := func(e ApiExecutor, pluginJSON string) executor.ExecuteTemplateReply {
+		return e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+		})
+	}
+
+	t.Run("read from the directory", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		e := NewApiExecutor(client, "token", WithValueFileDir(dir))
+		reply := run(e, `{"argocd": {"app": {"sync": {"apps": "apps.yaml", "appsSource": "file"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+		require.Len(t, appClient.syncRequests, 1)
+	})
+
+	t.Run("no directory configured", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "`+filepath.Join(dir, "apps.yaml")+`", "appsSource": "file"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "no value file directory is configured")
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("contents aren't echoed", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		e := NewApiExecutor(client, "token", WithValueFileDir(dir))
+		reply := run(e, `{"argocd": {"app": {"sync": {"apps": "secret.yaml", "appsSource": "file", "options": "secret.yaml", "optionsSource": "file"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.NotContains(t, reply.Node.Message, "hunter2")
+	})
+}
+
+func Test_readApps(t *testing.T) {
+	t.Parallel()
+
+	apps, err := readApps(SyncAction{Apps: "- name: my-app\n  namespace: argocd\n- {name: other, options: [Replace=true]}\n"})
+	require.NoError(t, err)
+	assert.Equal(t, []SyncApp{
+		{App: App{Name: "my-app", Namespace: "argocd"}},
+		{App: App{Name: "other"}, Options: []string{"Replace=true"}},
+	}, apps)
+
+	testCases := []struct {
+		name     string
+		apps     string
+		expected string
+	}{
+		{"empty", "", "no apps to sync: apps must be a YAML list of apps"},
+		{"empty list", "[]", "no apps to sync: the apps list is empty"},
+		{"object", "name: my-app", "apps must be a YAML list of apps, like `[{name: my-app}]`, but got an object"},
+		{"scalar", "my-app", "apps must be a YAML list of apps, like `[{name: my-app}]`, but got a single value"},
+		{"scalar entry", "[my-app]", "app 0 must be an object, like `{name: my-app}`, but got a single value"},
+		{"list entry", "[{name: a}, [b]]", "app 1 must be an object, like `{name: my-app}`, but got a list"},
+		{"missing name", "[{name: a}, {namespace: argocd}]", "app 1 has no name"},
+		{"invalid YAML", "[{name: a}", "failed to unmarshal apps"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := readApps(SyncAction{Apps: testCase.apps})
+			require.ErrorContains(t, err, testCase.expected)
+		})
+	}
+}
+
+// fakeApiClient hands out fake service clients. Methods not overridden panic, since the embedded interface is nil.
+type fakeApiClient struct {
+	apiclient.Client
+	appClient      *fakeAppClient
+	settingsClient *fakeSettingsClient
+	versionClient  *fakeVersionClient
+}
+
+func (c *fakeApiClient) NewApplicationClient() (io.Closer, application.ApplicationServiceClient, error) {
+	return argoio.NopCloser, c.appClient, nil
+}
+
+func (c *fakeApiClient) NewSettingsClient() (io.Closer, settings.SettingsServiceClient, error) {
+	return argoio.NopCloser, c.settingsClient, nil
+}
+
+func (c *fakeApiClient) NewVersionClient() (io.Closer, version.VersionServiceClient, error) {
+	return argoio.NopCloser, c.versionClient, nil
+}
+
+// fakeAppClient is an in-memory Application API. Methods not overridden panic, since the embedded interface is nil.
+type fakeAppClient struct {
+	application.ApplicationServiceClient
+
+	mu sync.Mutex
+	// apps are the known apps, keyed by name.
+	apps map[string]*v1alpha1.Application
+	// resources is returned by ManagedResources.
+	resources []*v1alpha1.ResourceDiff
+	// appResources, if set for the queried app, is returned by ManagedResources instead of resources.
+	appResources map[string][]*v1alpha1.ResourceDiff
+	// manifests is returned by GetManifests.
+	manifests []string
+	// manifestRevisions are the revisions returned by successive calls to GetManifests. The last one is repeated.
+	manifestRevisions []string
+	// manifestErrors are returned by GetManifests for the revisions they're keyed by.
+	manifestErrors  map[string]error
+	manifestQueries []*application.ApplicationManifestQuery
+	// signatureInfo is the signature info returned by RevisionMetadata, keyed by revision.
+	signatureInfo map[string]string
+	// syncDelay is how long each Sync call takes.
+	syncDelay time.Duration
+	// syncsInFlight and maxSyncsInFlight track how many Sync calls run at once.
+	syncsInFlight, maxSyncsInFlight int
+	// syncErrors are returned by Sync, keyed by app name.
+	syncErrors map[string]error
+	// transientSyncErrors are returned by successive calls to Sync, before it starts succeeding.
+	transientSyncErrors []error
+	// err, if set, is returned by every method.
+	err error
+	// hang, if true, makes Get block until its context is done, like a hung API server.
+	hang bool
+	// syncHang, if true, makes Sync block until its context is done, like a sync request to a hung API server.
+	syncHang bool
+	// patchErrors are returned by successive calls to Patch, before it starts succeeding.
+	patchErrors []error
+	// getResponses are returned by successive calls to Get, before it starts returning apps.
+	getResponses []*v1alpha1.Application
+	// calls records the name of each called method, in order.
+	calls            []string
+	syncRequests     []*application.ApplicationSyncRequest
+	rollbackRequests []*application.ApplicationRollbackRequest
+	deleteRequests   []*application.ApplicationDeleteRequest
+	getQueries       []*application.ApplicationQuery
+	resourcesQueries []*application.ResourcesQuery
+}
+
+// record records a call and returns the error every method should fail with, if any.
+func (c *fakeAppClient) record(call string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, call)
+	return c.err
+}
+
+func (c *fakeAppClient) Get(ctx context.Context, in *application.ApplicationQuery, _ ...grpc.CallOption) (*v1alpha1.Application, error) {
+	if err := c.record("Get"); err != nil {
+		return nil, err
+	}
+	if c.hang {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.getQueries = append(c.getQueries, in)
+	if len(c.getResponses) > 0 {
+		app := c.getResponses[0]
+		c.getResponses = c.getResponses[1:]
+		return app, nil
+	}
+	app, ok := c.apps[in.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app %q not found", in.GetName())
+	}
+	return app, nil
+}
+
+func (c *fakeAppClient) Create(_ context.Context, in *application.ApplicationCreateRequest, _ ...grpc.CallOption) (*v1alpha1.Application, error) {
+	if err := c.record("Create"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.apps[in.Application.Name]; ok && !in.GetUpsert() {
+		return nil, status.Errorf(codes.AlreadyExists, "app %q already exists", in.Application.Name)
+	}
+	if c.apps == nil {
+		c.apps = make(map[string]*v1alpha1.Application)
+	}
+	c.apps[in.Application.Name] = in.Application
+	return in.Application, nil
+}
+
+func (c *fakeAppClient) Delete(_ context.Context, in *application.ApplicationDeleteRequest, _ ...grpc.CallOption) (*application.ApplicationResponse, error) {
+	if err := c.record("Delete"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleteRequests = append(c.deleteRequests, in)
+	if _, ok := c.apps[in.GetName()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "app %q not found", in.GetName())
+	}
+	delete(c.apps, in.GetName())
+	return &application.ApplicationResponse{}, nil
+}
+
+func (c *fakeAppClient) List(_ context.Context, in *application.ApplicationQuery, _ ...grpc.CallOption) (*v1alpha1.ApplicationList, error) {
+	if err := c.record("List"); err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(in.GetSelector())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	list := &v1alpha1.ApplicationList{}
+	for _, app := range c.apps {
+		if !selector.Matches(labels.Set(app.Labels)) {
+			continue
+		}
+		if len(in.Projects) > 0 && !containsString(in.Projects, app.Spec.Project) {
+			continue
+		}
+		if in.GetAppNamespace() != "" && in.GetAppNamespace() != app.Namespace {
+			continue
+		}
+		list.Items = append(list.Items, *app)
+	}
+	return list, nil
+}
+
+func (c *fakeAppClient) Patch(_ context.Context, in *application.ApplicationPatchRequest, _ ...grpc.CallOption) (*v1alpha1.Application, error) {
+	if err := c.record("Patch"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.patchErrors) > 0 {
+		err := c.patchErrors[0]
+		c.patchErrors = c.patchErrors[1:]
+		return nil, err
+	}
+	app, ok := c.apps[in.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app %q not found", in.GetName())
+	}
+	if in.GetPatchType() != "merge" {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported patch type %q", in.GetPatchType())
+	}
+	appJSON, err := json.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	patchedJSON, err := jsonpatch.MergePatch(appJSON, []byte(in.GetPatch()))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	patched := &v1alpha1.Application{}
+	if err := json.Unmarshal(patchedJSON, patched); err != nil {
+		return nil, err
+	}
+	c.apps[in.GetName()] = patched
+	return patched, nil
+}
+
+func (c *fakeAppClient) ManagedResources(_ context.Context, in *application.ResourcesQuery, _ ...grpc.CallOption) (*application.ManagedResourcesResponse, error) {
+	if err := c.record("ManagedResources"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.resourcesQueries = append(c.resourcesQueries, in)
+	c.mu.Unlock()
+	// Like the server, filter by the query's fields, ignoring those which are empty.
+	matches := func(filter *string, value string) bool {
+		return filter == nil || *filter == "" || *filter == value
+	}
+	resources := c.resources
+	if appResources, ok := c.appResources[in.GetApplicationName()]; ok {
+		resources = appResources
+	}
+	var items []*v1alpha1.ResourceDiff
+	for _, res := range resources {
+		if matches(in.Group, res.Group) && matches(in.Kind, res.Kind) && matches(in.Namespace, res.Namespace) && matches(in.Name, res.Name) {
+			items = append(items, res)
+		}
+	}
+	return &application.ManagedResourcesResponse{Items: items}, nil
+}
+
+func (c *fakeAppClient) GetManifests(_ context.Context, in *application.ApplicationManifestQuery, _ ...grpc.CallOption) (*argorepoclient.ManifestResponse, error) {
+	if err := c.record("GetManifests"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifestQueries = append(c.manifestQueries, in)
+	if err := c.manifestErrors[in.GetRevision()]; err != nil {
+		return nil, err
+	}
+	var revision string
+	if len(c.manifestRevisions) > 0 {
+		revision = c.manifestRevisions[0]
+		if len(c.manifestRevisions) > 1 {
+			c.manifestRevisions = c.manifestRevisions[1:]
+		}
+	}
+	return &argorepoclient.ManifestResponse{Manifests: c.manifests, Revision: revision}, nil
+}
+
+func (c *fakeAppClient) RevisionMetadata(_ context.Context, in *application.RevisionMetadataQuery, _ ...grpc.CallOption) (*v1alpha1.RevisionMetadata, error) {
+	if err := c.record("RevisionMetadata"); err != nil {
+		return nil, err
+	}
+	return &v1alpha1.RevisionMetadata{SignatureInfo: c.signatureInfo[in.GetRevision()]}, nil
+}
+
+func (c *fakeAppClient) Rollback(_ context.Context, in *application.ApplicationRollbackRequest, _ ...grpc.CallOption) (*v1alpha1.Application, error) {
+	if err := c.record("Rollback"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rollbackRequests = append(c.rollbackRequests, in)
+	app, ok := c.apps[in.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app %q not found", in.GetName())
+	}
+	return app, nil
+}
+
+func (c *fakeAppClient) TerminateOperation(_ context.Context, in *application.OperationTerminateRequest, _ ...grpc.CallOption) (*application.OperationTerminateResponse, error) {
+	if err := c.record("TerminateOperation"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	app, ok := c.apps[in.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app %q not found", in.GetName())
+	}
+	if app.Operation == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Unable to terminate operation. No operation is in progress")
+	}
+	app.Operation = nil
+	return &application.OperationTerminateResponse{}, nil
+}
+
+func (c *fakeAppClient) Sync(ctx context.Context, in *application.ApplicationSyncRequest, _ ...grpc.CallOption) (*v1alpha1.Application, error) {
+	if err := c.record("Sync"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.syncRequests = append(c.syncRequests, in)
+	if c.syncHang {
+		c.mu.Unlock()
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if len(c.transientSyncErrors) > 0 {
+		err := c.transientSyncErrors[0]
+		c.transientSyncErrors = c.transientSyncErrors[1:]
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.syncsInFlight++
+	if c.syncsInFlight > c.maxSyncsInFlight {
+		c.maxSyncsInFlight = c.syncsInFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(c.syncDelay)
+	c.mu.Lock()
+	c.syncsInFlight--
+	c.mu.Unlock()
+	if err := c.syncErrors[in.GetName()]; err != nil {
+		return nil, err
+	}
+	synced := &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: in.GetName(), Namespace: in.GetAppNamespace()}}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if app, ok := c.apps[in.GetName()]; ok {
+		synced.Status.Sync.Revision = app.Status.Sync.Revision
+	}
+	return synced, nil
+}
+
+type fakeSettingsClient struct {
+	settings *settings.Settings
+	err      error
+}
+
+func (c *fakeSettingsClient) Get(_ context.Context, _ *settings.SettingsQuery, _ ...grpc.CallOption) (*settings.Settings, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.settings, nil
+}
+
+type fakeVersionClient struct {
+	version *version.VersionMessage
+	err     error
+}
+
+func (c *fakeVersionClient) Version(_ context.Context, _ *emptypb.Empty, _ ...grpc.CallOption) (*version.VersionMessage, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.version, nil
+}
+
+const testAppLabelKey = "app.kubernetes.io/instance"
+
+// testServerVersion is the version of the fake Argo CD API server.
+const testServerVersion = "v2.5.0+b895da4"
+
+// newTestConfigMap returns a ConfigMap tracked by the app "my-app" with the given data.
+func newTestConfigMap(name string, data map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "my-namespace",
+			"labels":    map[string]interface{}{testAppLabelKey: "my-app"},
+		},
+		"data": data,
+	}}
+}
+
+// newTestFakes returns fakes for an app "my-app" whose live state is given by live and whose target state is given by
+// target.
+func newTestFakes(t testing.TB, live, target []*unstructured.Unstructured) (*fakeApiClient, *fakeAppClient) {
+	t.Helper()
+	var resources []*v1alpha1.ResourceDiff
+	for _, obj := range live {
+		liveJSON, err := json.Marshal(obj)
+		require.NoError(t, err)
+		key := kube.GetResourceKey(obj)
+		resources = append(resources, &v1alpha1.ResourceDiff{
+			Group:               key.Group,
+			Kind:                key.Kind,
+			Namespace:           key.Namespace,
+			Name:                key.Name,
+			LiveState:           string(liveJSON),
+			NormalizedLiveState: string(liveJSON),
+		})
+	}
+	var manifests []string
+	for _, obj := range target {
+		manifest, err := json.Marshal(obj)
+		require.NoError(t, err)
+		manifests = append(manifests, string(manifest))
+	}
+	appClient := &fakeAppClient{
+		apps: map[string]*v1alpha1.Application{
+			"my-app": {
+				ObjectMeta: metav1.ObjectMeta{Name: "my-app", Namespace: "argocd"},
+				Spec: v1alpha1.ApplicationSpec{
+					Destination: v1alpha1.ApplicationDestination{Namespace: "my-namespace"},
+				},
+			},
+		},
+		resources: resources,
+		manifests: manifests,
+	}
+	settingsClient := &fakeSettingsClient{settings: &settings.Settings{AppLabelKey: testAppLabelKey}}
+	versionClient := &fakeVersionClient{version: &version.VersionMessage{Version: testServerVersion}}
+	return &fakeApiClient{appClient: appClient, settingsClient: settingsClient, versionClient: versionClient}, appClient
+}
+
+func Test_runAction(t *testing.T) {
+	t.Parallel()
+
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+	diffAction := &DiffAction{App: App{Name: "my-app"}}
+	syncAction := &SyncAction{Apps: "- name: my-app"}
+
+	t.Run("both sync and diff without diffThenSync", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: diffAction}})
+		require.ErrorContains(t, err, "multiple types of action defined (sync and diff)")
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("list and sync", func(t *testing.T) {
+		client, _ := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, List: &ListAction{}}})
+		require.ErrorContains(t, err, "multiple types of action defined (sync and list)")
+	})
+
+	t.Run("rollback and sync", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Rollback: &RollbackAction{App: App{Name: "my-app"}}}})
+		require.ErrorContains(t, err, "multiple types of action defined (sync and rollback)")
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("no action type", func(t *testing.T) {
+		client, _ := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{}})
+		require.ErrorContains(t, err, "no action type specified")
+	})
+
+	t.Run("diffThenSync without sync", func(t *testing.T) {
+		client, _ := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Diff: diffAction, DiffThenSync: true}})
+		require.ErrorContains(t, err, "requires exactly a sync and a diff")
+	})
+
+	t.Run("diffThenSync", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		result, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: diffAction, DiffThenSync: true}})
+		require.NoError(t, err)
+		assert.Contains(t, result.output, "key: old")
+		assert.Contains(t, result.output, "key: new")
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Equal(t, "my-app", appClient.syncRequests[0].GetName())
+		assert.Equal(t, "Sync", appClient.calls[len(appClient.calls)-1], "sync must run after the diff")
+	})
+
+	t.Run("diffThenSync outputs", func(t *testing.T) {
+		for name, live := range map[string][]*unstructured.Unstructured{"drifted": live, "in sync": target} {
+			client, _ := newTestFakes(t, live, target)
+			reply := execute(t, client, `{"argocd": {"app": {"diffThenSync": true, "diff": {"app": {"name": "my-app"}}, "sync": {"apps": "[{name: my-app}]"}}}}`)
+			require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, name)
+			require.NotNil(t, reply.Node.Outputs.Result)
+			assert.NotContains(t, *reply.Node.Outputs.Result, `"name":"my-app"`, "%s: the result is the diff", name)
+			var results []appSyncResult
+			require.NoError(t, json.Unmarshal([]byte(parameter(t, reply, "syncResults")), &results), name)
+			require.Len(t, results, 1)
+			assert.Equal(t, "my-app", results[0].Name)
+		}
+	})
+
+	t.Run("verifyRevision without diffThenSync", func(t *testing.T) {
+		client, _ := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Diff: diffAction, VerifyRevision: true}})
+		require.ErrorContains(t, err, "verifyRevision requires diffThenSync")
+	})
+
+	t.Run("diffThenSync with unchanged revision", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		appClient.manifestRevisions = []string{"abc123"}
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: diffAction, DiffThenSync: true, VerifyRevision: true}})
+		require.NoError(t, err)
+		assert.Len(t, appClient.syncRequests, 1)
+		require.Len(t, appClient.manifestQueries, 2)
+		assert.Nil(t, appClient.manifestQueries[1].Revision, "an empty revision must not be sent")
+	})
+
+	t.Run("diffThenSync with fallback revision", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		appClient.manifestErrors = map[string]error{"feature-x": status.Error(codes.Unknown, "Unable to resolve 'feature-x' to a commit SHA")}
+		appClient.manifestRevisions = []string{"abc123"}
+		e := NewApiExecutor(client, "")
+		fallbackDiff := &DiffAction{App: App{Name: "my-app"}, Revision: "feature-x", FallbackRevision: "HEAD"}
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: fallbackDiff, DiffThenSync: true, VerifyRevision: true}})
+		require.NoError(t, err)
+		assert.Len(t, appClient.syncRequests, 1)
+		require.Len(t, appClient.manifestQueries, 3)
+		assert.Equal(t, "HEAD", appClient.manifestQueries[2].GetRevision(), "the revision which was diffed must be verified")
+	})
+
+	t.Run("diffThenSync with changed revision", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		appClient.manifestRevisions = []string{"abc123", "def456"}
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: diffAction, DiffThenSync: true, VerifyRevision: true}})
+		require.ErrorContains(t, err, `state changed since diff: app "my-app" now targets revision "def456", but the diff was of revision "abc123"`)
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("verifyRevision with several diffed apps", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		e := NewApiExecutor(client, "")
+		multiDiff := &DiffAction{Apps: "[{name: my-app}]"}
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: syncAction, Diff: multiDiff, DiffThenSync: true, VerifyRevision: true}})
+		require.EqualError(t, err, "invalid action: verifyRevision requires a diff of a single app")
+		assert.Empty(t, appClient.calls)
+	})
+}
+
+func Test_syncAppsParallel(t *testing.T) {
+	t.Parallel()
+
+	t.Run("over limit", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{Apps: "[{name: a}, {name: b}, {name: c}]"}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 2, appClient, nil)
+		require.ErrorContains(t, err, "exceeds the limit of 2")
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("at limit", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{Apps: "[{name: a}, {name: b}]"}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 2, appClient, nil)
+		require.NoError(t, err)
+		assert.Len(t, appClient.syncRequests, 2)
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{Apps: "[{name: a}, {name: b}, {name: c}]"}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.Len(t, appClient.syncRequests, 3)
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		var apps []string
+		for i := 0; i < 30; i++ {
+			apps = append(apps, fmt.Sprintf("{name: app-%d}", i))
+		}
+		appsYAML := "[" + strings.Join(apps, ", ") + "]"
+		testCases := []struct {
+			name           string
+			maxConcurrency int
+			expected       int
+		}{
+			{"default", 0, defaultMaxConcurrency},
+			{"limited", 3, 3},
+			{"more workers than apps", 100, 30},
+		}
+		for _, testCase := range testCases {
+			testCase := testCase
+			t.Run(testCase.name, func(t *testing.T) {
+				t.Parallel()
+				_, appClient := newTestFakes(t, nil, nil)
+				appClient.syncDelay = 20 * time.Millisecond
+				appClient.syncErrors = map[string]error{"app-7": errors.New("boom"), "app-21": errors.New("bang")}
+				_, err := syncAppsParallel(context.Background(), SyncAction{Apps: appsYAML, MaxConcurrency: testCase.maxConcurrency}, nil, "", 0, appClient, nil)
+				var partial partialError
+				require.ErrorAs(t, err, &partial)
+				assert.Contains(t, err.Error(), "boom")
+				assert.Contains(t, err.Error(), "bang")
+				assert.Len(t, appClient.syncRequests, 30)
+				assert.LessOrEqual(t, appClient.maxSyncsInFlight, testCase.expected)
+				assert.Greater(t, appClient.maxSyncsInFlight, 1)
+			})
+		}
+
+		_, appClient := newTestFakes(t, nil, nil)
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: appsYAML, MaxConcurrency: -1}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "must not be negative")
+		assert.Empty(t, appClient.syncRequests)
+
+		// The action is rejected before any app is looked up, even with project defaults, which only fill in zero.
+		client, appClient := newTestFakes(t, nil, nil)
+		e := NewApiExecutor(client, "", WithDefaults(DefaultsConfig{Projects: map[string]ActionDefaults{"default": {MaxConcurrency: 5}}}))
+		_, err = e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: my-app}]", MaxConcurrency: -1}}})
+		require.EqualError(t, err, "invalid action: maxConcurrency must not be negative")
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("resources", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{
+			Apps:      "[{name: my-app}]",
+			Resources: []ResourceRef{{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "web"}},
+		}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Equal(t, []*v1alpha1.SyncOperationResource{
+			{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "web"},
+		}, appClient.syncRequests[0].GetResources())
+
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]"}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, appClient.syncRequests, 2)
+		assert.Nil(t, appClient.syncRequests[1].GetResources(), "no resources means a full sync")
+
+		action.Resources = append(action.Resources, ResourceRef{Kind: "ConfigMap"})
+		_, err = syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "resource 1 must set kind and name")
+		assert.Len(t, appClient.syncRequests, 2)
+	})
+
+	t.Run("several failures", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{}
+		var apps []string
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("app-%d", i)
+			apps = append(apps, "{name: "+name+"}")
+			if i%4 != 0 {
+				appClient.syncErrors[name] = fmt.Errorf("%s failed", name)
+			}
+		}
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[" + strings.Join(apps, ",") + "]", MaxConcurrency: 20}, nil, "", 0, appClient, nil)
+		var partial partialError
+		require.ErrorAs(t, err, &partial)
+		var multi multiError
+		require.ErrorAs(t, err, &multi)
+		assert.Len(t, multi, 15)
+		for name := range appClient.syncErrors {
+			assert.Contains(t, err.Error(), name+" failed")
+		}
+	})
+
+	// syncSelected lists the apps the action selects, like runActionWithClient does, and syncs them.
+	syncSelected := func(t *testing.T, action SyncAction, maxApps int, appClient *fakeAppClient) ([]appSyncResult, error) {
+		selected, err := selectApps(context.Background(), action, appClient)
+		require.NoError(t, err)
+		return syncAppsParallel(context.Background(), action, selected, "", maxApps, appClient, nil)
+	}
+
+	t.Run("selector", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		for _, app := range []*v1alpha1.Application{
+			{ObjectMeta: metav1.ObjectMeta{Name: "payments-b", Namespace: "argocd", Labels: map[string]string{"team": "payments"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "payments-a", Namespace: "argocd", Labels: map[string]string{"team": "payments"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "search", Namespace: "argocd", Labels: map[string]string{"team": "search"}}},
+		} {
+			appClient.apps[app.Name] = app
+		}
+		results, err := syncSelected(t, SyncAction{Selector: "team=payments"}, 0, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []appSyncResult{
+			{Name: "payments-a", Namespace: "argocd"},
+			{Name: "payments-b", Namespace: "argocd"},
+		}, results)
+
+		// Listed apps come first and aren't synced twice.
+		appClient.syncRequests = nil
+		results, err = syncSelected(t, SyncAction{Apps: "[{name: my-app}, {name: payments-b, revision: v2}]", Selector: "team=payments"}, 0, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []appSyncResult{
+			{Name: "my-app"},
+			{Name: "payments-b", Revision: "v2"},
+			{Name: "payments-a", Namespace: "argocd"},
+		}, results)
+		assert.Len(t, appClient.syncRequests, 3)
+
+		_, err = syncSelected(t, SyncAction{Selector: "team=billing"}, 0, appClient)
+		require.EqualError(t, err, `no apps to sync: no apps match selector "team=billing"`)
+
+		_, err = syncSelected(t, SyncAction{Selector: "team=payments"}, 1, appClient)
+		require.ErrorContains(t, err, "sync action targets 2 apps, which exceeds the limit of 1")
+	})
+
+	t.Run("application set", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		ownedBy := func(kind, name string) []metav1.OwnerReference {
+			return []metav1.OwnerReference{{APIVersion: "argoproj.io/v1alpha1", Kind: kind, Name: name}}
+		}
+		for _, app := range []*v1alpha1.Application{
+			{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-prod", Namespace: "argocd", OwnerReferences: ownedBy("ApplicationSet", "guestbook")}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-dev", Namespace: "argocd", OwnerReferences: ownedBy("Applicationset", "guestbook"), Labels: map[string]string{"team": "guestbook"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "guestbook-old", Namespace: "argocd", Labels: map[string]string{"team": "guestbook"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "payments-prod", Namespace: "argocd", OwnerReferences: ownedBy("ApplicationSet", "payments")}},
+		} {
+			appClient.apps[app.Name] = app
+		}
+		results, err := syncSelected(t, SyncAction{ApplicationSet: "guestbook"}, 0, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []appSyncResult{
+			{Name: "guestbook-dev", Namespace: "argocd"},
+			{Name: "guestbook-prod", Namespace: "argocd"},
+		}, results)
+
+		// Apps which are both selected and generated are only synced once.
+		appClient.syncRequests = nil
+		results, err = syncSelected(t, SyncAction{ApplicationSet: "guestbook", Selector: "team=guestbook"}, 0, appClient)
+		require.NoError(t, err)
+		assert.Len(t, results, 3)
+		assert.Len(t, appClient.syncRequests, 3)
+
+		// An ApplicationSet which generated no apps isn't an error.
+		appClient.syncRequests = nil
+		results, err = syncSelected(t, SyncAction{ApplicationSet: "search"}, 0, appClient)
+		require.NoError(t, err)
+		assert.NotNil(t, results)
+		assert.Empty(t, results)
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("operation state", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		startedAt := metav1.NewTime(time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC))
+		appClient.apps["my-app"].Status.OperationState = &v1alpha1.OperationState{
+			Phase:     synccommon.OperationRunning,
+			StartedAt: startedAt,
+		}
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", IncludeOperationState: true}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []appSyncResult{{
+			Name:      "my-app",
+			Namespace: "argocd",
+			Phase:     "Running",
+			StartedAt: &startedAt,
+		}}, results)
+	})
+
+	t.Run("resolved revision", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.OperationState = &v1alpha1.OperationState{
+			Phase:      synccommon.OperationRunning,
+			StartedAt:  metav1.Now(),
+			SyncResult: &v1alpha1.SyncOperationResult{Revision: "abc123"},
+		}
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", Revision: "main", IncludeOperationState: true}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "abc123", results[0].Revision)
+
+		// An operation which started before the sync was requested isn't the sync's.
+		appClient.apps["my-app"].Status.OperationState.StartedAt = metav1.NewTime(time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC))
+		results, err = syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "main", results[0].Revision)
+	})
+
+	t.Run("no operation state", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]"}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []appSyncResult{{Name: "my-app"}}, results)
+		assert.NotContains(t, appClient.calls, "Get")
+	})
+
+	t.Run("prune with options", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{Apps: "[{name: pruned}]", Options: "[ServerSideApply=true]", Prune: true}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		action = SyncAction{Apps: "[{name: kept}]", Options: "[ServerSideApply=true]"}
+		_, err = syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+
+		require.Len(t, appClient.syncRequests, 2)
+		assert.Equal(t, "pruned", appClient.syncRequests[0].GetName())
+		assert.True(t, appClient.syncRequests[0].GetPrune())
+		assert.Equal(t, []string{"ServerSideApply=true"}, appClient.syncRequests[0].GetSyncOptions().GetItems())
+		assert.Equal(t, "kept", appClient.syncRequests[1].GetName())
+		assert.False(t, appClient.syncRequests[1].GetPrune())
+		assert.Equal(t, []string{"ServerSideApply=true"}, appClient.syncRequests[1].GetSyncOptions().GetItems())
+	})
+
+	t.Run("use app retry", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		factor := int64(2)
+		retry := &v1alpha1.RetryStrategy{Limit: 3, Backoff: &v1alpha1.Backoff{Duration: "5s", Factor: &factor}}
+		appClient.apps["my-app"].Spec.SyncPolicy = &v1alpha1.SyncPolicy{Retry: retry}
+		appClient.apps["my-other-app"] = &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "my-other-app"}}
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}, {name: my-other-app}]", UseAppRetry: true}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]"}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+
+		require.Len(t, appClient.syncRequests, 3)
+		retries := map[string]*v1alpha1.RetryStrategy{}
+		for _, req := range appClient.syncRequests[:2] {
+			retries[req.GetName()] = req.GetRetryStrategy()
+		}
+		assert.Equal(t, retry, retries["my-app"])
+		assert.Nil(t, retries["my-other-app"], "apps without a retry strategy are synced once")
+		assert.Nil(t, appClient.syncRequests[2].GetRetryStrategy(), "the app's retry strategy is only used if requested")
+	})
+
+	newDryRunFakes := func(t *testing.T) *fakeAppClient {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.OperationState = &v1alpha1.OperationState{
+			Operation: v1alpha1.Operation{Sync: &v1alpha1.SyncOperation{DryRun: true, Prune: true}},
+			Phase:     synccommon.OperationSucceeded,
+			StartedAt: metav1.Now(),
+			SyncResult: &v1alpha1.SyncOperationResult{Resources: v1alpha1.ResourceResults{
+				{Kind: "ConfigMap", Namespace: "my-namespace", Name: "old-config", Status: synccommon.ResultCodePruned, Message: "pruned (dry run)"},
+				{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "web", Status: synccommon.ResultCodeSynced},
+				{Kind: "Secret", Namespace: "my-namespace", Name: "kept", Status: synccommon.ResultCodePruneSkipped},
+			}},
+		}
+		return appClient
+	}
+
+	t.Run("dry run prune", func(t *testing.T) {
+		appClient := newDryRunFakes(t)
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", DryRun: true, Prune: true}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "Succeeded", results[0].Phase)
+		assert.Equal(t, []ResourceRef{{Kind: "ConfigMap", Namespace: "my-namespace", Name: "old-config"}}, results[0].Pruned)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.True(t, appClient.syncRequests[0].GetDryRun())
+		assert.True(t, appClient.syncRequests[0].GetPrune())
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		appClient := newDryRunFakes(t)
+		appClient.apps["my-app"].Status.OperationState.Message = "successfully synced (all tasks run)"
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", DryRun: true}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "Succeeded", results[0].Phase)
+		assert.Equal(t, "successfully synced (all tasks run)", results[0].Message)
+		require.Len(t, results[0].Resources, 3)
+		assert.Equal(t, resourceResult{
+			ResourceRef: ResourceRef{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "web"},
+			Status:      "Synced",
+		}, results[0].Resources[1])
+		assert.Nil(t, results[0].Pruned)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.True(t, appClient.syncRequests[0].GetDryRun())
+		assert.False(t, appClient.syncRequests[0].GetPrune())
+	})
+
+	t.Run("dry run failure", func(t *testing.T) {
+		appClient := newDryRunFakes(t)
+		appClient.apps["my-app"].Status.OperationState.Phase = synccommon.OperationFailed
+		appClient.apps["my-app"].Status.OperationState.Message = "one or more objects failed to apply"
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", DryRun: true}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, `dry-run sync of app "my-app" failed: one or more objects failed to apply`)
+	})
+
+	t.Run("dry run prune allowlist", func(t *testing.T) {
+		appClient := newDryRunFakes(t)
+		action := SyncAction{
+			Apps:           "[{name: my-app, namespace: argocd}]",
+			DryRun:         true,
+			Prune:          true,
+			PruneAllowlist: []ResourceMatcher{{Kind: "ConfigMap", Name: "old-config"}},
+		}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+
+		action.PruneAllowlist = []ResourceMatcher{{Kind: "Secret"}}
+		_, err = syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "not in the prune allowlist: /ConfigMap/my-namespace/old-config")
+	})
+
+	t.Run("automated sync policy", func(t *testing.T) {
+		newAutomatedFakes := func(t *testing.T) *fakeAppClient {
+			_, appClient := newTestFakes(t, nil, nil)
+			appClient.apps["manual"] = &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: "argocd"}}
+			appClient.apps["my-app"].Spec.SyncPolicy = &v1alpha1.SyncPolicy{Automated: &v1alpha1.SyncPolicyAutomated{SelfHeal: true}}
+			return appClient
+		}
+		apps := "[{name: my-app}, {name: manual}]"
+
+		appClient := newAutomatedFakes(t)
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: apps, AutomatedSyncPolicy: AutomatedSyncPolicyProceed}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.Equal(t, &v1alpha1.SyncPolicyAutomated{SelfHeal: true}, results[0].Automated)
+		assert.Empty(t, results[0].Warning)
+		assert.Nil(t, results[1].Automated)
+		assert.Len(t, appClient.syncRequests, 2)
+
+		appClient = newAutomatedFakes(t)
+		results, err = syncAppsParallel(context.Background(), SyncAction{Apps: apps, AutomatedSyncPolicy: AutomatedSyncPolicyWarn}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.Contains(t, results[0].Warning, "automated sync enabled")
+		assert.Empty(t, results[1].Warning)
+		assert.Len(t, appClient.syncRequests, 2)
+
+		appClient = newAutomatedFakes(t)
+		results, err = syncAppsParallel(context.Background(), SyncAction{Apps: apps, AutomatedSyncPolicy: AutomatedSyncPolicySkip}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.True(t, results[0].Skipped)
+		assert.False(t, results[1].Skipped)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Equal(t, "manual", appClient.syncRequests[0].GetName())
+
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: apps, AutomatedSyncPolicy: "ignore"}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "unknown automated sync policy")
+	})
+
+	t.Run("manifests output", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "value"})})
+		appClient.manifestRevisions = []string{"abc123"}
+		dir := t.TempDir()
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app, namespace: argocd}]", ManifestsOutputDir: dir}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "abc123", results[0].Revision)
+		out, err := os.ReadFile(filepath.Join(dir, "argocd", "my-app.yaml"))
+		require.NoError(t, err)
+		require.NotNil(t, results[0].manifests)
+		assert.Equal(t, string(out), results[0].manifests.contents)
+		assert.Contains(t, string(out), "# revision: abc123")
+		assert.Contains(t, string(out), "name: my-config")
+	})
+
+	t.Run("revision", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+		action := SyncAction{Apps: "[{name: my-app}, {name: pinned, revision: v2}]", Revision: "v1"}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		revisions := map[string]string{}
+		for _, request := range appClient.syncRequests {
+			revisions[request.GetName()] = request.GetRevision()
+		}
+		assert.Equal(t, map[string]string{"my-app": "v1", "pinned": "v2"}, revisions)
+		assert.Equal(t, "v1", results[0].Revision)
+		assert.Equal(t, "v2", results[1].Revision)
+
+		// Without a revision, the app's target revision is synced.
+		_, appClient = newTestFakes(t, nil, nil)
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]"}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Empty(t, appClient.syncRequests[0].GetRevision())
+
+		// A pinned revision's signature is verified rather than the target revision's.
+		_, appClient = newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+		appClient.signatureInfo = map[string]string{"abc123": "Good signature from RSA key 4AEE18F83AFDEB23", "def456": "Revision is not signed."}
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app, revision: def456}]", VerifySignature: true}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, `revision "def456" is not verified`)
+		assert.Empty(t, appClient.syncRequests)
+	})
+
+	t.Run("verify signature", func(t *testing.T) {
+		newSignedFakes := func(t *testing.T, signatureInfo string) *fakeAppClient {
+			_, appClient := newTestFakes(t, nil, nil)
+			appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+			appClient.signatureInfo = map[string]string{"abc123": signatureInfo}
+			return appClient
+		}
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", VerifySignature: true}
+
+		appClient := newSignedFakes(t, "Good signature from RSA key 4AEE18F83AFDEB23")
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "abc123", results[0].Revision)
+		assert.Len(t, appClient.syncRequests, 1)
+
+		for signatureInfo, expected := range map[string]string{
+			"Revision is not signed.":                     `revision "abc123" is not verified: Revision is not signed.`,
+			"Bad signature from RSA key 4AEE18F83AFDEB23": `revision "abc123" is not verified: Bad signature`,
+			"": "GnuPG verification must be enabled",
+		} {
+			appClient := newSignedFakes(t, signatureInfo)
+			_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+			require.ErrorContains(t, err, expected)
+			assert.Empty(t, appClient.syncRequests, "unverified revisions must not be synced")
+		}
+
+		appClient = newSignedFakes(t, "")
+		appClient.apps["my-app"].Status.Sync.Revision = ""
+		_, err = syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "target revision is not known yet")
+		assert.NotContains(t, appClient.calls, "RevisionMetadata")
+	})
+
+	t.Run("dry run prune timeout", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", DryRun: true, Prune: true}
+		_, err := syncAppsParallel(context.Background(), action, nil, "10ms", 0, appClient, nil)
+		require.ErrorContains(t, err, "did not complete before the timeout")
+	})
+}
+
+// Test_syncAppsParallel_cancelled isn't parallel, so that goroutines started by other tests aren't mistaken for leaks.
+func Test_syncAppsParallel_cancelled(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	t.Run("timeout", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncHang = true
+		start := time.Now()
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}, {name: other-app}, {name: third-app}]", MaxConcurrency: 2}, nil, "50ms", 0, appClient, nil)
+		assert.Less(t, time.Since(start), time.Second, "the sync should return as soon as it times out")
+		require.ErrorContains(t, err, "DeadlineExceeded")
+		require.Len(t, results, 3)
+		for _, result := range results {
+			assert.NotEmpty(t, result.Error)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncHang = true
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := syncAppsParallel(ctx, SyncAction{Apps: "[{name: my-app}, {name: other-app}]"}, nil, "", 0, appClient, nil)
+		assert.Less(t, time.Since(start), time.Second, "the sync should return as soon as it's cancelled")
+		require.ErrorContains(t, err, "Canceled")
+	})
+}
+
+func Test_syncApp_syncWindow(t *testing.T) {
+	syncWindowPollInterval = time.Millisecond
+	blocked := status.Error(codes.PermissionDenied, "cannot sync: blocked by sync window")
+
+	t.Run("blocked", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"my-app": blocked}
+		result, err := syncApp(context.Background(), SyncApp{App: App{Name: "my-app"}}, SyncAction{}, nil, metav1.Now(), appClient, nil)
+		require.ErrorIs(t, err, errBlockedBySyncWindow)
+		assert.EqualError(t, err, `failed to sync app "my-app": blocked by sync window`)
+		assert.True(t, result.BlockedBySyncWindow)
+		assert.Len(t, appClient.syncRequests, 1)
+	})
+
+	t.Run("wait until a window allows it", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.transientSyncErrors = []error{blocked, blocked}
+		timings := newPhaseTimings()
+		result, err := syncApp(context.Background(), SyncApp{App: App{Name: "my-app"}}, SyncAction{WaitForSyncWindow: true}, nil, metav1.Now(), appClient, timings)
+		require.NoError(t, err)
+		assert.False(t, result.BlockedBySyncWindow)
+		assert.Len(t, appClient.syncRequests, 3)
+		assert.Contains(t, timings.durations, "syncWindowWait")
+	})
+
+	t.Run("wait times out", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"my-app": blocked}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		result, err := syncApp(ctx, SyncApp{App: App{Name: "my-app"}}, SyncAction{WaitForSyncWindow: true}, nil, metav1.Now(), appClient, nil)
+		require.ErrorIs(t, err, errBlockedBySyncWindow)
+		assert.ErrorContains(t, err, "no window allowed it before the timeout")
+		assert.True(t, result.BlockedBySyncWindow)
+	})
+}
+
+func Test_diffApp(t *testing.T) {
+	t.Parallel()
+
+	t.Run("kind and name filters", func(t *testing.T) {
+		newWidget := func(name, color string) *unstructured.Unstructured {
+			return &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Widget",
+				"metadata": map[string]interface{}{
+					"name":      name,
+					"namespace": "my-namespace",
+					"labels":    map[string]interface{}{testAppLabelKey: "my-app"},
+				},
+				"spec": map[string]interface{}{"color": color},
+			}}
+		}
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("frontend-config", map[string]interface{}{"key": "old"}),
+			newTestConfigMap("backend-config", map[string]interface{}{"key": "old"}),
+			newWidget("frontend-widget", "red"),
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("frontend-config", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("backend-config", map[string]interface{}{"key": "new"}),
+			newWidget("frontend-widget", "blue"),
+		}
+
+		for name, test := range map[string]struct {
+			action   DiffAction
+			expected []string
+		}{
+			"no filters":          {action: DiffAction{}, expected: []string{"backend-config", "frontend-config", "frontend-widget"}},
+			"include kinds":       {action: DiffAction{IncludeKinds: []string{"widget"}}, expected: []string{"frontend-widget"}},
+			"exclude kinds":       {action: DiffAction{ExcludeKinds: []string{"Widget"}}, expected: []string{"backend-config", "frontend-config"}},
+			"name glob":           {action: DiffAction{NameGlob: "frontend-*"}, expected: []string{"frontend-config", "frontend-widget"}},
+			"kind and name":       {action: DiffAction{IncludeKinds: []string{"ConfigMap"}, NameGlob: "frontend-*"}, expected: []string{"frontend-config"}},
+			"include and exclude": {action: DiffAction{IncludeKinds: []string{"ConfigMap", "Widget"}, ExcludeKinds: []string{"ConfigMap"}}, expected: []string{"frontend-widget"}},
+		} {
+			client, appClient := newTestFakes(t, live, target)
+			action := test.action
+			action.App = App{Name: "my-app"}
+			action.OutputFormat = DiffOutputFormatJSON
+			result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err, name)
+			var diff jsonDiff
+			require.NoError(t, json.Unmarshal([]byte(result.diff), &diff), name)
+			var names []string
+			for _, diff := range diff.Resources {
+				names = append(names, diff.Name)
+			}
+			assert.Equal(t, test.expected, names, name)
+			assert.Equal(t, len(test.expected), result.stats.Changed, "filtered-out resources must not be counted: %s", name)
+		}
+
+		client, appClient := newTestFakes(t, live, target)
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, NameGlob: "[frontend"}, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, `invalid nameGlob "[frontend"`)
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("namespace filter", func(t *testing.T) {
+		t.Parallel()
+		inNamespace := func(obj *unstructured.Unstructured, namespace string) *unstructured.Unstructured {
+			obj.SetNamespace(namespace)
+			return obj
+		}
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("frontend-config", map[string]interface{}{"key": "old"}),
+			inNamespace(newTestConfigMap("backend-config", map[string]interface{}{"key": "old"}), "other-namespace"),
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("frontend-config", map[string]interface{}{"key": "new"}),
+			inNamespace(newTestConfigMap("backend-config", map[string]interface{}{"key": "new"}), "other-namespace"),
+		}
+
+		for namespace, expected := range map[string][]string{
+			"":                {"my-namespace/frontend-config", "other-namespace/backend-config"},
+			"my-namespace":    {"my-namespace/frontend-config"},
+			"other-namespace": {"other-namespace/backend-config"},
+			"no-namespace":    nil,
+		} {
+			client, appClient := newTestFakes(t, live, target)
+			action := DiffAction{App: App{Name: "my-app"}, Namespace: namespace, OutputFormat: DiffOutputFormatJSON}
+			result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err, namespace)
+			var diff jsonDiff
+			require.NoError(t, json.Unmarshal([]byte(result.diff), &diff), namespace)
+			var names []string
+			for _, diff := range diff.Resources {
+				names = append(names, diff.Namespace+"/"+diff.Name)
+			}
+			assert.Equal(t, expected, names, namespace)
+			assert.Equal(t, len(expected), result.stats.Changed, "filtered-out resources must not be counted: %s", namespace)
+		}
+	})
+
+	t.Run("app not found", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "missing", Namespace: "argocd"}}, "", appClient, client.settingsClient, nil)
+		require.EqualError(t, err, `app "argocd/missing" does not exist`)
+		assert.True(t, isAppNotFoundError(err))
+		assert.Equal(t, errorCategoryNotFound, categorizeError(err))
+		assert.Equal(t, []string{"Get"}, appClient.calls)
+	})
+
+	t.Run("forwards the app namespace", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app", Namespace: "argocd"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		require.Len(t, appClient.getQueries, 1)
+		assert.Equal(t, "argocd", appClient.getQueries[0].GetAppNamespace())
+		require.Len(t, appClient.resourcesQueries, 1)
+		assert.Equal(t, "argocd", appClient.resourcesQueries[0].GetAppNamespace())
+	})
+
+	t.Run("revision", func(t *testing.T) {
+		t.Parallel()
+		resolveErr := status.Error(codes.Unknown, "Unable to resolve 'feature-x' to a commit SHA")
+		revisions := func(appClient *fakeAppClient) []*string {
+			var revisions []*string
+			for _, query := range appClient.manifestQueries {
+				revisions = append(revisions, query.Revision)
+			}
+			return revisions
+		}
+
+		t.Run("target revision", func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []*string{nil}, revisions(appClient), "an empty revision must not be sent")
+		})
+
+		t.Run("missing revision", func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			appClient.manifestErrors = map[string]error{"feature-x": resolveErr}
+			_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, Revision: "feature-x"}, "", appClient, client.settingsClient, nil)
+			require.ErrorContains(t, err, `revision "feature-x" doesn't exist in the repo of app "my-app"`)
+		})
+
+		t.Run("fallback revision", func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			appClient.manifestErrors = map[string]error{"feature-x": resolveErr}
+			action := DiffAction{App: App{Name: "my-app"}, Revision: "feature-x", FallbackRevision: "HEAD"}
+			result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []*string{pointer.String("feature-x"), pointer.String("HEAD")}, revisions(appClient))
+			assert.Equal(t, []string{`revision "feature-x" doesn't exist, so fallback revision "HEAD" was diffed instead`}, result.warnings)
+		})
+
+		t.Run("other errors don't fall back", func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			appClient.manifestErrors = map[string]error{"feature-x": status.Error(codes.Internal, "failed to generate manifests")}
+			action := DiffAction{App: App{Name: "my-app"}, Revision: "feature-x", FallbackRevision: "HEAD"}
+			_, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.ErrorContains(t, err, "failed to generate manifests")
+			assert.Len(t, appClient.manifestQueries, 1)
+		})
+
+		t.Run("fallback requires revision", func(t *testing.T) {
+			t.Parallel()
+			client, appClient := newTestFakes(t, nil, nil)
+			_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, FallbackRevision: "HEAD"}, "", appClient, client.settingsClient, nil)
+			require.EqualError(t, err, "fallbackRevision requires revision")
+		})
+	})
+
+	t.Run("refresh if older than", func(t *testing.T) {
+		t.Parallel()
+		testCases := []struct {
+			name         string
+			reconciledAt *metav1.Time
+			hardRefresh  bool
+			expected     []string
+		}{
+			{"recently reconciled", &metav1.Time{Time: time.Now().Add(-time.Minute)}, false, []string{""}},
+			{"stale", &metav1.Time{Time: time.Now().Add(-time.Hour)}, false, []string{"", "normal"}},
+			{"stale with hard refresh", &metav1.Time{Time: time.Now().Add(-time.Hour)}, true, []string{"", "hard"}},
+			{"never reconciled", nil, false, []string{"", "normal"}},
+		}
+		for _, testCase := range testCases {
+			testCase := testCase
+			t.Run(testCase.name, func(t *testing.T) {
+				t.Parallel()
+				client, appClient := newTestFakes(t, nil, nil)
+				appClient.apps["my-app"].Status.ReconciledAt = testCase.reconciledAt
+				action := DiffAction{App: App{Name: "my-app"}, Refresh: true, HardRefresh: testCase.hardRefresh, RefreshIfOlderThan: "10m"}
+				_, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+				require.NoError(t, err)
+				var refreshes []string
+				for _, query := range appClient.getQueries {
+					refreshes = append(refreshes, query.GetRefresh())
+				}
+				assert.Equal(t, testCase.expected, refreshes)
+			})
+		}
+	})
+
+	t.Run("normalizers", func(t *testing.T) {
+		newWidget := func(items ...interface{}) *unstructured.Unstructured {
+			return &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "example.com/v1",
+				"kind":       "Widget",
+				"metadata": map[string]interface{}{
+					"name":      "my-widget",
+					"namespace": "my-namespace",
+					"labels":    map[string]interface{}{testAppLabelKey: "my-app"},
+				},
+				"spec": map[string]interface{}{"items": items},
+			}}
+		}
+		live := []*unstructured.Unstructured{newWidget("a", "b", "c")}
+		target := []*unstructured.Unstructured{newWidget("c", "a", "b")}
+
+		client, appClient := newTestFakes(t, live, target)
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.NotEmpty(t, result.diff, "reordered array should show up without a normalizer")
+
+		for _, n := range []DiffNormalizer{
+			{Group: "example.com", Kind: "Widget", JSONPointer: "/spec/items"},
+			{JQExpression: ".spec.items |= sort"},
+		} {
+			client, appClient := newTestFakes(t, live, target)
+			action := DiffAction{App: App{Name: "my-app"}, Normalizers: []DiffNormalizer{n}}
+			result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err)
+			assert.Empty(t, result.diff)
+		}
+	})
+
+	t.Run("namespace-less target", func(t *testing.T) {
+		live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "same"})}
+		target := newTestConfigMap("my-config", map[string]interface{}{"key": "same"})
+		target.SetNamespace("")
+
+		client, appClient := newTestFakes(t, live, []*unstructured.Unstructured{target})
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Empty(t, result.diff)
+
+		client, appClient = newTestFakes(t, live, []*unstructured.Unstructured{target})
+		appClient.apps["my-app"].Spec.Destination.Namespace = "other-namespace"
+		result, err = diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, DestinationNamespace: "my-namespace"}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Empty(t, result.diff)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		hook := newTestConfigMap("my-hook", map[string]interface{}{"key": "old"})
+		hook.SetAnnotations(map[string]string{"argocd.argoproj.io/hook": "PreSync"})
+		hookTarget := newTestConfigMap("my-hook", map[string]interface{}{"key": "new"})
+		hookTarget.SetAnnotations(map[string]string{"argocd.argoproj.io/hook": "PreSync"})
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("unchanged", map[string]interface{}{"key": "same"}),
+			newTestConfigMap("modified", map[string]interface{}{"key": "old"}),
+			newTestConfigMap("removed", map[string]interface{}{"key": "old"}),
+			hook,
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("unchanged", map[string]interface{}{"key": "same"}),
+			newTestConfigMap("modified", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("added", map[string]interface{}{"key": "new"}),
+			hookTarget,
+		}
+		client, appClient := newTestFakes(t, live, target)
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 5, SkippedHooks: 1, Unchanged: 1, Changed: 3, Modified: 1, Added: 1, Removed: 1}, result.stats)
+		assert.True(t, strings.HasSuffix(result.diff, "\n1 resource modified, 1 added, 1 removed\n"), "the diff must end with a summary")
+		assert.Equal(t, []wfv1.Parameter{
+			{Name: "resourcesInspected", Value: wfv1.AnyStringPtr(5)},
+			{Name: "resourcesSkippedHooks", Value: wfv1.AnyStringPtr(1)},
+			{Name: "resourcesUnchanged", Value: wfv1.AnyStringPtr(1)},
+			{Name: "resourcesChanged", Value: wfv1.AnyStringPtr(3)},
+		}, result.stats.parameters())
+	})
+
+	t.Run("server compare options", func(t *testing.T) {
+		// The server's ignoreResourceStatusField compare option comes through the settings API as a resource override.
+		newWidget := func(phase string) *unstructured.Unstructured {
+			widget := newTestConfigMap("my-widget", nil)
+			widget.SetAPIVersion("example.com/v1")
+			widget.SetKind("Widget")
+			widget.Object["status"] = map[string]interface{}{"phase": phase}
+			return widget
+		}
+		live, target := newWidget("old"), newWidget("new")
+
+		client, appClient := newTestFakes(t, []*unstructured.Unstructured{live}, []*unstructured.Unstructured{target})
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.stats.Changed)
+
+		client, appClient = newTestFakes(t, []*unstructured.Unstructured{live}, []*unstructured.Unstructured{target})
+		client.settingsClient.settings.ResourceOverrides = map[string]*v1alpha1.ResourceOverride{
+			"*/*": {IgnoreDifferences: v1alpha1.OverrideIgnoreDiff{JSONPointers: []string{"/status"}}},
+		}
+		result, err = diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 1, Unchanged: 1}, result.stats)
+	})
+
+	t.Run("include hooks", func(t *testing.T) {
+		hook := newTestConfigMap("my-hook", map[string]interface{}{"key": "old"})
+		hook.SetAnnotations(map[string]string{"argocd.argoproj.io/hook": "PreSync"})
+		hookTarget := newTestConfigMap("my-hook", map[string]interface{}{"key": "new"})
+		hookTarget.SetAnnotations(map[string]string{"argocd.argoproj.io/hook": "PreSync"})
+		live := []*unstructured.Unstructured{hook}
+		target := []*unstructured.Unstructured{hookTarget}
+
+		client, appClient := newTestFakes(t, live, target)
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 1, SkippedHooks: 1}, result.stats)
+		assert.Empty(t, result.diff)
+
+		client, appClient = newTestFakes(t, live, target)
+		result, err = diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, IncludeHooks: true}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 1, Changed: 1, Modified: 1}, result.stats)
+		assert.Contains(t, result.diff, "key: new")
+	})
+
+	t.Run("canonical", func(t *testing.T) {
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("modified", map[string]interface{}{"key": "old"}),
+			newTestConfigMap("removed", map[string]interface{}{"key": "old"}),
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("modified", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("added-b", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("added-a", map[string]interface{}{"key": "new"}),
+		}
+		action := DiffAction{App: App{Name: "my-app"}, Canonical: true}
+		var first diffResult
+		// Target-only resources are collected from a map, so repeat the diff to catch any ordering differences.
+		for i := 0; i < 5; i++ {
+			client, appClient := newTestFakes(t, live, target)
+			result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err)
+			if i == 0 {
+				first = result
+				continue
+			}
+			assert.Equal(t, first.diff, result.diff)
+			assert.Equal(t, first.hash, result.hash)
+		}
+		assert.Equal(t, diffHash(first.diff), first.hash)
+		addedA := strings.Index(first.diff, "=== /ConfigMap/my-namespace/added-a\n")
+		addedB := strings.Index(first.diff, "=== /ConfigMap/my-namespace/added-b\n")
+		modified := strings.Index(first.diff, "=== /ConfigMap/my-namespace/modified\n")
+		removed := strings.Index(first.diff, "=== /ConfigMap/my-namespace/removed\n")
+		require.True(t, addedA >= 0 && addedB >= 0 && modified >= 0 && removed >= 0, first.diff)
+		assert.True(t, addedA < addedB && addedB < modified && modified < removed, "resources should be sorted:\n%s", first.diff)
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		names := []string{"charlie", "alpha", "delta", "bravo"}
+		var live, target []*unstructured.Unstructured
+		for _, name := range names {
+			live = append(live, newTestConfigMap(name, map[string]interface{}{"key": "old-" + name}))
+			target = append(target, newTestConfigMap(name, map[string]interface{}{"key": "new-" + name}))
+		}
+		var first string
+		for i := 0; i < 5; i++ {
+			client, appClient := newTestFakes(t, live, target)
+			result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+			require.NoError(t, err)
+			if i == 0 {
+				first = result.diff
+				continue
+			}
+			assert.Equal(t, first, result.diff)
+		}
+		previous := -1
+		for _, name := range []string{"alpha", "bravo", "charlie", "delta"} {
+			index := strings.Index(first, "key: new-"+name)
+			require.True(t, index >= 0, first)
+			assert.Greater(t, index, previous, "resources should be sorted:\n%s", first)
+			previous = index
+		}
+	})
+
+	t.Run("json output", func(t *testing.T) {
+		hook := newTestConfigMap("my-hook", map[string]interface{}{"key": "old"})
+		hook.SetAnnotations(map[string]string{"argocd.argoproj.io/hook": "PreSync"})
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("unchanged", map[string]interface{}{"key": "same"}),
+			newTestConfigMap("modified", map[string]interface{}{"key": "old"}),
+			hook,
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("unchanged", map[string]interface{}{"key": "same"}),
+			newTestConfigMap("modified", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("added", map[string]interface{}{"key": "new"}),
+		}
+		client, appClient := newTestFakes(t, live, target)
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, OutputFormat: DiffOutputFormatJSON}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		var diff jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(result.diff), &diff))
+		assert.Equal(t, diffSummary{Modified: 1, Added: 1}, diff.Summary)
+		resources := diff.Resources
+		require.Len(t, resources, 3)
+		for i, name := range []string{"added", "modified", "unchanged"} {
+			assert.Equal(t, "ConfigMap", resources[i].Kind)
+			assert.Equal(t, "my-namespace", resources[i].Namespace)
+			assert.Equal(t, name, resources[i].Name)
+		}
+		assert.True(t, resources[0].Modified)
+		assert.Contains(t, resources[0].Diff, "name: added")
+		assert.True(t, resources[1].Modified)
+		assert.Contains(t, resources[1].Diff, "key: new")
+		assert.False(t, resources[2].Modified)
+		assert.Empty(t, resources[2].Diff)
+
+		// An app without resources outputs an empty array rather than null.
+		client, appClient = newTestFakes(t, nil, nil)
+		result, err = diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, OutputFormat: DiffOutputFormatJSON}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"summary": {"modified": 0, "added": 0, "removed": 0}, "resources": []}`, result.diff)
+
+		_, err = diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, OutputFormat: "yaml"}, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, `unknown output format "yaml" (must be text or json)`)
+	})
+
+	t.Run("focused resource", func(t *testing.T) {
+		live := []*unstructured.Unstructured{
+			newTestConfigMap("focused", map[string]interface{}{"key": "old"}),
+			newTestConfigMap("other", map[string]interface{}{"key": "old"}),
+		}
+		target := []*unstructured.Unstructured{
+			newTestConfigMap("focused", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("other", map[string]interface{}{"key": "new"}),
+			newTestConfigMap("added", map[string]interface{}{"key": "new"}),
+		}
+		client, appClient := newTestFakes(t, live, target)
+		action := DiffAction{App: App{Name: "my-app"}, Resource: &ResourceRef{Kind: "ConfigMap", Namespace: "my-namespace", Name: "focused"}}
+		result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 1, Changed: 1, Modified: 1}, result.stats)
+		assert.Contains(t, result.diff, "key: new")
+		assert.NotContains(t, result.diff, "name: other")
+		assert.NotContains(t, result.diff, "name: added")
+
+		// A resource which only exists in the target state is diffed as an addition.
+		client, appClient = newTestFakes(t, live, target)
+		action.Resource.Name = "added"
+		result, err = diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, diffStats{Inspected: 1, Changed: 1, Added: 1}, result.stats)
+		assert.Contains(t, result.diff, "name: added")
+
+		client, appClient = newTestFakes(t, live, target)
+		action.Resource.Name = "missing"
+		_, err = diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, `resource /ConfigMap/my-namespace/missing not found in app "my-app"`)
+
+		action.Resource = &ResourceRef{Kind: "ConfigMap"}
+		_, err = diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, "resource must set kind and name")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.hang = true
+		done := make(chan error)
+		go func() {
+			_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "10ms", appClient, client.settingsClient, nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			require.Error(t, err)
+			assert.Equal(t, codes.DeadlineExceeded, grpcCode(err))
+		case <-time.After(5 * time.Second):
+			t.Fatal("diff ignored the action's timeout")
+		}
+	})
+
+	t.Run("invalid normalizer", func(t *testing.T) {
+		client, appClient := newTestFakes(t, nil, nil)
+		action := DiffAction{App: App{Name: "my-app"}, Normalizers: []DiffNormalizer{{JQExpression: "|"}}}
+		_, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, "failed to parse normalizers")
+		assert.Empty(t, appClient.calls)
+	})
+}
+
+// Test_diffApp_stdout isn't parallel, since it replaces os.Stdout.
+func Test_diffApp_stdout(t *testing.T) {
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+	client, appClient := newTestFakes(t, live, target)
+
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = writer
+	result, diffErr := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+	os.Stdout = stdout
+	require.NoError(t, writer.Close())
+	written, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	require.NoError(t, diffErr)
+	assert.NotEmpty(t, result.diff)
+	assert.Empty(t, string(written), "diffs must not write to stdout")
+}
+
+func Test_listApps(t *testing.T) {
+	t.Parallel()
+
+	newApp := func(name, project, team string) *v1alpha1.Application {
+		return &v1alpha1.Application{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "argocd", Labels: map[string]string{"team": team}},
+			Spec:       v1alpha1.ApplicationSpec{Project: project},
+			Status: v1alpha1.ApplicationStatus{
+				Sync:   v1alpha1.SyncStatus{Status: v1alpha1.SyncStatusCodeSynced},
+				Health: v1alpha1.HealthStatus{Status: health.HealthStatusHealthy},
+			},
+		}
+	}
+	appClient := &fakeAppClient{apps: map[string]*v1alpha1.Application{
+		"payments-api":    newApp("payments-api", "payments", "payments"),
+		"payments-worker": newApp("payments-worker", "payments", "payments"),
+		"search":          newApp("search", "search", "search"),
+	}}
+
+	t.Run("selector", func(t *testing.T) {
+		out, err := listApps(context.Background(), ListAction{Selector: "team=payments"}, "", appClient)
+		require.NoError(t, err)
+		assert.JSONEq(t, `[
+			{"name": "payments-api", "namespace": "argocd", "project": "payments", "syncStatus": "Synced", "healthStatus": "Healthy"},
+			{"name": "payments-worker", "namespace": "argocd", "project": "payments", "syncStatus": "Synced", "healthStatus": "Healthy"}
+		]`, out)
+	})
+
+	t.Run("project", func(t *testing.T) {
+		out, err := listApps(context.Background(), ListAction{Projects: []string{"search"}}, "", appClient)
+		require.NoError(t, err)
+		var summaries []appSummary
+		require.NoError(t, json.Unmarshal([]byte(out), &summaries))
+		require.Len(t, summaries, 1)
+		assert.Equal(t, "search", summaries[0].Name)
+	})
+
+	t.Run("paging", func(t *testing.T) {
+		var names []string
+		for offset := 0; offset < 4; offset += 2 {
+			out, err := listApps(context.Background(), ListAction{Limit: 2, Offset: offset}, "", appClient)
+			require.NoError(t, err)
+			var summaries []appSummary
+			require.NoError(t, json.Unmarshal([]byte(out), &summaries))
+			for _, summary := range summaries {
+				names = append(names, summary.Name)
+			}
+		}
+		assert.Equal(t, []string{"payments-api", "payments-worker", "search"}, names)
+	})
+
+	t.Run("offset past end", func(t *testing.T) {
+		out, err := listApps(context.Background(), ListAction{Offset: 10}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, "[]", out)
+	})
+
+	t.Run("negative limit", func(t *testing.T) {
+		_, err := listApps(context.Background(), ListAction{Limit: -1}, "", appClient)
+		require.Error(t, err)
+	})
+}
+
+func TestApiExecutor_runAction_authReload(t *testing.T) {
+	t.Parallel()
+
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+	action := ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "my-app"}}}}
+	denied := status.Error(codes.PermissionDenied, "permission denied")
+
+	t.Run("reload and succeed", func(t *testing.T) {
+		staleClient, staleAppClient := newTestFakes(t, live, target)
+		staleAppClient.err = denied
+		freshClient, _ := newTestFakes(t, live, target)
+		reloads := 0
+		e := NewApiExecutor(staleClient, "", WithAPIClientReloader(func() (apiclient.Client, error) {
+			reloads++
+			return freshClient, nil
+		}))
+		result, err := e.runAction(context.Background(), action)
+		require.NoError(t, err)
+		assert.Contains(t, result.output, "key: new")
+		assert.Equal(t, 1, reloads)
+		assert.Same(t, freshClient, e.apiClient.get())
+	})
+
+	t.Run("reload and still fail", func(t *testing.T) {
+		staleClient, staleAppClient := newTestFakes(t, live, target)
+		staleAppClient.err = denied
+		reloads := 0
+		e := NewApiExecutor(staleClient, "", WithAPIClientReloader(func() (apiclient.Client, error) {
+			reloads++
+			return staleClient, nil
+		}))
+		_, err := e.runAction(context.Background(), action)
+		require.ErrorIs(t, err, ErrAuthFailed)
+		assert.Equal(t, 1, reloads)
+	})
+
+	t.Run("no reloader", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		appClient.err = denied
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), action)
+		require.ErrorIs(t, err, ErrAuthFailed)
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		client, appClient := newTestFakes(t, live, target)
+		appClient.err = status.Error(codes.Unavailable, "unavailable")
+		reloads := 0
+		e := NewApiExecutor(client, "", WithAPIClientReloader(func() (apiclient.Client, error) {
+			reloads++
+			return client, nil
+		}))
+		_, err := e.runAction(context.Background(), action)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, ErrAuthFailed)
+		assert.Zero(t, reloads)
+	})
+}
+
+func Test_buildDiffConfig(t *testing.T) {
+	t.Parallel()
+
+	app := &v1alpha1.Application{Spec: v1alpha1.ApplicationSpec{
+		IgnoreDifferences: []v1alpha1.ResourceIgnoreDifferences{{Kind: "ConfigMap", JSONPointers: []string{"/data"}}},
+	}}
+	override := v1alpha1.ResourceOverride{IgnoreDifferences: v1alpha1.OverrideIgnoreDiff{JSONPointers: []string{"/spec"}}}
+	argoSettings := &settings.Settings{
+		AppLabelKey:       "example.com/app",
+		TrackingMethod:    "annotation",
+		ResourceOverrides: map[string]*v1alpha1.ResourceOverride{"example.com/Widget": &override},
+	}
+
+	for _, ignoreAggregatedRoles := range []bool{false, true} {
+		diffConfig, err := buildDiffConfig(app, argoSettings, DiffAction{IgnoreAggregatedRoles: ignoreAggregatedRoles})
+		require.NoError(t, err)
+		assert.Equal(t, "example.com/app", diffConfig.AppLabelKey())
+		assert.Equal(t, "annotation", diffConfig.TrackingMethod())
+		assert.Equal(t, map[string]v1alpha1.ResourceOverride{"example.com/Widget": override}, diffConfig.Overrides())
+		assert.Equal(t, app.Spec.IgnoreDifferences, diffConfig.Ignores())
+		assert.Equal(t, ignoreAggregatedRoles, diffConfig.IgnoreAggregatedRoles())
+	}
+}
+
+func Test_setRevision(t *testing.T) {
+	newAppClient := func() *fakeAppClient {
+		return &fakeAppClient{apps: map[string]*v1alpha1.Application{
+			"my-app": {
+				ObjectMeta: metav1.ObjectMeta{Name: "my-app", Namespace: "argocd"},
+				Spec: v1alpha1.ApplicationSpec{Source: v1alpha1.ApplicationSource{
+					RepoURL:        "https://example.com/repo.git",
+					TargetRevision: "main",
+				}},
+			},
+		}}
+	}
+	setRevisionRetryBackoff = time.Millisecond
+
+	t.Run("single source", func(t *testing.T) {
+		appClient := newAppClient()
+		out, err := setRevision(context.Background(), SetRevisionAction{App: App{Name: "my-app"}, Revision: "v1.2.3"}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, "v1.2.3", out)
+		assert.Equal(t, "v1.2.3", appClient.apps["my-app"].Spec.Source.TargetRevision)
+		assert.Equal(t, "https://example.com/repo.git", appClient.apps["my-app"].Spec.Source.RepoURL)
+		assert.NotContains(t, appClient.calls, "Sync")
+	})
+
+	t.Run("multi source", func(t *testing.T) {
+		appClient := newAppClient()
+		_, err := setRevision(context.Background(), SetRevisionAction{App: App{Name: "my-app"}, Revision: "v1.2.3", SourceIndex: 1}, "", appClient)
+		require.ErrorContains(t, err, "only single-source apps are supported")
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		appClient := newAppClient()
+		appClient.patchErrors = []error{errors.New("the object has been modified; please apply your changes to the latest version and try again")}
+		out, err := setRevision(context.Background(), SetRevisionAction{App: App{Name: "my-app"}, Revision: "v1.2.3"}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, "v1.2.3", out)
+		assert.Equal(t, []string{"Patch", "Patch"}, appClient.calls)
+	})
+
+	t.Run("persistent conflict", func(t *testing.T) {
+		appClient := newAppClient()
+		conflict := status.Error(codes.Aborted, "conflict")
+		appClient.patchErrors = []error{conflict, conflict, conflict, conflict}
+		_, err := setRevision(context.Background(), SetRevisionAction{App: App{Name: "my-app"}, Revision: "v1.2.3"}, "", appClient)
+		require.Error(t, err)
+		assert.Len(t, appClient.calls, setRevisionRetries+1)
+	})
+
+	t.Run("missing revision", func(t *testing.T) {
+		_, err := setRevision(context.Background(), SetRevisionAction{App: App{Name: "my-app"}}, "", newAppClient())
+		require.ErrorContains(t, err, "revision is required")
+	})
+}
+
+func Test_waitForHealth(t *testing.T) {
+	appPollInterval = time.Millisecond
+	newApp := func(name string, phase synccommon.OperationPhase, healthStatus health.HealthStatusCode, startedAt metav1.Time) *v1alpha1.Application {
+		app := &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "argocd"}}
+		app.Status.Health.Status = healthStatus
+		app.Status.OperationState = &v1alpha1.OperationState{Phase: phase, StartedAt: startedAt, Message: "boom"}
+		return app
+	}
+	now := metav1.Now()
+
+	t.Run("healthy", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.getResponses = []*v1alpha1.Application{
+			newApp("my-app", synccommon.OperationRunning, health.HealthStatusProgressing, now),
+			newApp("my-app", synccommon.OperationSucceeded, health.HealthStatusProgressing, now),
+		}
+		appClient.apps["my-app"] = newApp("my-app", synccommon.OperationSucceeded, health.HealthStatusHealthy, now)
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", WaitForHealth: true}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "Healthy", results[0].Health)
+		assert.Equal(t, "Succeeded", results[0].Phase)
+		assert.Equal(t, []string{"Sync", "Get", "Get", "Get"}, appClient.calls)
+	})
+
+	t.Run("sync failed", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"] = newApp("my-app", synccommon.OperationFailed, health.HealthStatusDegraded, now)
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", WaitForHealth: true}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, `sync of app "my-app" failed: boom`)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["b"] = newApp("b", synccommon.OperationSucceeded, health.HealthStatusDegraded, now)
+		appClient.apps["a"] = newApp("a", synccommon.OperationRunning, health.HealthStatusProgressing, now)
+		// An operation which started before the sync was requested is a previous one.
+		appClient.apps["c"] = newApp("c", synccommon.OperationSucceeded, health.HealthStatusHealthy, metav1.NewTime(now.Add(-time.Hour)))
+		appClient.apps["my-app"] = newApp("my-app", synccommon.OperationSucceeded, health.HealthStatusHealthy, now)
+		action := SyncAction{Apps: "[{name: b}, {name: a}, {name: c}, {name: my-app}]", WaitForHealth: true, HealthTimeout: "20ms"}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		var partial partialError
+		require.ErrorAs(t, err, &partial)
+		assert.Equal(t, "timed out waiting for apps to become healthy: a (health: Progressing, operation: Running), "+
+			"b (health: Degraded, operation: Succeeded), c (health: Healthy, operation: not started)", err.Error())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, appClient := newTestFakes(t, nil, nil)
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", HealthTimeout: "1m"}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "healthTimeout requires waitForHealth")
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", WaitForHealth: true, HealthTimeout: "soon"}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "failed to parse health timeout")
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", WaitForHealth: true, DryRun: true}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "can't be combined with dryRun")
+		assert.Empty(t, appClient.syncRequests)
+	})
+}
+
+func Test_waitForChildApps(t *testing.T) {
+	appPollInterval = time.Millisecond
+	now := metav1.Now()
+	newApp := func(name string, syncStatus v1alpha1.SyncStatusCode, healthStatus health.HealthStatusCode) *v1alpha1.Application {
+		app := &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "argocd"}}
+		app.Status.Sync.Status = syncStatus
+		app.Status.Health.Status = healthStatus
+		app.Status.OperationState = &v1alpha1.OperationState{Phase: synccommon.OperationSucceeded, StartedAt: now}
+		return app
+	}
+	childResource := func(name string) *v1alpha1.ResourceDiff {
+		return &v1alpha1.ResourceDiff{Group: "argoproj.io", Kind: "Application", Namespace: "argocd", Name: name}
+	}
+	newFakes := func(t *testing.T) *fakeAppClient {
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"] = newApp("my-app", v1alpha1.SyncStatusCodeSynced, health.HealthStatusHealthy)
+		appClient.apps["frontend"] = newApp("frontend", v1alpha1.SyncStatusCodeSynced, health.HealthStatusHealthy)
+		appClient.apps["backend"] = newApp("backend", v1alpha1.SyncStatusCodeSynced, health.HealthStatusHealthy)
+		appClient.apps["database"] = newApp("database", v1alpha1.SyncStatusCodeSynced, health.HealthStatusHealthy)
+		appClient.appResources = map[string][]*v1alpha1.ResourceDiff{
+			"my-app": {
+				childResource("frontend"),
+				childResource("backend"),
+				{Kind: "ConfigMap", Namespace: "argocd", Name: "not-an-app"},
+			},
+			// backend is itself an app of apps, which also manages its parent.
+			"backend":  {childResource("database"), childResource("my-app")},
+			"frontend": {},
+			"database": {childResource("backend")},
+		}
+		return appClient
+	}
+
+	t.Run("waits for descendants", func(t *testing.T) {
+		appClient := newFakes(t)
+		appClient.getResponses = []*v1alpha1.Application{
+			newApp("my-app", v1alpha1.SyncStatusCodeSynced, health.HealthStatusHealthy),
+			newApp("frontend", v1alpha1.SyncStatusCodeOutOfSync, health.HealthStatusProgressing),
+		}
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app, namespace: argocd}]", WaitForHealth: true, SyncChildApps: true}, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, []childAppResult{
+			{Name: "frontend", Namespace: "argocd", Parent: "argocd/my-app", Sync: "Synced", Health: "Healthy"},
+			{Name: "backend", Namespace: "argocd", Parent: "argocd/my-app", Sync: "Synced", Health: "Healthy"},
+			{Name: "database", Namespace: "argocd", Parent: "argocd/backend", Sync: "Synced", Health: "Healthy"},
+		}, results[0].Children, "each app must be waited for once, despite the cycles")
+	})
+
+	t.Run("child fails", func(t *testing.T) {
+		appClient := newFakes(t)
+		backend := appClient.apps["backend"]
+		backend.Status.Sync.Status = v1alpha1.SyncStatusCodeOutOfSync
+		backend.Status.OperationState.Phase = synccommon.OperationFailed
+		backend.Status.OperationState.Message = "boom"
+		results, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app, namespace: argocd}]", WaitForHealth: true, SyncChildApps: true}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, `child apps of app "my-app" aren't synced and healthy: sync of child app "backend" failed: boom`)
+		require.Len(t, results, 1)
+		require.Len(t, results[0].Children, 2, "the children of a failed app aren't waited for")
+		assert.Equal(t, "OutOfSync", results[0].Children[1].Sync)
+		assert.Contains(t, results[0].Children[1].Error, "boom")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		appClient := newFakes(t)
+		appClient.apps["frontend"].Status.Health.Status = health.HealthStatusDegraded
+		action := SyncAction{Apps: "[{name: my-app, namespace: argocd}]", WaitForHealth: true, SyncChildApps: true, HealthTimeout: "20ms"}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, `timed out waiting for child app "frontend" to become synced and healthy (sync: Synced, health: Degraded)`)
+	})
+
+	t.Run("requires waitForHealth", func(t *testing.T) {
+		appClient := newFakes(t)
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", SyncChildApps: true}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "syncChildApps requires waitForHealth")
+		assert.Empty(t, appClient.syncRequests)
+	})
+}
+
+func Test_createApp(t *testing.T) {
+	appPollInterval = time.Millisecond
+	appYAML := `
+metadata:
+  name: preview-123
+  namespace: argocd
+spec:
+  project: default
+  source:
+    repoURL: https://example.com/repo.git
+    path: preview
+  destination:
+    server: https://kubernetes.default.svc
+    namespace: preview-123
+`
+	reconciled := func(status v1alpha1.SyncStatusCode) *v1alpha1.Application {
+		app := &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "preview-123", Namespace: "argocd"}}
+		app.Status.Sync.Status = status
+		if status != "" {
+			now := metav1.Now()
+			app.Status.ReconciledAt = &now
+		}
+		return app
+	}
+
+	t.Run("without waiting", func(t *testing.T) {
+		appClient := &fakeAppClient{}
+		out, err := createApp(context.Background(), CreateAction{Application: appYAML}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, App{Name: "preview-123", Namespace: "argocd"}, out)
+		assert.Equal(t, "preview", appClient.apps["preview-123"].Spec.Source.Path)
+		assert.Equal(t, []string{"Create"}, appClient.calls)
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		appClient := &fakeAppClient{}
+		_, err := createApp(context.Background(), CreateAction{Application: appYAML}, "", appClient)
+		require.NoError(t, err)
+		updatedYAML := strings.Replace(appYAML, "path: preview", "path: preview-v2", 1)
+
+		_, err = createApp(context.Background(), CreateAction{Application: updatedYAML}, "", appClient)
+		require.ErrorContains(t, err, `failed to create app "preview-123"`)
+		assert.Equal(t, "preview", appClient.apps["preview-123"].Spec.Source.Path)
+
+		out, err := createApp(context.Background(), CreateAction{Application: updatedYAML, Upsert: true}, "", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, App{Name: "preview-123", Namespace: "argocd"}, out)
+		assert.Equal(t, "preview-v2", appClient.apps["preview-123"].Spec.Source.Path)
+	})
+
+	t.Run("wait for reconcile", func(t *testing.T) {
+		appClient := &fakeAppClient{getResponses: []*v1alpha1.Application{
+			reconciled(""),
+			reconciled(v1alpha1.SyncStatusCodeUnknown),
+			reconciled(v1alpha1.SyncStatusCodeOutOfSync),
+		}}
+		out, err := createApp(context.Background(), CreateAction{Application: appYAML, WaitForReconcile: true}, "10s", appClient)
+		require.NoError(t, err)
+		assert.Equal(t, "preview-123", out.Name)
+		assert.Equal(t, []string{"Create", "Get", "Get", "Get"}, appClient.calls)
+	})
+
+	t.Run("reconcile timeout", func(t *testing.T) {
+		appClient := &fakeAppClient{}
+		app := reconciled(v1alpha1.SyncStatusCodeUnknown)
+		app.Status.Conditions = []v1alpha1.ApplicationCondition{{Type: v1alpha1.ApplicationConditionComparisonError, Message: "repo not found"}}
+		for i := 0; i < 1000; i++ {
+			appClient.getResponses = append(appClient.getResponses, app)
+		}
+		_, err := createApp(context.Background(), CreateAction{Application: appYAML, WaitForReconcile: true}, "20ms", appClient)
+		require.ErrorContains(t, err, `app "preview-123" was not reconciled before the timeout`)
+		require.ErrorContains(t, err, "repo not found")
+	})
+
+	t.Run("invalid application", func(t *testing.T) {
+		appClient := &fakeAppClient{}
+		_, err := createApp(context.Background(), CreateAction{Application: "metadata: {name: x}\nspec: {bogus: true}"}, "", appClient)
+		require.ErrorContains(t, err, "failed to unmarshal application")
+		assert.Empty(t, appClient.calls)
+	})
+}
+
+func TestApiExecutor_Execute_create(t *testing.T) {
+	t.Parallel()
+
+	client, _ := newTestFakes(t, nil, nil)
+	reply := execute(t, client, `{"argocd": {"app": {"create": {"application": "metadata: {name: preview-123, namespace: argocd}\nspec: {project: default}"}}}}`)
+	assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+	assert.Equal(t, "preview-123", parameter(t, reply, "name"))
+	assert.Equal(t, "argocd", parameter(t, reply, "namespace"))
+}
+
+func Test_exitCodeParameter(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		result   actionResult
+		err      error
+		expected string
+	}{
+		{"success", actionResult{}, nil, "0"},
+		{"diff found", actionResult{changesFound: true}, nil, "1"},
+		{"partial failure", actionResult{}, fmt.Errorf("failed to sync apps: %w", partialError{multiError{errors.New("boom")}}), "2"},
+		{"failure", actionResult{}, errors.New("boom"), "3"},
+		{"failed on diff", actionResult{changesFound: true}, fmt.Errorf("%w: 1 resource modified, 0 added, 0 removed", errDiffFound), "1"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			param := exitCodeParameter(testCase.result, testCase.err)
+			assert.Equal(t, "exitCode", param.Name)
+			assert.Equal(t, testCase.expected, param.Value.String())
+		})
+	}
+
+	t.Run("partial sync failure", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"b": errors.New("boom")}
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: a}, {name: b}]"}, nil, "", 0, appClient, nil)
+		assert.Equal(t, "2", exitCodeParameter(actionResult{}, err).Value.String())
+
+		appClient.syncErrors = map[string]error{"a": errors.New("boom"), "b": errors.New("boom")}
+		_, err = syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: a}, {name: b}]"}, nil, "", 0, appClient, nil)
+		assert.Equal(t, "3", exitCodeParameter(actionResult{}, err).Value.String())
+	})
+}
+
+// execute runs the plugin template with the given JSON against the fake client.
+func execute(t *testing.T, client *fakeApiClient, pluginJSON string) executor.ExecuteTemplateReply {
+	t.Helper()
+	e := NewApiExecutor(client, "token")
+	return e.Execute(executor.ExecuteTemplateArgs{
+		Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+	})
+}
+
+// parameter returns the value of the reply's output parameter with the given name.
+func parameter(t *testing.T, reply executor.ExecuteTemplateReply, name string) string {
+	t.Helper()
+	require.NotNil(t, reply.Node.Outputs)
+	for _, param := range reply.Node.Outputs.Parameters {
+		if param.Name == name {
+			return param.Value.String()
+		}
+	}
+	require.Failf(t, "missing output parameter", "no %q parameter", name)
+	return ""
+}
+
+func TestApiExecutor_Execute_messages(t *testing.T) {
+	t.Parallel()
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]"}}, "successMessage": "synced ${app} to ${revision}"}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "synced argocd/my-app to abc123", reply.Node.Message)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"refresh": {"app": {"name": "missing"}}}, "failureMessage": "${action} of ${app} failed: ${error}"}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.True(t, strings.HasPrefix(reply.Node.Message, "refresh of missing failed: failed to refresh app"), reply.Node.Message)
+		assert.Contains(t, reply.Node.Message, `app "missing" not found`)
+	})
+
+	t.Run("unknown variable", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"refresh": {"app": {"name": "my-app"}}}, "successMessage": "refreshed ${apps}"}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "successMessage uses unknown variables: ${apps}")
+		assert.Empty(t, appClient.calls)
+	})
+}
+
+func TestApiExecutor_Execute_warnings(t *testing.T) {
+	t.Parallel()
+
+	t.Run("warnings", func(t *testing.T) {
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Conditions = []v1alpha1.ApplicationCondition{{Type: v1alpha1.ApplicationConditionComparisonError, Message: "boom"}}
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "errorConditionPolicy": "skip"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "with warnings: skipped diff")
+		var warnings []string
+		require.NoError(t, json.Unmarshal([]byte(parameter(t, reply, "warnings")), &warnings))
+		require.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "ComparisonError: boom")
+		assert.Equal(t, "0", parameter(t, reply, "exitCode"))
+	})
+
+	t.Run("sync warnings", func(t *testing.T) {
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Spec.SyncPolicy = &v1alpha1.SyncPolicy{Automated: &v1alpha1.SyncPolicyAutomated{}}
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "automatedSyncPolicy": "skip"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, `["app \"my-app\": app has automated sync enabled, so it was skipped"]`, parameter(t, reply, "warnings"))
+	})
+
+	t.Run("no warnings", func(t *testing.T) {
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, wfv1.Progress("1/1"), reply.Node.Progress)
+		assert.Equal(t, "Action completed", reply.Node.Message)
+		assert.Equal(t, "[]", parameter(t, reply, "warnings"))
+	})
+}
+
+func TestApiExecutor_Execute_appNotFound(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name       string
+		pluginJSON string
+		expected   string
+	}{
+		{"missing app", `{"argocd": {"app": {"diff": {"app": {"name": "missing"}}}}}`, "true"},
+		{"one of several apps missing", `{"argocd": {"app": {"diff": {"apps": "[{name: my-app}, {name: missing}]"}}}}`, "true"},
+		{"existing app", `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`, "false"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			client, _ := newTestFakes(t, nil, nil)
+			reply := execute(t, client, testCase.pluginJSON)
+			assert.Equal(t, testCase.expected, parameter(t, reply, "appNotFound"))
+		})
+	}
+
+	t.Run("failed for another reason", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.err = status.Error(codes.Internal, "boom")
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Equal(t, "false", parameter(t, reply, "appNotFound"))
+	})
+}
+
+func TestApiExecutor_Execute_errorCategory(t *testing.T) {
+	t.Parallel()
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"refresh": {"app": {"name": "missing"}}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Equal(t, "NotFound", parameter(t, reply, "errorCategory"))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"refresh": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "", parameter(t, reply, "errorCategory"))
+	})
+}
+
+func TestApiExecutor_Execute_applicationSet(t *testing.T) {
+	t.Parallel()
+
+	client, appClient := newTestFakes(t, nil, nil)
+	reply := execute(t, client, `{"argocd": {"app": {"sync": {"applicationSet": "guestbook"}}}}`)
+	assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+	assert.Contains(t, reply.Node.Message, `no apps are owned by ApplicationSet "guestbook", so nothing was synced`)
+	require.NotNil(t, reply.Node.Outputs.Result)
+	assert.Equal(t, "[]", *reply.Node.Outputs.Result)
+	assert.Empty(t, appClient.syncRequests)
+}
+
+func TestApiExecutor_Execute_syncWindow(t *testing.T) {
+	t.Parallel()
+
+	t.Run("blocked", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"my-app": status.Error(codes.PermissionDenied, "cannot sync: blocked by sync window")}
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "blocked by sync window")
+		assert.NotContains(t, reply.Node.Message, ErrAuthFailed.Error(), "a sync window isn't an auth failure")
+		assert.Equal(t, "true", parameter(t, reply, "blockedBySyncWindow"))
+		assert.Equal(t, string(errorCategorySyncWindow), parameter(t, reply, "errorCategory"))
+	})
+
+	t.Run("not blocked", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "false", parameter(t, reply, "blockedBySyncWindow"))
+	})
+}
+
+func TestApiExecutor_Execute_diffTruncated(t *testing.T) {
+	t.Parallel()
+
+	newDriftedFakes := func() *fakeApiClient {
+		var live, target []*unstructured.Unstructured
+		for _, name := range []string{"config-a", "config-b", "config-c"} {
+			live = append(live, newTestConfigMap(name, map[string]interface{}{"key": "old"}))
+			target = append(target, newTestConfigMap(name, map[string]interface{}{"key": "new"}))
+		}
+		client, _ := newTestFakes(t, live, target)
+		return client
+	}
+	run := func(e ApiExecutor, pluginJSON string) executor.ExecuteTemplateReply {
+		return e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+		})
+	}
+
+	t.Run("not truncated", func(t *testing.T) {
+		t.Parallel()
+		reply := execute(t, newDriftedFakes(), `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "false", parameter(t, reply, "diffTruncated"))
+		assert.NotContains(t, *reply.Node.Outputs.Result, "truncated")
+	})
+
+	t.Run("action cap", func(t *testing.T) {
+		t.Parallel()
+		reply := execute(t, newDriftedFakes(), `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "maxOutputBytes": 60}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "true", parameter(t, reply, "diffTruncated"))
+		require.NotNil(t, reply.Node.Outputs.Result)
+		assert.LessOrEqual(t, len(*reply.Node.Outputs.Result), 60)
+		assert.Contains(t, *reply.Node.Outputs.Result, "bytes omitted)")
+		assert.Equal(t, "3", parameter(t, reply, "resourcesChanged"), "the counts cover the whole diff")
+	})
+
+	t.Run("plugin default", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(newDriftedFakes(), "token", WithMaxDiffOutputBytes(60))
+		reply := run(e, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, "true", parameter(t, reply, "diffTruncated"))
+
+		reply = run(e, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "maxOutputBytes": -1}}}}`)
+		assert.Equal(t, "false", parameter(t, reply, "diffTruncated"), "a negative cap overrides the default")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		reply := execute(t, newDriftedFakes(), `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "outputFormat": "json", "maxOutputBytes": 300}}}}`)
+		assert.Equal(t, "true", parameter(t, reply, "diffTruncated"))
+		require.NotNil(t, reply.Node.Outputs.Result)
+		var parsed jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(*reply.Node.Outputs.Result), &parsed))
+		assert.Equal(t, 3, parsed.Summary.Modified)
+		assert.Equal(t, 3, len(parsed.Resources)+parsed.OmittedResources)
+		assert.Positive(t, parsed.OmittedResources)
+	})
+}
+
+func TestApiExecutor_Execute_outOfSync(t *testing.T) {
+	t.Parallel()
+
+	t.Run("out of sync", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t,
+			[]*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})},
+			[]*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})})
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "true", parameter(t, reply, "outOfSync"))
+	})
+
+	t.Run("in sync", func(t *testing.T) {
+		t.Parallel()
+		configMap := newTestConfigMap("my-config", map[string]interface{}{"key": "same"})
+		client, _ := newTestFakes(t, []*unstructured.Unstructured{configMap}, []*unstructured.Unstructured{configMap})
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "false", parameter(t, reply, "outOfSync"))
+	})
+
+	t.Run("fail on diff", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t,
+			[]*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})},
+			[]*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})})
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "failOnDiff": true}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Equal(t, "action failed: diff found changes: 1 resource modified, 0 added, 0 removed", reply.Node.Message)
+		assert.Equal(t, "1", parameter(t, reply, "exitCode"))
+		require.NotNil(t, reply.Node.Outputs.Result)
+		assert.Contains(t, *reply.Node.Outputs.Result, "key: new", "the diff is still the result")
+	})
+
+	t.Run("fail on diff without changes", func(t *testing.T) {
+		t.Parallel()
+		configMap := newTestConfigMap("my-config", map[string]interface{}{"key": "same"})
+		client, _ := newTestFakes(t, []*unstructured.Unstructured{configMap}, []*unstructured.Unstructured{configMap})
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "failOnDiff": true}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "0", parameter(t, reply, "exitCode"))
+	})
+}
+
+func TestApiExecutor_Execute_syncResults(t *testing.T) {
+	t.Parallel()
+
+	client, appClient := newTestFakes(t, nil, nil)
+	appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+	appClient.syncErrors = map[string]error{"broken": errors.New("boom")}
+	reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}, {name: broken}]"}}}}`)
+	assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+	assert.Equal(t, wfv1.Progress("1/2"), reply.Node.Progress)
+	assert.Equal(t, "2", parameter(t, reply, "exitCode"))
+	assert.Contains(t, reply.Node.Message, "failed to sync 1 of 2 apps (broken)")
+	require.NotNil(t, reply.Node.Outputs.Result)
+	var results []appSyncResult
+	require.NoError(t, json.Unmarshal([]byte(*reply.Node.Outputs.Result), &results))
+	assert.Equal(t, []appSyncResult{
+		{Name: "my-app", Namespace: "argocd", Revision: "abc123"},
+		{Name: "broken", Error: `failed to sync app "broken": boom`},
+	}, results)
+}
+
+func TestApiExecutor_Execute_syncRevision(t *testing.T) {
+	t.Parallel()
+
+	t.Run("single app", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Sync.Revision = "abc123"
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "abc123", parameter(t, reply, "revision"))
+	})
+
+	t.Run("several apps", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}, {name: other-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		for _, param := range reply.Node.Outputs.Parameters {
+			assert.NotEqual(t, "revision", param.Name)
+		}
+	})
+}
+
+func TestApiExecutor_Execute_allowPartialSuccess(t *testing.T) {
+	t.Parallel()
+
+	t.Run("some apps fail", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"broken": errors.New("boom")}
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}, {name: broken}]", "allowPartialSuccess": true}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, wfv1.Progress("1/2"), reply.Node.Progress)
+		assert.Equal(t, "2", parameter(t, reply, "exitCode"))
+		assert.Contains(t, reply.Node.Message, "failed to sync 1 of 2 apps (broken)")
+		assert.Contains(t, parameter(t, reply, "warnings"), "failed to sync 1 of 2 apps (broken)")
+	})
+
+	t.Run("every app fails", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.syncErrors = map[string]error{"broken": errors.New("boom")}
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: broken}]", "allowPartialSuccess": true}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Equal(t, wfv1.Progress("0/1"), reply.Node.Progress)
+		assert.Equal(t, "3", parameter(t, reply, "exitCode"))
+	})
+}
+
+func Test_errorConditionPolicy(t *testing.T) {
+	t.Parallel()
+
+	newFakes := func(t *testing.T) (*fakeApiClient, *fakeAppClient) {
+		client, appClient := newTestFakes(t, nil, nil)
+		appClient.apps["my-app"].Status.Conditions = []v1alpha1.ApplicationCondition{
+			{Type: v1alpha1.ApplicationConditionComparisonError, Message: "repository not found"},
+			{Type: v1alpha1.ApplicationConditionSharedResourceWarning, Message: "shared resource"},
+		}
+		appClient.apps["healthy"] = &v1alpha1.Application{ObjectMeta: metav1.ObjectMeta{Name: "healthy", Namespace: "argocd"}}
+		return client, appClient
+	}
+
+	t.Run("diff fails", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, ErrorConditionPolicy: ErrorConditionPolicyFail}, "", appClient, client.settingsClient, nil)
+		require.EqualError(t, err, `app "my-app" has error conditions: ComparisonError: repository not found`)
+		assert.NotContains(t, appClient.calls, "GetManifests")
+	})
+
+	t.Run("diff skips", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, ErrorConditionPolicy: ErrorConditionPolicySkip}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Empty(t, result.diff)
+		assert.NotContains(t, appClient.calls, "GetManifests")
+	})
+
+	t.Run("diff skips with JSON output", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		action := DiffAction{App: App{Name: "my-app"}, ErrorConditionPolicy: ErrorConditionPolicySkip, OutputFormat: DiffOutputFormatJSON}
+		result, err := diffApp(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"summary": {"modified": 0, "added": 0, "removed": 0}, "resources": []}`, result.diff)
+	})
+
+	t.Run("diff proceeds", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Contains(t, appClient.calls, "GetManifests")
+	})
+
+	t.Run("sync fails", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newFakes(t)
+		action := SyncAction{Apps: "[{name: my-app}, {name: healthy}]", ErrorConditionPolicy: ErrorConditionPolicyFail}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "repository not found")
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Equal(t, "healthy", appClient.syncRequests[0].GetName())
+	})
+
+	t.Run("sync skips", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newFakes(t)
+		action := SyncAction{Apps: "[{name: my-app}, {name: healthy}]", ErrorConditionPolicy: ErrorConditionPolicySkip}
+		results, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		assert.True(t, results[0].Skipped)
+		assert.Contains(t, results[0].Warning, "ComparisonError: repository not found")
+		assert.False(t, results[1].Skipped)
+		assert.Len(t, appClient.syncRequests, 1)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newFakes(t)
+		_, err := syncAppsParallel(context.Background(), SyncAction{Apps: "[{name: my-app}]", ErrorConditionPolicy: "ignore"}, nil, "", 0, appClient, nil)
+		require.ErrorContains(t, err, "unknown error condition policy")
+	})
+}
+
+func Test_diffApp_bestEffortSettings(t *testing.T) {
+	t.Parallel()
+
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+
+	t.Run("strict", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, live, target)
+		client.settingsClient.err = status.Error(codes.Unavailable, "settings unavailable")
+		_, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}}, "", appClient, client.settingsClient, nil)
+		require.ErrorContains(t, err, "failed to get argo settings")
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, live, target)
+		client.settingsClient.err = status.Error(codes.Unavailable, "settings unavailable")
+		result, err := diffApp(context.Background(), DiffAction{App: App{Name: "my-app"}, BestEffortSettings: true}, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Contains(t, result.diff, "key: new")
+		assert.Equal(t, 1, result.stats.Changed)
+		require.Len(t, result.warnings, 1)
+		assert.Contains(t, result.warnings[0], "settings unavailable")
+	})
+}
+
+func Test_mergeSyncOptions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		actionOptions []string
+		appOptions    []string
+		expected      []string
+	}{
+		{"no app options", []string{"Prune=true"}, nil, []string{"Prune=true"}},
+		{"added", []string{"Prune=true"}, []string{"Replace=true"}, []string{"Prune=true", "Replace=true"}},
+		{"overridden", []string{"Replace=false", "Prune=true"}, []string{"Replace=true"}, []string{"Prune=true", "Replace=true"}},
+		{"deduplicated", []string{"Prune=true", "Prune=true"}, []string{"Prune=true"}, []string{"Prune=true"}},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, testCase.expected, mergeSyncOptions(testCase.actionOptions, testCase.appOptions))
+		})
+	}
+
+	t.Run("per-app options only apply to their app", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{
+			Apps:    "[{name: a}, {name: b, options: [Replace=true]}]",
+			Options: "[ServerSideApply=true]",
+		}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		options := make(map[string][]string)
+		for _, req := range appClient.syncRequests {
+			options[req.GetName()] = req.GetSyncOptions().GetItems()
+		}
+		assert.Equal(t, []string{"ServerSideApply=true"}, options["a"])
+		assert.Equal(t, []string{"ServerSideApply=true", "Replace=true"}, options["b"])
+	})
+
+	t.Run("flags", func(t *testing.T) {
+		t.Parallel()
+		testCases := []struct {
+			name     string
+			action   SyncAction
+			expected []string
+		}{
+			{"server-side apply", SyncAction{Apps: "[{name: a}]", ServerSideApply: true}, []string{"ServerSideApply=true"}},
+			{"replace", SyncAction{Apps: "[{name: a}]", Replace: true}, []string{"Replace=true"}},
+			{"both", SyncAction{Apps: "[{name: a}]", ServerSideApply: true, Replace: true}, []string{"ServerSideApply=true", "Replace=true"}},
+			{"merged with options", SyncAction{Apps: "[{name: a}]", Options: "[Validate=false]", ServerSideApply: true}, []string{"Validate=false", "ServerSideApply=true"}},
+			{"not duplicated", SyncAction{Apps: "[{name: a}]", Options: "[ServerSideApply=true, Replace=true]", ServerSideApply: true, Replace: true}, []string{"ServerSideApply=true", "Replace=true"}},
+			{"override options", SyncAction{Apps: "[{name: a}]", Options: "{ServerSideApply: false}", ServerSideApply: true}, []string{"ServerSideApply=true"}},
+			{"overridden by app options", SyncAction{Apps: "[{name: a, options: [Replace=false]}]", Replace: true}, []string{"Replace=false"}},
+		}
+		for _, testCase := range testCases {
+			testCase := testCase
+			t.Run(testCase.name, func(t *testing.T) {
+				t.Parallel()
+				_, appClient := newTestFakes(t, nil, nil)
+				_, err := syncAppsParallel(context.Background(), testCase.action, nil, "", 0, appClient, nil)
+				require.NoError(t, err)
+				require.Len(t, appClient.syncRequests, 1)
+				assert.Equal(t, testCase.expected, appClient.syncRequests[0].GetSyncOptions().GetItems())
+			})
+		}
+	})
+
+	t.Run("map options", func(t *testing.T) {
+		t.Parallel()
+		_, appClient := newTestFakes(t, nil, nil)
+		action := SyncAction{
+			Apps:    "[{name: a, options: {Replace: true}}]",
+			Options: "{ServerSideApply: true, Validate: false}",
+		}
+		_, err := syncAppsParallel(context.Background(), action, nil, "", 0, appClient, nil)
+		require.NoError(t, err)
+		require.Len(t, appClient.syncRequests, 1)
+		assert.Equal(t, []string{"ServerSideApply=true", "Validate=false", "Replace=true"}, appClient.syncRequests[0].GetSyncOptions().GetItems())
+	})
+}
+
+func TestSyncOptions_UnmarshalYAML(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		yaml     string
+		expected SyncOptions
+		err      string
+	}{
+		{name: "list", yaml: "[Prune=true, ServerSideApply=true]", expected: SyncOptions{"Prune=true", "ServerSideApply=true"}},
+		{name: "map", yaml: "{ServerSideApply: true, PrunePropagationPolicy: foreground}", expected: SyncOptions{"ServerSideApply=true", "PrunePropagationPolicy=foreground"}},
+		{name: "block map", yaml: "Validate: false\nReplace: true\n", expected: SyncOptions{"Validate=false", "Replace=true"}},
+		{name: "empty", yaml: "", expected: nil},
+		{name: "null", yaml: "~", expected: nil},
+		{name: "scalar", yaml: "Prune=true", err: "sync options must be a list, like `[Prune=true]`, or a map, like `{Prune: true}`, but got a single value"},
+		{name: "nested map value", yaml: "{Validate: false, Prune: [true]}", err: "sync option 1 must have a single value"},
+		{name: "nested list item", yaml: "[[Prune=true]]", err: "cannot unmarshal"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var options SyncOptions
+			err := yaml.Unmarshal([]byte(testCase.yaml), &options)
+			if testCase.err != "" {
+				require.ErrorContains(t, err, testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testCase.expected, options)
+		})
+	}
+}
+
+func Test_diffApps(t *testing.T) {
+	t.Parallel()
+
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+	newFakes := func(t *testing.T) (*fakeApiClient, *fakeAppClient) {
+		client, appClient := newTestFakes(t, live, target)
+		otherApp := *appClient.apps["my-app"]
+		otherApp.Name = "other-app"
+		appClient.apps["other-app"] = &otherApp
+		return client, appClient
+	}
+
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		action := DiffAction{Apps: "[{name: my-app}, {name: other-app, namespace: argocd}]"}
+		result, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.stats.Changed)
+		assert.Contains(t, result.diff, "===== app my-app =====\n")
+		assert.Contains(t, result.diff, "===== app argocd/other-app =====\n")
+		assert.Less(t, strings.Index(result.diff, "app my-app"), strings.Index(result.diff, "app argocd/other-app"), "apps are output in order")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		action := DiffAction{Apps: "[{name: other-app}, {name: my-app}]", OutputFormat: DiffOutputFormatJSON}
+		result, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		var diffs map[string]jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(result.diff), &diffs))
+		require.Len(t, diffs, 2)
+		for _, app := range []string{"my-app", "other-app"} {
+			assert.Equal(t, diffSummary{Modified: 1}, diffs[app].Summary)
+			require.Len(t, diffs[app].Resources, 1)
+			assert.Equal(t, "my-config", diffs[app].Resources[0].Name)
+		}
+	})
+
+	t.Run("json with a skipped app", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		appClient.apps["other-app"].Status.Conditions = []v1alpha1.ApplicationCondition{{Type: v1alpha1.ApplicationConditionComparisonError, Message: "boom"}}
+		action := DiffAction{Apps: "[{name: my-app}, {name: other-app}]", OutputFormat: DiffOutputFormatJSON, ErrorConditionPolicy: ErrorConditionPolicySkip}
+		result, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		var diffs map[string]jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(result.diff), &diffs))
+		require.Len(t, diffs, 2)
+		assert.Len(t, diffs["my-app"].Resources, 1)
+		assert.Equal(t, jsonDiff{Resources: []resourceDiff{}}, diffs["other-app"])
+		require.Len(t, result.warnings, 1)
+		assert.Contains(t, result.warnings[0], `app "other-app": skipped diff`)
+	})
+
+	t.Run("one app fails", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		action := DiffAction{Apps: "[{name: my-app}, {name: missing-app}, {name: other-app}]"}
+		result, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		var partial partialError
+		require.ErrorAs(t, err, &partial)
+		assert.ErrorContains(t, err, `failed to diff app "missing-app"`)
+		assert.Contains(t, result.diff, "===== app my-app =====")
+		assert.Contains(t, result.diff, "===== app other-app =====", "a failed app must not stop the rest being diffed")
+	})
+
+	t.Run("every app fails", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		action := DiffAction{Apps: "[{name: missing-app}, {name: gone-app}]"}
+		_, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		var partial partialError
+		require.Error(t, err)
+		assert.False(t, errors.As(err, &partial))
+		assert.ErrorContains(t, err, `"missing-app"`)
+		assert.ErrorContains(t, err, `"gone-app"`)
+	})
+
+	t.Run("output dir per app", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		dir := t.TempDir()
+		action := DiffAction{Apps: "[{name: my-app}, {name: other-app}]", OutputDir: dir}
+		result, err := diffApps(context.Background(), action, "", appClient, client.settingsClient, nil)
+		require.NoError(t, err)
+		require.Len(t, result.files, 2)
+		for _, app := range []string{"my-app", "other-app"} {
+			path := filepath.Join(app, "ConfigMap", "my-namespace", "my-config.diff")
+			written, err := os.ReadFile(filepath.Join(dir, path))
+			require.NoError(t, err)
+			assert.Equal(t, string(written), result.files[path])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newFakes(t)
+		_, err := diffApps(context.Background(), DiffAction{App: App{Name: "my-app"}, Apps: "[{name: other-app}]"}, "", appClient, client.settingsClient, nil)
+		assert.EqualError(t, err, "a diff action may set app or apps, but not both")
+		_, err = diffApps(context.Background(), DiffAction{Apps: "[]"}, "", appClient, client.settingsClient, nil)
+		assert.EqualError(t, err, "no apps to diff: the apps list is empty")
+		_, err = diffApps(context.Background(), DiffAction{Apps: "[{name: my-app}]", Resource: &ResourceRef{Kind: "ConfigMap", Name: "my-config"}}, "", appClient, client.settingsClient, nil)
+		assert.ErrorContains(t, err, "resource can't be combined with apps")
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("runAction outputs the apps which were diffed", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newFakes(t)
+		e := NewApiExecutor(client, "")
+		action := ActionSpec{App: &AppActionSpec{Diff: &DiffAction{Apps: "[{name: my-app}, {name: missing-app}]"}}}
+		result, err := e.runAction(context.Background(), action)
+		require.ErrorContains(t, err, "failed to diff apps")
+		assert.Contains(t, result.output, "===== app my-app =====")
+	})
 }
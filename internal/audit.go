@@ -0,0 +1,61 @@
+package argocd
+
+import (
+	"context"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+)
+
+// auditInfo identifies what requested an action, so that it can be recorded in Argo CD's operation history. The Argo CD
+// API doesn't support impersonation, so operations are still initiated by the plugin's token.
+type auditInfo struct {
+	workflow executor.ObjectMeta
+	// identity is the action's Identity, if it set one. The workflow's author chooses it, so nothing vouches for it.
+	identity string
+}
+
+// unverifiedIdentityInfo is the name of the operation info holding the identity an action claims to act for. It says
+// that the identity is unverified, so that it isn't mistaken for who started the operation.
+const unverifiedIdentityInfo = "Requested identity (unverified)"
+
+func newAuditInfo(workflow *executor.Workflow, identity string) auditInfo {
+	info := auditInfo{identity: identity}
+	if workflow != nil {
+		info.workflow = workflow.ObjectMeta
+	}
+	return info
+}
+
+// operationInfos returns the infos to attach to an operation, which Argo CD shows in the app's operation history.
+func (a auditInfo) operationInfos() []*v1alpha1.Info {
+	var infos []*v1alpha1.Info
+	if a.workflow.Name != "" {
+		name := a.workflow.Name
+		if a.workflow.Namespace != "" {
+			name = a.workflow.Namespace + "/" + name
+		}
+		infos = append(infos, &v1alpha1.Info{Name: "Workflow", Value: name})
+	}
+	if a.workflow.Uid != "" {
+		infos = append(infos, &v1alpha1.Info{Name: "Workflow UID", Value: a.workflow.Uid})
+	}
+	if a.identity != "" {
+		infos = append(infos, &v1alpha1.Info{Name: unverifiedIdentityInfo, Value: a.identity})
+	}
+	return infos
+}
+
+type auditInfoKey struct{}
+
+// contextWithAuditInfo returns a copy of ctx which carries info, so that the operations started while handling a
+// request record what requested them.
+func contextWithAuditInfo(ctx context.Context, info auditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+// auditInfoFrom returns the audit info carried by ctx, which is empty if there isn't any.
+func auditInfoFrom(ctx context.Context) auditInfo {
+	info, _ := ctx.Value(auditInfoKey{}).(auditInfo)
+	return info
+}
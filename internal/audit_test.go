@@ -0,0 +1,54 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_auditInfo_operationInfos(t *testing.T) {
+	t.Parallel()
+
+	workflow := &executor.Workflow{ObjectMeta: executor.ObjectMeta{Name: "deploy-abc12", Namespace: "argo", Uid: "1234"}}
+	assert.Equal(t, []*v1alpha1.Info{
+		{Name: "Workflow", Value: "argo/deploy-abc12"},
+		{Name: "Workflow UID", Value: "1234"},
+		{Name: unverifiedIdentityInfo, Value: "svc-deployer"},
+	}, newAuditInfo(workflow, "svc-deployer").operationInfos())
+	assert.Equal(t, []*v1alpha1.Info{{Name: "Workflow", Value: "argo/deploy-abc12"}, {Name: "Workflow UID", Value: "1234"}},
+		newAuditInfo(workflow, "").operationInfos())
+	assert.Nil(t, newAuditInfo(nil, "").operationInfos())
+}
+
+func Test_auditInfoFrom(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, auditInfo{}, auditInfoFrom(context.Background()))
+	info := newAuditInfo(nil, "svc-deployer")
+	assert.Equal(t, info, auditInfoFrom(contextWithAuditInfo(context.Background(), info)))
+}
+
+func TestApiExecutor_Execute_auditInfo(t *testing.T) {
+	t.Parallel()
+
+	client, appClient := newTestFakes(t, nil, nil)
+	e := NewApiExecutor(client, "token")
+	reply := e.Execute(executor.ExecuteTemplateArgs{
+		Workflow: &executor.Workflow{ObjectMeta: executor.ObjectMeta{Name: "deploy-abc12", Namespace: "argo", Uid: "1234"}},
+		Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(
+			`{"argocd": {"identity": "svc-deployer", "app": {"sync": {"apps": "[{name: my-app}]"}}}}`)}}},
+	})
+	require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+	require.Len(t, appClient.syncRequests, 1)
+	assert.Equal(t, []*v1alpha1.Info{
+		{Name: "Workflow", Value: "argo/deploy-abc12"},
+		{Name: "Workflow UID", Value: "1234"},
+		{Name: unverifiedIdentityInfo, Value: "svc-deployer"},
+	}, appClient.syncRequests[0].GetInfos())
+}
@@ -0,0 +1,281 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	repoapiclient "github.com/argoproj/argo-cd/v2/reposerver/apiclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultCircuitBreakerCooldown is how long the circuit stays open if the config doesn't say.
+const DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// CircuitBreakerConfig configures the circuit breaker around Argo CD API calls. While the API server is degraded, the
+// breaker fails calls right away instead of adding to its load, across all actions.
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive calls failing with Unavailable or ResourceExhausted which opens the
+	// circuit. Zero or less disables the breaker.
+	Threshold int
+	// Cooldown is how long the circuit stays open before a single call is let through to check whether the API server
+	// has recovered. Defaults to DefaultCircuitBreakerCooldown.
+	Cooldown time.Duration
+}
+
+// ParseCircuitBreakerConfig parses a YAML circuit breaker config like the following.
+//
+//	threshold: 5
+//	cooldown: 1m
+func ParseCircuitBreakerConfig(configYAML string) (CircuitBreakerConfig, error) {
+	var raw struct {
+		Threshold int    `yaml:"threshold"`
+		Cooldown  string `yaml:"cooldown"`
+	}
+	err := yaml.Unmarshal([]byte(configYAML), &raw)
+	if err != nil {
+		return CircuitBreakerConfig{}, fmt.Errorf("failed to unmarshal circuit breaker config: %w", err)
+	}
+	if raw.Threshold < 0 {
+		return CircuitBreakerConfig{}, errors.New("circuit breaker threshold must not be negative")
+	}
+	config := CircuitBreakerConfig{Threshold: raw.Threshold, Cooldown: DefaultCircuitBreakerCooldown}
+	if raw.Cooldown != "" {
+		config.Cooldown, err = time.ParseDuration(raw.Cooldown)
+		if err != nil {
+			return CircuitBreakerConfig{}, fmt.Errorf("failed to parse circuit breaker cooldown: %w", err)
+		}
+		if config.Cooldown <= 0 {
+			return CircuitBreakerConfig{}, errors.New("circuit breaker cooldown must be positive")
+		}
+	}
+	return config, nil
+}
+
+// circuitState is the state of a circuitBreaker. Its values are the ones reported by the circuit state metric.
+type circuitState int
+
+const (
+	// circuitClosed lets every call through.
+	circuitClosed circuitState = iota
+	// circuitOpen fails every call until the cooldown has passed.
+	circuitOpen
+	// circuitHalfOpen lets a single call through to check whether the API server has recovered, and fails the others.
+	circuitHalfOpen
+)
+
+// circuitBreaker counts consecutive failed API calls and opens once they reach the threshold. It's shared by every
+// action, and the config is passed to each call, so that reloading the config takes effect right away.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// metrics, if set, records the breaker's state.
+	metrics *Metrics
+}
+
+// do runs call unless the circuit is open, and records whether it failed because the API server is degraded.
+func (b *circuitBreaker) do(ctx context.Context, config CircuitBreakerConfig, call func() error) error {
+	if config.Threshold <= 0 {
+		return call()
+	}
+	err := b.allow(config)
+	if err != nil {
+		return err
+	}
+	err = call()
+	b.record(ctx, config, err)
+	return err
+}
+
+// allow returns an error if the circuit is open, or if it's half-open and another call is already checking whether the
+// API server has recovered.
+func (b *circuitBreaker) allow(config CircuitBreakerConfig) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		cooldown := config.Cooldown
+		if cooldown <= 0 {
+			cooldown = DefaultCircuitBreakerCooldown
+		}
+		if retryAt := b.openedAt.Add(cooldown); time.Now().Before(retryAt) {
+			return fmt.Errorf("%w: %d consecutive Argo CD API calls failed, so calls are paused until %s", errCircuitOpen, b.failures, retryAt.UTC().Format(time.RFC3339))
+		}
+		b.setStateLocked(circuitHalfOpen)
+	case circuitHalfOpen:
+		return fmt.Errorf("%w: waiting for another call to find out whether the Argo CD API has recovered", errCircuitOpen)
+	}
+	return nil
+}
+
+// record records the outcome of a call which allow let through. Calls which failed because their own context was done
+// say nothing about the API server, so they're not counted.
+func (b *circuitBreaker) record(ctx context.Context, config CircuitBreakerConfig, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil && ctx.Err() != nil {
+		if b.state == circuitHalfOpen {
+			// Let the next call check instead. The cooldown has already passed.
+			b.setStateLocked(circuitOpen)
+		}
+		return
+	}
+	if !isServerFailure(err) {
+		b.failures = 0
+		b.setStateLocked(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= config.Threshold {
+		b.openedAt = time.Now()
+		b.setStateLocked(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setStateLocked(state circuitState) {
+	b.state = state
+	b.metrics.setCircuitState(state)
+}
+
+// isServerFailure reports whether err means the API server is unavailable or overloaded. Other errors, like NotFound,
+// show that the server is responding.
+func isServerFailure(err error) bool {
+	code := grpcCode(err)
+	return err != nil && (code == codes.Unavailable || code == codes.ResourceExhausted)
+}
+
+// circuitAppClient passes Application API calls through a circuitBreaker.
+type circuitAppClient struct {
+	application.ApplicationServiceClient
+	breaker *circuitBreaker
+	config  CircuitBreakerConfig
+}
+
+func (c *circuitAppClient) List(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (list *v1alpha1.ApplicationList, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		list, err = c.ApplicationServiceClient.List(ctx, in, opts...)
+		return err
+	})
+	return list, err
+}
+
+func (c *circuitAppClient) Get(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		app, err = c.ApplicationServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *circuitAppClient) Create(ctx context.Context, in *application.ApplicationCreateRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		app, err = c.ApplicationServiceClient.Create(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *circuitAppClient) Delete(ctx context.Context, in *application.ApplicationDeleteRequest, opts ...grpc.CallOption) (res *application.ApplicationResponse, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.ApplicationServiceClient.Delete(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *circuitAppClient) GetManifests(ctx context.Context, in *application.ApplicationManifestQuery, opts ...grpc.CallOption) (res *repoapiclient.ManifestResponse, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.ApplicationServiceClient.GetManifests(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *circuitAppClient) ManagedResources(ctx context.Context, in *application.ResourcesQuery, opts ...grpc.CallOption) (res *application.ManagedResourcesResponse, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.ApplicationServiceClient.ManagedResources(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *circuitAppClient) Patch(ctx context.Context, in *application.ApplicationPatchRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		app, err = c.ApplicationServiceClient.Patch(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *circuitAppClient) RevisionMetadata(ctx context.Context, in *application.RevisionMetadataQuery, opts ...grpc.CallOption) (metadata *v1alpha1.RevisionMetadata, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		metadata, err = c.ApplicationServiceClient.RevisionMetadata(ctx, in, opts...)
+		return err
+	})
+	return metadata, err
+}
+
+func (c *circuitAppClient) Rollback(ctx context.Context, in *application.ApplicationRollbackRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		app, err = c.ApplicationServiceClient.Rollback(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *circuitAppClient) Sync(ctx context.Context, in *application.ApplicationSyncRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		app, err = c.ApplicationServiceClient.Sync(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *circuitAppClient) TerminateOperation(ctx context.Context, in *application.OperationTerminateRequest, opts ...grpc.CallOption) (res *application.OperationTerminateResponse, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.ApplicationServiceClient.TerminateOperation(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+// circuitSettingsClient passes Settings API calls through a circuitBreaker.
+type circuitSettingsClient struct {
+	settings.SettingsServiceClient
+	breaker *circuitBreaker
+	config  CircuitBreakerConfig
+}
+
+func (c *circuitSettingsClient) Get(ctx context.Context, in *settings.SettingsQuery, opts ...grpc.CallOption) (res *settings.Settings, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.SettingsServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+// circuitVersionClient passes Version API calls through a circuitBreaker.
+type circuitVersionClient struct {
+	version.VersionServiceClient
+	breaker *circuitBreaker
+	config  CircuitBreakerConfig
+}
+
+func (c *circuitVersionClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (res *version.VersionMessage, err error) {
+	err = c.breaker.do(ctx, c.config, func() error {
+		res, err = c.VersionServiceClient.Version(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
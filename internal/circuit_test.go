@@ -0,0 +1,152 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCircuitBreakerConfig(t *testing.T) {
+	t.Parallel()
+
+	config, err := ParseCircuitBreakerConfig("threshold: 5\ncooldown: 1m\n")
+	require.NoError(t, err)
+	assert.Equal(t, CircuitBreakerConfig{Threshold: 5, Cooldown: time.Minute}, config)
+
+	config, err = ParseCircuitBreakerConfig("threshold: 5\n")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCircuitBreakerCooldown, config.Cooldown)
+
+	testCases := []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{"negative threshold", "threshold: -1\n", "threshold must not be negative"},
+		{"invalid cooldown", "threshold: 5\ncooldown: soon\n", "failed to parse circuit breaker cooldown"},
+		{"zero cooldown", "threshold: 5\ncooldown: 0s\n", "cooldown must be positive"},
+		{"not YAML", "threshold: [", "failed to unmarshal circuit breaker config"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := ParseCircuitBreakerConfig(testCase.yaml)
+			require.ErrorContains(t, err, testCase.expected)
+		})
+	}
+}
+
+func Test_circuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	notFound := status.Error(codes.NotFound, "not found")
+	failWith := func(err error) func() error {
+		return func() error { return err }
+	}
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		t.Parallel()
+		registry := prometheus.NewRegistry()
+		metrics, err := NewMetrics(registry)
+		require.NoError(t, err)
+		b := &circuitBreaker{metrics: metrics}
+		config := CircuitBreakerConfig{Threshold: 2, Cooldown: time.Hour}
+		ctx := context.Background()
+
+		assert.Equal(t, unavailable, b.do(ctx, config, failWith(unavailable)))
+		assert.Equal(t, unavailable, b.do(ctx, config, failWith(unavailable)))
+		assert.Equal(t, float64(circuitOpen), testutil.ToFloat64(metrics.circuitState))
+		called := false
+		err = b.do(ctx, config, func() error {
+			called = true
+			return nil
+		})
+		require.ErrorIs(t, err, errCircuitOpen)
+		assert.ErrorContains(t, err, "2 consecutive Argo CD API calls failed")
+		assert.False(t, called, "calls must fail without being made while the circuit is open")
+		assert.Equal(t, errorCategoryTransient, categorizeError(err))
+	})
+
+	t.Run("other errors reset the count", func(t *testing.T) {
+		t.Parallel()
+		b := &circuitBreaker{}
+		config := CircuitBreakerConfig{Threshold: 2, Cooldown: time.Hour}
+		ctx := context.Background()
+		_ = b.do(ctx, config, failWith(unavailable))
+		_ = b.do(ctx, config, failWith(notFound))
+		_ = b.do(ctx, config, failWith(unavailable))
+		assert.NoError(t, b.do(ctx, config, failWith(nil)))
+		assert.Equal(t, circuitClosed, b.state)
+	})
+
+	t.Run("cancelled calls aren't counted", func(t *testing.T) {
+		t.Parallel()
+		b := &circuitBreaker{}
+		config := CircuitBreakerConfig{Threshold: 1, Cooldown: time.Hour}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = b.do(ctx, config, failWith(status.FromContextError(ctx.Err()).Err()))
+		assert.Equal(t, circuitClosed, b.state)
+	})
+
+	t.Run("half-open", func(t *testing.T) {
+		t.Parallel()
+		b := &circuitBreaker{}
+		config := CircuitBreakerConfig{Threshold: 1, Cooldown: time.Millisecond}
+		ctx := context.Background()
+		_ = b.do(ctx, config, failWith(unavailable))
+		require.Equal(t, circuitOpen, b.state)
+		time.Sleep(5 * time.Millisecond)
+
+		// A failed check reopens the circuit.
+		assert.Equal(t, unavailable, b.do(ctx, config, failWith(unavailable)))
+		assert.Equal(t, circuitOpen, b.state)
+		time.Sleep(5 * time.Millisecond)
+
+		// Other calls fail while one is checking, and a successful check closes the circuit.
+		err := b.do(ctx, config, func() error {
+			assert.ErrorIs(t, b.do(ctx, config, failWith(nil)), errCircuitOpen)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, circuitClosed, b.state)
+		assert.NoError(t, b.do(ctx, config, failWith(nil)))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		var b *circuitBreaker
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, unavailable, b.do(context.Background(), CircuitBreakerConfig{}, failWith(unavailable)))
+		}
+	})
+}
+
+func TestApiExecutor_circuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	client, appClient := newTestFakes(t, nil, nil)
+	appClient.err = status.Error(codes.Unavailable, "connection refused")
+	e := NewApiExecutor(client, "", WithRetryPolicy(RetryPolicy{}), WithCircuitBreaker(CircuitBreakerConfig{Threshold: 2, Cooldown: time.Hour}))
+	action := ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app"}}}}
+	for i := 0; i < 2; i++ {
+		_, err := e.runAction(context.Background(), action)
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, errCircuitOpen))
+	}
+	calls := len(appClient.calls)
+
+	_, err := e.runAction(context.Background(), action)
+	require.ErrorIs(t, err, errCircuitOpen)
+	assert.Len(t, appClient.calls, calls, "no API call may be made while the circuit is open")
+}
@@ -0,0 +1,134 @@
+package argocd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	argoio "github.com/argoproj/argo-cd/v2/util/io"
+)
+
+// serviceClients are the Argo CD service clients actions call. Each one holds a connection to the API server, so
+// they're shared by concurrent actions instead of being created for every action.
+type serviceClients struct {
+	appClient      application.ApplicationServiceClient
+	settingsClient settings.SettingsServiceClient
+	versionClient  version.VersionServiceClient
+	closers        []io.Closer
+	// refs is the number of actions using the clients, and retired is set once they're replaced. The connections are
+	// closed once both are true, so that replacing the clients doesn't break the actions still using them. Both are
+	// guarded by the apiClientHolder's mutex.
+	refs    int
+	retired bool
+}
+
+func newServiceClients(apiClient apiclient.Client) (*serviceClients, error) {
+	appCloser, appClient, err := apiClient.NewApplicationClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Application API client: %w", err)
+	}
+	settingsCloser, settingsClient, err := apiClient.NewSettingsClient()
+	if err != nil {
+		argoio.Close(appCloser)
+		return nil, fmt.Errorf("failed to initialize Settings API client: %w", err)
+	}
+	versionCloser, versionClient, err := apiClient.NewVersionClient()
+	if err != nil {
+		argoio.Close(appCloser)
+		argoio.Close(settingsCloser)
+		return nil, fmt.Errorf("failed to initialize Version API client: %w", err)
+	}
+	return &serviceClients{
+		appClient:      appClient,
+		settingsClient: settingsClient,
+		versionClient:  versionClient,
+		closers:        []io.Closer{appCloser, settingsCloser, versionCloser},
+	}, nil
+}
+
+func (c *serviceClients) close() {
+	for _, closer := range c.closers {
+		argoio.Close(closer)
+	}
+}
+
+// apiClientHolder holds the current API client, which is replaced when the auth token is reloaded, and the service
+// clients created from it.
+type apiClientHolder struct {
+	mu      sync.RWMutex
+	client  apiclient.Client
+	clients *serviceClients
+}
+
+func (h *apiClientHolder) get() apiclient.Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.client
+}
+
+// set replaces the API client. Service clients created from the old one are closed once no action is using them.
+func (h *apiClientHolder) set(client apiclient.Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.client = client
+	h.retireLocked(h.clients)
+}
+
+// acquire returns the service clients, creating them if they don't exist yet, and a function to call once the caller
+// is done with them.
+func (h *apiClientHolder) acquire() (*serviceClients, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client == nil {
+		return nil, nil, errors.New("Argo CD API client isn't initialized")
+	}
+	if h.clients == nil {
+		clients, err := newServiceClients(h.client)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.clients = clients
+	}
+	clients := h.clients
+	clients.refs++
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			clients.refs--
+			if clients.retired && clients.refs == 0 {
+				clients.close()
+			}
+		})
+	}
+	return clients, release, nil
+}
+
+// invalidate discards the given service clients if they're still the current ones, so that the next action creates
+// new ones. It's called when the API server can't be reached, in case the connection is broken.
+func (h *apiClientHolder) invalidate(clients *serviceClients) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients == clients {
+		h.retireLocked(clients)
+	}
+}
+
+func (h *apiClientHolder) retireLocked(clients *serviceClients) {
+	if clients == nil {
+		return
+	}
+	if h.clients == clients {
+		h.clients = nil
+	}
+	clients.retired = true
+	if clients.refs == 0 {
+		clients.close()
+	}
+}
@@ -0,0 +1,206 @@
+package argocd
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// countingApiClient is a fakeApiClient which counts the service clients created from it and how many were closed. If
+// addr is set, each service client also opens a real gRPC connection to it, like the Argo CD API client does.
+type countingApiClient struct {
+	*fakeApiClient
+	addr    string
+	mu      sync.Mutex
+	created int
+	closed  int
+}
+
+func (c *countingApiClient) NewApplicationClient() (io.Closer, application.ApplicationServiceClient, error) {
+	closer, err := c.open()
+	return closer, c.appClient, err
+}
+
+func (c *countingApiClient) NewSettingsClient() (io.Closer, settings.SettingsServiceClient, error) {
+	closer, err := c.open()
+	return closer, c.settingsClient, err
+}
+
+func (c *countingApiClient) NewVersionClient() (io.Closer, version.VersionServiceClient, error) {
+	closer, err := c.open()
+	return closer, c.versionClient, err
+}
+
+func (c *countingApiClient) open() (io.Closer, error) {
+	c.mu.Lock()
+	c.created++
+	c.mu.Unlock()
+	closer := &countingCloser{client: c}
+	if c.addr != "" {
+		conn, err := grpc.Dial(c.addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		if err != nil {
+			return nil, err
+		}
+		closer.conn = conn
+	}
+	return closer, nil
+}
+
+func (c *countingApiClient) counts() (created, closed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.created, c.closed
+}
+
+type countingCloser struct {
+	client *countingApiClient
+	conn   *grpc.ClientConn
+}
+
+func (c *countingCloser) Close() error {
+	c.client.mu.Lock()
+	c.client.closed++
+	c.client.mu.Unlock()
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+func newCountingFakes(t testing.TB) (*countingApiClient, *fakeAppClient) {
+	t.Helper()
+	client, appClient := newTestFakes(t, nil, nil)
+	return &countingApiClient{fakeApiClient: client}, appClient
+}
+
+var refreshAction = ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app"}}}}
+
+func TestApiExecutor_runAction_reusesClients(t *testing.T) {
+	t.Parallel()
+
+	t.Run("concurrent actions", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newCountingFakes(t)
+		e := NewApiExecutor(client, "")
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := e.runAction(context.Background(), refreshAction)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		created, closed := client.counts()
+		assert.Equal(t, 3, created, "the application, settings, and version clients must be created once")
+		assert.Equal(t, 0, closed)
+	})
+
+	t.Run("recreated when unavailable", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newCountingFakes(t)
+		e := NewApiExecutor(client, "", WithRetryPolicy(RetryPolicy{}))
+		appClient.err = status.Error(codes.Unavailable, "connection refused")
+		_, err := e.runAction(context.Background(), refreshAction)
+		require.Error(t, err)
+		created, closed := client.counts()
+		assert.Equal(t, 3, created)
+		assert.Equal(t, 3, closed, "clients must be closed after the connection fails")
+
+		appClient.err = nil
+		_, err = e.runAction(context.Background(), refreshAction)
+		require.NoError(t, err)
+		created, _ = client.counts()
+		assert.Equal(t, 6, created)
+	})
+
+	t.Run("other errors keep the clients", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newCountingFakes(t)
+		e := NewApiExecutor(client, "")
+		_, err := e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "missing"}}}})
+		require.Error(t, err)
+		_, err = e.runAction(context.Background(), refreshAction)
+		require.NoError(t, err)
+		created, closed := client.counts()
+		assert.Equal(t, 3, created)
+		assert.Equal(t, 0, closed)
+	})
+}
+
+func Test_apiClientHolder(t *testing.T) {
+	t.Parallel()
+
+	t.Run("replaced clients are closed once released", func(t *testing.T) {
+		t.Parallel()
+		oldClient, _ := newCountingFakes(t)
+		newClient, _ := newCountingFakes(t)
+		holder := &apiClientHolder{client: oldClient}
+		oldClients, release, err := holder.acquire()
+		require.NoError(t, err)
+
+		holder.set(newClient)
+		_, closed := oldClient.counts()
+		assert.Equal(t, 0, closed, "clients in use must not be closed")
+		newClients, releaseNew, err := holder.acquire()
+		require.NoError(t, err)
+		assert.NotSame(t, oldClients, newClients)
+
+		release()
+		release()
+		_, closed = oldClient.counts()
+		assert.Equal(t, 3, closed)
+		releaseNew()
+		_, closed = newClient.counts()
+		assert.Equal(t, 0, closed)
+	})
+
+	t.Run("not initialized", func(t *testing.T) {
+		t.Parallel()
+		_, _, err := (&apiClientHolder{}).acquire()
+		require.ErrorContains(t, err, "API client isn't initialized")
+	})
+}
+
+// BenchmarkApiExecutor_runAction measures the per-action overhead of creating the service clients, each of which
+// opens a gRPC connection, compared to sharing them.
+func BenchmarkApiExecutor_runAction(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	server := grpc.NewServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	for name, shared := range map[string]bool{"shared clients": true, "new clients per action": false} {
+		b.Run(name, func(b *testing.B) {
+			client, _ := newCountingFakes(b)
+			client.addr = listener.Addr().String()
+			e := NewApiExecutor(client, "")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := e.runAction(context.Background(), refreshAction)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !shared {
+					e.apiClient.set(client)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package argocd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PluginConfig is the plugin's config file. Its startup section is only read when the plugin starts, and its executor
+// section is read again whenever the config is reloaded.
+type PluginConfig struct {
+	Startup  StartupConfig
+	Executor ExecutorConfig
+}
+
+// DefaultPluginConfig returns the config used when nothing is configured.
+func DefaultPluginConfig() PluginConfig {
+	return PluginConfig{
+		Startup:  DefaultStartupConfig(),
+		Executor: DefaultExecutorConfig(),
+	}
+}
+
+// ParsePluginConfig parses a YAML or JSON config file like the following on top of base. The startup and executor
+// sections use the same format as ParseStartupConfig and ParseExecutorConfig, and may each be left out.
+//
+//	startup:
+//	  server: argocd-server.argocd.svc.cluster.local
+//	  logLevel: debug
+//	executor:
+//	  maxSyncApps: 200
+//	  defaultTimeout: 1h
+func ParsePluginConfig(configYAML string, base PluginConfig) (PluginConfig, error) {
+	var raw map[string]yaml.Node
+	err := yaml.Unmarshal([]byte(configYAML), &raw)
+	if err != nil {
+		return PluginConfig{}, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	// Settings outside of a section would be silently ignored otherwise.
+	var unknown []string
+	for key := range raw {
+		if key != "startup" && key != "executor" {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return PluginConfig{}, fmt.Errorf("unknown config keys %s: settings must be under startup or executor", strings.Join(unknown, ", "))
+	}
+	startup, executor := raw["startup"], raw["executor"]
+	config := base
+	if !startup.IsZero() {
+		startupYAML, err := yaml.Marshal(&startup)
+		if err != nil {
+			return PluginConfig{}, fmt.Errorf("failed to marshal startup config: %w", err)
+		}
+		config.Startup, err = ParseStartupConfig(string(startupYAML), config.Startup)
+		if err != nil {
+			return PluginConfig{}, err
+		}
+	}
+	if !executor.IsZero() {
+		executorYAML, err := yaml.Marshal(&executor)
+		if err != nil {
+			return PluginConfig{}, fmt.Errorf("failed to marshal executor config: %w", err)
+		}
+		config.Executor, err = ParseExecutorConfig(string(executorYAML), config.Executor)
+		if err != nil {
+			return PluginConfig{}, err
+		}
+	}
+	return config, nil
+}
+
+// LoadPluginConfig parses configYAML, which may be empty, on top of the defaults, overrides it with the environment
+// variables read with getenv, as described by ApplyStartupEnv and ApplyExecutorEnv, and validates the result.
+func LoadPluginConfig(configYAML string, getenv func(string) string) (PluginConfig, error) {
+	config, err := ParsePluginConfig(configYAML, DefaultPluginConfig())
+	if err != nil {
+		return PluginConfig{}, err
+	}
+	config.Startup, err = ApplyStartupEnv(config.Startup, getenv)
+	if err != nil {
+		return PluginConfig{}, err
+	}
+	config.Executor, err = ApplyExecutorEnv(config.Executor, getenv)
+	if err != nil {
+		return PluginConfig{}, err
+	}
+	err = config.Startup.Validate()
+	if err != nil {
+		return PluginConfig{}, fmt.Errorf("invalid startup config: %w", err)
+	}
+	return config, nil
+}
+
+// ExecutorConfig holds the executor settings which can be reloaded while the plugin is running.
+type ExecutorConfig struct {
+	// MaxSyncApps is the maximum number of apps a single sync action may target. Zero or less means no limit.
+	MaxSyncApps int
+	// RetryPolicy decides which failed API calls are retried.
+	RetryPolicy RetryPolicy
+	// Defaults are applied to actions which don't set their own timeout or concurrency.
+	Defaults DefaultsConfig
+	// DefaultTimeout is the timeout of actions which don't set their own and don't get one from Defaults. Zero or less
+	// means no timeout.
+	DefaultTimeout time.Duration
+	// Allowlist restricts the apps actions may target. Empty means any app.
+	Allowlist Allowlist
+	// MaxDiffOutputBytes caps the size of the output of diff actions, and of the manifests sync actions record, which
+	// don't set their own cap. Zero or less means no limit.
+	MaxDiffOutputBytes int
+	// CircuitBreaker configures the circuit breaker around Argo CD API calls. It's disabled by default.
+	CircuitBreaker CircuitBreakerConfig
+	// ValueFileDir is the directory which values with the file source, like a sync action's apps, are read from. Files
+	// outside of it can't be read. Empty means values can't be read from files.
+	ValueFileDir string
+	// OutputBaseDir is the directory which actions' output directories, like a diff action's outputDir, are created
+	// under. Empty means actions can't write files.
+	OutputBaseDir string
+}
+
+// DefaultExecutorConfig returns the config used when nothing is configured.
+func DefaultExecutorConfig() ExecutorConfig {
+	return ExecutorConfig{
+		MaxSyncApps: DefaultMaxSyncApps,
+		RetryPolicy: DefaultRetryPolicy,
+	}
+}
+
+// ParseExecutorConfig parses a YAML config like the following on top of base. Top-level fields which aren't set keep
+// their value from base. retryPolicy, defaults, allowlist, and circuitBreaker use the same format as ParseRetryPolicy,
+// ParseDefaultsConfig, ParseAllowlist, and ParseCircuitBreakerConfig.
+//
+//	maxSyncApps: 200
+//	retryPolicy:
+//	  limit: 5
+//	  backoffs:
+//	    Unavailable: 200ms
+//	defaults:
+//	  timeout: 5m
+//	defaultTimeout: 1h
+//	allowlist:
+//	- project: payments
+//	maxDiffOutputBytes: 262144
+//	circuitBreaker:
+//	  threshold: 5
+//	  cooldown: 1m
+//	valueFileDir: /var/run/argocd-plugin/values
+//	outputBaseDir: /var/run/argocd-plugin/outputs
+func ParseExecutorConfig(configYAML string, base ExecutorConfig) (ExecutorConfig, error) {
+	var raw struct {
+		MaxSyncApps        *int      `yaml:"maxSyncApps"`
+		RetryPolicy        yaml.Node `yaml:"retryPolicy"`
+		Defaults           yaml.Node `yaml:"defaults"`
+		DefaultTimeout     *string   `yaml:"defaultTimeout"`
+		Allowlist          yaml.Node `yaml:"allowlist"`
+		MaxDiffOutputBytes *int      `yaml:"maxDiffOutputBytes"`
+		CircuitBreaker     yaml.Node `yaml:"circuitBreaker"`
+		ValueFileDir       *string   `yaml:"valueFileDir"`
+		OutputBaseDir      *string   `yaml:"outputBaseDir"`
+	}
+	err := yaml.Unmarshal([]byte(configYAML), &raw)
+	if err != nil {
+		return ExecutorConfig{}, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	config := base
+	if raw.MaxSyncApps != nil {
+		config.MaxSyncApps = *raw.MaxSyncApps
+	}
+	if !raw.RetryPolicy.IsZero() {
+		policyYAML, err := yaml.Marshal(&raw.RetryPolicy)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to marshal retry policy: %w", err)
+		}
+		config.RetryPolicy, err = ParseRetryPolicy(string(policyYAML))
+		if err != nil {
+			return ExecutorConfig{}, err
+		}
+	}
+	if !raw.Defaults.IsZero() {
+		defaultsYAML, err := yaml.Marshal(&raw.Defaults)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to marshal defaults: %w", err)
+		}
+		config.Defaults, err = ParseDefaultsConfig(string(defaultsYAML))
+		if err != nil {
+			return ExecutorConfig{}, err
+		}
+	}
+	if raw.DefaultTimeout != nil {
+		config.DefaultTimeout, err = time.ParseDuration(*raw.DefaultTimeout)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse defaultTimeout: %w", err)
+		}
+	}
+	if !raw.Allowlist.IsZero() {
+		allowlistYAML, err := yaml.Marshal(&raw.Allowlist)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to marshal allowlist: %w", err)
+		}
+		config.Allowlist, err = ParseAllowlist(string(allowlistYAML))
+		if err != nil {
+			return ExecutorConfig{}, err
+		}
+	}
+	if raw.MaxDiffOutputBytes != nil {
+		config.MaxDiffOutputBytes = *raw.MaxDiffOutputBytes
+	}
+	if !raw.CircuitBreaker.IsZero() {
+		circuitBreakerYAML, err := yaml.Marshal(&raw.CircuitBreaker)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to marshal circuit breaker config: %w", err)
+		}
+		config.CircuitBreaker, err = ParseCircuitBreakerConfig(string(circuitBreakerYAML))
+		if err != nil {
+			return ExecutorConfig{}, err
+		}
+	}
+	if raw.ValueFileDir != nil {
+		config.ValueFileDir = *raw.ValueFileDir
+	}
+	if raw.OutputBaseDir != nil {
+		config.OutputBaseDir = *raw.OutputBaseDir
+	}
+	return config, nil
+}
+
+// ApplyExecutorEnv overrides config with the environment variables which are set, read with getenv:
+// PLUGIN_MAX_SYNC_APPS, PLUGIN_RETRY_POLICY, PLUGIN_DEFAULTS, PLUGIN_DEFAULT_TIMEOUT, PLUGIN_ALLOWLIST,
+// PLUGIN_MAX_DIFF_OUTPUT_BYTES, PLUGIN_CIRCUIT_BREAKER, PLUGIN_VALUE_FILE_DIR, and PLUGIN_OUTPUT_BASE_DIR. The YAML
+// ones use the same format as the matching fields of ParseExecutorConfig.
+func ApplyExecutorEnv(config ExecutorConfig, getenv func(string) string) (ExecutorConfig, error) {
+	var err error
+	if maxSyncApps := getenv("PLUGIN_MAX_SYNC_APPS"); maxSyncApps != "" {
+		config.MaxSyncApps, err = strconv.Atoi(maxSyncApps)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_MAX_SYNC_APPS: %w", err)
+		}
+	}
+	if retryPolicy := getenv("PLUGIN_RETRY_POLICY"); retryPolicy != "" {
+		config.RetryPolicy, err = ParseRetryPolicy(retryPolicy)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_RETRY_POLICY: %w", err)
+		}
+	}
+	if defaults := getenv("PLUGIN_DEFAULTS"); defaults != "" {
+		config.Defaults, err = ParseDefaultsConfig(defaults)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_DEFAULTS: %w", err)
+		}
+	}
+	if defaultTimeout := getenv("PLUGIN_DEFAULT_TIMEOUT"); defaultTimeout != "" {
+		config.DefaultTimeout, err = time.ParseDuration(defaultTimeout)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_DEFAULT_TIMEOUT: %w", err)
+		}
+	}
+	if allowlist := getenv("PLUGIN_ALLOWLIST"); allowlist != "" {
+		config.Allowlist, err = ParseAllowlist(allowlist)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_ALLOWLIST: %w", err)
+		}
+	}
+	if maxBytes := getenv("PLUGIN_MAX_DIFF_OUTPUT_BYTES"); maxBytes != "" {
+		config.MaxDiffOutputBytes, err = strconv.Atoi(maxBytes)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_MAX_DIFF_OUTPUT_BYTES: %w", err)
+		}
+	}
+	if circuitBreaker := getenv("PLUGIN_CIRCUIT_BREAKER"); circuitBreaker != "" {
+		config.CircuitBreaker, err = ParseCircuitBreakerConfig(circuitBreaker)
+		if err != nil {
+			return ExecutorConfig{}, fmt.Errorf("failed to parse PLUGIN_CIRCUIT_BREAKER: %w", err)
+		}
+	}
+	if valueFileDir := getenv("PLUGIN_VALUE_FILE_DIR"); valueFileDir != "" {
+		config.ValueFileDir = valueFileDir
+	}
+	if outputBaseDir := getenv("PLUGIN_OUTPUT_BASE_DIR"); outputBaseDir != "" {
+		config.OutputBaseDir = outputBaseDir
+	}
+	return config, nil
+}
+
+// configHolder holds the current config. Each action holds a read lock on inFlight while it runs, so that a reload can
+// optionally wait for in-flight actions to drain.
+type configHolder struct {
+	mu       sync.RWMutex
+	config   ExecutorConfig
+	inFlight sync.RWMutex
+}
+
+func (h *configHolder) get() ExecutorConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+func (h *configHolder) set(config ExecutorConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+}
+
+// Config returns the executor's current config.
+func (e *ApiExecutor) Config() ExecutorConfig {
+	return e.config.get()
+}
+
+// ReloadConfig loads the config file's contents, configYAML, the same way as LoadPluginConfig and, if it's valid, makes
+// its executor section the executor's config. Settings which aren't in the file or the environment go back to their
+// defaults, and changes to the startup section only take effect once the plugin is restarted. An invalid config is
+// rejected and the current config is kept. In-flight actions always finish with the config they started with. If drain
+// is true, the new config is only applied once in-flight actions have finished, and new actions wait until it has been.
+func (e *ApiExecutor) ReloadConfig(configYAML string, getenv func(string) string, drain bool) error {
+	config, err := LoadPluginConfig(configYAML, getenv)
+	if err != nil {
+		return err
+	}
+	if drain {
+		e.config.inFlight.Lock()
+		defer e.config.inFlight.Unlock()
+	}
+	e.config.set(config.Executor)
+	return nil
+}
@@ -0,0 +1,211 @@
+package argocd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestParseExecutorConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("overrides base", func(t *testing.T) {
+		config, err := ParseExecutorConfig("maxSyncApps: 50\nretryPolicy:\n  limit: 1\n  backoffs:\n    Unavailable: 1s\ndefaults:\n  timeout: 5m\ndefaultTimeout: 1h\nmaxDiffOutputBytes: 1024\nvalueFileDir: /values\n", DefaultExecutorConfig())
+		require.NoError(t, err)
+		assert.Equal(t, ExecutorConfig{
+			MaxSyncApps:        50,
+			RetryPolicy:        RetryPolicy{Limit: 1, Backoffs: map[codes.Code]time.Duration{codes.Unavailable: time.Second}},
+			Defaults:           DefaultsConfig{ActionDefaults: ActionDefaults{Timeout: "5m"}},
+			DefaultTimeout:     time.Hour,
+			MaxDiffOutputBytes: 1024,
+			ValueFileDir:       "/values",
+		}, config)
+	})
+
+	t.Run("keeps unset fields", func(t *testing.T) {
+		base := ExecutorConfig{MaxSyncApps: 10, RetryPolicy: DefaultRetryPolicy}
+		config, err := ParseExecutorConfig("defaults:\n  maxConcurrency: 5\n", base)
+		require.NoError(t, err)
+		assert.Equal(t, 10, config.MaxSyncApps)
+		assert.Equal(t, DefaultRetryPolicy, config.RetryPolicy)
+		assert.Equal(t, 5, config.Defaults.MaxConcurrency)
+	})
+
+	t.Run("allowlist", func(t *testing.T) {
+		config, err := ParseExecutorConfig("allowlist:\n- project: payments\n", DefaultExecutorConfig())
+		require.NoError(t, err)
+		assert.Equal(t, Allowlist{{Project: "payments"}}, config.Allowlist)
+
+		_, err = ParseExecutorConfig("allowlist:\n- {}\n", DefaultExecutorConfig())
+		require.ErrorContains(t, err, "allowlist rule 0 must set name, namespace, or project")
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		config, err := ParseExecutorConfig("circuitBreaker:\n  threshold: 5\n  cooldown: 1m\n", DefaultExecutorConfig())
+		require.NoError(t, err)
+		assert.Equal(t, CircuitBreakerConfig{Threshold: 5, Cooldown: time.Minute}, config.CircuitBreaker)
+
+		_, err = ParseExecutorConfig("circuitBreaker:\n  threshold: -1\n", DefaultExecutorConfig())
+		require.ErrorContains(t, err, "threshold must not be negative")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseExecutorConfig("retryPolicy:\n  backoffs:\n    Sometimes: 1s\n", DefaultExecutorConfig())
+		require.ErrorContains(t, err, "unknown gRPC code")
+
+		_, err = ParseExecutorConfig("defaultTimeout: soon\n", DefaultExecutorConfig())
+		require.ErrorContains(t, err, "failed to parse defaultTimeout")
+	})
+}
+
+func TestApplyExecutorEnv(t *testing.T) {
+	t.Parallel()
+
+	file := ExecutorConfig{MaxSyncApps: 50, DefaultTimeout: time.Hour, MaxDiffOutputBytes: 1024}
+
+	t.Run("keeps file values", func(t *testing.T) {
+		config, err := ApplyExecutorEnv(file, getenv(nil))
+		require.NoError(t, err)
+		assert.Equal(t, file, config)
+	})
+
+	t.Run("env overrides file", func(t *testing.T) {
+		config, err := ApplyExecutorEnv(file, getenv(map[string]string{
+			"PLUGIN_MAX_SYNC_APPS":         "10",
+			"PLUGIN_RETRY_POLICY":          "limit: 1\n",
+			"PLUGIN_DEFAULTS":              "maxConcurrency: 5\n",
+			"PLUGIN_DEFAULT_TIMEOUT":       "10m",
+			"PLUGIN_ALLOWLIST":             "- project: payments\n",
+			"PLUGIN_MAX_DIFF_OUTPUT_BYTES": "2048",
+			"PLUGIN_CIRCUIT_BREAKER":       "threshold: 5\n",
+			"PLUGIN_VALUE_FILE_DIR":        "/values",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, ExecutorConfig{
+			MaxSyncApps:        10,
+			RetryPolicy:        RetryPolicy{Limit: 1, Backoffs: map[codes.Code]time.Duration{}},
+			Defaults:           DefaultsConfig{ActionDefaults: ActionDefaults{MaxConcurrency: 5}},
+			DefaultTimeout:     10 * time.Minute,
+			Allowlist:          Allowlist{{Project: "payments"}},
+			MaxDiffOutputBytes: 2048,
+			CircuitBreaker:     CircuitBreakerConfig{Threshold: 5, Cooldown: DefaultCircuitBreakerCooldown},
+			ValueFileDir:       "/values",
+		}, config)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ApplyExecutorEnv(file, getenv(map[string]string{"PLUGIN_MAX_SYNC_APPS": "many"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_MAX_SYNC_APPS")
+
+		_, err = ApplyExecutorEnv(file, getenv(map[string]string{"PLUGIN_DEFAULT_TIMEOUT": "soon"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_DEFAULT_TIMEOUT")
+
+		_, err = ApplyExecutorEnv(file, getenv(map[string]string{"PLUGIN_ALLOWLIST": "- {}\n"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_ALLOWLIST")
+	})
+}
+
+func TestParsePluginConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sections", func(t *testing.T) {
+		config, err := ParsePluginConfig("startup:\n  server: argocd.example.com\nexecutor:\n  maxSyncApps: 50\n  defaultTimeout: 1h\n", DefaultPluginConfig())
+		require.NoError(t, err)
+		assert.Equal(t, "argocd.example.com", config.Startup.Server)
+		assert.Equal(t, DefaultAgentTokenFile, config.Startup.AgentTokenFile)
+		assert.Equal(t, 50, config.Executor.MaxSyncApps)
+		assert.Equal(t, time.Hour, config.Executor.DefaultTimeout)
+		assert.Equal(t, DefaultRetryPolicy, config.Executor.RetryPolicy)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		config, err := ParsePluginConfig(`{"executor": {"maxDiffOutputBytes": 1024}}`, DefaultPluginConfig())
+		require.NoError(t, err)
+		assert.Equal(t, DefaultStartupConfig(), config.Startup)
+		assert.Equal(t, 1024, config.Executor.MaxDiffOutputBytes)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		config, err := ParsePluginConfig("", DefaultPluginConfig())
+		require.NoError(t, err)
+		assert.Equal(t, DefaultPluginConfig(), config)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParsePluginConfig("maxSyncApps: 50\nserver: argocd.example.com\n", DefaultPluginConfig())
+		require.EqualError(t, err, "unknown config keys maxSyncApps, server: settings must be under startup or executor")
+
+		_, err = ParsePluginConfig("startup:\n  connectRetryLimit: -1\n", DefaultPluginConfig())
+		require.ErrorContains(t, err, "connect retry limit must not be negative")
+
+		_, err = ParsePluginConfig("executor:\n  defaultTimeout: soon\n", DefaultPluginConfig())
+		require.ErrorContains(t, err, "failed to parse defaultTimeout")
+	})
+}
+
+func TestLoadPluginConfig(t *testing.T) {
+	t.Parallel()
+
+	configYAML := "startup:\n  server: argocd.example.com\n  logLevel: debug\nexecutor:\n  maxSyncApps: 50\n  defaultTimeout: 1h\n"
+	config, err := LoadPluginConfig(configYAML, getenv(map[string]string{"ARGOCD_SERVER": "argocd.internal", "PLUGIN_DEFAULT_TIMEOUT": "10m"}))
+	require.NoError(t, err)
+	assert.Equal(t, "argocd.internal", config.Startup.Server, "the environment overrides the file")
+	assert.Equal(t, LogLevelDebug, config.Startup.LogLevel)
+	assert.Equal(t, 50, config.Executor.MaxSyncApps)
+	assert.Equal(t, 10*time.Minute, config.Executor.DefaultTimeout, "the environment overrides the file")
+
+	_, err = LoadPluginConfig("startup:\n  grpcWebRootPath: argo-cd\n", getenv(nil))
+	require.ErrorContains(t, err, "invalid startup config: grpcWebRootPath requires grpcWeb")
+
+	_, err = LoadPluginConfig("startup:\n  grpcWebRootPath: argo-cd\n", getenv(map[string]string{"ARGOCD_GRPC_WEB": "true"}))
+	require.NoError(t, err, "a setting from the environment may fix a conflict in the file")
+}
+
+func TestApiExecutor_ReloadConfig(t *testing.T) {
+	t.Parallel()
+
+	e := NewApiExecutor(nil, "")
+
+	err := e.ReloadConfig("executor:\n  maxSyncApps: 50\n", getenv(nil), false)
+	require.NoError(t, err)
+	assert.Equal(t, 50, e.Config().MaxSyncApps)
+
+	err = e.ReloadConfig("executor:\n  maxSyncApps: [not a number]\n", getenv(nil), false)
+	require.Error(t, err)
+	assert.Equal(t, 50, e.Config().MaxSyncApps, "an invalid config must not replace the current one")
+
+	err = e.ReloadConfig("executor:\n  defaults:\n    timeout: 1m\n", getenv(nil), true)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultMaxSyncApps, e.Config().MaxSyncApps, "fields not in the new config go back to their defaults")
+	assert.Equal(t, "1m", e.Config().Defaults.Timeout)
+
+	err = e.ReloadConfig("executor:\n  maxSyncApps: 50\n", getenv(map[string]string{"PLUGIN_MAX_SYNC_APPS": "20"}), false)
+	require.NoError(t, err)
+	assert.Equal(t, 20, e.Config().MaxSyncApps, "the environment overrides the file on reload too")
+}
+
+func TestApiExecutor_ReloadConfig_drain(t *testing.T) {
+	t.Parallel()
+
+	e := NewApiExecutor(nil, "")
+	// Simulate an in-flight action.
+	e.config.inFlight.RLock()
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- e.ReloadConfig("executor:\n  maxSyncApps: 50\n", getenv(nil), true)
+	}()
+
+	select {
+	case <-reloaded:
+		t.Fatal("a draining reload must wait for in-flight actions")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.Equal(t, DefaultMaxSyncApps, e.Config().MaxSyncApps)
+
+	e.config.inFlight.RUnlock()
+	require.NoError(t, <-reloaded)
+	assert.Equal(t, 50, e.Config().MaxSyncApps)
+}
@@ -0,0 +1,123 @@
+package argocd
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ActionDefaults are values applied to actions which don't set them.
+type ActionDefaults struct {
+	// Timeout is the default action timeout.
+	Timeout string `yaml:"timeout,omitempty"`
+	// MaxConcurrency is the default maximum number of apps a sync action syncs at once.
+	MaxConcurrency int `yaml:"maxConcurrency,omitempty"`
+}
+
+// DefaultsConfig holds global action defaults and overrides for the apps of specific projects.
+type DefaultsConfig struct {
+	ActionDefaults `yaml:",inline"`
+	// Projects maps project names to the defaults for actions targeting that project's apps. Fields which aren't set
+	// fall back to the global defaults.
+	Projects map[string]ActionDefaults `yaml:"projects,omitempty"`
+}
+
+// ParseDefaultsConfig parses a YAML defaults config like the following.
+//
+//	timeout: 5m
+//	maxConcurrency: 10
+//	projects:
+//	  platform:
+//	    timeout: 30m
+//	    maxConcurrency: 50
+func ParseDefaultsConfig(configYAML string) (DefaultsConfig, error) {
+	var config DefaultsConfig
+	err := yaml.Unmarshal([]byte(configYAML), &config)
+	if err != nil {
+		return DefaultsConfig{}, fmt.Errorf("failed to unmarshal defaults config: %w", err)
+	}
+	err = config.ActionDefaults.validate()
+	if err != nil {
+		return DefaultsConfig{}, err
+	}
+	for project, defaults := range config.Projects {
+		err = defaults.validate()
+		if err != nil {
+			return DefaultsConfig{}, fmt.Errorf("invalid defaults for project %q: %w", project, err)
+		}
+	}
+	return config, nil
+}
+
+func (d ActionDefaults) validate() error {
+	if d.Timeout != "" {
+		if _, err := time.ParseDuration(d.Timeout); err != nil {
+			return fmt.Errorf("failed to parse timeout: %w", err)
+		}
+	}
+	if d.MaxConcurrency < 0 {
+		return fmt.Errorf("maxConcurrency must not be negative")
+	}
+	return nil
+}
+
+// resolve returns the defaults for an action targeting apps in the given projects. Each field is taken from the
+// projects' entries if any of them sets it, otherwise from the global defaults. When the projects' entries disagree,
+// the smallest value wins, so that an action spanning projects never gets more headroom than any one of them allows.
+func (c DefaultsConfig) resolve(projects []string) ActionDefaults {
+	resolved := ActionDefaults{}
+	var timeout time.Duration
+	for _, project := range projects {
+		defaults, ok := c.Projects[project]
+		if !ok {
+			continue
+		}
+		if defaults.Timeout != "" {
+			// Timeouts were validated when the config was parsed.
+			duration, _ := time.ParseDuration(defaults.Timeout)
+			if resolved.Timeout == "" || duration < timeout {
+				resolved.Timeout, timeout = defaults.Timeout, duration
+			}
+		}
+		if defaults.MaxConcurrency > 0 && (resolved.MaxConcurrency == 0 || defaults.MaxConcurrency < resolved.MaxConcurrency) {
+			resolved.MaxConcurrency = defaults.MaxConcurrency
+		}
+	}
+	if resolved.Timeout == "" {
+		resolved.Timeout = c.Timeout
+	}
+	if resolved.MaxConcurrency == 0 {
+		resolved.MaxConcurrency = c.MaxConcurrency
+	}
+	return resolved
+}
+
+// applyDefaults returns a copy of the action with unset timeout and concurrency values filled in from the defaults for
+// the projects of the apps it targets.
+func applyDefaults(action ActionSpec, targets actionTargets, config DefaultsConfig) ActionSpec {
+	if !needsDefaults(action) {
+		return action
+	}
+	needsConcurrency := action.App.Sync != nil && action.App.Sync.MaxConcurrency == 0
+	defaults := config.resolve(targets.projects())
+	if action.Timeout == "" {
+		action.Timeout = defaults.Timeout
+	}
+	if needsConcurrency {
+		app := *action.App
+		syncAction := *app.Sync
+		syncAction.MaxConcurrency = defaults.MaxConcurrency
+		app.Sync = &syncAction
+		action.App = &app
+	}
+	return action
+}
+
+// needsDefaults returns true if the action leaves a value unset which the defaults would fill in.
+func needsDefaults(action ActionSpec) bool {
+	if action.App == nil {
+		return false
+	}
+	return action.Timeout == "" || (action.App.Sync != nil && action.App.Sync.MaxConcurrency == 0)
+}
@@ -0,0 +1,100 @@
+package argocd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDefaultsConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		config, err := ParseDefaultsConfig("timeout: 5m\nmaxConcurrency: 10\nprojects:\n  platform:\n    timeout: 30m\n")
+		require.NoError(t, err)
+		assert.Equal(t, DefaultsConfig{
+			ActionDefaults: ActionDefaults{Timeout: "5m", MaxConcurrency: 10},
+			Projects:       map[string]ActionDefaults{"platform": {Timeout: "30m"}},
+		}, config)
+	})
+
+	t.Run("invalid project timeout", func(t *testing.T) {
+		_, err := ParseDefaultsConfig("projects:\n  platform:\n    timeout: forever\n")
+		require.ErrorContains(t, err, `invalid defaults for project "platform"`)
+	})
+
+	t.Run("negative concurrency", func(t *testing.T) {
+		_, err := ParseDefaultsConfig("maxConcurrency: -1\n")
+		require.Error(t, err)
+	})
+}
+
+func TestDefaultsConfig_resolve(t *testing.T) {
+	t.Parallel()
+
+	config := DefaultsConfig{
+		ActionDefaults: ActionDefaults{Timeout: "5m", MaxConcurrency: 10},
+		Projects: map[string]ActionDefaults{
+			"platform": {Timeout: "30m", MaxConcurrency: 50},
+			"payments": {Timeout: "10m"},
+		},
+	}
+	testCases := []struct {
+		name     string
+		projects []string
+		expected ActionDefaults
+	}{
+		{"no projects", nil, ActionDefaults{Timeout: "5m", MaxConcurrency: 10}},
+		{"project without entry", []string{"default"}, ActionDefaults{Timeout: "5m", MaxConcurrency: 10}},
+		{"project entry", []string{"platform"}, ActionDefaults{Timeout: "30m", MaxConcurrency: 50}},
+		{"partial project entry", []string{"payments"}, ActionDefaults{Timeout: "10m", MaxConcurrency: 10}},
+		{"several projects", []string{"platform", "payments", "default"}, ActionDefaults{Timeout: "10m", MaxConcurrency: 50}},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, testCase.expected, config.resolve(testCase.projects))
+		})
+	}
+}
+
+func Test_applyDefaults(t *testing.T) {
+	t.Parallel()
+
+	config := DefaultsConfig{
+		ActionDefaults: ActionDefaults{Timeout: "5m", MaxConcurrency: 10},
+		Projects:       map[string]ActionDefaults{"platform": {Timeout: "30m", MaxConcurrency: 50}},
+	}
+	web := actionTargets{named: []targetApp{{App: App{Name: "web", Namespace: "argocd"}, project: "platform", found: true}}}
+	billing := actionTargets{named: []targetApp{{App: App{Name: "billing", Namespace: "argocd"}, project: "payments", found: true}}}
+
+	t.Run("project defaults", func(t *testing.T) {
+		action := ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: web}]"}}}
+		resolved := applyDefaults(action, web, config)
+		assert.Equal(t, "30m", resolved.Timeout)
+		assert.Equal(t, 50, resolved.App.Sync.MaxConcurrency)
+		assert.Equal(t, 0, action.App.Sync.MaxConcurrency, "the original action must not be modified")
+	})
+
+	t.Run("global defaults", func(t *testing.T) {
+		action := ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "billing"}}}}
+		resolved := applyDefaults(action, billing, config)
+		assert.Equal(t, "5m", resolved.Timeout)
+	})
+
+	t.Run("selected apps", func(t *testing.T) {
+		action := ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Selector: "team=web"}}}
+		resolved := applyDefaults(action, actionTargets{selected: web.named}, config)
+		assert.Equal(t, "30m", resolved.Timeout)
+	})
+
+	t.Run("action values win", func(t *testing.T) {
+		action := ActionSpec{Timeout: "1m", App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: web}]", MaxConcurrency: 2}}}
+		assert.False(t, needsDefaults(action), "the apps' projects don't need to be looked up")
+		resolved := applyDefaults(action, web, config)
+		assert.Equal(t, "1m", resolved.Timeout)
+		assert.Equal(t, 2, resolved.App.Sync.MaxConcurrency)
+	})
+}
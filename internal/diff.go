@@ -1,10 +1,21 @@
 package argocd
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/argoproj/argo-cd/v2/controller"
 	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
@@ -15,6 +26,7 @@ import (
 	"github.com/argoproj/gitops-engine/pkg/sync/hook"
 	"github.com/argoproj/gitops-engine/pkg/sync/ignore"
 	"github.com/argoproj/gitops-engine/pkg/utils/kube"
+	"github.com/itchyny/gojq"
 	"gopkg.in/yaml.v3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -66,8 +78,23 @@ func getRefreshType(refresh bool, hardRefresh bool) *string {
 	return nil
 }
 
-func groupObjsByKey(localObs []*unstructured.Unstructured, liveObjs []*unstructured.Unstructured, appNamespace string) (map[kube.ResourceKey]*unstructured.Unstructured, error) {
+// optionalRevision returns revision as a query field, or nil if it's empty, so that the server uses the app's target
+// revision.
+func optionalRevision(revision string) *string {
+	if revision == "" {
+		return nil
+	}
+	return &revision
+}
+
+// groupObjsByKey deduplicates the target objects and maps them by key, leaving out ignored objects and, unless
+// includeHooks is set, hooks. If focus is set, liveObjs only hold the focused resource's live state, so when it has
+// none the focused resource's namespace is what tells whether its kind is namespaced.
+func groupObjsByKey(localObs []*unstructured.Unstructured, liveObjs []*unstructured.Unstructured, appNamespace string, focus *ResourceRef, includeHooks bool) (map[kube.ResourceKey]*unstructured.Unstructured, error) {
 	namespacedByGk := make(map[schema.GroupKind]bool)
+	if focus != nil {
+		namespacedByGk[schema.GroupKind{Group: focus.Group, Kind: focus.Kind}] = focus.Namespace != ""
+	}
 	for i := range liveObjs {
 		if liveObjs[i] != nil {
 			key := kube.GetResourceKey(liveObjs[i])
@@ -81,7 +108,7 @@ func groupObjsByKey(localObs []*unstructured.Unstructured, liveObjs []*unstructu
 	objByKey := make(map[kube.ResourceKey]*unstructured.Unstructured)
 	for i := range localObs {
 		obj := localObs[i]
-		if !(hook.IsHook(obj) || ignore.Ignore(obj)) {
+		if !(hook.IsHook(obj) && !includeHooks || ignore.Ignore(obj)) {
 			objByKey[kube.GetResourceKey(obj)] = obj
 		}
 	}
@@ -126,8 +153,9 @@ func groupObjsForDiff(resources *application.ManagedResourcesResponse, objs map[
 	return items, nil
 }
 
-// GetDiff gets a diff between two unstructured objects to stdout using an external diff utility
-func GetDiff(live *unstructured.Unstructured, target *unstructured.Unstructured) (string, error) {
+// GetDiff gets a diff between two unstructured objects to stdout using an external diff utility. Cleanup failures are
+// logged with ctx's logger.
+func GetDiff(ctx context.Context, live *unstructured.Unstructured, target *unstructured.Unstructured) (string, error) {
 	tempDir, err := os.MkdirTemp("", "argocd-diff")
 	if err != nil {
 		return "", err
@@ -135,7 +163,7 @@ func GetDiff(live *unstructured.Unstructured, target *unstructured.Unstructured)
 	defer func() {
 		err = os.RemoveAll(tempDir)
 		if err != nil {
-			fmt.Printf("Failed to delete temp dir %s: %v\n", tempDir, err)
+			contextLogger(ctx).Warnf("failed to delete temp dir %s: %v", tempDir, err)
 		}
 	}()
 	targetFile, err := os.CreateTemp(tempDir, "target")
@@ -183,3 +211,529 @@ func GetDiff(live *unstructured.Unstructured, target *unstructured.Unstructured)
 	}
 	return "", nil
 }
+
+// focusItems returns only the item for the given resource, or an error if the app has no such resource.
+func focusItems(items []objKeyLiveTarget, ref ResourceRef, appName string) ([]objKeyLiveTarget, error) {
+	for _, item := range items {
+		if item.key.Group == ref.Group && item.key.Kind == ref.Kind && item.key.Namespace == ref.Namespace && item.key.Name == ref.Name {
+			return []objKeyLiveTarget{item}, nil
+		}
+	}
+	return nil, fmt.Errorf("resource %s not found in app %q: it's neither managed by the app nor in its target manifests", ref.String(), appName)
+}
+
+// filterItems returns the items which the action's kind, name and namespace filters keep. Without filters, every item
+// is kept.
+func filterItems(items []objKeyLiveTarget, action DiffAction) []objKeyLiveTarget {
+	if len(action.IncludeKinds) == 0 && len(action.ExcludeKinds) == 0 && action.NameGlob == "" && action.Namespace == "" {
+		return items
+	}
+	var filtered []objKeyLiveTarget
+	for _, item := range items {
+		if len(action.IncludeKinds) > 0 && !containsKind(action.IncludeKinds, item.key.Kind) {
+			continue
+		}
+		if containsKind(action.ExcludeKinds, item.key.Kind) {
+			continue
+		}
+		if action.Namespace != "" && item.key.Namespace != action.Namespace {
+			continue
+		}
+		if action.NameGlob != "" {
+			// The pattern was validated before diffing, so matching can't fail.
+			if matched, _ := path.Match(action.NameGlob, item.key.Name); !matched {
+				continue
+			}
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
+// containsKind reports whether kinds contains kind, ignoring case.
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortObjKeyLiveTargets sorts items by group, kind, namespace and name, so that diffs always come out in one order.
+func sortObjKeyLiveTargets(items []objKeyLiveTarget) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].key, items[j].key
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
+
+// canonicalResourceDiff returns a resource's diff in canonical form: a header naming the resource, followed by the diff
+// with trailing whitespace trimmed from every line and exactly one trailing newline.
+func canonicalResourceDiff(key kube.ResourceKey, diff string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "=== %s\n", key.String())
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		b.WriteString(strings.TrimRight(line, " \t\r"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// diffHash returns the hex-encoded SHA-256 of a diff.
+func diffHash(diff string) string {
+	sum := sha256.Sum256([]byte(diff))
+	return hex.EncodeToString(sum[:])
+}
+
+// resourceDiff is a resource's entry in a JSON diff.
+type resourceDiff struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Modified  bool   `json:"modified"`
+	Diff      string `json:"diff"`
+}
+
+func newResourceDiff(key kube.ResourceKey, modified bool, diff string) resourceDiff {
+	return resourceDiff{Group: key.Group, Kind: key.Kind, Name: key.Name, Namespace: key.Namespace, Modified: modified, Diff: diff}
+}
+
+// truncatedMarker ends a text diff which was cut to fit the output size cap.
+const truncatedMarker = "... (truncated, %d bytes omitted)\n"
+
+// truncateDiff cuts the diff output down to at most maxBytes, if maxBytes is positive, and returns true if it had to.
+func truncateDiff(ctx context.Context, diff string, action DiffAction, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(diff) <= maxBytes {
+		return diff, false
+	}
+	if action.OutputFormat == DiffOutputFormatJSON {
+		truncated, err := truncateJSONDiff(diff, action.Apps != "", maxBytes)
+		if err == nil {
+			return truncated, true
+		}
+		// The plugin generated the JSON, so this can't happen. Cutting it like text at least keeps the output small.
+		contextLogger(ctx).Errorf("failed to truncate JSON diff: %v", err)
+	}
+	return truncateTextDiff(diff, maxBytes), true
+}
+
+// truncateTextDiff cuts a text diff at the end of a line, if there is one early enough, and appends a marker saying how
+// many bytes were left out. The result, marker included, fits in maxBytes unless maxBytes is smaller than the marker.
+func truncateTextDiff(diff string, maxBytes int) string {
+	// The marker is longest when every byte is omitted.
+	budget := maxBytes - len(fmt.Sprintf(truncatedMarker, len(diff)))
+	if budget < 0 {
+		budget = 0
+	}
+	cut := strings.LastIndexByte(diff[:budget], '\n') + 1
+	if cut == 0 {
+		cut = budget
+		for cut > 0 && !utf8.RuneStart(diff[cut]) {
+			cut--
+		}
+	}
+	return diff[:cut] + fmt.Sprintf(truncatedMarker, len(diff)-cut)
+}
+
+// truncateJSONDiff leaves resources out of a JSON diff, last ones first, until it fits in maxBytes, and counts them in
+// each app's omittedResources, so that the output stays valid JSON. The summaries still count every resource. If
+// multiApp is true, the diff maps apps to their JSON diffs, and the last app in key order loses its resources first.
+// If the diff doesn't fit even without any resources, it's returned without any.
+func truncateJSONDiff(diff string, multiApp bool, maxBytes int) (string, error) {
+	diffs := make(map[string]*jsonDiff)
+	if multiApp {
+		err := json.Unmarshal([]byte(diff), &diffs)
+		if err != nil {
+			return "", fmt.Errorf("failed to unmarshal diffs: %w", err)
+		}
+	} else {
+		single := &jsonDiff{}
+		err := json.Unmarshal([]byte(diff), single)
+		if err != nil {
+			return "", fmt.Errorf("failed to unmarshal diff: %w", err)
+		}
+		diffs[""] = single
+	}
+	keys := make([]string, 0, len(diffs))
+	resources := make(map[string][]resourceDiff)
+	total := 0
+	for key, appDiff := range diffs {
+		keys = append(keys, key)
+		resources[key] = appDiff.Resources
+		total += len(appDiff.Resources)
+	}
+	sort.Strings(keys)
+
+	// marshal keeps the first kept resources, in app key order.
+	marshal := func(kept int) ([]byte, error) {
+		for _, key := range keys {
+			n := len(resources[key])
+			if n > kept {
+				n = kept
+			}
+			kept -= n
+			diffs[key].Resources = resources[key][:n]
+			diffs[key].OmittedResources = len(resources[key]) - n
+		}
+		if multiApp {
+			return json.Marshal(diffs)
+		}
+		return json.Marshal(diffs[""])
+	}
+	var marshalErr error
+	// Find the most resources which fit. Keeping fewer resources never makes the output longer.
+	kept := sort.Search(total+1, func(kept int) bool {
+		out, err := marshal(kept)
+		if err != nil {
+			marshalErr = err
+		}
+		return len(out) > maxBytes
+	}) - 1
+	if marshalErr != nil {
+		return "", fmt.Errorf("failed to marshal diff: %w", marshalErr)
+	}
+	if kept < 0 {
+		kept = 0
+	}
+	out, err := marshal(kept)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal diff: %w", err)
+	}
+	return string(out), nil
+}
+
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// sanitizePathSegment makes s safe to use as a single path segment.
+func sanitizePathSegment(s string) string {
+	s = unsafePathChars.ReplaceAllString(s, "_")
+	if s == "" || s == "." || s == ".." {
+		return "_" + s
+	}
+	return s
+}
+
+// resourceDiffPath returns the path, relative to the output directory, of the file holding the diff for key. Resources
+// without a namespace are placed under `_cluster`.
+func resourceDiffPath(key kube.ResourceKey) string {
+	kind := key.Kind
+	if key.Group != "" {
+		kind += "." + key.Group
+	}
+	namespace := key.Namespace
+	if namespace == "" {
+		namespace = "_cluster"
+	}
+	return filepath.Join(sanitizePathSegment(kind), sanitizePathSegment(namespace), sanitizePathSegment(key.Name)+".diff")
+}
+
+// writeResourceDiff writes the diff for a single resource to its own file under dir.
+func writeResourceDiff(dir string, key kube.ResourceKey, diff string) error {
+	path := filepath.Join(dir, resourceDiffPath(key))
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = os.WriteFile(path, []byte(diff), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// normalizer is a validated, ready-to-apply DiffNormalizer.
+type normalizer struct {
+	spec    DiffNormalizer
+	pointer []string
+	code    *gojq.Code
+}
+
+// newNormalizers validates and compiles the given normalizers.
+func newNormalizers(specs []DiffNormalizer) ([]normalizer, error) {
+	normalizers := make([]normalizer, len(specs))
+	for i, spec := range specs {
+		normalizers[i].spec = spec
+		if (spec.JSONPointer == "") == (spec.JQExpression == "") {
+			return nil, fmt.Errorf("normalizer %d must set exactly one of jsonPointer or jqExpression", i)
+		}
+		if spec.JSONPointer != "" {
+			pointer, err := parseJSONPointer(spec.JSONPointer)
+			if err != nil {
+				return nil, fmt.Errorf("normalizer %d has an invalid jsonPointer: %w", i, err)
+			}
+			normalizers[i].pointer = pointer
+			continue
+		}
+		query, err := gojq.Parse(spec.JQExpression)
+		if err != nil {
+			return nil, fmt.Errorf("normalizer %d has an invalid jqExpression: %w", i, err)
+		}
+		code, err := gojq.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("normalizer %d has an invalid jqExpression: %w", i, err)
+		}
+		normalizers[i].code = code
+	}
+	return normalizers, nil
+}
+
+// normalize applies every matching normalizer to obj in place. A nil obj is left alone.
+func normalize(obj *unstructured.Unstructured, normalizers []normalizer) error {
+	if obj == nil {
+		return nil
+	}
+	gvk := obj.GroupVersionKind()
+	for _, n := range normalizers {
+		if n.spec.Group != "" && n.spec.Group != gvk.Group || n.spec.Kind != "" && n.spec.Kind != gvk.Kind {
+			continue
+		}
+		if n.pointer != nil {
+			err := sortArrayAtPointer(obj.Object, n.pointer)
+			if err != nil {
+				return fmt.Errorf("failed to apply normalizer %q: %w", n.spec.JSONPointer, err)
+			}
+			continue
+		}
+		normalized, err := runJQ(n.code, obj.Object)
+		if err != nil {
+			return fmt.Errorf("failed to apply normalizer %q: %w", n.spec.JQExpression, err)
+		}
+		obj.Object = normalized
+	}
+	return nil
+}
+
+// runJQ runs code against obj and returns the single object it produces.
+func runJQ(code *gojq.Code, obj map[string]interface{}) (map[string]interface{}, error) {
+	// gojq only handles plain JSON types, so round-trip the object to get rid of any int64s.
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var input interface{}
+	err = json.Unmarshal(data, &input)
+	if err != nil {
+		return nil, err
+	}
+	iter := code.Run(input)
+	first, ok := iter.Next()
+	if !ok {
+		return nil, errors.New("expression produced no output")
+	}
+	if err, ok := first.(error); ok {
+		return nil, err
+	}
+	if _, ok := iter.Next(); ok {
+		return nil, errors.New("expression produced more than one output")
+	}
+	normalized, ok := first.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expression did not produce an object")
+	}
+	return normalized, nil
+}
+
+// parseJSONPointer splits an RFC 6901 JSON pointer into its unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// sortArrayAtPointer sorts the array pointed to by pointer by the JSON encoding of its elements. If nothing exists at
+// the pointer, obj is left alone.
+func sortArrayAtPointer(obj interface{}, pointer []string) error {
+	current := obj
+	for _, token := range pointer {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			current = v[token]
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil
+			}
+			current = v[index]
+		default:
+			return nil
+		}
+	}
+	if current == nil {
+		return nil
+	}
+	array, ok := current.([]interface{})
+	if !ok {
+		return fmt.Errorf("value at pointer is not an array")
+	}
+	keys := make([]string, len(array))
+	for i := range array {
+		key, err := json.Marshal(array[i])
+		if err != nil {
+			return err
+		}
+		keys[i] = string(key)
+	}
+	sort.Sort(byKey{keys: keys, values: array})
+	return nil
+}
+
+// byKey sorts values by the corresponding string in keys.
+type byKey struct {
+	keys   []string
+	values []interface{}
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+// fieldDefault is a field which Kubernetes sets to a default value if it's not specified.
+type fieldDefault struct {
+	// kinds restricts the default to resources of these kinds. Empty matches all kinds.
+	kinds []string
+	// path is the path to the field. A "*" matches every element of an array.
+	path  []string
+	value interface{}
+}
+
+// podSpecPaths are the paths to pod specs within the resources which embed them.
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// commonDefaults is a curated list of fields which are commonly defaulted by Kubernetes and which would otherwise show
+// up as noise in client-side diffs.
+var commonDefaults = buildCommonDefaults()
+
+func buildCommonDefaults() []fieldDefault {
+	defaults := []fieldDefault{
+		{kinds: []string{"Service"}, path: []string{"spec", "ports", "*", "protocol"}, value: "TCP"},
+		{kinds: []string{"Service"}, path: []string{"spec", "sessionAffinity"}, value: "None"},
+		{kinds: []string{"Service"}, path: []string{"spec", "type"}, value: "ClusterIP"},
+		{kinds: []string{"Deployment"}, path: []string{"spec", "revisionHistoryLimit"}, value: 10},
+		{kinds: []string{"Deployment"}, path: []string{"spec", "progressDeadlineSeconds"}, value: 600},
+	}
+	podDefaults := []fieldDefault{
+		{path: []string{"restartPolicy"}, value: "Always"},
+		{path: []string{"dnsPolicy"}, value: "ClusterFirst"},
+		{path: []string{"schedulerName"}, value: "default-scheduler"},
+		{path: []string{"terminationGracePeriodSeconds"}, value: 30},
+		{path: []string{"securityContext"}, value: map[string]interface{}{}},
+	}
+	for _, containers := range []string{"initContainers", "containers"} {
+		podDefaults = append(podDefaults,
+			fieldDefault{path: []string{containers, "*", "ports", "*", "protocol"}, value: "TCP"},
+			fieldDefault{path: []string{containers, "*", "terminationMessagePath"}, value: "/dev/termination-log"},
+			fieldDefault{path: []string{containers, "*", "terminationMessagePolicy"}, value: "File"},
+		)
+	}
+	for kind, podSpecPath := range podSpecPaths {
+		for _, d := range podDefaults {
+			path := append(append([]string{}, podSpecPath...), d.path...)
+			defaults = append(defaults, fieldDefault{kinds: []string{kind}, path: path, value: d.value})
+		}
+	}
+	return defaults
+}
+
+// stripDefaults removes fields from live which hold a common default value and which aren't set in target. Nothing is
+// stripped unless both live and target are non-nil.
+func stripDefaults(live, target *unstructured.Unstructured) {
+	if live == nil || target == nil {
+		return
+	}
+	for _, d := range commonDefaults {
+		if len(d.kinds) > 0 && !containsString(d.kinds, live.GetKind()) {
+			continue
+		}
+		stripDefault(live.Object, target.Object, d.path, d.value)
+	}
+}
+
+// stripDefault walks path through live and target together and deletes the field from live if its value equals value
+// and target doesn't set it.
+func stripDefault(live, target interface{}, path []string, value interface{}) {
+	if len(path) == 0 {
+		return
+	}
+	if path[0] == "*" {
+		liveArray, ok := live.([]interface{})
+		if !ok {
+			return
+		}
+		targetArray, _ := target.([]interface{})
+		for i := range liveArray {
+			var targetElem interface{}
+			if i < len(targetArray) {
+				targetElem = targetArray[i]
+			}
+			stripDefault(liveArray[i], targetElem, path[1:], value)
+		}
+		return
+	}
+	liveMap, ok := live.(map[string]interface{})
+	if !ok {
+		return
+	}
+	liveValue, ok := liveMap[path[0]]
+	if !ok {
+		return
+	}
+	targetMap, _ := target.(map[string]interface{})
+	targetValue, targetHasField := targetMap[path[0]]
+	if len(path) > 1 {
+		stripDefault(liveValue, targetValue, path[1:], value)
+		return
+	}
+	if !targetHasField && jsonEqual(liveValue, value) {
+		delete(liveMap, path[0])
+	}
+}
+
+// jsonEqual reports whether a and b have the same JSON representation, which glosses over differences between numeric
+// types.
+func jsonEqual(a, b interface{}) bool {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
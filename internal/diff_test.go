@@ -1,7 +1,14 @@
 package argocd
 
 import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/argoproj/gitops-engine/pkg/utils/kube"
 	"github.com/stretchr/testify/assert"
@@ -48,7 +55,7 @@ func Test_groupObjsByKey(t *testing.T) {
 				},
 			},
 		}
-		grouped, err := groupObjsByKey(localObjs, localObjs, "my-namespace")
+		grouped, err := groupObjsByKey(localObjs, localObjs, "my-namespace", nil, false)
 		require.NoError(t, err)
 		assert.Equal(t, map[kube.ResourceKey]*unstructured.Unstructured{
 			kube.ResourceKey{
@@ -60,3 +67,306 @@ func Test_groupObjsByKey(t *testing.T) {
 		}, grouped)
 	})
 }
+
+func Test_writeResourceDiff(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	keys := []kube.ResourceKey{
+		{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "my-deployment"},
+		{Kind: "ConfigMap", Namespace: "my-namespace", Name: "my-config"},
+		{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: "system:my-role"},
+		{Kind: "ConfigMap", Namespace: "other", Name: ".."},
+	}
+	for _, key := range keys {
+		require.NoError(t, writeResourceDiff(dir, key, "diff for "+key.Name))
+	}
+
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"Deployment.apps/my-namespace/my-deployment.diff",
+		"ConfigMap/my-namespace/my-config.diff",
+		"ClusterRole.rbac.authorization.k8s.io/_cluster/system_my-role.diff",
+		"ConfigMap/other/_...diff",
+	}, files)
+
+	contents, err := os.ReadFile(filepath.Join(dir, "Deployment.apps", "my-namespace", "my-deployment.diff"))
+	require.NoError(t, err)
+	assert.Equal(t, "diff for my-deployment", string(contents))
+}
+
+func Test_canonicalResourceDiff(t *testing.T) {
+	t.Parallel()
+
+	key := kube.ResourceKey{Group: "apps", Kind: "Deployment", Namespace: "my-namespace", Name: "my-deployment"}
+	expected := "=== apps/Deployment/my-namespace/my-deployment\n3c3\n< replicas: 1\n---\n> replicas: 2\n"
+	assert.Equal(t, expected, canonicalResourceDiff(key, "3c3\n< replicas: 1  \n---\n> replicas: 2\n\n"))
+	assert.Equal(t, expected, canonicalResourceDiff(key, "3c3\r\n< replicas: 1\r\n---\r\n> replicas: 2"))
+	assert.Equal(t, diffHash(expected), diffHash(canonicalResourceDiff(key, "3c3\n< replicas: 1\n---\n> replicas: 2\n")))
+}
+
+func Test_sortObjKeyLiveTargets(t *testing.T) {
+	t.Parallel()
+
+	items := []objKeyLiveTarget{
+		{key: kube.ResourceKey{Group: "apps", Kind: "Deployment", Namespace: "b", Name: "web"}},
+		{key: kube.ResourceKey{Kind: "Service", Namespace: "a", Name: "web"}},
+		{key: kube.ResourceKey{Group: "apps", Kind: "Deployment", Namespace: "a", Name: "web"}},
+		{key: kube.ResourceKey{Kind: "ConfigMap", Namespace: "a", Name: "web"}},
+	}
+	sortObjKeyLiveTargets(items)
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.key.String())
+	}
+	assert.Equal(t, []string{
+		"/ConfigMap/a/web",
+		"/Service/a/web",
+		"apps/Deployment/a/web",
+		"apps/Deployment/b/web",
+	}, keys)
+}
+
+func Test_newNormalizers(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{
+			{JSONPointer: "/spec/ports"},
+			{JQExpression: ".spec.ports |= sort_by(.port)"},
+		})
+		require.NoError(t, err)
+		assert.Len(t, normalizers, 2)
+	})
+
+	t.Run("neither set", func(t *testing.T) {
+		_, err := newNormalizers([]DiffNormalizer{{Kind: "Service"}})
+		require.ErrorContains(t, err, "exactly one")
+	})
+
+	t.Run("both set", func(t *testing.T) {
+		_, err := newNormalizers([]DiffNormalizer{{JSONPointer: "/spec", JQExpression: "."}})
+		require.ErrorContains(t, err, "exactly one")
+	})
+
+	t.Run("invalid pointer", func(t *testing.T) {
+		_, err := newNormalizers([]DiffNormalizer{{JSONPointer: "spec/ports"}})
+		require.ErrorContains(t, err, "invalid jsonPointer")
+	})
+
+	t.Run("invalid jq", func(t *testing.T) {
+		_, err := newNormalizers([]DiffNormalizer{{JQExpression: ".spec.ports |="}})
+		require.ErrorContains(t, err, "invalid jqExpression")
+	})
+}
+
+func Test_normalize(t *testing.T) {
+	t.Parallel()
+
+	newService := func(ports ...interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "my-service"},
+			"spec":       map[string]interface{}{"ports": ports},
+		}}
+	}
+	http := map[string]interface{}{"name": "http", "port": int64(80)}
+	https := map[string]interface{}{"name": "https", "port": int64(443)}
+
+	t.Run("json pointer", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{{JSONPointer: "/spec/ports"}})
+		require.NoError(t, err)
+		a, b := newService(http, https), newService(https, http)
+		require.NoError(t, normalize(a, normalizers))
+		require.NoError(t, normalize(b, normalizers))
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("jq expression", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{{JQExpression: ".spec.ports |= sort_by(.port)"}})
+		require.NoError(t, err)
+		a, b := newService(http, https), newService(https, http)
+		require.NoError(t, normalize(a, normalizers))
+		require.NoError(t, normalize(b, normalizers))
+		assert.Equal(t, a, b)
+	})
+
+	t.Run("kind mismatch", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{{Kind: "Deployment", JSONPointer: "/spec/ports"}})
+		require.NoError(t, err)
+		obj := newService(https, http)
+		require.NoError(t, normalize(obj, normalizers))
+		assert.Equal(t, newService(https, http), obj)
+	})
+
+	t.Run("missing path", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{{JSONPointer: "/spec/missing"}})
+		require.NoError(t, err)
+		obj := newService(https, http)
+		require.NoError(t, normalize(obj, normalizers))
+		assert.Equal(t, newService(https, http), obj)
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		normalizers, err := newNormalizers([]DiffNormalizer{{JSONPointer: "/metadata/name"}})
+		require.NoError(t, err)
+		require.Error(t, normalize(newService(), normalizers))
+	})
+}
+
+func Test_stripDefaults(t *testing.T) {
+	t.Parallel()
+
+	newService := func(port map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "my-service"},
+			"spec":       map[string]interface{}{"ports": []interface{}{port}},
+		}}
+	}
+
+	t.Run("defaulted protocol", func(t *testing.T) {
+		live := newService(map[string]interface{}{"port": int64(80), "protocol": "TCP"})
+		target := newService(map[string]interface{}{"port": int64(80)})
+
+		diff, err := GetDiff(context.Background(), live, target)
+		require.NoError(t, err)
+		assert.Contains(t, diff, "protocol: TCP")
+
+		stripDefaults(live, target)
+		assert.Equal(t, target, live)
+		diff, err = GetDiff(context.Background(), live, target)
+		require.NoError(t, err)
+		assert.Empty(t, diff)
+	})
+
+	t.Run("explicitly set protocol", func(t *testing.T) {
+		live := newService(map[string]interface{}{"port": int64(80), "protocol": "TCP"})
+		target := newService(map[string]interface{}{"port": int64(80), "protocol": "TCP"})
+		stripDefaults(live, target)
+		assert.Equal(t, "TCP", live.Object["spec"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})["protocol"])
+	})
+
+	t.Run("non-default protocol", func(t *testing.T) {
+		live := newService(map[string]interface{}{"port": int64(53), "protocol": "UDP"})
+		target := newService(map[string]interface{}{"port": int64(53)})
+		stripDefaults(live, target)
+		assert.Equal(t, "UDP", live.Object["spec"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})["protocol"])
+	})
+
+	t.Run("pod template", func(t *testing.T) {
+		newDeployment := func(podSpec map[string]interface{}) *unstructured.Unstructured {
+			return &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"metadata":   map[string]interface{}{"name": "my-deployment"},
+				"spec": map[string]interface{}{
+					"template": map[string]interface{}{"spec": podSpec},
+				},
+			}}
+		}
+		live := newDeployment(map[string]interface{}{
+			"dnsPolicy":                     "ClusterFirst",
+			"terminationGracePeriodSeconds": int64(30),
+			"containers": []interface{}{map[string]interface{}{
+				"name":                     "main",
+				"terminationMessagePolicy": "File",
+			}},
+		})
+		target := newDeployment(map[string]interface{}{
+			"containers": []interface{}{map[string]interface{}{"name": "main"}},
+		})
+		stripDefaults(live, target)
+		assert.Equal(t, target, live)
+	})
+
+	t.Run("nil target", func(t *testing.T) {
+		live := newService(map[string]interface{}{"port": int64(80), "protocol": "TCP"})
+		stripDefaults(live, nil)
+		assert.Equal(t, newService(map[string]interface{}{"port": int64(80), "protocol": "TCP"}), live)
+	})
+}
+
+func Test_truncateTextDiff(t *testing.T) {
+	t.Parallel()
+
+	diff := "line 1\nline 2\nline 3\n" + strings.Repeat("x", 100) + "\n"
+	truncated := truncateTextDiff(diff, 60)
+	assert.LessOrEqual(t, len(truncated), 60)
+	assert.Equal(t, "line 1\nline 2\nline 3\n... (truncated, 101 bytes omitted)\n", truncated)
+
+	// Without a line break early enough, the diff is cut mid-line, but not mid-character.
+	truncated = truncateTextDiff(strings.Repeat("é", 50), 40)
+	assert.LessOrEqual(t, len(truncated), 40)
+	assert.True(t, utf8.ValidString(truncated), truncated)
+	assert.Contains(t, truncated, "bytes omitted")
+}
+
+func Test_truncateDiff(t *testing.T) {
+	t.Parallel()
+
+	t.Run("under the cap", func(t *testing.T) {
+		truncated, ok := truncateDiff(context.Background(), "small diff\n", DiffAction{}, 100)
+		assert.False(t, ok)
+		assert.Equal(t, "small diff\n", truncated)
+
+		truncated, ok = truncateDiff(context.Background(), "small diff\n", DiffAction{}, 0)
+		assert.False(t, ok, "zero means no limit")
+		assert.Equal(t, "small diff\n", truncated)
+	})
+
+	resources := []resourceDiff{
+		{Kind: "ConfigMap", Name: "a", Modified: true, Diff: strings.Repeat("a", 100)},
+		{Kind: "ConfigMap", Name: "b", Modified: true, Diff: strings.Repeat("b", 100)},
+		{Kind: "ConfigMap", Name: "c", Modified: true, Diff: strings.Repeat("c", 100)},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		out, err := json.Marshal(jsonDiff{Summary: diffSummary{Modified: 3}, Resources: resources})
+		require.NoError(t, err)
+		truncated, ok := truncateDiff(context.Background(), string(out), DiffAction{OutputFormat: DiffOutputFormatJSON}, len(out)-50)
+		assert.True(t, ok)
+		assert.LessOrEqual(t, len(truncated), len(out)-50)
+		var parsed jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(truncated), &parsed))
+		assert.Equal(t, diffSummary{Modified: 3}, parsed.Summary, "the summary counts every resource")
+		assert.Equal(t, resources[:2], parsed.Resources)
+		assert.Equal(t, 1, parsed.OmittedResources)
+
+		truncated, ok = truncateDiff(context.Background(), string(out), DiffAction{OutputFormat: DiffOutputFormatJSON}, 10)
+		assert.True(t, ok)
+		require.NoError(t, json.Unmarshal([]byte(truncated), &parsed))
+		assert.Empty(t, parsed.Resources)
+		assert.Equal(t, 3, parsed.OmittedResources)
+	})
+
+	t.Run("json for several apps", func(t *testing.T) {
+		out, err := json.Marshal(map[string]jsonDiff{
+			"app-a": {Summary: diffSummary{Modified: 3}, Resources: resources},
+			"app-b": {Summary: diffSummary{Modified: 3}, Resources: resources},
+		})
+		require.NoError(t, err)
+		// Each resource takes up almost 200 bytes, so this leaves room for three of them.
+		maxBytes := len(out) - 450
+		truncated, ok := truncateDiff(context.Background(), string(out), DiffAction{Apps: "[{name: app-a}, {name: app-b}]", OutputFormat: DiffOutputFormatJSON}, maxBytes)
+		assert.True(t, ok)
+		assert.LessOrEqual(t, len(truncated), maxBytes)
+		var parsed map[string]jsonDiff
+		require.NoError(t, json.Unmarshal([]byte(truncated), &parsed))
+		assert.Equal(t, resources, parsed["app-a"].Resources, "the last app loses its resources first")
+		assert.Equal(t, 0, parsed["app-a"].OmittedResources)
+		assert.Empty(t, parsed["app-b"].Resources)
+		assert.Equal(t, 3, parsed["app-b"].OmittedResources)
+	})
+}
@@ -0,0 +1,261 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrAuthFailed is returned when the Argo CD API keeps rejecting the auth token.
+var ErrAuthFailed = errors.New("authentication failed, token may have been rotated")
+
+// errDiffFound is returned by diff actions which found changes and were asked to fail on them.
+var errDiffFound = errors.New("diff found changes")
+
+// errHealthTimeout is returned when apps didn't become healthy before the timeout.
+var errHealthTimeout = errors.New("timed out waiting for apps to become healthy")
+
+// errCircuitOpen is returned for Argo CD API calls which the circuit breaker failed without making them.
+var errCircuitOpen = errors.New("circuit open")
+
+// errBlockedBySyncWindow is returned for an app which a sync window of its project doesn't allow to be synced.
+var errBlockedBySyncWindow = errors.New("blocked by sync window")
+
+// multiError aggregates the errors of operations which ran in parallel.
+type multiError []error
+
+func (m multiError) Error() string {
+	messages := make([]string, len(m))
+	for i, err := range m {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, ", ")
+}
+
+// partialError is returned by actions which failed for some of their apps but succeeded for others.
+type partialError struct {
+	err error
+}
+
+func (e partialError) Error() string {
+	return e.err.Error()
+}
+
+func (e partialError) Unwrap() error {
+	return e.err
+}
+
+// unhealthyError is returned for an app which didn't become healthy before the timeout.
+type unhealthyError struct {
+	app    string
+	health string
+	phase  string
+}
+
+func (e unhealthyError) Error() string {
+	return fmt.Sprintf("app %q is not healthy (health: %s, operation: %s)", e.app, e.health, e.phase)
+}
+
+// appNotFoundError is returned when an action's app doesn't exist, so that workflows can tell this apart from other
+// failures, for example to create the app before diffing it. It wraps the API's NotFound error.
+type appNotFoundError struct {
+	app string
+	err error
+}
+
+func (e appNotFoundError) Error() string {
+	return fmt.Sprintf("app %q does not exist", e.app)
+}
+
+func (e appNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// combineUnhealthyErrors replaces the unhealthyErrors in errs with a single error naming every app which isn't healthy.
+func combineUnhealthyErrors(errs multiError) multiError {
+	var combined multiError
+	var unhealthy []string
+	for _, err := range errs {
+		var unhealthyErr unhealthyError
+		if errors.As(err, &unhealthyErr) {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (health: %s, operation: %s)", unhealthyErr.app, unhealthyErr.health, unhealthyErr.phase))
+			continue
+		}
+		combined = append(combined, err)
+	}
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		combined = append(combined, fmt.Errorf("%w: %s", errHealthTimeout, strings.Join(unhealthy, ", ")))
+	}
+	return combined
+}
+
+// grpcCode returns the gRPC status code of err or of the first error it wraps which has one. Errors without a status
+// return codes.Unknown.
+func grpcCode(err error) codes.Code {
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &statusErr) {
+		return statusErr.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
+
+// isAuthError reports whether err was caused by the Argo CD API rejecting the auth token. If err wraps a multiError,
+// every one of its errors must be an auth error.
+func isAuthError(err error) bool {
+	var multi multiError
+	if errors.As(err, &multi) {
+		for _, err := range multi {
+			if !isAuthError(err) {
+				return false
+			}
+		}
+		return len(multi) > 0
+	}
+	if isSyncWindowError(err) {
+		return false
+	}
+	code := grpcCode(err)
+	return code == codes.Unauthenticated || code == codes.PermissionDenied
+}
+
+// isSyncWindowError reports whether err was returned because a sync window doesn't allow the app to be synced. The API
+// returns PermissionDenied, like for a token which isn't allowed to sync, so the message is checked too.
+func isSyncWindowError(err error) bool {
+	return errors.Is(err, errBlockedBySyncWindow) ||
+		grpcCode(err) == codes.PermissionDenied && strings.Contains(err.Error(), "blocked by sync window")
+}
+
+// isUnavailableError reports whether err was caused by the Argo CD API server being unreachable. If err wraps a
+// multiError, any one of its errors may be.
+func isUnavailableError(err error) bool {
+	var multi multiError
+	if errors.As(err, &multi) {
+		for _, err := range multi {
+			if isUnavailableError(err) {
+				return true
+			}
+		}
+		return false
+	}
+	return grpcCode(err) == codes.Unavailable
+}
+
+// isConflictError reports whether err was caused by a concurrent update to the same object. The API doesn't map
+// Kubernetes conflicts to a gRPC code, so the message is checked too.
+func isConflictError(err error) bool {
+	return grpcCode(err) == codes.Aborted || strings.Contains(err.Error(), "the object has been modified")
+}
+
+// isNotFoundError reports whether err was returned because an object, like an app, doesn't exist.
+func isNotFoundError(err error) bool {
+	return grpcCode(err) == codes.NotFound
+}
+
+// isAppNotFoundError reports whether err was returned because an action's app doesn't exist. If err wraps a multiError,
+// any one of its errors may be.
+func isAppNotFoundError(err error) bool {
+	var multi multiError
+	if errors.As(err, &multi) {
+		for _, err := range multi {
+			if isAppNotFoundError(err) {
+				return true
+			}
+		}
+		return false
+	}
+	var notFound appNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// isRevisionNotFoundError reports whether err was returned because a revision, like a deleted branch, doesn't exist in
+// the app's repo. The repo server doesn't map this to a gRPC code, so the message is checked.
+func isRevisionNotFoundError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "unable to resolve") || strings.Contains(message, "unknown revision") ||
+		strings.Contains(message, "couldn't find remote ref")
+}
+
+// isNoOperationError reports whether err was returned by TerminateOperation because the app had no running operation.
+func isNoOperationError(err error) bool {
+	return grpcCode(err) == codes.InvalidArgument && strings.Contains(err.Error(), "No operation is in progress")
+}
+
+// errorCategory classifies why an action failed, so that workflows can decide whether to retry it.
+type errorCategory string
+
+const (
+	// errorCategoryNotFound means an app or another object doesn't exist.
+	errorCategoryNotFound errorCategory = "NotFound"
+	// errorCategoryUnauthorized means the token was rejected or isn't allowed to do what the action does, or the
+	// plugin's allowlist doesn't allow the action's apps.
+	errorCategoryUnauthorized errorCategory = "Unauthorized"
+	// errorCategoryTimeout means the action's timeout expired, for example while waiting for apps to become healthy.
+	errorCategoryTimeout errorCategory = "Timeout"
+	// errorCategoryConflict means the action conflicted with the app's state, like an operation already in progress
+	// or a concurrent update.
+	errorCategoryConflict errorCategory = "Conflict"
+	// errorCategorySyncWindow means a sync window of the app's project doesn't allow syncing it right now, so a retry
+	// may succeed once a window opens.
+	errorCategorySyncWindow errorCategory = "SyncWindow"
+	// errorCategoryTransient means the API server was unavailable or overloaded, or the circuit breaker paused calls to
+	// it, so a retry may succeed.
+	errorCategoryTransient errorCategory = "Transient"
+	// errorCategoryUnknown means any other error, including invalid actions.
+	errorCategoryUnknown errorCategory = "Unknown"
+)
+
+// categorizeError returns the category of err, from its gRPC status code where it has one. If err wraps a multiError,
+// its errors must all have the same category, or it's unknown.
+func categorizeError(err error) errorCategory {
+	var multi multiError
+	if errors.As(err, &multi) {
+		if len(multi) == 0 {
+			return errorCategoryUnknown
+		}
+		category := categorizeError(multi[0])
+		for _, err := range multi[1:] {
+			if categorizeError(err) != category {
+				return errorCategoryUnknown
+			}
+		}
+		return category
+	}
+	if isSyncWindowError(err) {
+		return errorCategorySyncWindow
+	}
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, errNotAllowed) {
+		return errorCategoryUnauthorized
+	}
+	if errors.Is(err, errCircuitOpen) {
+		return errorCategoryTransient
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errHealthTimeout) {
+		return errorCategoryTimeout
+	}
+	var unhealthy unhealthyError
+	if errors.As(err, &unhealthy) {
+		return errorCategoryTimeout
+	}
+	if isConflictError(err) {
+		return errorCategoryConflict
+	}
+	switch grpcCode(err) {
+	case codes.NotFound:
+		return errorCategoryNotFound
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return errorCategoryUnauthorized
+	case codes.DeadlineExceeded:
+		return errorCategoryTimeout
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return errorCategoryConflict
+	case codes.Unavailable, codes.ResourceExhausted:
+		return errorCategoryTransient
+	}
+	return errorCategoryUnknown
+}
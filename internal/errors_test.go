@@ -0,0 +1,124 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_grpcCode(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, codes.NotFound, grpcCode(status.Error(codes.NotFound, "not found")))
+	assert.Equal(t, codes.NotFound, grpcCode(fmt.Errorf("wrapped: %w", status.Error(codes.NotFound, "not found"))))
+	assert.Equal(t, codes.Unknown, grpcCode(errors.New("plain")))
+}
+
+func Test_isAuthError(t *testing.T) {
+	t.Parallel()
+
+	denied := status.Error(codes.PermissionDenied, "permission denied")
+	unauthenticated := status.Error(codes.Unauthenticated, "invalid session")
+	notFound := status.Error(codes.NotFound, "not found")
+
+	assert.True(t, isAuthError(denied))
+	assert.True(t, isAuthError(fmt.Errorf("wrapped: %w", unauthenticated)))
+	assert.False(t, isAuthError(notFound))
+	assert.False(t, isAuthError(errors.New("plain")))
+	assert.True(t, isAuthError(fmt.Errorf("wrapped: %w", multiError{denied, unauthenticated})))
+	assert.False(t, isAuthError(multiError{denied, notFound}))
+	assert.False(t, isAuthError(multiError{}))
+	assert.False(t, isAuthError(status.Error(codes.PermissionDenied, "cannot sync: blocked by sync window")))
+}
+
+func Test_isSyncWindowError(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isSyncWindowError(fmt.Errorf("wrapped: %w", status.Error(codes.PermissionDenied, "cannot sync: blocked by sync window"))))
+	assert.True(t, isSyncWindowError(fmt.Errorf("failed to sync app %q: %w", "my-app", errBlockedBySyncWindow)))
+	assert.False(t, isSyncWindowError(status.Error(codes.PermissionDenied, "permission denied")))
+	assert.False(t, isSyncWindowError(errors.New("blocked by sync window")))
+}
+
+func Test_isUnavailableError(t *testing.T) {
+	t.Parallel()
+
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	notFound := status.Error(codes.NotFound, "not found")
+
+	assert.True(t, isUnavailableError(fmt.Errorf("wrapped: %w", unavailable)))
+	assert.False(t, isUnavailableError(notFound))
+	assert.False(t, isUnavailableError(nil))
+	assert.True(t, isUnavailableError(multiError{notFound, unavailable}))
+	assert.False(t, isUnavailableError(multiError{notFound}))
+}
+
+func Test_isConflictError(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isConflictError(status.Error(codes.Aborted, "aborted")))
+	assert.True(t, isConflictError(fmt.Errorf("error updating application: %w", errors.New(`Operation cannot be fulfilled on applications.argoproj.io "my-app": the object has been modified; please apply your changes to the latest version and try again`))))
+	assert.False(t, isConflictError(status.Error(codes.NotFound, "not found")))
+}
+
+func Test_isAppNotFoundError(t *testing.T) {
+	t.Parallel()
+
+	notFound := appNotFoundError{app: "my-app", err: status.Error(codes.NotFound, "app \"my-app\" not found")}
+
+	assert.True(t, isAppNotFoundError(fmt.Errorf("failed to diff app: %w", notFound)))
+	assert.True(t, isAppNotFoundError(partialError{multiError{errors.New("boom"), notFound}}))
+	assert.False(t, isAppNotFoundError(status.Error(codes.NotFound, "not found")))
+	assert.False(t, isAppNotFoundError(nil))
+	assert.Equal(t, codes.NotFound, grpcCode(notFound))
+}
+
+func Test_isRevisionNotFoundError(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isRevisionNotFoundError(status.Error(codes.Unknown, "Unable to resolve 'feature-x' to a commit SHA")))
+	assert.True(t, isRevisionNotFoundError(errors.New("fatal: couldn't find remote ref feature-x")))
+	assert.False(t, isRevisionNotFoundError(status.Error(codes.Internal, "failed to generate manifests")))
+}
+
+func Test_categorizeError(t *testing.T) {
+	t.Parallel()
+
+	notFound := status.Error(codes.NotFound, "app \"my-app\" not found")
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	testCases := []struct {
+		name     string
+		err      error
+		expected errorCategory
+	}{
+		{"not found", fmt.Errorf("failed to refresh app: %w", notFound), errorCategoryNotFound},
+		{"permission denied", status.Error(codes.PermissionDenied, "permission denied"), errorCategoryUnauthorized},
+		{"auth failed", fmt.Errorf("%w: %v", ErrAuthFailed, errors.New("invalid session")), errorCategoryUnauthorized},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "context deadline exceeded"), errorCategoryTimeout},
+		{"context deadline exceeded", fmt.Errorf("failed to wait for sync: %w", context.DeadlineExceeded), errorCategoryTimeout},
+		{"unhealthy", combineUnhealthyErrors(multiError{unhealthyError{app: "my-app", health: "Progressing", phase: "Running"}}), errorCategoryTimeout},
+		{"operation in progress", status.Error(codes.FailedPrecondition, "another operation is already in progress"), errorCategoryConflict},
+		{"concurrent update", errors.New("the object has been modified; please apply your changes to the latest version and try again"), errorCategoryConflict},
+		{"sync window", status.Error(codes.PermissionDenied, "cannot sync: blocked by sync window"), errorCategorySyncWindow},
+		{"sync window wait", multiError{fmt.Errorf("failed to sync app %q: %w", "my-app", errBlockedBySyncWindow)}, errorCategorySyncWindow},
+		{"unavailable", unavailable, errorCategoryTransient},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "rate limited"), errorCategoryTransient},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad request"), errorCategoryUnknown},
+		{"plain", errors.New("app name is required"), errorCategoryUnknown},
+		{"same categories", fmt.Errorf("failed to sync apps: %w", partialError{multiError{notFound, notFound}}), errorCategoryNotFound},
+		{"mixed categories", multiError{notFound, unavailable}, errorCategoryUnknown},
+		{"empty", multiError{}, errorCategoryUnknown},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, testCase.expected, categorizeError(testCase.err))
+		})
+	}
+}
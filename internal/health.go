@@ -0,0 +1,60 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+)
+
+// readinessTimeout bounds the readiness check's API call, so that probes fail quickly when the API server hangs.
+const readinessTimeout = 2 * time.Second
+
+// Ready checks that the executor isn't shutting down, that the Argo CD API client is initialized, and that the API
+// server is reachable, by fetching its settings, which is cheap and doesn't depend on the token's permissions.
+func (e *ApiExecutor) Ready(ctx context.Context) error {
+	if e.requests.isDraining() {
+		return ErrShuttingDown
+	}
+	clients, release, err := e.apiClient.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	_, err = clients.settingsClient.Get(ctx, &settings.SettingsQuery{})
+	if err != nil {
+		if isUnavailableError(err) {
+			e.apiClient.invalidate(clients)
+		}
+		return fmt.Errorf("Argo CD API server is unreachable: %w", err)
+	}
+	return nil
+}
+
+// Healthz handles liveness probes. It always succeeds once the plugin is serving.
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// ReadinessChecker reports whether it's ready to handle requests.
+type ReadinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// Readyz returns a handler for readiness probes, which fails with 503 Service Unavailable while the executor isn't
+// ready.
+func Readyz(executor ReadinessChecker) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := executor.Ready(req.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
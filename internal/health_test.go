@@ -0,0 +1,56 @@
+package argocd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHealthz(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+
+	probe := func(e *ApiExecutor) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Readyz(e)(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w
+	}
+
+	t.Run("reachable", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(&fakeApiClient{settingsClient: &fakeSettingsClient{settings: &settings.Settings{}}}, "")
+		w := probe(&e)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok\n", w.Body.String())
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		t.Parallel()
+		client := &fakeApiClient{settingsClient: &fakeSettingsClient{err: status.Error(codes.Unavailable, "connection refused")}}
+		e := NewApiExecutor(client, "")
+		w := probe(&e)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), "Argo CD API server is unreachable")
+		assert.Contains(t, w.Body.String(), "connection refused")
+	})
+
+	t.Run("not initialized", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		w := probe(&e)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), "API client isn't initialized")
+	})
+}
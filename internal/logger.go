@@ -0,0 +1,156 @@
+package argocd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// LogLevel is the minimum severity of the messages a Logger writes.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// ParseLogLevel parses a log level name: debug, info, warn, or error.
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (must be debug, info, warn, or error)", level)
+}
+
+// Logger writes leveled log messages.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// With returns a Logger which adds the given key-value pairs to each message, for example to identify the request
+	// the message is about.
+	With(keysAndValues ...interface{}) Logger
+}
+
+// NewLogger returns a Logger which writes messages of at least the given level with the standard library's default
+// logger.
+func NewLogger(level LogLevel) Logger {
+	return &stdLogger{level: level, out: log.Default()}
+}
+
+type stdLogger struct {
+	level LogLevel
+	out   *log.Logger
+	// fields are written after each message, as space-separated key=value pairs.
+	fields string
+}
+
+func (l *stdLogger) logf(level LogLevel, prefix string, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.out.Print(prefix + fmt.Sprintf(format, args...) + l.fields)
+}
+
+func (l *stdLogger) With(keysAndValues ...interface{}) Logger {
+	fields := l.fields
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields += fmt.Sprintf(" %v=%s", keysAndValues[i], formatLogValue(value))
+	}
+	return &stdLogger{level: l.level, out: l.out, fields: fields}
+}
+
+// formatLogValue formats a field's value, quoting it if it's empty or would otherwise be ambiguous.
+func formatLogValue(value interface{}) string {
+	formatted := fmt.Sprint(value)
+	if formatted == "" || strings.ContainsAny(formatted, " \t\n\"=") {
+		return strconv.Quote(formatted)
+	}
+	return formatted
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogLevelDebug, "debug: ", format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogLevelInfo, "info: ", format, args...)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogLevelWarn, "warning: ", format, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogLevelError, "error: ", format, args...)
+}
+
+// newRequestID returns a random ID which identifies a request's log messages.
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// actionLogFields returns the log fields identifying an action: its type and the apps it targets.
+func actionLogFields(action ActionSpec) []interface{} {
+	fields := []interface{}{"action", actionTypeLabel(action)}
+	if action.App == nil {
+		return fields
+	}
+	apps, err := targetApps(*action.App)
+	if err != nil || len(apps) == 0 {
+		return fields
+	}
+	names := make([]string, len(apps))
+	for i, app := range apps {
+		names[i] = app.Name
+	}
+	return append(fields, "app", strings.Join(names, ","))
+}
+
+type loggerKey struct{}
+
+// contextWithLogger returns a copy of ctx which carries logger, so that messages logged while handling a request
+// include its fields.
+func contextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger carried by ctx, or the executor's logger if there isn't one.
+func (e *ApiExecutor) loggerFrom(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return e.logger
+}
+
+// contextLogger returns the logger carried by ctx, or one logging info and above, like the executor's default, if there
+// isn't one. It's for functions which aren't executor methods.
+func contextLogger(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return NewLogger(LogLevelInfo)
+}
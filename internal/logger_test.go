@@ -0,0 +1,107 @@
+package argocd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]LogLevel{
+		"debug":   LogLevelDebug,
+		"info":    LogLevelInfo,
+		"WARN":    LogLevelWarn,
+		"warning": LogLevelWarn,
+		"error":   LogLevelError,
+	} {
+		level, err := ParseLogLevel(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, level)
+	}
+	_, err := ParseLogLevel("verbose")
+	require.ErrorContains(t, err, "unknown log level")
+}
+
+func Test_stdLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := &stdLogger{level: LogLevelWarn, out: log.New(&buf, "", 0)}
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+	assert.Equal(t, "warning: warn 3\nerror: error 4\n", buf.String())
+}
+
+func Test_stdLogger_With(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger := &stdLogger{level: LogLevelInfo, out: log.New(&buf, "", 0)}
+	withApp := logger.With("app", "my-app")
+	withApp.With("template", "", "message", `say "hi"`, "dangling").Infof("syncing %d apps", 1)
+	withApp.Infof("done")
+	logger.Infof("no fields")
+	assert.Equal(t, "info: syncing 1 apps app=my-app template=\"\" message=\"say \\\"hi\\\"\" dangling=(MISSING)\n"+
+		"info: done app=my-app\ninfo: no fields\n", buf.String())
+}
+
+func Test_actionLogFields(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []interface{}{"action", "invalid"}, actionLogFields(ActionSpec{}))
+	assert.Equal(t, []interface{}{"action", "diff", "app", "my-app"},
+		actionLogFields(ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "my-app"}}}}))
+	assert.Equal(t, []interface{}{"action", "sync", "app", "app-1,app-2"},
+		actionLogFields(ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: app-1}, {name: app-2}]"}}}))
+	assert.Equal(t, []interface{}{"action", "list"}, actionLogFields(ActionSpec{App: &AppActionSpec{List: &ListAction{}}}))
+}
+
+func TestApiExecutor_Execute_logging(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	client, _ := newTestFakes(t, nil, nil)
+	e := NewApiExecutor(client, "", WithLogger(&stdLogger{level: LogLevelDebug, out: log.New(&buf, "", 0)}))
+	reply := e.Execute(executor.ExecuteTemplateArgs{
+		Template: &wfv1.Template{
+			Name:   "promote",
+			Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(`{"argocd": {"app": {"diff": {"app": {"name": "missing-app"}}}}}`)}},
+		},
+	})
+	require.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1, "the error must be logged once")
+	assert.Regexp(t, regexp.MustCompile(`^error: action failed: .* requestID=[0-9a-f]{16} template=promote action=diff app=missing-app$`), lines[0])
+}
+
+func TestApiExecutor_loggerFrom(t *testing.T) {
+	t.Parallel()
+
+	e := NewApiExecutor(nil, "")
+	assert.Same(t, e.logger, e.loggerFrom(context.Background()))
+	logger := e.logger.With("requestID", "abc")
+	assert.Same(t, logger, e.loggerFrom(contextWithLogger(context.Background(), logger)))
+}
+
+func Test_contextLogger(t *testing.T) {
+	t.Parallel()
+
+	assert.NotNil(t, contextLogger(context.Background()))
+	logger := NewLogger(LogLevelDebug).With("requestID", "abc")
+	assert.Same(t, logger, contextLogger(contextWithLogger(context.Background(), logger)))
+}
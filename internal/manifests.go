@@ -0,0 +1,99 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/pointer"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// redactedValue replaces the values of Secrets written to outputs, like the Argo CD UI does.
+const redactedValue = "++++++++"
+
+// appManifestsPath returns the path, relative to the output directory, of the file holding the app's manifests. Apps
+// without a namespace are placed under `_default`.
+func appManifestsPath(app App) string {
+	namespace := app.Namespace
+	if namespace == "" {
+		namespace = "_default"
+	}
+	return filepath.Join(sanitizePathSegment(namespace), sanitizePathSegment(app.Name)+".yaml")
+}
+
+// appManifests is the manifests file writeAppManifests wrote for an app.
+type appManifests struct {
+	// revision is the revision the manifests were rendered from.
+	revision string
+	// contents are what was written to the file.
+	contents string
+	// truncated is true if the file was cut to fit the size cap.
+	truncated bool
+}
+
+// writeAppManifests fetches the app's rendered manifests at revision, or at its target revision if revision is empty,
+// and writes them, with Secret values redacted, to a single YAML file under dir. The file starts with a comment naming
+// the revision the manifests were rendered from. If maxBytes is positive, the file is cut down to at most maxBytes the
+// same way a text diff is.
+func writeAppManifests(ctx context.Context, dir string, app App, revision string, maxBytes int, appClient application.ApplicationServiceClient) (appManifests, error) {
+	res, err := appClient.GetManifests(ctx, &application.ApplicationManifestQuery{
+		Name:         pointer.String(app.Name),
+		AppNamespace: pointer.String(app.Namespace),
+		Revision:     optionalRevision(revision),
+	})
+	if err != nil {
+		return appManifests{}, fmt.Errorf("failed to get manifests: %w", err)
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "# revision: %s\n", res.Revision)
+	for _, manifest := range res.Manifests {
+		obj, err := v1alpha1.UnmarshalToUnstructured(manifest)
+		if err != nil {
+			return appManifests{}, fmt.Errorf("failed to unmarshal manifest to unstructured: %w", err)
+		}
+		redactSecret(obj)
+		manifestYAML, err := k8syaml.Marshal(obj.Object)
+		if err != nil {
+			return appManifests{}, fmt.Errorf("failed to marshal manifest: %w", err)
+		}
+		out.WriteString("---\n")
+		out.Write(manifestYAML)
+	}
+	result := appManifests{revision: res.Revision, contents: out.String()}
+	if maxBytes > 0 && len(result.contents) > maxBytes {
+		result.contents = truncateTextDiff(result.contents, maxBytes)
+		result.truncated = true
+	}
+	path := filepath.Join(dir, appManifestsPath(app))
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return appManifests{}, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = os.WriteFile(path, []byte(result.contents), 0o644)
+	if err != nil {
+		return appManifests{}, fmt.Errorf("failed to write file: %w", err)
+	}
+	return result, nil
+}
+
+// redactSecret replaces the values of a Secret's data and stringData with redactedValue. Other objects are left as-is.
+func redactSecret(obj *unstructured.Unstructured) {
+	if obj == nil || obj.GetKind() != "Secret" || obj.GroupVersionKind().Group != "" {
+		return
+	}
+	for _, field := range []string{"data", "stringData"} {
+		values, ok := obj.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range values {
+			values[key] = redactedValue
+		}
+	}
+}
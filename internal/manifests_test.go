@@ -0,0 +1,69 @@
+package argocd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_appManifestsPath(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, filepath.Join("argocd", "my-app.yaml"), appManifestsPath(App{Namespace: "argocd", Name: "my-app"}))
+	assert.Equal(t, filepath.Join("_default", "my-app.yaml"), appManifestsPath(App{Name: "my-app"}))
+}
+
+func Test_writeAppManifests(t *testing.T) {
+	t.Parallel()
+
+	_, appClient := newTestFakes(t, nil, nil)
+	appClient.manifests = []string{
+		`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "my-config"}, "data": {"key": "value"}}`,
+		`{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "my-secret"}, "data": {"password": "aHVudGVyMg=="}, "stringData": {"token": "abc"}}`,
+	}
+	appClient.manifestRevisions = []string{"abc123"}
+	dir := t.TempDir()
+
+	manifests, err := writeAppManifests(context.Background(), dir, App{Namespace: "argocd", Name: "my-app"}, "", 0, appClient)
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", manifests.revision)
+	assert.False(t, manifests.truncated)
+	out, err := os.ReadFile(filepath.Join(dir, "argocd", "my-app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, manifests.contents, string(out))
+	assert.Contains(t, string(out), "# revision: abc123\n")
+	assert.Contains(t, string(out), "key: value")
+	assert.Contains(t, string(out), "password: ++++++++")
+	assert.Contains(t, string(out), "token: ++++++++")
+	assert.NotContains(t, string(out), "aHVudGVyMg==")
+
+	t.Run("capped", func(t *testing.T) {
+		dir := t.TempDir()
+		manifests, err := writeAppManifests(context.Background(), dir, App{Namespace: "argocd", Name: "my-app"}, "", 100, appClient)
+		require.NoError(t, err)
+		assert.True(t, manifests.truncated)
+		assert.LessOrEqual(t, len(manifests.contents), 100)
+		assert.Contains(t, manifests.contents, "... (truncated, ")
+		out, err := os.ReadFile(filepath.Join(dir, "argocd", "my-app.yaml"))
+		require.NoError(t, err)
+		assert.Equal(t, manifests.contents, string(out))
+	})
+}
+
+func Test_redactSecret(t *testing.T) {
+	t.Parallel()
+
+	notCoreSecret := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Secret",
+		"data":       map[string]interface{}{"key": "value"},
+	}}
+	redactSecret(notCoreSecret)
+	assert.Equal(t, "value", notCoreSecret.Object["data"].(map[string]interface{})["key"])
+	redactSecret(nil)
+}
@@ -0,0 +1,90 @@
+package argocd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+)
+
+// messageVariables are the variables node message templates may use. error is only set for failure messages.
+var messageVariables = map[string]bool{"action": true, "app": true, "revision": true, "error": true}
+
+// validateMessages checks that the action's message templates only use known variables.
+func (s ActionSpec) validateMessages() multiError {
+	var errs multiError
+	if err := validateMessage("successMessage", s.SuccessMessage, false); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateMessage("failureMessage", s.FailureMessage, true); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// validateMessage checks that template only uses known variables, and only uses ${error} if it's a failure message.
+func validateMessage(field, template string, failure bool) error {
+	unknown := make(map[string]bool)
+	os.Expand(template, func(name string) string {
+		if !messageVariables[name] || (name == "error" && !failure) {
+			unknown[name] = true
+		}
+		return ""
+	})
+	if len(unknown) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, "${"+name+"}")
+	}
+	sort.Strings(names)
+	return fmt.Errorf("%s uses unknown variables: %s", field, strings.Join(names, ", "))
+}
+
+// nodeMessage expands the variables in a message template for an action which returned result and err.
+func nodeMessage(template string, action ActionSpec, result actionResult, err error) string {
+	variables := map[string]string{
+		"action":   actionTypeLabel(action),
+		"app":      strings.Join(messageApps(action, result), ", "),
+		"revision": parameterValue(result.parameters, "revision"),
+	}
+	if err != nil {
+		variables["error"] = err.Error()
+	}
+	return os.Expand(template, func(name string) string {
+		return variables[name]
+	})
+}
+
+// messageApps returns the apps an action acted on, as namespace/name if they have a namespace. For a sync, they're the
+// apps which were synced, including the ones matched by a selector or ApplicationSet.
+func messageApps(action ActionSpec, result actionResult) []string {
+	if result.apps != nil {
+		return result.apps
+	}
+	if action.App == nil {
+		return nil
+	}
+	apps, err := targetApps(*action.App)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, len(apps))
+	for i, app := range apps {
+		keys[i] = appKey(app)
+	}
+	return keys
+}
+
+// parameterValue returns the value of the named output parameter, or an empty string if there's none.
+func parameterValue(parameters []wfv1.Parameter, name string) string {
+	for _, param := range parameters {
+		if param.Name == name && param.Value != nil {
+			return param.Value.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package argocd
+
+import (
+	"errors"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nodeMessage(t *testing.T) {
+	t.Parallel()
+
+	refresh := ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app", Namespace: "argocd"}}}}
+	sync := ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Selector: "team=payments"}}}
+	revision := wfv1.Parameter{Name: "revision", Value: wfv1.AnyStringPtr("abc123")}
+	testCases := []struct {
+		name     string
+		template string
+		action   ActionSpec
+		result   actionResult
+		err      error
+		expected string
+	}{
+		{"action and app", "${action} of ${app} done", refresh, actionResult{}, nil, "refresh of argocd/my-app done"},
+		{"synced apps", "synced ${app} to ${revision}", sync, actionResult{apps: []string{"a", "b"}, parameters: []wfv1.Parameter{revision}}, nil, "synced a, b to abc123"},
+		{"no revision", "synced ${app} to ${revision}", refresh, actionResult{}, nil, "synced argocd/my-app to "},
+		{"error", "${app}: ${error}", refresh, actionResult{}, errors.New("boom"), "argocd/my-app: boom"},
+		{"no variables", "done", refresh, actionResult{}, nil, "done"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, testCase.expected, nodeMessage(testCase.template, testCase.action, testCase.result, testCase.err))
+		})
+	}
+}
+
+func Test_validateMessage(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, validateMessage("successMessage", "${action} of $app to ${revision}", false))
+	assert.NoError(t, validateMessage("failureMessage", "${error}", true))
+	assert.EqualError(t, validateMessage("successMessage", "${error}", false), "successMessage uses unknown variables: ${error}")
+	assert.EqualError(t, validateMessage("failureMessage", "${b} ${a} ${b}", true), "failureMessage uses unknown variables: ${a}, ${b}")
+}
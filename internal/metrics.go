@@ -0,0 +1,88 @@
+package argocd
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the actions the executor runs.
+type Metrics struct {
+	actions        *prometheus.CounterVec
+	actionDuration *prometheus.HistogramVec
+	circuitState   prometheus.Gauge
+}
+
+// NewMetrics creates the executor's metrics and registers them with registerer.
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "executor_actions_total",
+			Help: "Number of actions run, by action type and result.",
+		}, []string{"type", "result"}),
+		actionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "executor_action_duration_seconds",
+			Help:    "How long actions took to run, by action type.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800},
+		}, []string{"type"}),
+		circuitState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "executor_api_circuit_state",
+			Help: "State of the circuit breaker around Argo CD API calls: 0 closed, 1 open, 2 half-open.",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{m.actions, m.actionDuration, m.circuitState} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// observe records an action of the given type which started at start and returned err.
+func (m *Metrics) observe(actionType string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.actions.WithLabelValues(actionType, actionResultLabel(err)).Inc()
+	m.actionDuration.WithLabelValues(actionType).Observe(time.Since(start).Seconds())
+}
+
+// setCircuitState records the state of the circuit breaker around Argo CD API calls.
+func (m *Metrics) setCircuitState(state circuitState) {
+	if m == nil {
+		return
+	}
+	m.circuitState.Set(float64(state))
+}
+
+// actionTypeLabel returns the type label of an action: the name of its action type, diffThenSync, validate for actions
+// which are only validated, or invalid for actions which don't have exactly one type.
+func actionTypeLabel(action ActionSpec) string {
+	if action.ValidateOnly {
+		return "validate"
+	}
+	if action.App == nil {
+		return "invalid"
+	}
+	if action.App.DiffThenSync {
+		return "diffThenSync"
+	}
+	actionTypes := appActionTypes(*action.App)
+	if len(actionTypes) != 1 {
+		return "invalid"
+	}
+	return actionTypes[0]
+}
+
+// actionResultLabel returns the result label of an action which returned err: succeeded, partial, or failed.
+func actionResultLabel(err error) string {
+	if err == nil {
+		return "succeeded"
+	}
+	var partial partialError
+	if errors.As(err, &partial) {
+		return "partial"
+	}
+	return "failed"
+}
@@ -0,0 +1,56 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApiExecutor_metrics(t *testing.T) {
+	t.Parallel()
+
+	registry := prometheus.NewRegistry()
+	metrics, err := NewMetrics(registry)
+	require.NoError(t, err)
+
+	client, _ := newTestFakes(t, nil, nil)
+	e := NewApiExecutor(client, "", WithMetrics(metrics))
+	_, err = e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: my-app}]"}}})
+	require.NoError(t, err)
+	_, err = e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "my-app"}}}})
+	require.NoError(t, err)
+	_, err = e.runAction(context.Background(), ActionSpec{App: &AppActionSpec{}})
+	require.Error(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.actions.WithLabelValues("sync", "succeeded")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.actions.WithLabelValues("diff", "succeeded")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.actions.WithLabelValues("invalid", "failed")))
+	assert.Equal(t, 3, testutil.CollectAndCount(metrics.actionDuration), "each action type gets its own histogram")
+
+	_, err = NewMetrics(registry)
+	assert.Error(t, err, "registering the metrics twice must fail")
+}
+
+func Test_actionTypeLabel(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "sync", actionTypeLabel(ActionSpec{App: &AppActionSpec{Sync: &SyncAction{}}}))
+	assert.Equal(t, "refresh", actionTypeLabel(ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{}}}))
+	assert.Equal(t, "diffThenSync", actionTypeLabel(ActionSpec{App: &AppActionSpec{Sync: &SyncAction{}, Diff: &DiffAction{}, DiffThenSync: true}}))
+	assert.Equal(t, "invalid", actionTypeLabel(ActionSpec{App: &AppActionSpec{Sync: &SyncAction{}, Diff: &DiffAction{}}}))
+	assert.Equal(t, "invalid", actionTypeLabel(ActionSpec{}))
+	assert.Equal(t, "validate", actionTypeLabel(ActionSpec{App: &AppActionSpec{Sync: &SyncAction{}}, ValidateOnly: true}))
+}
+
+func Test_actionResultLabel(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "succeeded", actionResultLabel(nil))
+	assert.Equal(t, "partial", actionResultLabel(partialError{err: errors.New("app failed")}))
+	assert.Equal(t, "failed", actionResultLabel(errors.New("action failed")))
+}
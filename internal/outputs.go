@@ -0,0 +1,147 @@
+package argocd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+)
+
+// resolveOutputDirs returns a copy of action whose output directories are resolved under baseDir, so that an action
+// can't write outside of it. The directories are created if they don't exist yet.
+func resolveOutputDirs(action ActionSpec, baseDir string) (ActionSpec, error) {
+	if action.App == nil {
+		return action, nil
+	}
+	app := *action.App
+	if app.Diff != nil && app.Diff.OutputDir != "" {
+		diff := *app.Diff
+		var err error
+		diff.OutputDir, err = resolveOutputDir(diff.OutputDir, baseDir)
+		if err != nil {
+			return action, fmt.Errorf("invalid diff outputDir: %w", err)
+		}
+		app.Diff = &diff
+	}
+	if app.Sync != nil && app.Sync.ManifestsOutputDir != "" {
+		sync := *app.Sync
+		var err error
+		sync.ManifestsOutputDir, err = resolveOutputDir(sync.ManifestsOutputDir, baseDir)
+		if err != nil {
+			return action, fmt.Errorf("invalid sync manifestsOutputDir: %w", err)
+		}
+		app.Sync = &sync
+	}
+	action.App = &app
+	return action, nil
+}
+
+// resolveOutputDir returns the absolute path of dir, which must be relative to baseDir and stay inside of it, and
+// creates it. Symlinks are followed before checking, so that they can't lead out of baseDir.
+func resolveOutputDir(dir string, baseDir string) (string, error) {
+	if baseDir == "" {
+		return "", errors.New("files can't be written, since no output base directory is configured")
+	}
+	if filepath.IsAbs(dir) {
+		return "", fmt.Errorf("%q must be relative to the output base directory", dir)
+	}
+	resolvedBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the output base directory: %w", err)
+	}
+	path := filepath.Join(resolvedBase, dir)
+	if !isInsideDir(path, resolvedBase) {
+		return "", fmt.Errorf("%q is outside of the output base directory", dir)
+	}
+	// The closest existing parent is checked before creating anything, so that a symlink can't get the directory
+	// created outside of the base directory.
+	existing := path
+	for {
+		_, err = os.Lstat(existing)
+		if err == nil || existing == resolvedBase {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolvedExisting, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", dir, err)
+	}
+	if !isInsideDir(resolvedExisting, resolvedBase) {
+		return "", fmt.Errorf("%q is outside of the output base directory", dir)
+	}
+	err = os.MkdirAll(path, 0o755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", dir, err)
+	}
+	if !isInsideDir(resolved, resolvedBase) {
+		return "", fmt.Errorf("%q is outside of the output base directory", dir)
+	}
+	return resolved, nil
+}
+
+// isInsideDir returns true if path is dir or is under it. Both must be clean, absolute paths.
+func isInsideDir(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// fileContents returns a JSON object mapping the paths of the written files to their contents, and true if some files
+// had to be left out of it. Files are included in path order until the next one would make the object larger than
+// maxBytes, if maxBytes is positive.
+func fileContents(files map[string]string, maxBytes int) (string, bool, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	included := make(map[string]string, len(files))
+	out := []byte("{}")
+	truncated := false
+	for _, path := range paths {
+		included[path] = files[path]
+		next, err := json.Marshal(included)
+		if err != nil {
+			return "", false, err
+		}
+		if maxBytes > 0 && len(next) > maxBytes {
+			delete(included, path)
+			truncated = true
+			break
+		}
+		out = next
+	}
+	return string(out), truncated, nil
+}
+
+// manifestsParameters returns the `manifests` output parameter, a JSON object mapping the paths of the manifests files
+// the sync results recorded to their contents, and the `manifestsTruncated` parameter, which is true if a file was cut
+// or left out of it to fit maxBytes.
+func manifestsParameters(results []appSyncResult, maxBytes int) ([]wfv1.Parameter, error) {
+	files := make(map[string]string)
+	truncated := false
+	for _, result := range results {
+		if result.manifests == nil {
+			continue
+		}
+		files[appManifestsPath(App{Name: result.Name, Namespace: result.Namespace})] = result.manifests.contents
+		truncated = truncated || result.manifests.truncated
+	}
+	contents, omitted, err := fileContents(files, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifests: %w", err)
+	}
+	return []wfv1.Parameter{
+		{Name: "manifests", Value: wfv1.AnyStringPtr(contents)},
+		{Name: "manifestsTruncated", Value: wfv1.AnyStringPtr(truncated || omitted)},
+	}, nil
+}
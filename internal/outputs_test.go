@@ -0,0 +1,176 @@
+package argocd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_resolveOutputDir(t *testing.T) {
+	t.Parallel()
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(base, "link")))
+
+	t.Run("relative", func(t *testing.T) {
+		dir, err := resolveOutputDir("diffs/my-app", base)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(base, "diffs", "my-app"), dir)
+		assert.DirExists(t, dir)
+	})
+
+	t.Run("no base directory configured", func(t *testing.T) {
+		_, err := resolveOutputDir("diffs", "")
+		assert.ErrorContains(t, err, "no output base directory is configured")
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		_, err := resolveOutputDir(filepath.Join(base, "diffs"), base)
+		assert.ErrorContains(t, err, "must be relative to the output base directory")
+	})
+
+	t.Run("outside of the base directory", func(t *testing.T) {
+		for _, dir := range []string{"..", "../diffs", "diffs/../../diffs", "link", "link/diffs"} {
+			_, err := resolveOutputDir(dir, base)
+			assert.ErrorContains(t, err, "is outside of the output base directory", dir)
+		}
+		entries, err := os.ReadDir(outside)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func Test_fileContents(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"b.diff": "bbbb", "a.diff": "aaaa"}
+
+	contents, truncated, err := fileContents(files, 0)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a.diff": "aaaa", "b.diff": "bbbb"}`, contents)
+	assert.False(t, truncated)
+
+	contents, truncated, err = fileContents(files, len(`{"a.diff":"aaaa"}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a.diff": "aaaa"}`, contents, "files are kept in path order")
+	assert.True(t, truncated)
+
+	contents, truncated, err = fileContents(files, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "{}", contents)
+	assert.True(t, truncated)
+}
+
+func TestApiExecutor_Execute_diffOutputDir(t *testing.T) {
+	t.Parallel()
+
+	newDriftedFakes := func() *fakeApiClient {
+		live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+		target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+		client, _ := newTestFakes(t, live, target)
+		return client
+	}
+	run := func(e ApiExecutor, pluginJSON string) executor.ExecuteTemplateReply {
+		return e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+		})
+	}
+
+	t.Run("written under the base directory", func(t *testing.T) {
+		t.Parallel()
+		base := t.TempDir()
+		e := NewApiExecutor(newDriftedFakes(), "token", WithOutputBaseDir(base))
+		reply := run(e, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "outputDir": "diffs"}}}}`)
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+		assert.Empty(t, reply.Node.Outputs.Artifacts)
+		var files map[string]string
+		require.NoError(t, json.Unmarshal([]byte(parameter(t, reply, "diffFiles")), &files))
+		path := filepath.Join("ConfigMap", "my-namespace", "my-config.diff")
+		require.Contains(t, files, path)
+		written, err := os.ReadFile(filepath.Join(base, "diffs", path))
+		require.NoError(t, err)
+		assert.Equal(t, string(written), files[path])
+		assert.Equal(t, "false", parameter(t, reply, "diffFilesTruncated"))
+	})
+
+	t.Run("no base directory configured", func(t *testing.T) {
+		t.Parallel()
+		reply := execute(t, newDriftedFakes(), `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "outputDir": "/tmp/diffs"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "no output base directory is configured")
+	})
+
+	t.Run("outside of the base directory", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(newDriftedFakes(), "token", WithOutputBaseDir(t.TempDir()))
+		reply := run(e, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}, "outputDir": "../diffs"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "is outside of the output base directory")
+	})
+}
+
+func TestApiExecutor_Execute_manifestsOutputDir(t *testing.T) {
+	t.Parallel()
+
+	newFakes := func() *fakeApiClient {
+		client, _ := newTestFakes(t, nil, []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "value"})})
+		return client
+	}
+	run := func(e ApiExecutor, pluginJSON string) executor.ExecuteTemplateReply {
+		return e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(pluginJSON)}}},
+		})
+	}
+
+	t.Run("written under the base directory", func(t *testing.T) {
+		t.Parallel()
+		base := t.TempDir()
+		e := NewApiExecutor(newFakes(), "token", WithOutputBaseDir(base))
+		reply := run(e, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]", "manifestsOutputDir": "manifests"}}}}`)
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+		assert.Empty(t, reply.Node.Outputs.Artifacts)
+		var files map[string]string
+		require.NoError(t, json.Unmarshal([]byte(parameter(t, reply, "manifests")), &files))
+		path := filepath.Join("argocd", "my-app.yaml")
+		require.Contains(t, files, path)
+		written, err := os.ReadFile(filepath.Join(base, "manifests", path))
+		require.NoError(t, err)
+		assert.Equal(t, string(written), files[path])
+		assert.Contains(t, files[path], "name: my-config")
+		assert.Equal(t, "false", parameter(t, reply, "manifestsTruncated"))
+	})
+
+	t.Run("capped", func(t *testing.T) {
+		t.Parallel()
+		base := t.TempDir()
+		e := NewApiExecutor(newFakes(), "token", WithOutputBaseDir(base), WithMaxDiffOutputBytes(60))
+		reply := run(e, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]", "manifestsOutputDir": "manifests"}}}}`)
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+		assert.Equal(t, "true", parameter(t, reply, "manifestsTruncated"))
+		written, err := os.ReadFile(filepath.Join(base, "manifests", "argocd", "my-app.yaml"))
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(written), 60)
+
+		reply = run(e, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]", "manifestsOutputDir": "manifests", "maxManifestsBytes": -1}}}}`)
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+		assert.Equal(t, "false", parameter(t, reply, "manifestsTruncated"), "a negative cap overrides the default")
+	})
+
+	t.Run("no base directory configured", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "manifestsOutputDir": "/tmp/manifests"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "no output base directory is configured")
+		assert.Empty(t, appClient.syncRequests, "nothing is synced if the manifests can't be recorded")
+	})
+}
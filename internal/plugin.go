@@ -1,10 +1,10 @@
 package argocd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
 	"net/http"
 
 	// metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -16,6 +16,7 @@ var (
 	ErrWrongContentType = errors.New("Content-Type header is not set to 'application/json'")
 	ErrReadingBody      = errors.New("couldn't read request body")
 	ErrMarshallingBody  = errors.New("couldn't unmarshal request body")
+	ErrUnauthorized     = errors.New("request isn't authorized")
 )
 
 // Executor performs the tasks requested by the Workflow.
@@ -25,40 +26,84 @@ type Executor interface {
 	Execute(args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply
 }
 
+// requestTrackingExecutor is an Executor which tracks the requests it handles, so that it can refuse new ones and wait
+// for in-flight ones when it shuts down.
+type requestTrackingExecutor interface {
+	startRequest() bool
+	endRequest()
+}
+
+// contextExecutor is an Executor which can run a template within a context, so that its work is cancelled if the
+// request is.
+type contextExecutor interface {
+	ExecuteContext(ctx context.Context, args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply
+}
+
+// loggingExecutor is an Executor with a leveled logger, which the handler also uses for the requests it rejects.
+type loggingExecutor interface {
+	loggerFrom(ctx context.Context) Logger
+}
+
 func ArgocdPlugin(plugin Executor) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if tracker, ok := plugin.(requestTrackingExecutor); ok {
+			if !tracker.startRequest() {
+				http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer tracker.endRequest()
+		}
+
+		var logger Logger = NewLogger(LogLevelInfo)
+		if loggingPlugin, ok := plugin.(loggingExecutor); ok {
+			logger = loggingPlugin.loggerFrom(req.Context())
+		}
+		logger = logger.With("remoteAddr", req.RemoteAddr)
+
+		if err := plugin.Authorize(req); err != nil {
+			logger.Warnf("%v: %v", ErrUnauthorized.Error(), err)
+			http.Error(w, ErrUnauthorized.Error(), http.StatusForbidden)
+			return
+		}
+
 		if header := req.Header.Get("Content-Type"); header != "application/json" {
-			log.Print(ErrWrongContentType)
+			logger.Warnf("%v", ErrWrongContentType)
 			http.Error(w, ErrWrongContentType.Error(), http.StatusBadRequest)
 			return
 		}
 
 		body, err := io.ReadAll(req.Body)
 		if err != nil {
-			log.Printf("%v: %v", ErrReadingBody.Error(), err)
+			logger.Warnf("%v: %v", ErrReadingBody.Error(), err)
 			http.Error(w, ErrReadingBody.Error(), http.StatusBadRequest)
 			return
 		}
 
 		args := executor.ExecuteTemplateArgs{}
 		if err := json.Unmarshal(body, &args); err != nil || args.Workflow == nil || args.Template == nil {
-			log.Printf("%v: %v", ErrMarshallingBody.Error(), err)
+			logger.Warnf("%v: %v", ErrMarshallingBody.Error(), err)
 			http.Error(w, ErrMarshallingBody.Error(), http.StatusBadRequest)
 			return
 		}
 
-		resp := plugin.Execute(args)
+		var resp executor.ExecuteTemplateReply
+		if contextPlugin, ok := plugin.(contextExecutor); ok {
+			// The request's context is cancelled if the workflow controller closes the connection.
+			resp = contextPlugin.ExecuteContext(req.Context(), args)
+		} else {
+			resp = plugin.Execute(args)
+		}
 
 		jsonResp, err := json.Marshal(resp)
 		if err != nil {
-			log.Printf("Error marshalling result: %v", err)
+			logger.Errorf("failed to marshal result: %v", err)
 			http.Error(w, "something went wrong", http.StatusBadRequest)
 		}
 
 		w.WriteHeader(http.StatusOK)
 		_, err = w.Write(jsonResp)
 		if err != nil {
-			log.Printf("Error marshalling result: %v", err)
+			logger.Errorf("failed to write result: %v", err)
 		}
 		return
 	}
@@ -2,8 +2,10 @@ package argocd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -45,11 +48,13 @@ func (errReader) Read(_ []byte) (n int, err error) {
 type executorSpy struct {
 	AuthorizeCalled bool
 	ExecuteCalled   bool
+	// AuthorizeErr is returned by Authorize.
+	AuthorizeErr error
 }
 
 func (e *executorSpy) Authorize(_ *http.Request) error {
 	e.AuthorizeCalled = true
-	return nil
+	return e.AuthorizeErr
 }
 
 func (e *executorSpy) Execute(_ executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply {
@@ -57,6 +62,17 @@ func (e *executorSpy) Execute(_ executor.ExecuteTemplateArgs) executor.ExecuteTe
 	return executor.ExecuteTemplateReply{}
 }
 
+// contextExecutorSpy is an executorSpy which also records the context ExecuteContext is called with.
+type contextExecutorSpy struct {
+	executorSpy
+	ctx context.Context
+}
+
+func (e *contextExecutorSpy) ExecuteContext(ctx context.Context, args executor.ExecuteTemplateArgs) executor.ExecuteTemplateReply {
+	e.ctx = ctx
+	return e.Execute(args)
+}
+
 func TestArgocdPlugin(t *testing.T) {
 	spy := executorSpy{}
 	argocdPlugin := ArgocdPlugin(&spy)
@@ -116,3 +132,46 @@ func TestArgocdPlugin(t *testing.T) {
 		})
 	}
 }
+
+func TestArgocdPlugin_unauthorized(t *testing.T) {
+	spy := executorSpy{AuthorizeErr: errors.New("invalid agent token")}
+	request, _ := http.NewRequest(http.MethodPost, "/api/v1/template.execute", bytes.NewReader(validWorkflowBody))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	ArgocdPlugin(&spy)(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, ErrUnauthorized.Error(), strings.Trim(response.Body.String(), "\n"))
+	assert.True(t, spy.AuthorizeCalled)
+	assert.False(t, spy.ExecuteCalled)
+}
+
+func TestArgocdPlugin_logging(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewApiExecutor(nil, "token", WithLogger(&stdLogger{level: LogLevelInfo, out: log.New(&buf, "", 0)}))
+	request, _ := http.NewRequest(http.MethodPost, "/api/v1/template.execute", bytes.NewReader(validWorkflowBody))
+	request.Header.Set("Content-Type", "application/json")
+	request.RemoteAddr = "10.0.0.1:1234"
+	response := httptest.NewRecorder()
+	ArgocdPlugin(&e)(response, request)
+
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, "warning: request isn't authorized: missing Authorization header remoteAddr=10.0.0.1:1234\n", buf.String(),
+		"rejected requests are logged with the executor's logger")
+}
+
+func TestArgocdPlugin_requestContext(t *testing.T) {
+	spy := contextExecutorSpy{}
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/api/v1/template.execute", bytes.NewReader(validWorkflowBody))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	ArgocdPlugin(&spy)(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.True(t, spy.ExecuteCalled)
+	require.NotNil(t, spy.ctx)
+	require.NoError(t, spy.ctx.Err())
+	cancel()
+	assert.Error(t, spy.ctx.Err(), "cancelling the request must cancel the execution")
+}
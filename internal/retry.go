@@ -0,0 +1,236 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	repoapiclient "github.com/argoproj/argo-cd/v2/reposerver/apiclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"gopkg.in/yaml.v3"
+)
+
+// RetryPolicy decides whether, and how soon, a failed Argo CD API call is retried, based on its gRPC status code.
+type RetryPolicy struct {
+	// Limit is the maximum number of times a single call is retried.
+	Limit int
+	// Backoffs maps the codes which are retried to how long to wait before the first retry. Each subsequent retry waits
+	// Factor times as long as the previous one. Calls failing with any other code are not retried.
+	Backoffs map[codes.Code]time.Duration
+	// Factor multiplies the backoff after each retry. Defaults to 2.
+	Factor int
+}
+
+// DefaultRetryPolicy retries calls which failed because the API server was briefly unavailable or overloaded. Errors
+// like PermissionDenied or NotFound won't go away by retrying, so they fail immediately. It doesn't apply to Sync and
+// Patch calls, which are only retried if the action sets its own retry strategy.
+var DefaultRetryPolicy = RetryPolicy{
+	Limit: 3,
+	Backoffs: map[codes.Code]time.Duration{
+		codes.Unavailable:       100 * time.Millisecond,
+		codes.ResourceExhausted: 2 * time.Second,
+		codes.Aborted:           500 * time.Millisecond,
+	},
+}
+
+// ParseRetryPolicy parses a YAML retry policy like the following. Codes are named as in the gRPC documentation.
+//
+//	limit: 5
+//	backoffs:
+//	  Unavailable: 200ms
+//	  ResourceExhausted: 5s
+//	factor: 3
+func ParseRetryPolicy(policyYAML string) (RetryPolicy, error) {
+	var raw struct {
+		Limit    int               `yaml:"limit"`
+		Backoffs map[string]string `yaml:"backoffs"`
+		Factor   int               `yaml:"factor"`
+	}
+	err := yaml.Unmarshal([]byte(policyYAML), &raw)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("failed to unmarshal retry policy: %w", err)
+	}
+	if raw.Limit < 0 {
+		return RetryPolicy{}, fmt.Errorf("retry limit must not be negative")
+	}
+	if raw.Factor < 0 {
+		return RetryPolicy{}, fmt.Errorf("retry factor must not be negative")
+	}
+	codesByName := make(map[string]codes.Code)
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		codesByName[code.String()] = code
+	}
+	policy := RetryPolicy{Limit: raw.Limit, Backoffs: make(map[codes.Code]time.Duration), Factor: raw.Factor}
+	for name, backoff := range raw.Backoffs {
+		code, ok := codesByName[name]
+		if !ok {
+			return RetryPolicy{}, fmt.Errorf("unknown gRPC code %q", name)
+		}
+		duration, err := time.ParseDuration(backoff)
+		if err != nil {
+			return RetryPolicy{}, fmt.Errorf("failed to parse backoff for %s: %w", name, err)
+		}
+		policy.Backoffs[code] = duration
+	}
+	return policy, nil
+}
+
+// do calls call until it succeeds, fails with a code which isn't retried, runs out of retries, or ctx is done.
+func (p RetryPolicy) do(ctx context.Context, call func() error) error {
+	err := call()
+	for attempt := 0; err != nil && attempt < p.Limit; attempt++ {
+		backoff, ok := p.Backoffs[grpcCode(err)]
+		if !ok {
+			return err
+		}
+		factor := p.Factor
+		if factor == 0 {
+			factor = 2
+		}
+		for i := 0; i < attempt; i++ {
+			backoff *= time.Duration(factor)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		err = call()
+	}
+	return err
+}
+
+// policy returns the policy which retries the same codes as base, but with the strategy's limit, backoff and factor.
+// A strategy without a backoff keeps base's backoff for each code.
+func (s RetryStrategy) policy(base RetryPolicy) (RetryPolicy, error) {
+	if s.Limit < 0 {
+		return RetryPolicy{}, errors.New("retry limit must not be negative")
+	}
+	if s.Factor < 0 {
+		return RetryPolicy{}, errors.New("retry factor must not be negative")
+	}
+	policy := RetryPolicy{Limit: s.Limit, Backoffs: make(map[codes.Code]time.Duration), Factor: s.Factor}
+	for code, backoff := range base.Backoffs {
+		policy.Backoffs[code] = backoff
+	}
+	if s.Backoff != "" {
+		backoff, err := time.ParseDuration(s.Backoff)
+		if err != nil {
+			return RetryPolicy{}, fmt.Errorf("failed to parse retry backoff: %w", err)
+		}
+		for code := range policy.Backoffs {
+			policy.Backoffs[code] = backoff
+		}
+	}
+	return policy, nil
+}
+
+// retryingAppClient retries the Application API calls made by the plugin according to a RetryPolicy. Other calls are
+// passed through as-is.
+type retryingAppClient struct {
+	application.ApplicationServiceClient
+	policy RetryPolicy
+	// writePolicy, if set, retries Sync and Patch calls. They aren't idempotent: if a failed call reached the server, a
+	// retry fails, for example because the sync it started is already running, so they're only retried if the action
+	// opts in.
+	writePolicy *RetryPolicy
+}
+
+// write calls call once, or according to writePolicy if it's set.
+func (c *retryingAppClient) write(ctx context.Context, call func() error) error {
+	if c.writePolicy == nil {
+		return call()
+	}
+	return c.writePolicy.do(ctx, call)
+}
+
+func (c *retryingAppClient) List(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (list *v1alpha1.ApplicationList, err error) {
+	err = c.policy.do(ctx, func() error {
+		list, err = c.ApplicationServiceClient.List(ctx, in, opts...)
+		return err
+	})
+	return list, err
+}
+
+func (c *retryingAppClient) Get(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.policy.do(ctx, func() error {
+		app, err = c.ApplicationServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *retryingAppClient) GetManifests(ctx context.Context, in *application.ApplicationManifestQuery, opts ...grpc.CallOption) (res *repoapiclient.ManifestResponse, err error) {
+	err = c.policy.do(ctx, func() error {
+		res, err = c.ApplicationServiceClient.GetManifests(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *retryingAppClient) ManagedResources(ctx context.Context, in *application.ResourcesQuery, opts ...grpc.CallOption) (res *application.ManagedResourcesResponse, err error) {
+	err = c.policy.do(ctx, func() error {
+		res, err = c.ApplicationServiceClient.ManagedResources(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *retryingAppClient) Patch(ctx context.Context, in *application.ApplicationPatchRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.write(ctx, func() error {
+		app, err = c.ApplicationServiceClient.Patch(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *retryingAppClient) RevisionMetadata(ctx context.Context, in *application.RevisionMetadataQuery, opts ...grpc.CallOption) (metadata *v1alpha1.RevisionMetadata, err error) {
+	err = c.policy.do(ctx, func() error {
+		metadata, err = c.ApplicationServiceClient.RevisionMetadata(ctx, in, opts...)
+		return err
+	})
+	return metadata, err
+}
+
+func (c *retryingAppClient) Sync(ctx context.Context, in *application.ApplicationSyncRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = c.write(ctx, func() error {
+		app, err = c.ApplicationServiceClient.Sync(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+// retryingSettingsClient retries Settings API calls according to a RetryPolicy.
+type retryingSettingsClient struct {
+	settings.SettingsServiceClient
+	policy RetryPolicy
+}
+
+func (c *retryingSettingsClient) Get(ctx context.Context, in *settings.SettingsQuery, opts ...grpc.CallOption) (res *settings.Settings, err error) {
+	err = c.policy.do(ctx, func() error {
+		res, err = c.SettingsServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+// retryingVersionClient retries Version API calls according to a RetryPolicy.
+type retryingVersionClient struct {
+	version.VersionServiceClient
+	policy RetryPolicy
+}
+
+func (c *retryingVersionClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (res *version.VersionMessage, err error) {
+	err = c.policy.do(ctx, func() error {
+		res, err = c.VersionServiceClient.Version(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
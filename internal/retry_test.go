@@ -0,0 +1,222 @@
+package argocd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		policy, err := ParseRetryPolicy("limit: 5\nbackoffs:\n  Unavailable: 200ms\n  ResourceExhausted: 5s\nfactor: 3\n")
+		require.NoError(t, err)
+		assert.Equal(t, RetryPolicy{
+			Limit: 5,
+			Backoffs: map[codes.Code]time.Duration{
+				codes.Unavailable:       200 * time.Millisecond,
+				codes.ResourceExhausted: 5 * time.Second,
+			},
+			Factor: 3,
+		}, policy)
+	})
+
+	t.Run("unknown code", func(t *testing.T) {
+		_, err := ParseRetryPolicy("backoffs:\n  Sometimes: 1s\n")
+		require.ErrorContains(t, err, "unknown gRPC code")
+	})
+
+	t.Run("invalid backoff", func(t *testing.T) {
+		_, err := ParseRetryPolicy("backoffs:\n  Unavailable: soon\n")
+		require.Error(t, err)
+	})
+
+	t.Run("negative limit", func(t *testing.T) {
+		_, err := ParseRetryPolicy("limit: -1\n")
+		require.Error(t, err)
+	})
+
+	t.Run("negative factor", func(t *testing.T) {
+		_, err := ParseRetryPolicy("factor: -1\n")
+		require.Error(t, err)
+	})
+}
+
+func TestRetryPolicy_do(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{
+		Limit: 2,
+		Backoffs: map[codes.Code]time.Duration{
+			codes.Unavailable: time.Millisecond,
+		},
+	}
+	failing := func(code codes.Code, failures int) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= failures {
+				return status.Error(code, "failed")
+			}
+			return nil
+		}, &calls
+	}
+
+	t.Run("retriable code succeeds", func(t *testing.T) {
+		call, calls := failing(codes.Unavailable, 2)
+		require.NoError(t, policy.do(context.Background(), call))
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("retriable code runs out of retries", func(t *testing.T) {
+		call, calls := failing(codes.Unavailable, 3)
+		err := policy.do(context.Background(), call)
+		assert.Equal(t, codes.Unavailable, grpcCode(err))
+		assert.Equal(t, 3, *calls)
+	})
+
+	t.Run("non-retriable code fails immediately", func(t *testing.T) {
+		call, calls := failing(codes.PermissionDenied, 1)
+		err := policy.do(context.Background(), call)
+		assert.Equal(t, codes.PermissionDenied, grpcCode(err))
+		assert.Equal(t, 1, *calls)
+	})
+
+	t.Run("factor", func(t *testing.T) {
+		// The first retry waits 1ms and the second one an hour, so only the first one happens before the deadline.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		steep := RetryPolicy{Limit: 2, Backoffs: map[codes.Code]time.Duration{codes.Unavailable: time.Millisecond}, Factor: 3600000}
+		call, calls := failing(codes.Unavailable, 3)
+		require.Error(t, steep.do(ctx, call))
+		assert.Equal(t, 2, *calls)
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		slow := RetryPolicy{Limit: 2, Backoffs: map[codes.Code]time.Duration{codes.Unavailable: time.Hour}}
+		call, calls := failing(codes.Unavailable, 3)
+		require.Error(t, slow.do(ctx, call))
+		assert.Equal(t, 1, *calls)
+	})
+}
+
+func Test_retryingAppClient(t *testing.T) {
+	t.Parallel()
+
+	_, appClient := newTestFakes(t, nil, nil)
+	appClient.err = status.Error(codes.NotFound, "not found")
+	client := &retryingAppClient{ApplicationServiceClient: appClient, policy: RetryPolicy{
+		Limit:    3,
+		Backoffs: map[codes.Code]time.Duration{codes.Unavailable: time.Millisecond},
+	}}
+	_, err := client.Get(context.Background(), &application.ApplicationQuery{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"Get"}, appClient.calls)
+
+	appClient.calls = nil
+	appClient.err = status.Error(codes.Unavailable, "unavailable")
+	_, err = client.Get(context.Background(), &application.ApplicationQuery{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"Get", "Get", "Get", "Get"}, appClient.calls)
+
+	// Sync and Patch may have taken effect even if they failed, so they're only retried with a write policy.
+	appClient.calls = nil
+	_, err = client.Sync(context.Background(), &application.ApplicationSyncRequest{})
+	require.Error(t, err)
+	_, err = client.Patch(context.Background(), &application.ApplicationPatchRequest{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"Sync", "Patch"}, appClient.calls)
+
+	appClient.calls = nil
+	client.writePolicy = &RetryPolicy{Limit: 1, Backoffs: map[codes.Code]time.Duration{codes.Unavailable: time.Millisecond}}
+	_, err = client.Sync(context.Background(), &application.ApplicationSyncRequest{})
+	require.Error(t, err)
+	_, err = client.Patch(context.Background(), &application.ApplicationPatchRequest{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"Sync", "Sync", "Patch", "Patch"}, appClient.calls)
+}
+
+func TestRetryStrategy_policy(t *testing.T) {
+	t.Parallel()
+
+	base := RetryPolicy{
+		Limit: 3,
+		Backoffs: map[codes.Code]time.Duration{
+			codes.Unavailable:       100 * time.Millisecond,
+			codes.ResourceExhausted: 2 * time.Second,
+		},
+	}
+
+	t.Run("backoff", func(t *testing.T) {
+		policy, err := RetryStrategy{Limit: 5, Backoff: "1s", Factor: 3}.policy(base)
+		require.NoError(t, err)
+		assert.Equal(t, RetryPolicy{
+			Limit: 5,
+			Backoffs: map[codes.Code]time.Duration{
+				codes.Unavailable:       time.Second,
+				codes.ResourceExhausted: time.Second,
+			},
+			Factor: 3,
+		}, policy)
+	})
+
+	t.Run("default backoff", func(t *testing.T) {
+		policy, err := RetryStrategy{Limit: 1}.policy(base)
+		require.NoError(t, err)
+		assert.Equal(t, RetryPolicy{Limit: 1, Backoffs: base.Backoffs}, policy)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := RetryStrategy{Backoff: "soon"}.policy(base)
+		require.ErrorContains(t, err, "failed to parse retry backoff")
+		_, err = RetryStrategy{Limit: -1}.policy(base)
+		require.ErrorContains(t, err, "retry limit must not be negative")
+		_, err = RetryStrategy{Factor: -1}.policy(base)
+		require.ErrorContains(t, err, "retry factor must not be negative")
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		newClient := func(transientErrors ...error) (*fakeApiClient, *fakeAppClient) {
+			client, appClient := newTestFakes(t, nil, nil)
+			appClient.transientSyncErrors = transientErrors
+			return client, appClient
+		}
+		unavailable := status.Error(codes.Unavailable, "connection reset")
+
+		client, appClient := newClient(unavailable, unavailable)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "retry": {"limit": 2, "backoff": "1ms"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Len(t, appClient.syncRequests, 3)
+
+		// Without a strategy, sync requests aren't retried.
+		client, appClient = newClient(unavailable)
+		reply = execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Len(t, appClient.syncRequests, 1)
+
+		// The strategy's limit replaces the plugin's.
+		client, appClient = newClient(unavailable, unavailable)
+		reply = execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "retry": {"limit": 1, "backoff": "1ms"}}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Len(t, appClient.syncRequests, 2)
+
+		client, appClient = newClient(status.Error(codes.NotFound, "app not found"))
+		reply = execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "retry": {"limit": 2, "backoff": "1ms"}}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Len(t, appClient.syncRequests, 1)
+
+		client, _ = newClient()
+		reply = execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]", "retry": {"backoff": "soon"}}}}}`)
+		assert.Contains(t, reply.Node.Message, "invalid sync retry strategy")
+	})
+}
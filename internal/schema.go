@@ -0,0 +1,126 @@
+package argocd
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schemaEnums lists the values of the string types which only accept a fixed set of values.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(DiffOutputFormat("")):     {string(DiffOutputFormatText), string(DiffOutputFormatJSON)},
+	reflect.TypeOf(ErrorConditionPolicy("")): {string(ErrorConditionPolicyProceed), string(ErrorConditionPolicyFail), string(ErrorConditionPolicySkip)},
+	reflect.TypeOf(AutomatedSyncPolicy("")):  {string(AutomatedSyncPolicyProceed), string(AutomatedSyncPolicyWarn), string(AutomatedSyncPolicySkip)},
+	reflect.TypeOf(ValueSource("")):          {string(ValueSourceInline), string(ValueSourceBase64), string(ValueSourceFile)},
+}
+
+// schemaFieldEnums lists the values of plain string fields which only accept a fixed set of values, keyed by
+// {type}.{field}.
+var schemaFieldEnums = map[string][]string{
+	"DeleteAction.propagationPolicy": {"foreground", "background"},
+}
+
+// schemaRequired lists the fields which are tagged omitempty but which validation requires, by type.
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(PluginSpec{}):   {"argocd"},
+	reflect.TypeOf(App{}):          {"name"},
+	reflect.TypeOf(CreateAction{}): {"application"},
+}
+
+// Schema returns a JSON schema for the plugin block of a workflow template, generated from PluginSpec, so that
+// templates can be checked before they run. Each struct is a definition in `$defs`, named after its type. Unknown
+// fields are rejected, since the plugin would silently ignore them. The schema can't express every rule, like which
+// action types may be combined, so ActionSpec.Validate is still the final word.
+func Schema() map[string]interface{} {
+	defs := make(map[string]interface{})
+	root := schemaFor(reflect.TypeOf(PluginSpec{}), defs)
+	schema := map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "Argo CD executor plugin spec",
+		"$defs":   defs,
+	}
+	for key, value := range root {
+		schema[key] = value
+	}
+	return schema
+}
+
+// schemaFor returns the schema of a value of type t, adding the definitions of any structs it refers to to defs.
+func schemaFor(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if values, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{"type": "string", "enum": values}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), defs)
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			// Claim the name before recursing, in case the struct refers to itself.
+			defs[t.Name()] = nil
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), defs)}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema of a struct, with a property for each field which is marshaled to JSON. Fields
+// without omitempty are required, as are the ones listed in schemaRequired.
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := append([]string{}, schemaRequired[t]...)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		property := schemaFor(field.Type, defs)
+		if values, ok := schemaFieldEnums[t.Name()+"."+name]; ok {
+			property["enum"] = values
+		}
+		properties[name] = property
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// SchemaHandler serves the plugin spec's JSON schema.
+func SchemaHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(Schema())
+}
@@ -0,0 +1,94 @@
+package argocd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+
+	// Round-trip through JSON, so that the assertions see the schema as it's served.
+	out, err := json.Marshal(Schema())
+	require.NoError(t, err)
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &schema))
+	defs := schema["$defs"].(map[string]interface{})
+	def := func(name string) map[string]interface{} {
+		definition, _ := defs[name].(map[string]interface{})
+		return definition
+	}
+	property := func(def map[string]interface{}, name string) map[string]interface{} {
+		properties, _ := def["properties"].(map[string]interface{})
+		prop, _ := properties[name].(map[string]interface{})
+		return prop
+	}
+
+	t.Run("root", func(t *testing.T) {
+		assert.Equal(t, "object", schema["type"])
+		assert.Equal(t, []interface{}{"argocd"}, schema["required"])
+		assert.Equal(t, map[string]interface{}{"$ref": "#/$defs/ActionSpec"}, property(schema, "argocd"))
+	})
+
+	t.Run("actions", func(t *testing.T) {
+		appActions := def("AppActionSpec")
+		for _, action := range []string{"sync", "diff", "list", "setRevision", "create", "delete", "rollback", "terminate", "refresh", "waitForSync", "version"} {
+			assert.Contains(t, appActions["properties"], action)
+		}
+		assert.Equal(t, false, appActions["additionalProperties"], "unknown fields are rejected")
+		assert.Equal(t, map[string]interface{}{"type": "boolean"}, property(def("SyncAction"), "dryRun"))
+		assert.Equal(t, map[string]interface{}{"type": "integer"}, property(def("SyncAction"), "maxConcurrency"))
+		assert.Equal(t, map[string]interface{}{"type": "array", "items": map[string]interface{}{"$ref": "#/$defs/ResourceRef"}}, property(def("SyncAction"), "resources"))
+	})
+
+	t.Run("required fields", func(t *testing.T) {
+		assert.Equal(t, []interface{}{"name"}, def("App")["required"])
+		assert.Equal(t, []interface{}{"kind", "name"}, def("ResourceRef")["required"])
+		assert.Equal(t, []interface{}{"application"}, def("CreateAction")["required"])
+		assert.NotContains(t, def("SyncAction"), "required")
+	})
+
+	t.Run("enums", func(t *testing.T) {
+		assert.Equal(t, []interface{}{"text", "json"}, property(def("DiffAction"), "outputFormat")["enum"])
+		assert.Equal(t, []interface{}{"proceed", "fail", "skip"}, property(def("SyncAction"), "errorConditionPolicy")["enum"])
+		assert.Equal(t, []interface{}{"proceed", "warn", "skip"}, property(def("SyncAction"), "automatedSyncPolicy")["enum"])
+		assert.Equal(t, []interface{}{"inline", "base64", "file"}, property(def("SyncAction"), "appsSource")["enum"])
+		assert.Equal(t, []interface{}{"foreground", "background"}, property(def("DeleteAction"), "propagationPolicy")["enum"])
+	})
+}
+
+// Test_schemaEnums checks that the schema's enums agree with validation, so that they don't drift apart.
+func Test_schemaEnums(t *testing.T) {
+	t.Parallel()
+
+	for _, value := range schemaEnums[reflect.TypeOf(DiffOutputFormat(""))] {
+		assert.NoError(t, DiffOutputFormat(value).validate())
+	}
+	for _, value := range schemaEnums[reflect.TypeOf(ErrorConditionPolicy(""))] {
+		assert.NoError(t, ErrorConditionPolicy(value).validate())
+	}
+	for _, value := range schemaEnums[reflect.TypeOf(AutomatedSyncPolicy(""))] {
+		assert.Empty(t, SyncAction{AutomatedSyncPolicy: AutomatedSyncPolicy(value)}.validate())
+	}
+	for _, value := range schemaFieldEnums["DeleteAction.propagationPolicy"] {
+		assert.Empty(t, DeleteAction{App: App{Name: "my-app"}, Cascade: true, PropagationPolicy: value}.validate())
+	}
+}
+
+func TestSchemaHandler(t *testing.T) {
+	t.Parallel()
+
+	w := httptest.NewRecorder()
+	SchemaHandler(w, httptest.NewRequest("GET", "/schema", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/schema+json", w.Header().Get("Content-Type"))
+	var schema map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &schema))
+	assert.Contains(t, schema, "$defs")
+}
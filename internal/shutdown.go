@@ -0,0 +1,77 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultDrainTimeout is how long Shutdown waits for in-flight actions by default. It's a little shorter than a pod's
+// default termination grace period, so that the plugin exits on its own before it's killed.
+const DefaultDrainTimeout = 25 * time.Second
+
+// ErrShuttingDown is returned for requests which arrive after the executor started shutting down.
+var ErrShuttingDown = errors.New("plugin is shutting down")
+
+// requestTracker tracks the requests being handled, so that shutdown can wait for them.
+type requestTracker struct {
+	mu       sync.Mutex
+	draining bool
+	active   sync.WaitGroup
+}
+
+// start records the start of a request. It returns false, and the request must be refused, if the executor is
+// shutting down.
+func (t *requestTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active.Add(1)
+	return true
+}
+
+// done records the end of a request which start accepted.
+func (t *requestTracker) done() {
+	t.active.Done()
+}
+
+// isDraining reports whether the executor is shutting down.
+func (t *requestTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// startRequest records the start of a request, returning false if the executor is shutting down.
+func (e *ApiExecutor) startRequest() bool {
+	return e.requests.start()
+}
+
+// endRequest records the end of a request which startRequest accepted.
+func (e *ApiExecutor) endRequest() {
+	e.requests.done()
+}
+
+// Shutdown stops the executor accepting new requests, which are refused with ErrShuttingDown, and waits for in-flight
+// ones to finish. If ctx is done first, Shutdown returns an error and the remaining requests are abandoned.
+func (e *ApiExecutor) Shutdown(ctx context.Context) error {
+	e.requests.mu.Lock()
+	e.requests.draining = true
+	e.requests.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		e.requests.active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for in-flight actions: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,61 @@
+package argocd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApiExecutor_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	t.Run("waits for in-flight requests", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		require.True(t, e.startRequest())
+		shutdown := make(chan error)
+		go func() {
+			shutdown <- e.Shutdown(context.Background())
+		}()
+
+		select {
+		case <-shutdown:
+			t.Fatal("shutdown must wait for in-flight requests")
+		case <-time.After(20 * time.Millisecond):
+		}
+		assert.False(t, e.startRequest(), "new requests must be refused while draining")
+		assert.ErrorIs(t, e.Ready(context.Background()), ErrShuttingDown)
+
+		e.endRequest()
+		assert.NoError(t, <-shutdown)
+	})
+
+	t.Run("drain timeout", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		require.True(t, e.startRequest())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := e.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "gave up waiting for in-flight actions")
+	})
+
+	t.Run("refuses new requests with 503", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		require.NoError(t, e.Shutdown(context.Background()))
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/template.execute", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		ArgocdPlugin(&e)(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Contains(t, w.Body.String(), ErrShuttingDown.Error())
+	})
+}
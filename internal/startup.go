@@ -0,0 +1,391 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultAgentTokenFile is where Argo Workflows mounts the token the controller authenticates to the plugin with.
+const DefaultAgentTokenFile = "/var/run/argo/token"
+
+// DefaultAddr is the address the plugin listens on by default, which must match the port in the plugin's sidecar spec.
+const DefaultAddr = ":3000"
+
+const (
+	// DefaultConnectRetryLimit is how many times connecting to the Argo CD API server is retried at startup by default.
+	DefaultConnectRetryLimit = 10
+	// DefaultConnectBackoff is how long the plugin waits before first retrying to connect by default.
+	DefaultConnectBackoff = time.Second
+)
+
+// StartupConfig holds the settings which are only read when the plugin starts: where its tokens come from, how it
+// connects to Argo CD, how it serves requests, and how it logs.
+type StartupConfig struct {
+	// AgentTokenFile is the file the agent token, which requests from the workflow controller must carry, is read from.
+	AgentTokenFile string
+	// AuthTokenFile is the file the Argo CD auth token is read from. If it's empty, the API client reads the token from
+	// the ARGOCD_AUTH_TOKEN environment variable.
+	AuthTokenFile string
+	// Server is the address of the Argo CD API server. If it's empty, the API client reads it from the ARGOCD_SERVER
+	// environment variable.
+	Server string
+	// Insecure skips verifying the Argo CD API server's certificate.
+	Insecure bool
+	// PlainText connects to the Argo CD API server without TLS.
+	PlainText bool
+	// GRPCWeb connects using gRPC-web over HTTP/1.1 instead of gRPC, for ingresses and load balancers which don't
+	// support HTTP/2. If it's false, the API client tries gRPC first and falls back to gRPC-web.
+	GRPCWeb bool
+	// GRPCWebRootPath is the path the Argo CD API is served under, when an ingress serves it under a path prefix. It
+	// requires GRPCWeb.
+	GRPCWebRootPath string
+	// ConnectRetryLimit is how many times connecting to the Argo CD API server is retried at startup before the plugin
+	// gives up. Zero means the plugin gives up after the first failure.
+	ConnectRetryLimit int
+	// ConnectBackoff is how long to wait before the first retry. Each subsequent retry waits twice as long as the
+	// previous one, up to maxConnectBackoff.
+	ConnectBackoff time.Duration
+	// AgentTokenReloadInterval is how often the agent token file is re-read.
+	AgentTokenReloadInterval time.Duration
+	// Addr is the address the plugin listens on.
+	Addr string
+	// TLSCertFile and TLSKeyFile are the PEM-encoded certificate and key the plugin serves TLS with. If they're empty,
+	// the plugin serves plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSMinVersion is the oldest TLS version the plugin accepts.
+	TLSMinVersion uint16
+	// DrainTimeout is how long the plugin waits for in-flight actions to finish when it's stopped.
+	DrainTimeout time.Duration
+	// ReloadDrain makes a config reload wait for in-flight actions to finish before applying the new settings.
+	ReloadDrain bool
+	// LogLevel is the minimum severity of the messages the plugin logs.
+	LogLevel LogLevel
+}
+
+// DefaultStartupConfig returns the startup config used when nothing is configured.
+func DefaultStartupConfig() StartupConfig {
+	return StartupConfig{
+		AgentTokenFile: DefaultAgentTokenFile,
+		// TODO: verify the server's certificate by default once a root CA can be configured.
+		Insecure:                 true,
+		ConnectRetryLimit:        DefaultConnectRetryLimit,
+		ConnectBackoff:           DefaultConnectBackoff,
+		AgentTokenReloadInterval: DefaultAgentTokenReloadInterval,
+		Addr:                     DefaultAddr,
+		TLSMinVersion:            DefaultTLSMinVersion,
+		DrainTimeout:             DefaultDrainTimeout,
+		LogLevel:                 LogLevelInfo,
+	}
+}
+
+// ParseStartupConfig parses a YAML or JSON config like the following on top of base. Fields which aren't set keep
+// their value from base.
+//
+//	agentTokenFile: /var/run/argo/token
+//	authTokenFile: /var/run/argocd/token
+//	server: argocd-server.argocd.svc.cluster.local
+//	insecure: true
+//	plainText: false
+//	grpcWeb: true
+//	grpcWebRootPath: argo-cd
+//	connectRetryLimit: 10
+//	connectBackoff: 1s
+//	agentTokenReloadInterval: 30s
+//	addr: :3000
+//	tlsCertFile: /etc/plugin/tls/tls.crt
+//	tlsKeyFile: /etc/plugin/tls/tls.key
+//	tlsMinVersion: "1.3"
+//	drainTimeout: 25s
+//	reloadDrain: true
+//	logLevel: debug
+func ParseStartupConfig(configYAML string, base StartupConfig) (StartupConfig, error) {
+	var raw struct {
+		AgentTokenFile           *string `yaml:"agentTokenFile"`
+		AuthTokenFile            *string `yaml:"authTokenFile"`
+		Server                   *string `yaml:"server"`
+		Insecure                 *bool   `yaml:"insecure"`
+		PlainText                *bool   `yaml:"plainText"`
+		GRPCWeb                  *bool   `yaml:"grpcWeb"`
+		GRPCWebRootPath          *string `yaml:"grpcWebRootPath"`
+		ConnectRetryLimit        *int    `yaml:"connectRetryLimit"`
+		ConnectBackoff           *string `yaml:"connectBackoff"`
+		AgentTokenReloadInterval *string `yaml:"agentTokenReloadInterval"`
+		Addr                     *string `yaml:"addr"`
+		TLSCertFile              *string `yaml:"tlsCertFile"`
+		TLSKeyFile               *string `yaml:"tlsKeyFile"`
+		TLSMinVersion            *string `yaml:"tlsMinVersion"`
+		DrainTimeout             *string `yaml:"drainTimeout"`
+		ReloadDrain              *bool   `yaml:"reloadDrain"`
+		LogLevel                 *string `yaml:"logLevel"`
+	}
+	err := yaml.Unmarshal([]byte(configYAML), &raw)
+	if err != nil {
+		return StartupConfig{}, fmt.Errorf("failed to unmarshal startup config: %w", err)
+	}
+	config := base
+	if raw.AgentTokenFile != nil {
+		config.AgentTokenFile = *raw.AgentTokenFile
+	}
+	if raw.AuthTokenFile != nil {
+		config.AuthTokenFile = *raw.AuthTokenFile
+	}
+	if raw.Server != nil {
+		config.Server = *raw.Server
+	}
+	if raw.Insecure != nil {
+		config.Insecure = *raw.Insecure
+	}
+	if raw.PlainText != nil {
+		config.PlainText = *raw.PlainText
+	}
+	if raw.GRPCWeb != nil {
+		config.GRPCWeb = *raw.GRPCWeb
+	}
+	if raw.GRPCWebRootPath != nil {
+		config.GRPCWebRootPath = *raw.GRPCWebRootPath
+	}
+	if raw.ConnectRetryLimit != nil {
+		config.ConnectRetryLimit = *raw.ConnectRetryLimit
+	}
+	if raw.ConnectBackoff != nil {
+		config.ConnectBackoff, err = time.ParseDuration(*raw.ConnectBackoff)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse connectBackoff: %w", err)
+		}
+	}
+	if raw.AgentTokenReloadInterval != nil {
+		config.AgentTokenReloadInterval, err = time.ParseDuration(*raw.AgentTokenReloadInterval)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse agentTokenReloadInterval: %w", err)
+		}
+	}
+	if raw.Addr != nil {
+		config.Addr = *raw.Addr
+	}
+	if raw.TLSCertFile != nil {
+		config.TLSCertFile = *raw.TLSCertFile
+	}
+	if raw.TLSKeyFile != nil {
+		config.TLSKeyFile = *raw.TLSKeyFile
+	}
+	if raw.TLSMinVersion != nil {
+		config.TLSMinVersion, err = ParseTLSVersion(*raw.TLSMinVersion)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse tlsMinVersion: %w", err)
+		}
+	}
+	if raw.DrainTimeout != nil {
+		config.DrainTimeout, err = time.ParseDuration(*raw.DrainTimeout)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse drainTimeout: %w", err)
+		}
+	}
+	if raw.ReloadDrain != nil {
+		config.ReloadDrain = *raw.ReloadDrain
+	}
+	if raw.LogLevel != nil {
+		config.LogLevel, err = ParseLogLevel(*raw.LogLevel)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse logLevel: %w", err)
+		}
+	}
+	err = config.validateRanges()
+	if err != nil {
+		return StartupConfig{}, err
+	}
+	return config, nil
+}
+
+// ApplyStartupEnv overrides config with the environment variables which are set, read with getenv:
+// PLUGIN_AGENT_TOKEN_FILE, ARGOCD_AUTH_TOKEN_FILE, ARGOCD_SERVER, ARGOCD_INSECURE, ARGOCD_PLAINTEXT, ARGOCD_GRPC_WEB,
+// ARGOCD_GRPC_WEB_ROOT_PATH, PLUGIN_CONNECT_RETRY_LIMIT, PLUGIN_CONNECT_BACKOFF, PLUGIN_AGENT_TOKEN_RELOAD_INTERVAL,
+// PLUGIN_ADDR, PLUGIN_TLS_CERT_FILE, PLUGIN_TLS_KEY_FILE, PLUGIN_TLS_MIN_VERSION, PLUGIN_DRAIN_TIMEOUT,
+// PLUGIN_RELOAD_DRAIN, and PLUGIN_LOG_LEVEL. Setting ARGOCD_AUTH_TOKEN clears the auth token file, so that the token
+// from the environment is used, unless ARGOCD_AUTH_TOKEN_FILE is set too.
+func ApplyStartupEnv(config StartupConfig, getenv func(string) string) (StartupConfig, error) {
+	if tokenFile := getenv("PLUGIN_AGENT_TOKEN_FILE"); tokenFile != "" {
+		config.AgentTokenFile = tokenFile
+	}
+	if getenv("ARGOCD_AUTH_TOKEN") != "" {
+		config.AuthTokenFile = ""
+	}
+	if tokenFile := getenv("ARGOCD_AUTH_TOKEN_FILE"); tokenFile != "" {
+		config.AuthTokenFile = tokenFile
+	}
+	if server := getenv("ARGOCD_SERVER"); server != "" {
+		config.Server = server
+	}
+	if insecure := getenv("ARGOCD_INSECURE"); insecure != "" {
+		var err error
+		config.Insecure, err = strconv.ParseBool(insecure)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse ARGOCD_INSECURE: %w", err)
+		}
+	}
+	if plainText := getenv("ARGOCD_PLAINTEXT"); plainText != "" {
+		var err error
+		config.PlainText, err = strconv.ParseBool(plainText)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse ARGOCD_PLAINTEXT: %w", err)
+		}
+	}
+	if grpcWeb := getenv("ARGOCD_GRPC_WEB"); grpcWeb != "" {
+		var err error
+		config.GRPCWeb, err = strconv.ParseBool(grpcWeb)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse ARGOCD_GRPC_WEB: %w", err)
+		}
+	}
+	if rootPath := getenv("ARGOCD_GRPC_WEB_ROOT_PATH"); rootPath != "" {
+		config.GRPCWebRootPath = rootPath
+	}
+	if retryLimit := getenv("PLUGIN_CONNECT_RETRY_LIMIT"); retryLimit != "" {
+		var err error
+		config.ConnectRetryLimit, err = strconv.Atoi(retryLimit)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_CONNECT_RETRY_LIMIT: %w", err)
+		}
+	}
+	if backoff := getenv("PLUGIN_CONNECT_BACKOFF"); backoff != "" {
+		var err error
+		config.ConnectBackoff, err = time.ParseDuration(backoff)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_CONNECT_BACKOFF: %w", err)
+		}
+	}
+	if interval := getenv("PLUGIN_AGENT_TOKEN_RELOAD_INTERVAL"); interval != "" {
+		var err error
+		config.AgentTokenReloadInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_AGENT_TOKEN_RELOAD_INTERVAL: %w", err)
+		}
+	}
+	if addr := getenv("PLUGIN_ADDR"); addr != "" {
+		config.Addr = addr
+	}
+	if certFile := getenv("PLUGIN_TLS_CERT_FILE"); certFile != "" {
+		config.TLSCertFile = certFile
+	}
+	if keyFile := getenv("PLUGIN_TLS_KEY_FILE"); keyFile != "" {
+		config.TLSKeyFile = keyFile
+	}
+	if version := getenv("PLUGIN_TLS_MIN_VERSION"); version != "" {
+		var err error
+		config.TLSMinVersion, err = ParseTLSVersion(version)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_TLS_MIN_VERSION: %w", err)
+		}
+	}
+	if timeout := getenv("PLUGIN_DRAIN_TIMEOUT"); timeout != "" {
+		var err error
+		config.DrainTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_DRAIN_TIMEOUT: %w", err)
+		}
+	}
+	if drain := getenv("PLUGIN_RELOAD_DRAIN"); drain != "" {
+		var err error
+		config.ReloadDrain, err = strconv.ParseBool(drain)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_RELOAD_DRAIN: %w", err)
+		}
+	}
+	if level := getenv("PLUGIN_LOG_LEVEL"); level != "" {
+		var err error
+		config.LogLevel, err = ParseLogLevel(level)
+		if err != nil {
+			return StartupConfig{}, fmt.Errorf("failed to parse PLUGIN_LOG_LEVEL: %w", err)
+		}
+	}
+	err := config.validateRanges()
+	if err != nil {
+		return StartupConfig{}, err
+	}
+	return config, nil
+}
+
+// Validate checks that the options for connecting to Argo CD and for serving TLS are compatible with each other. Call
+// it once the config is complete, since a setting from the environment may fix a conflict in the file.
+func (c StartupConfig) Validate() error {
+	if strings.Contains(c.Server, "://") {
+		return fmt.Errorf("server %q must be a host and port without a scheme; set plainText to connect without TLS", c.Server)
+	}
+	if strings.Contains(c.Server, "/") {
+		return fmt.Errorf("server %q must be a host and port without a path; set grpcWebRootPath to connect to an API served under a path", c.Server)
+	}
+	if c.GRPCWebRootPath != "" && !c.GRPCWeb {
+		return errors.New("grpcWebRootPath requires grpcWeb, since only gRPC-web requests can be served under a path")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tlsCertFile and tlsKeyFile must be set together")
+	}
+	return c.validateRanges()
+}
+
+// validateRanges checks the settings which are invalid on their own, so that they're rejected where they're parsed.
+func (c StartupConfig) validateRanges() error {
+	if c.ConnectRetryLimit < 0 {
+		return errors.New("connect retry limit must not be negative")
+	}
+	if c.ConnectBackoff < 0 {
+		return errors.New("connect backoff must not be negative")
+	}
+	if c.AgentTokenReloadInterval <= 0 {
+		return errors.New("agent token reload interval must be positive")
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("drain timeout must not be negative")
+	}
+	return nil
+}
+
+// maxConnectBackoff caps the wait between retries to connect, so that the plugin notices soon once Argo CD is back.
+const maxConnectBackoff = 30 * time.Second
+
+// Connect builds the executor's API client with newClient and checks that the Argo CD API server is reachable, the
+// same way readiness probes do, retrying both up to retryLimit times with exponential backoff. The executor isn't
+// ready until it's connected, so the plugin can start serving while Connect runs in the background. It returns an
+// error once it runs out of retries, ctx is done, or the executor is shutting down.
+func (e *ApiExecutor) Connect(ctx context.Context, newClient func() (apiclient.Client, error), retryLimit int, backoff time.Duration) error {
+	err := e.connect(ctx, newClient)
+	for attempt := 0; err != nil && attempt < retryLimit; attempt++ {
+		if errors.Is(err, ErrShuttingDown) {
+			return err
+		}
+		e.logger.Warnf("failed to connect to the Argo CD API server, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+		err = e.connect(ctx, newClient)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Argo CD API server: %w", err)
+	}
+	return nil
+}
+
+// connect builds the API client, unless a previous attempt already did, and checks that the API server is reachable.
+func (e *ApiExecutor) connect(ctx context.Context, newClient func() (apiclient.Client, error)) error {
+	if e.apiClient.get() == nil {
+		client, err := newClient()
+		if err != nil {
+			return fmt.Errorf("failed to initialize Argo CD API client: %w", err)
+		}
+		e.apiClient.set(client)
+	}
+	return e.Ready(ctx)
+}
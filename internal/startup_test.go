@@ -0,0 +1,265 @@
+package argocd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseStartupConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("yaml", func(t *testing.T) {
+		config, err := ParseStartupConfig("agentTokenFile: /agent\nauthTokenFile: /auth\nserver: argocd.example.com\ninsecure: false\nplainText: true\ngrpcWeb: true\ngrpcWebRootPath: argo-cd\nconnectRetryLimit: 3\nconnectBackoff: 5s\nagentTokenReloadInterval: 10s\naddr: 127.0.0.1:3000\ntlsCertFile: /tls.crt\ntlsKeyFile: /tls.key\ntlsMinVersion: \"1.3\"\ndrainTimeout: 1m\nreloadDrain: true\nlogLevel: debug\n", DefaultStartupConfig())
+		require.NoError(t, err)
+		assert.Equal(t, StartupConfig{
+			AgentTokenFile:           "/agent",
+			AuthTokenFile:            "/auth",
+			Server:                   "argocd.example.com",
+			Insecure:                 false,
+			PlainText:                true,
+			GRPCWeb:                  true,
+			GRPCWebRootPath:          "argo-cd",
+			ConnectRetryLimit:        3,
+			ConnectBackoff:           5 * time.Second,
+			AgentTokenReloadInterval: 10 * time.Second,
+			Addr:                     "127.0.0.1:3000",
+			TLSCertFile:              "/tls.crt",
+			TLSKeyFile:               "/tls.key",
+			TLSMinVersion:            tls.VersionTLS13,
+			DrainTimeout:             time.Minute,
+			ReloadDrain:              true,
+			LogLevel:                 LogLevelDebug,
+		}, config)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		config, err := ParseStartupConfig(`{"server": "argocd.example.com", "drainTimeout": "5m"}`, DefaultStartupConfig())
+		require.NoError(t, err)
+		assert.Equal(t, "argocd.example.com", config.Server)
+		assert.Equal(t, 5*time.Minute, config.DrainTimeout)
+	})
+
+	t.Run("keeps unset fields", func(t *testing.T) {
+		config, err := ParseStartupConfig("server: argocd.example.com\n", DefaultStartupConfig())
+		require.NoError(t, err)
+		assert.Equal(t, DefaultAgentTokenFile, config.AgentTokenFile)
+		assert.True(t, config.Insecure)
+		assert.Equal(t, DefaultConnectRetryLimit, config.ConnectRetryLimit)
+		assert.Equal(t, DefaultConnectBackoff, config.ConnectBackoff)
+		assert.Equal(t, DefaultAddr, config.Addr)
+		assert.Equal(t, uint16(DefaultTLSMinVersion), config.TLSMinVersion)
+		assert.Equal(t, LogLevelInfo, config.LogLevel)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseStartupConfig("insecure: [yes]\n", DefaultStartupConfig())
+		require.ErrorContains(t, err, "failed to unmarshal startup config")
+
+		_, err = ParseStartupConfig("drainTimeout: soon\n", DefaultStartupConfig())
+		require.ErrorContains(t, err, "failed to parse drainTimeout")
+
+		_, err = ParseStartupConfig("logLevel: loud\n", DefaultStartupConfig())
+		require.ErrorContains(t, err, "failed to parse logLevel")
+
+		_, err = ParseStartupConfig("agentTokenReloadInterval: 0s\n", DefaultStartupConfig())
+		require.ErrorContains(t, err, "agent token reload interval must be positive")
+
+		_, err = ParseStartupConfig("connectRetryLimit: -1\n", DefaultStartupConfig())
+		require.ErrorContains(t, err, "connect retry limit must not be negative")
+	})
+}
+
+// getenv returns a function which reads environment variables from env instead of the process's environment.
+func getenv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestApplyStartupEnv(t *testing.T) {
+	t.Parallel()
+
+	file := DefaultStartupConfig()
+	file.AuthTokenFile = "/auth"
+	file.Server = "argocd.example.com"
+
+	t.Run("keeps file values", func(t *testing.T) {
+		config, err := ApplyStartupEnv(file, getenv(nil))
+		require.NoError(t, err)
+		assert.Equal(t, file, config)
+	})
+
+	t.Run("env overrides file", func(t *testing.T) {
+		config, err := ApplyStartupEnv(file, getenv(map[string]string{
+			"PLUGIN_AGENT_TOKEN_FILE":            "/env/agent",
+			"ARGOCD_AUTH_TOKEN_FILE":             "/env/auth",
+			"ARGOCD_SERVER":                      "argocd.internal",
+			"ARGOCD_INSECURE":                    "false",
+			"ARGOCD_PLAINTEXT":                   "true",
+			"ARGOCD_GRPC_WEB":                    "true",
+			"ARGOCD_GRPC_WEB_ROOT_PATH":          "/argo-cd",
+			"PLUGIN_CONNECT_RETRY_LIMIT":         "0",
+			"PLUGIN_CONNECT_BACKOFF":             "100ms",
+			"PLUGIN_AGENT_TOKEN_RELOAD_INTERVAL": "10s",
+			"PLUGIN_ADDR":                        ":8443",
+			"PLUGIN_TLS_CERT_FILE":               "/tls.crt",
+			"PLUGIN_TLS_KEY_FILE":                "/tls.key",
+			"PLUGIN_TLS_MIN_VERSION":             "1.3",
+			"PLUGIN_DRAIN_TIMEOUT":               "0s",
+			"PLUGIN_RELOAD_DRAIN":                "true",
+			"PLUGIN_LOG_LEVEL":                   "warn",
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, StartupConfig{
+			AgentTokenFile:           "/env/agent",
+			AuthTokenFile:            "/env/auth",
+			Server:                   "argocd.internal",
+			Insecure:                 false,
+			PlainText:                true,
+			GRPCWeb:                  true,
+			GRPCWebRootPath:          "/argo-cd",
+			ConnectRetryLimit:        0,
+			ConnectBackoff:           100 * time.Millisecond,
+			AgentTokenReloadInterval: 10 * time.Second,
+			Addr:                     ":8443",
+			TLSCertFile:              "/tls.crt",
+			TLSKeyFile:               "/tls.key",
+			TLSMinVersion:            tls.VersionTLS13,
+			DrainTimeout:             0,
+			ReloadDrain:              true,
+			LogLevel:                 LogLevelWarn,
+		}, config)
+	})
+
+	t.Run("auth token from env", func(t *testing.T) {
+		config, err := ApplyStartupEnv(file, getenv(map[string]string{"ARGOCD_AUTH_TOKEN": "token"}))
+		require.NoError(t, err)
+		assert.Empty(t, config.AuthTokenFile)
+
+		config, err = ApplyStartupEnv(file, getenv(map[string]string{"ARGOCD_AUTH_TOKEN": "token", "ARGOCD_AUTH_TOKEN_FILE": "/env/auth"}))
+		require.NoError(t, err)
+		assert.Equal(t, "/env/auth", config.AuthTokenFile)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ApplyStartupEnv(file, getenv(map[string]string{"ARGOCD_INSECURE": "maybe"}))
+		require.ErrorContains(t, err, "failed to parse ARGOCD_INSECURE")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"PLUGIN_TLS_MIN_VERSION": "2.0"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_TLS_MIN_VERSION")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"PLUGIN_RELOAD_DRAIN": "sometimes"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_RELOAD_DRAIN")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"ARGOCD_GRPC_WEB": "sometimes"}))
+		require.ErrorContains(t, err, "failed to parse ARGOCD_GRPC_WEB")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"PLUGIN_CONNECT_RETRY_LIMIT": "forever"}))
+		require.ErrorContains(t, err, "failed to parse PLUGIN_CONNECT_RETRY_LIMIT")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"PLUGIN_CONNECT_BACKOFF": "-1s"}))
+		require.ErrorContains(t, err, "connect backoff must not be negative")
+
+		_, err = ApplyStartupEnv(file, getenv(map[string]string{"PLUGIN_DRAIN_TIMEOUT": "-1s"}))
+		require.ErrorContains(t, err, "drain timeout must not be negative")
+	})
+}
+
+func TestStartupConfig_Validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		modify   func(config *StartupConfig)
+		expected string
+	}{
+		{"defaults", func(config *StartupConfig) {}, ""},
+		{"gRPC-web under a path", func(config *StartupConfig) {
+			config.GRPCWeb = true
+			config.GRPCWebRootPath = "argo-cd"
+		}, ""},
+		{"plain text", func(config *StartupConfig) {
+			config.Server = "argocd-server.argocd.svc.cluster.local:80"
+			config.PlainText = true
+		}, ""},
+		{"scheme", func(config *StartupConfig) { config.Server = "https://argocd.example.com" }, "must be a host and port without a scheme"},
+		{"path", func(config *StartupConfig) { config.Server = "argocd.example.com/argo-cd" }, "set grpcWebRootPath"},
+		{"root path without gRPC-web", func(config *StartupConfig) { config.GRPCWebRootPath = "argo-cd" }, "grpcWebRootPath requires grpcWeb"},
+		{"negative retry limit", func(config *StartupConfig) { config.ConnectRetryLimit = -1 }, "connect retry limit must not be negative"},
+		{"TLS", func(config *StartupConfig) {
+			config.TLSCertFile = "/tls.crt"
+			config.TLSKeyFile = "/tls.key"
+		}, ""},
+		{"TLS cert without key", func(config *StartupConfig) { config.TLSCertFile = "/tls.crt" }, "tlsCertFile and tlsKeyFile must be set together"},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			config := DefaultStartupConfig()
+			testCase.modify(&config)
+			err := config.Validate()
+			if testCase.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, testCase.expected)
+		})
+	}
+}
+
+func TestApiExecutor_Connect(t *testing.T) {
+	t.Parallel()
+
+	reachable := &fakeApiClient{settingsClient: &fakeSettingsClient{settings: &settings.Settings{}}}
+
+	t.Run("retries until reachable", func(t *testing.T) {
+		t.Parallel()
+		attempts := 0
+		newClient := func() (apiclient.Client, error) {
+			attempts++
+			if attempts < 3 {
+				return nil, errors.New("dial failed")
+			}
+			return reachable, nil
+		}
+		e := NewApiExecutor(nil, "")
+		require.ErrorContains(t, e.Ready(context.Background()), "API client isn't initialized")
+		err := e.Connect(context.Background(), newClient, 5, time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+		assert.NoError(t, e.Ready(context.Background()))
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		t.Parallel()
+		attempts := 0
+		newClient := func() (apiclient.Client, error) {
+			attempts++
+			return &fakeApiClient{settingsClient: &fakeSettingsClient{err: status.Error(codes.Unavailable, "connection refused")}}, nil
+		}
+		e := NewApiExecutor(nil, "")
+		err := e.Connect(context.Background(), newClient, 2, time.Millisecond)
+		require.ErrorContains(t, err, "failed to connect to the Argo CD API server: Argo CD API server is unreachable")
+		assert.Equal(t, 1, attempts, "the client is only built once it's built successfully")
+		assert.Error(t, e.Ready(context.Background()))
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		require.NoError(t, e.Shutdown(context.Background()))
+		err := e.Connect(context.Background(), func() (apiclient.Client, error) { return reachable, nil }, 5, time.Hour)
+		assert.ErrorIs(t, err, ErrShuttingDown)
+	})
+}
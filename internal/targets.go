@@ -0,0 +1,137 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"k8s.io/utils/pointer"
+)
+
+// targetApp is an app an action targets, along with its project if it was found.
+type targetApp struct {
+	App
+	project string
+	found   bool
+}
+
+// foundTargetApp returns the target for an app the API returned.
+func foundTargetApp(app v1alpha1.Application) targetApp {
+	return targetApp{App: App{Name: app.Name, Namespace: app.Namespace}, project: app.Spec.Project, found: true}
+}
+
+// actionTargets are the apps an action targets, resolved once so that the allowlist, the defaults, and the sync all
+// see the same apps.
+type actionTargets struct {
+	// named are the apps the action names. They're only looked up if getNamed was set, and are otherwise not found.
+	named []targetApp
+	// selected are the apps a sync action selects by label or ApplicationSet.
+	selected []targetApp
+}
+
+// resolveTargets resolves the apps an action targets. Named apps are fetched one at a time if getNamed is set, since
+// their projects are only needed to check the allowlist or apply project defaults. A sync action's selected apps are
+// always listed, once, since the sync needs them.
+func resolveTargets(ctx context.Context, action AppActionSpec, getNamed bool, appClient application.ApplicationServiceClient) (actionTargets, error) {
+	var targets actionTargets
+	apps, err := targetApps(action)
+	if err != nil {
+		return targets, err
+	}
+	seen := make(map[App]bool)
+	for _, app := range apps {
+		if seen[app] {
+			continue
+		}
+		seen[app] = true
+		target := targetApp{App: app}
+		if getNamed {
+			target, err = getTargetApp(ctx, app, appClient)
+			if err != nil {
+				return targets, err
+			}
+		}
+		targets.named = append(targets.named, target)
+	}
+	if action.Sync != nil && (action.Sync.Selector != "" || action.Sync.ApplicationSet != "") {
+		targets.selected, err = selectApps(ctx, *action.Sync, appClient)
+		if err != nil {
+			return targets, err
+		}
+	}
+	return targets, nil
+}
+
+// getTargetApp gets a named app. An app which doesn't exist isn't an error, since the action itself reports it.
+func getTargetApp(ctx context.Context, app App, appClient application.ApplicationServiceClient) (targetApp, error) {
+	found, err := appClient.Get(ctx, &application.ApplicationQuery{Name: pointer.String(app.Name), AppNamespace: pointer.String(app.Namespace)})
+	if isNotFoundError(err) {
+		return targetApp{App: app}, nil
+	}
+	if err != nil {
+		return targetApp{}, fmt.Errorf("failed to get app %q: %w", appKey(app), err)
+	}
+	return foundTargetApp(*found), nil
+}
+
+// all returns the named and selected apps.
+func (t actionTargets) all() []targetApp {
+	return append(append([]targetApp{}, t.named...), t.selected...)
+}
+
+// projects returns the distinct projects of the apps which were found.
+func (t actionTargets) projects() []string {
+	seen := make(map[string]bool)
+	var projects []string
+	for _, app := range t.all() {
+		if app.found && !seen[app.project] {
+			seen[app.project] = true
+			projects = append(projects, app.project)
+		}
+	}
+	return projects
+}
+
+// targetApps returns the apps an action targets by name. A sync action's selected apps aren't included, since they
+// can only be found by listing apps.
+func targetApps(action AppActionSpec) ([]App, error) {
+	var apps []App
+	if action.Sync != nil {
+		syncApps, err := readApps(*action.Sync)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range syncApps {
+			apps = append(apps, app.App)
+		}
+	}
+	if action.Diff != nil && action.Diff.Apps != "" {
+		diffApps, err := readDiffApps(*action.Diff)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, diffApps...)
+	} else if action.Diff != nil {
+		apps = append(apps, action.Diff.App)
+	}
+	if action.SetRevision != nil {
+		apps = append(apps, action.SetRevision.App)
+	}
+	if action.Delete != nil {
+		apps = append(apps, action.Delete.App)
+	}
+	if action.Rollback != nil {
+		apps = append(apps, action.Rollback.App)
+	}
+	if action.Terminate != nil {
+		apps = append(apps, action.Terminate.App)
+	}
+	if action.Refresh != nil {
+		apps = append(apps, action.Refresh.App)
+	}
+	if action.WaitForSync != nil {
+		apps = append(apps, action.WaitForSync.App)
+	}
+	return apps, nil
+}
@@ -0,0 +1,54 @@
+package argocd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_resolveTargets(t *testing.T) {
+	t.Parallel()
+
+	newTargetFakes := func() *fakeAppClient {
+		return &fakeAppClient{apps: map[string]*v1alpha1.Application{
+			"web":     {ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "argocd", Labels: map[string]string{"team": "web"}}, Spec: v1alpha1.ApplicationSpec{Project: "platform"}},
+			"billing": {ObjectMeta: metav1.ObjectMeta{Name: "billing", Namespace: "argocd"}, Spec: v1alpha1.ApplicationSpec{Project: "payments"}},
+		}}
+	}
+
+	t.Run("named apps are fetched one at a time", func(t *testing.T) {
+		t.Parallel()
+		appClient := newTargetFakes()
+		action := AppActionSpec{Sync: &SyncAction{Apps: "[{name: web}, {name: web}, {name: missing}]"}}
+		targets, err := resolveTargets(context.Background(), action, true, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []targetApp{
+			{App: App{Name: "web", Namespace: "argocd"}, project: "platform", found: true},
+			{App: App{Name: "missing"}},
+		}, targets.named)
+		assert.Equal(t, []string{"Get", "Get"}, appClient.calls, "duplicate apps are only fetched once, and apps aren't listed")
+		assert.Equal(t, []string{"platform"}, targets.projects())
+	})
+
+	t.Run("named apps aren't fetched unless needed", func(t *testing.T) {
+		t.Parallel()
+		appClient := newTargetFakes()
+		targets, err := resolveTargets(context.Background(), AppActionSpec{Diff: &DiffAction{App: App{Name: "billing"}}}, false, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []targetApp{{App: App{Name: "billing"}}}, targets.named)
+		assert.Empty(t, appClient.calls)
+	})
+
+	t.Run("selected apps are listed once", func(t *testing.T) {
+		t.Parallel()
+		appClient := newTargetFakes()
+		targets, err := resolveTargets(context.Background(), AppActionSpec{Sync: &SyncAction{Selector: "team=web"}}, true, appClient)
+		require.NoError(t, err)
+		assert.Equal(t, []targetApp{{App: App{Name: "web", Namespace: "argocd"}, project: "platform", found: true}}, targets.selected)
+		assert.Equal(t, []string{"List"}, appClient.calls)
+	})
+}
@@ -0,0 +1,51 @@
+package argocd
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+)
+
+// phaseTimings records how long each phase of an action took. Phases which run more than once, like the Sync RPC for
+// each app of a sync action, accumulate their durations. A nil *phaseTimings records nothing, so callers don't need to
+// check whether timings were requested.
+type phaseTimings struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+func newPhaseTimings() *phaseTimings {
+	return &phaseTimings{durations: make(map[string]time.Duration)}
+}
+
+// track starts timing a phase and returns a function which stops it. It's meant to be used like
+// `defer timings.track("phase")()`, or called explicitly when the phase ends before the function returns.
+func (t *phaseTimings) track(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.durations[phase] += elapsed
+	}
+}
+
+// parameter returns the `timings` output parameter, a JSON object mapping each phase to its duration in milliseconds.
+func (t *phaseTimings) parameter() (wfv1.Parameter, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	millis := make(map[string]float64, len(t.durations))
+	for phase, duration := range t.durations {
+		millis[phase] = float64(duration.Microseconds()) / 1000
+	}
+	out, err := json.Marshal(millis)
+	if err != nil {
+		return wfv1.Parameter{}, err
+	}
+	return wfv1.Parameter{Name: "timings", Value: wfv1.AnyStringPtr(string(out))}, nil
+}
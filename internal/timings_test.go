@@ -0,0 +1,63 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func Test_phaseTimings(t *testing.T) {
+	t.Parallel()
+
+	t.Run("nil records nothing", func(t *testing.T) {
+		var timings *phaseTimings
+		timings.track("get")()
+	})
+
+	t.Run("accumulates", func(t *testing.T) {
+		timings := newPhaseTimings()
+		for i := 0; i < 2; i++ {
+			stop := timings.track("syncRPC")
+			time.Sleep(time.Millisecond)
+			stop()
+		}
+		assert.GreaterOrEqual(t, timings.durations["syncRPC"], 2*time.Millisecond)
+	})
+}
+
+func TestApiExecutor_runAction_timings(t *testing.T) {
+	t.Parallel()
+
+	live := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "old"})}
+	target := []*unstructured.Unstructured{newTestConfigMap("my-config", map[string]interface{}{"key": "new"})}
+	client, _ := newTestFakes(t, live, target)
+	e := NewApiExecutor(client, "")
+	result, err := e.runAction(context.Background(), ActionSpec{
+		App: &AppActionSpec{
+			Diff:         &DiffAction{App: App{Name: "my-app"}},
+			Sync:         &SyncAction{Apps: "[{name: my-app}]"},
+			DiffThenSync: true,
+		},
+		IncludeTimings: true,
+	})
+	require.NoError(t, err)
+
+	var timingsJSON string
+	for _, param := range result.parameters {
+		if param.Name == "timings" {
+			timingsJSON = param.Value.String()
+		}
+	}
+	require.NotEmpty(t, timingsJSON)
+	var timings map[string]float64
+	require.NoError(t, json.Unmarshal([]byte(timingsJSON), &timings))
+	for _, phase := range []string{"clientInit", "get", "managedResources", "getManifests", "settings", "diffCompute", "syncRPC"} {
+		require.Contains(t, timings, phase)
+		assert.GreaterOrEqual(t, timings[phase], 0.0, phase)
+	}
+}
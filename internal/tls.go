@@ -0,0 +1,37 @@
+package argocd
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// DefaultTLSMinVersion is the oldest TLS version the plugin accepts unless configured otherwise.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// ParseTLSVersion parses a TLS version: 1.0, 1.1, 1.2, or 1.3.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (must be 1.0, 1.1, 1.2, or 1.3)", version)
+}
+
+// NewTLSConfig returns the TLS config for serving the plugin with the PEM-encoded certificate and key in the given
+// files. Requests are still authorized with the agent token; TLS only protects the token and the actions in transit.
+func NewTLSConfig(certFile, keyFile string, minVersion uint16) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
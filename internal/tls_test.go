@@ -0,0 +1,117 @@
+package argocd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key to a temporary directory, and
+// returns their paths.
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "argocd-executor-plugin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "tls.crt")
+	keyFile = filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	} {
+		version, err := ParseTLSVersion(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, version)
+	}
+	_, err := ParseTLSVersion("TLS1.3")
+	require.ErrorContains(t, err, "unknown TLS version")
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	t.Run("serves the plugin", func(t *testing.T) {
+		t.Parallel()
+		certFile, keyFile := writeTestCertificate(t)
+		config, err := NewTLSConfig(certFile, keyFile, tls.VersionTLS13)
+		require.NoError(t, err)
+		e := NewApiExecutor(nil, "my-token")
+		server := httptest.NewUnstartedServer(http.HandlerFunc(ArgocdPlugin(&e)))
+		server.TLS = config
+		server.StartTLS()
+		defer server.Close()
+
+		post := func(t *testing.T, client *http.Client, token string) (*http.Response, error) {
+			req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			return client.Do(req)
+		}
+		pool := x509.NewCertPool()
+		certPEM, err := os.ReadFile(certFile)
+		require.NoError(t, err)
+		require.True(t, pool.AppendCertsFromPEM(certPEM))
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+		res, err := post(t, client, "")
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode, "the agent token must still be required over TLS")
+
+		res, err = post(t, client, "my-token")
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "an authorized request must reach the body checks")
+
+		oldClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS12}}}
+		_, err = post(t, oldClient, "my-token")
+		assert.Error(t, err, "versions older than the minimum must be refused")
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewTLSConfig(filepath.Join(t.TempDir(), "tls.crt"), filepath.Join(t.TempDir(), "tls.key"), DefaultTLSMinVersion)
+		require.ErrorContains(t, err, "failed to load TLS certificate")
+	})
+}
@@ -0,0 +1,70 @@
+package argocd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultAgentTokenReloadInterval is how often WatchAgentToken re-reads the agent token file.
+const DefaultAgentTokenReloadInterval = 30 * time.Second
+
+// tokenHolder holds the agent token, which is replaced when the token file is reloaded.
+type tokenHolder struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func (h *tokenHolder) get() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.token
+}
+
+func (h *tokenHolder) set(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token = token
+}
+
+// ReloadAgentToken reads the agent token from tokenFile and makes it the token requests are authorized against. An
+// unreadable or empty file is rejected and the current token is kept.
+func (e *ApiExecutor) ReloadAgentToken(tokenFile string) error {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read agent token file: %w", err)
+	}
+	trimmed := strings.TrimSpace(string(token))
+	if trimmed == "" {
+		return errors.New("agent token file is empty")
+	}
+	e.agentToken.set(trimmed)
+	return nil
+}
+
+// WatchAgentToken re-reads the agent token from tokenFile every interval until ctx is done, so that a token rotated in
+// a mounted secret is picked up without a restart. Failed reloads are logged and the current token is kept.
+func (e *ApiExecutor) WatchAgentToken(ctx context.Context, tokenFile string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous := e.agentToken.get()
+			err := e.ReloadAgentToken(tokenFile)
+			if err != nil {
+				e.logger.Warnf("keeping the current agent token: %s", err)
+				continue
+			}
+			if e.agentToken.get() != previous {
+				e.logger.Infof("reloaded agent token from %s", tokenFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package argocd
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func authorize(e *ApiExecutor, token string) error {
+	req := httptest.NewRequest("POST", "/api/v1/template.execute", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return e.Authorize(req)
+}
+
+func TestApiExecutor_ReloadAgentToken(t *testing.T) {
+	t.Parallel()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	e := NewApiExecutor(nil, "old-token")
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("new-token\n"), 0600))
+	require.NoError(t, e.ReloadAgentToken(tokenFile))
+	assert.NoError(t, authorize(&e, "new-token"))
+	assert.Error(t, authorize(&e, "old-token"))
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("  \n"), 0600))
+	assert.EqualError(t, e.ReloadAgentToken(tokenFile), "agent token file is empty")
+	assert.NoError(t, authorize(&e, "new-token"), "an empty file must not replace the current token")
+
+	err := e.ReloadAgentToken(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "failed to read agent token file")
+	assert.NoError(t, authorize(&e, "new-token"), "a missing file must not replace the current token")
+}
+
+func TestApiExecutor_WatchAgentToken(t *testing.T) {
+	t.Parallel()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("old-token"), 0600))
+	e := NewApiExecutor(nil, "old-token")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.WatchAgentToken(ctx, tokenFile, 5*time.Millisecond)
+	require.NoError(t, authorize(&e, "old-token"))
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("new-token"), 0600))
+	assert.Eventually(t, func() bool {
+		return authorize(&e, "old-token") != nil
+	}, time.Second, 5*time.Millisecond, "the old token must stop being accepted")
+	assert.NoError(t, authorize(&e, "new-token"))
+}
@@ -0,0 +1,209 @@
+package argocd
+
+import (
+	"context"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/application"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/settings"
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	repoapiclient "github.com/argoproj/argo-cd/v2/reposerver/apiclient"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// tracerName is the instrumentation name of the executor's spans.
+const tracerName = "github.com/crenshaw-dev/argocd-executor-plugin"
+
+// Span attribute keys.
+const (
+	attrActionType   = attribute.Key("argocd.action.type")
+	attrAppName      = attribute.Key("argocd.app.name")
+	attrAppNamespace = attribute.Key("argocd.app.namespace")
+	attrTemplateName = attribute.Key("argo.template.name")
+	attrRequestID    = attribute.Key("plugin.request.id")
+)
+
+// startSpan starts a child span of the span in ctx, using the same tracer provider. If ctx has no span, the new span
+// isn't recorded.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan ends span, recording err on it if it's set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	span.End()
+}
+
+// recordSpanError records err on span and marks the span as failed.
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// appAttributes returns the span attributes identifying app.
+func appAttributes(app App) trace.SpanStartEventOption {
+	return trace.WithAttributes(attrAppName.String(app.Name), attrAppNamespace.String(app.Namespace))
+}
+
+// metadataCarrier lets trace context be propagated in outgoing gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// traceCall runs call in a client span named after the API method, with the span's context propagated to the Argo CD
+// API server in the call's metadata.
+func traceCall(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	ctx, span := startSpan(ctx, method, trace.WithSpanKind(trace.SpanKindClient))
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	err := call(metadata.NewOutgoingContext(ctx, md))
+	endSpan(span, err)
+	return err
+}
+
+// tracingAppClient records a span for each Application API call.
+type tracingAppClient struct {
+	application.ApplicationServiceClient
+}
+
+func (c *tracingAppClient) List(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (list *v1alpha1.ApplicationList, err error) {
+	err = traceCall(ctx, "ApplicationService/List", func(ctx context.Context) error {
+		list, err = c.ApplicationServiceClient.List(ctx, in, opts...)
+		return err
+	})
+	return list, err
+}
+
+func (c *tracingAppClient) Get(ctx context.Context, in *application.ApplicationQuery, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = traceCall(ctx, "ApplicationService/Get", func(ctx context.Context) error {
+		app, err = c.ApplicationServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *tracingAppClient) Create(ctx context.Context, in *application.ApplicationCreateRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = traceCall(ctx, "ApplicationService/Create", func(ctx context.Context) error {
+		app, err = c.ApplicationServiceClient.Create(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *tracingAppClient) Delete(ctx context.Context, in *application.ApplicationDeleteRequest, opts ...grpc.CallOption) (res *application.ApplicationResponse, err error) {
+	err = traceCall(ctx, "ApplicationService/Delete", func(ctx context.Context) error {
+		res, err = c.ApplicationServiceClient.Delete(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *tracingAppClient) GetManifests(ctx context.Context, in *application.ApplicationManifestQuery, opts ...grpc.CallOption) (res *repoapiclient.ManifestResponse, err error) {
+	err = traceCall(ctx, "ApplicationService/GetManifests", func(ctx context.Context) error {
+		res, err = c.ApplicationServiceClient.GetManifests(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *tracingAppClient) ManagedResources(ctx context.Context, in *application.ResourcesQuery, opts ...grpc.CallOption) (res *application.ManagedResourcesResponse, err error) {
+	err = traceCall(ctx, "ApplicationService/ManagedResources", func(ctx context.Context) error {
+		res, err = c.ApplicationServiceClient.ManagedResources(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+func (c *tracingAppClient) Patch(ctx context.Context, in *application.ApplicationPatchRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = traceCall(ctx, "ApplicationService/Patch", func(ctx context.Context) error {
+		app, err = c.ApplicationServiceClient.Patch(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *tracingAppClient) RevisionMetadata(ctx context.Context, in *application.RevisionMetadataQuery, opts ...grpc.CallOption) (metadata *v1alpha1.RevisionMetadata, err error) {
+	err = traceCall(ctx, "ApplicationService/RevisionMetadata", func(ctx context.Context) error {
+		metadata, err = c.ApplicationServiceClient.RevisionMetadata(ctx, in, opts...)
+		return err
+	})
+	return metadata, err
+}
+
+func (c *tracingAppClient) Rollback(ctx context.Context, in *application.ApplicationRollbackRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = traceCall(ctx, "ApplicationService/Rollback", func(ctx context.Context) error {
+		app, err = c.ApplicationServiceClient.Rollback(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *tracingAppClient) Sync(ctx context.Context, in *application.ApplicationSyncRequest, opts ...grpc.CallOption) (app *v1alpha1.Application, err error) {
+	err = traceCall(ctx, "ApplicationService/Sync", func(ctx context.Context) error {
+		app, err = c.ApplicationServiceClient.Sync(ctx, in, opts...)
+		return err
+	})
+	return app, err
+}
+
+func (c *tracingAppClient) TerminateOperation(ctx context.Context, in *application.OperationTerminateRequest, opts ...grpc.CallOption) (res *application.OperationTerminateResponse, err error) {
+	err = traceCall(ctx, "ApplicationService/TerminateOperation", func(ctx context.Context) error {
+		res, err = c.ApplicationServiceClient.TerminateOperation(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+// tracingSettingsClient records a span for each Settings API call.
+type tracingSettingsClient struct {
+	settings.SettingsServiceClient
+}
+
+func (c *tracingSettingsClient) Get(ctx context.Context, in *settings.SettingsQuery, opts ...grpc.CallOption) (res *settings.Settings, err error) {
+	err = traceCall(ctx, "SettingsService/Get", func(ctx context.Context) error {
+		res, err = c.SettingsServiceClient.Get(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
+
+// tracingVersionClient records a span for each Version API call.
+type tracingVersionClient struct {
+	version.VersionServiceClient
+}
+
+func (c *tracingVersionClient) Version(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (res *version.VersionMessage, err error) {
+	err = traceCall(ctx, "VersionService/Version", func(ctx context.Context) error {
+		res, err = c.VersionServiceClient.Version(ctx, in, opts...)
+		return err
+	})
+	return res, err
+}
@@ -0,0 +1,179 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/argoproj/argo-workflows/v3/pkg/plugins/executor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeTracerProvider records the spans started with its tracers.
+type fakeTracerProvider struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+func (p *fakeTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return fakeTracer{provider: p}
+}
+
+// span returns the first span with the given name.
+func (p *fakeTracerProvider) span(t *testing.T, name string) *fakeSpan {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, span := range p.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	require.Failf(t, "missing span", "no %q span", name)
+	return nil
+}
+
+type fakeTracer struct {
+	provider *fakeTracerProvider
+}
+
+func (t fakeTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	config := trace.NewSpanStartConfig(opts...)
+	span := &fakeSpan{
+		Span:     trace.SpanFromContext(context.Background()),
+		provider: t.provider,
+		name:     name,
+		attrs:    config.Attributes(),
+	}
+	if parent, ok := trace.SpanFromContext(ctx).(*fakeSpan); ok {
+		span.parent = parent.name
+	}
+	t.provider.mu.Lock()
+	t.provider.spans = append(t.provider.spans, span)
+	t.provider.mu.Unlock()
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type fakeSpan struct {
+	trace.Span
+	provider *fakeTracerProvider
+	name     string
+	parent   string
+	attrs    []attribute.KeyValue
+	err      error
+	ended    bool
+}
+
+func (s *fakeSpan) TracerProvider() trace.TracerProvider { return s.provider }
+
+func (s *fakeSpan) SetAttributes(attrs ...attribute.KeyValue) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *fakeSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeSpan) End(...trace.SpanEndOption) {
+	s.provider.mu.Lock()
+	defer s.provider.mu.Unlock()
+	s.ended = true
+}
+
+func TestApiExecutor_Execute_tracing(t *testing.T) {
+	t.Parallel()
+
+	t.Run("sync", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		provider := &fakeTracerProvider{}
+		e := NewApiExecutor(client, "", WithTracerProvider(provider))
+		reply := e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{
+				Name:   "promote",
+				Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(`{"argocd": {"app": {"sync": {"apps": "[{name: my-app, namespace: argocd}]"}}}}`)}},
+			},
+		})
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+
+		execute := provider.span(t, "Execute")
+		assert.Contains(t, execute.attrs, attrTemplateName.String("promote"))
+		runAction := provider.span(t, "runAction")
+		assert.Equal(t, "Execute", runAction.parent)
+		assert.Contains(t, runAction.attrs, attrActionType.String("sync"))
+		assert.Equal(t, "runAction", provider.span(t, "syncAppsParallel").parent)
+		syncApp := provider.span(t, "syncApp")
+		assert.Equal(t, "syncAppsParallel", syncApp.parent)
+		assert.Contains(t, syncApp.attrs, attrAppName.String("my-app"))
+		assert.Contains(t, syncApp.attrs, attrAppNamespace.String("argocd"))
+		assert.Equal(t, "syncApp", provider.span(t, "ApplicationService/Sync").parent, "API calls must be child spans")
+		for _, span := range provider.spans {
+			assert.True(t, span.ended, "span %q must be ended", span.name)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		provider := &fakeTracerProvider{}
+		e := NewApiExecutor(client, "", WithTracerProvider(provider))
+		reply := e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{
+				Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(`{"argocd": {"app": {"delete": {"app": {"name": "my-app"}}}}}`)}},
+			},
+		})
+		require.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase, reply.Node.Message)
+
+		runAction := provider.span(t, "runAction")
+		assert.Contains(t, runAction.attrs, attrActionType.String("delete"))
+		assert.Equal(t, "runAction", provider.span(t, "ApplicationService/Delete").parent)
+	})
+
+	t.Run("failed diff", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		provider := &fakeTracerProvider{}
+		e := NewApiExecutor(client, "", WithTracerProvider(provider))
+		reply := e.Execute(executor.ExecuteTemplateArgs{
+			Template: &wfv1.Template{
+				Plugin: &wfv1.Plugin{Object: wfv1.Object{Value: json.RawMessage(`{"argocd": {"app": {"diff": {"app": {"name": "missing-app"}}}}}`)}},
+			},
+		})
+		require.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+
+		diffApp := provider.span(t, "diffApp")
+		assert.Equal(t, "runAction", diffApp.parent)
+		assert.Contains(t, diffApp.attrs, attrAppName.String("missing-app"))
+		assert.Error(t, diffApp.err)
+		assert.Error(t, provider.span(t, "runAction").err)
+		assert.Error(t, provider.span(t, "Execute").err)
+	})
+}
+
+func Test_metadataCarrier(t *testing.T) {
+	t.Parallel()
+
+	spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanContext)
+	md := metadata.MD{}
+	propagation.TraceContext{}.Inject(ctx, metadataCarrier(md))
+	assert.Equal(t, []string{"00-01000000000000000000000000000000-0200000000000000-01"}, md.Get("traceparent"))
+
+	extracted := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), metadataCarrier(md)))
+	assert.Equal(t, spanContext.TraceID(), extracted.TraceID())
+}
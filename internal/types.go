@@ -8,6 +8,25 @@ type PluginSpec struct {
 type ActionSpec struct {
 	App     *AppActionSpec `json:"app,omitempty"`
 	Timeout string         `json:"timeout,omitempty"`
+	// IncludeTimings, if true, sets the `timings` output parameter to a JSON object mapping each phase of the action
+	// (like getManifests or syncRPC) to how long it took, in milliseconds.
+	IncludeTimings bool `json:"includeTimings,omitempty"`
+	// ValidateOnly, if true, only validates the action, without contacting Argo CD, and fails the node with every
+	// problem found. See Validate.
+	ValidateOnly bool `json:"validateOnly,omitempty"`
+	// Identity, if set, names who or what the action acts for, like a service identity. It's recorded, along with the
+	// workflow's name and UID, in the info of the operations the action starts, which shows up in Argo CD's operation
+	// history. Anyone who can write a workflow can set it, so it's recorded as a requested, unverified identity. Argo CD
+	// still attributes the operations to the plugin's token, since its API doesn't support impersonation.
+	Identity string `json:"identity,omitempty"`
+	// SuccessMessage, if set, replaces the node's message when the action succeeds, like `synced ${app} to
+	// ${revision}`. ${action} is the action type, ${app} lists the apps the action targeted, and ${revision} is the
+	// `revision` output parameter, which is only set by some actions. Warnings are still appended. Argo Workflows
+	// substitutes {{...}} variables itself, so these use ${...} instead.
+	SuccessMessage string `json:"successMessage,omitempty"`
+	// FailureMessage, if set, replaces the node's message when the action fails. It may use the same variables as
+	// SuccessMessage, and ${error}, which is why the action failed.
+	FailureMessage string `json:"failureMessage,omitempty"`
 }
 
 // AppActionSpec describes all possible actions that can be taken by the plugin.
@@ -15,23 +34,407 @@ type AppActionSpec struct {
 	// A sync action
 	Sync *SyncAction `json:"sync,omitempty"`
 	Diff *DiffAction `json:"diff,omitempty"`
+	// A list action
+	List *ListAction `json:"list,omitempty"`
+	// A set-revision action
+	SetRevision *SetRevisionAction `json:"setRevision,omitempty"`
+	// A create action
+	Create *CreateAction `json:"create,omitempty"`
+	// A delete action
+	Delete *DeleteAction `json:"delete,omitempty"`
+	// A rollback action
+	Rollback *RollbackAction `json:"rollback,omitempty"`
+	// A terminate action
+	Terminate *TerminateAction `json:"terminate,omitempty"`
+	// A refresh action
+	Refresh *RefreshAction `json:"refresh,omitempty"`
+	// A wait-for-sync action
+	WaitForSync *WaitAction `json:"waitForSync,omitempty"`
+	// A version action
+	Version *VersionAction `json:"version,omitempty"`
+	// DiffThenSync must be set to run both a diff and a sync in one action. The diff runs first and its output is
+	// returned, even if it's empty, then the sync runs. The sync's results are the `syncResults` output parameter.
+	// Without it, setting both is treated as a mistake.
+	DiffThenSync bool `json:"diffThenSync,omitempty"`
+	// VerifyRevision, if true, checks just before a diff-then-sync action syncs that the diffed app's target revision
+	// still resolves to the revision which was diffed, and fails the action if it doesn't.
+	VerifyRevision bool `json:"verifyRevision,omitempty"`
 }
 
 type DiffAction struct {
-	App         `json:"app,omitempty"`
-	Revision    string `json:"revision,omitempty"`
-	Refresh     bool   `json:"refresh,omitempty"`
-	HardRefresh bool   `json:"hardRefresh,omitempty"`
+	App `json:"app,omitempty"`
+	// Apps, if set instead of App, is a YAML array of the apps to diff, like a sync action's apps. For example,
+	// `[{name: my-app}, {name: my-app, namespace: app-ns}]`. Each app is diffed with the action's other settings, and
+	// the outputs are combined, keyed by app.
+	Apps string `json:"apps,omitempty"`
+	// AppsSource describes how Apps should be read. Defaults to inline YAML.
+	AppsSource ValueSource `json:"appsSource,omitempty"`
+	// Revision, if set, is the revision to diff against, like a branch, tag, or commit SHA, instead of the app's target
+	// revision. The action fails if it doesn't exist, unless FallbackRevision is set.
+	Revision string `json:"revision,omitempty"`
+	// FallbackRevision, if set, is diffed against instead of Revision if Revision doesn't exist, like a deleted feature
+	// branch, for example `HEAD`. A warning says that the fallback was used. Requires Revision.
+	FallbackRevision string `json:"fallbackRevision,omitempty"`
+	Refresh          bool   `json:"refresh,omitempty"`
+	HardRefresh      bool   `json:"hardRefresh,omitempty"`
+	// RefreshIfOlderThan, if set, is a duration, like "5m". The app is only refreshed before the diff if it was last
+	// reconciled longer ago than that, or never, which saves refreshing apps the controller just reconciled. The refresh
+	// is hard if HardRefresh is set. It takes precedence over Refresh.
+	RefreshIfOlderThan string `json:"refreshIfOlderThan,omitempty"`
+	// OutputDir, if set, is a directory to which each changed resource's diff is written as its own file, laid out as
+	// {kind}.{group}/{namespace}/{name}.diff. It must be relative to the plugin's output base directory. The files'
+	// contents are also returned as the `diffFiles` output parameter. When diffing several apps, each app's files are
+	// written to a subdirectory named after the app.
+	OutputDir string `json:"outputDir,omitempty"`
+	// Normalizers canonicalize fields of both the live and target resources before diffing, for example by sorting
+	// arrays whose order doesn't matter. Unlike the app's ignoreDifferences, which hide a field entirely, a normalized
+	// field still shows up in the diff if its canonical values differ.
+	Normalizers []DiffNormalizer `json:"normalizers,omitempty"`
+	// StripDefaults, if true, removes fields from the live state which hold a well-known Kubernetes default value (for
+	// example `protocol: TCP` on a port) when the target state doesn't set them. This is a heuristic based on a curated
+	// list of common defaults, not on the resource's schema, so some defaulted fields will still show up.
+	StripDefaults bool `json:"stripDefaults,omitempty"`
+	// IgnoreAggregatedRoles should match the `ignoreAggregatedRoles` compare option in the server's
+	// `resource.compareoptions` setting. The settings API doesn't expose that option, so it can't be read from the
+	// server.
+	IgnoreAggregatedRoles bool `json:"ignoreAggregatedRoles,omitempty"`
+	// DestinationNamespace is the namespace set on namespaced target resources which don't specify one, mirroring what
+	// Argo CD does when it applies them. Defaults to the app's destination namespace.
+	DestinationNamespace string `json:"destinationNamespace,omitempty"`
+	// ErrorConditionPolicy decides what to do if the app has error conditions, in which case the diff would likely be
+	// misleading. Defaults to proceed. A skipped app's diff is empty.
+	ErrorConditionPolicy ErrorConditionPolicy `json:"errorConditionPolicy,omitempty"`
+	// BestEffortSettings, if true, lets the diff proceed with default settings when Argo CD's settings can't be fetched,
+	// instead of failing. The default settings track apps by the app.kubernetes.io/instance label and have no resource
+	// overrides, so the diff may differ from Argo CD's. A warning is added to the node's message.
+	BestEffortSettings bool `json:"bestEffortSettings,omitempty"`
+	// Canonical, if true, outputs the diff in a canonical form, so that the same logical diff always produces the same
+	// bytes: each resource's diff starts with a header naming it, and trailing whitespace is trimmed. Resources are always
+	// sorted by group, kind, namespace and name. The SHA-256 of the output is set as the `diffHash` output parameter,
+	// which can be stored and compared between runs to tell whether drift has changed.
+	Canonical bool `json:"canonical,omitempty"`
+	// Resource, if set, restricts the diff to this one resource of the app. Only that resource's live state is fetched,
+	// so this is cheaper than diffing the whole app. The action fails if the resource is neither managed by the app nor
+	// in its target manifests.
+	Resource *ResourceRef `json:"resource,omitempty"`
+	// IncludeHooks, if true, diffs hook resources too. By default they're skipped, since a hook's live state usually
+	// belongs to its last run rather than tracking the target state.
+	IncludeHooks bool `json:"includeHooks,omitempty"`
+	// OutputFormat is the format of the `diff` output parameter. Defaults to text. With Canonical, the JSON output is
+	// what's hashed.
+	OutputFormat DiffOutputFormat `json:"outputFormat,omitempty"`
+	// IncludeKinds, if set, restricts the diff to resources of these kinds, like Deployment. Kinds are matched
+	// case-insensitively. Resources which are filtered out aren't diffed or counted, even if they changed.
+	IncludeKinds []string `json:"includeKinds,omitempty"`
+	// ExcludeKinds leaves resources of these kinds out of the diff. It's applied after IncludeKinds.
+	ExcludeKinds []string `json:"excludeKinds,omitempty"`
+	// NameGlob, if set, restricts the diff to resources whose names match this glob, like `guestbook-*`.
+	NameGlob string `json:"nameGlob,omitempty"`
+	// Namespace, if set, restricts the diff to resources in this namespace, for apps which deploy to several. Unlike the
+	// app's namespace, it's the namespace of the app's resources. Cluster-scoped resources are left out.
+	Namespace string `json:"namespace,omitempty"`
+	// FailOnDiff, if true, fails the action if the diff found changes, with a summary of them, so that the diff can gate
+	// a workflow on drift. The diff is still the step's result, and the `exitCode` output parameter is still 1. If a
+	// sync was also requested, it isn't run.
+	FailOnDiff bool `json:"failOnDiff,omitempty"`
+	// MaxOutputBytes, if positive, caps the size of the diff output, so that a huge diff doesn't exceed the workflow's
+	// limits on results. A text diff is cut at the end of a line and marked `... (truncated, N bytes omitted)`, and a
+	// JSON diff leaves out its last resources instead, counting them in `omittedResources`. The `diffTruncated` output
+	// parameter says whether the diff was cut. Zero uses the plugin's default, and a negative value means no limit.
+	MaxOutputBytes int `json:"maxOutputBytes,omitempty"`
+}
+
+// DiffNormalizer describes how to canonicalize a field before diffing. Exactly one of JSONPointer or JQExpression must
+// be set.
+type DiffNormalizer struct {
+	// Group restricts the normalizer to resources in this API group. Empty matches all groups.
+	Group string `json:"group,omitempty"`
+	// Kind restricts the normalizer to resources of this kind. Empty matches all kinds.
+	Kind string `json:"kind,omitempty"`
+	// JSONPointer points to an array whose elements are sorted, for example `/spec/ports`.
+	JSONPointer string `json:"jsonPointer,omitempty"`
+	// JQExpression is a jq expression which takes the whole resource and returns its normalized form, for example
+	// `.spec.ports |= sort_by(.port)`.
+	JQExpression string `json:"jqExpression,omitempty"`
+}
+
+// ListAction describes an action that lists apps and outputs their statuses as JSON, without changing them.
+type ListAction struct {
+	// Selector is a label selector to restrict the listed apps, for example `team=payments`.
+	Selector string `json:"selector,omitempty"`
+	// Projects restricts the listed apps to these projects.
+	Projects []string `json:"projects,omitempty"`
+	// Namespace restricts the listed apps to this namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// Limit is the maximum number of apps to output. Zero means no limit.
+	Limit int `json:"limit,omitempty"`
+	// Offset is the number of apps to skip before outputting any. Apps are sorted by namespace and name, so Limit and
+	// Offset can be used to page through a large result set.
+	Offset int `json:"offset,omitempty"`
+}
+
+// SetRevisionAction describes an action that sets an app's target revision without syncing it.
+type SetRevisionAction struct {
+	App `json:"app,omitempty"`
+	// Revision is the new target revision, for example a commit SHA, tag, or branch.
+	Revision string `json:"revision,omitempty"`
+	// SourceIndex is the index of the source to update in a multi-source app. The Argo CD API this plugin is built
+	// against only supports single-source apps, so it must be 0.
+	SourceIndex int `json:"sourceIndex,omitempty"`
+	// Retry, if set, retries the patch request if it fails with an error which the plugin's policy retries. Patch
+	// requests aren't retried otherwise.
+	Retry *RetryStrategy `json:"retry,omitempty"`
+}
+
+// RollbackAction describes an action that rolls an app back to a previously deployed revision. At most one of ID and
+// Revision may be set. If neither is, the app is rolled back to the deployment before the current one.
+type RollbackAction struct {
+	App `json:"app,omitempty"`
+	// ID is the ID of the entry in the app's deployment history to roll back to.
+	ID int64 `json:"id,omitempty"`
+	// Revision is a previously deployed revision to roll back to. If it was deployed several times, the most recent
+	// deployment is used.
+	Revision string `json:"revision,omitempty"`
+	// Prune, if true, deletes resources which aren't part of the revision being rolled back to.
+	Prune bool `json:"prune,omitempty"`
+}
+
+// TerminateAction describes an action that terminates the app's running operation, like a sync which is stuck.
+type TerminateAction struct {
+	App `json:"app,omitempty"`
+}
+
+// RefreshAction describes an action that makes Argo CD refresh an app from git without syncing it.
+type RefreshAction struct {
+	App `json:"app,omitempty"`
+	// Hard, if true, also invalidates the repo server's manifest cache, so that the manifests are regenerated.
+	Hard bool `json:"hard,omitempty"`
+}
+
+// WaitAction describes an action that waits for the app's running operation, like a sync started by automated sync, to
+// finish, without starting one. If no operation is running, the last operation's result is reported right away.
+type WaitAction struct {
+	App `json:"app,omitempty"`
+}
+
+// VersionAction describes an action that reports the versions of the Argo CD API server and of the plugin.
+type VersionAction struct{}
+
+// CreateAction describes an action that creates an app, or updates it if requested. The app's name and namespace are
+// set as the `name` and `namespace` output parameters.
+type CreateAction struct {
+	// Application is the YAML manifest of the Application to create.
+	Application string `json:"application,omitempty"`
+	// Upsert, if true, updates the app if it already exists with a different spec, instead of failing. An app which
+	// already exists with the same spec is left as it is either way.
+	Upsert bool `json:"upsert,omitempty"`
+	// WaitForReconcile, if true, waits until Argo CD has reconciled the new app for the first time before returning,
+	// so that a following diff or status check doesn't see an Unknown status. The wait is bounded by the action
+	// timeout, or by five minutes if no timeout is set.
+	WaitForReconcile bool `json:"waitForReconcile,omitempty"`
+}
+
+// DeleteAction describes an action that deletes an app.
+type DeleteAction struct {
+	App `json:"app,omitempty"`
+	// Cascade, if true, also deletes the app's resources. Otherwise, they're left in the cluster.
+	Cascade bool `json:"cascade,omitempty"`
+	// PropagationPolicy is how the app's resources are deleted, foreground or background. Defaults to foreground.
+	// Requires Cascade.
+	PropagationPolicy string `json:"propagationPolicy,omitempty"`
+	// Wait, if true, waits until the app is gone before returning. With Cascade, that's once its resources have been
+	// deleted. The wait is bounded by the action timeout, or by five minutes if no timeout is set.
+	Wait bool `json:"wait,omitempty"`
 }
 
 // SyncAction describes an action that triggers an argocd sync.
 type SyncAction struct {
 	// Apps is a YAML array of objects representing the apps to be synced. For example, `[{name: my-app}, {name: my-app, namespace: app-ns}]`.
+	// Each app may also set its own sync options, for example `[{name: my-app, options: [Replace=true]}]`, and its own
+	// revision, for example `[{name: my-app, revision: v1.2.3}]`.
 	Apps string `json:"apps,omitempty"`
-	// Options is a YAML array of option=value pairs to configure the sync operation. https://argo-cd.readthedocs.io/en/stable/user-guide/sync-options/
+	// AppsSource describes how Apps should be read. Defaults to inline YAML.
+	AppsSource ValueSource `json:"appsSource,omitempty"`
+	// Selector, if set, is a label selector, like `team=payments`, and every app matching it is synced too. Matching apps
+	// are synced after the ones in Apps, sorted by namespace and name, and apps listed in Apps aren't synced twice. At
+	// least one of Apps, Selector, and ApplicationSet must be set, and the action fails if none of them names any app,
+	// unless ApplicationSet is set.
+	Selector string `json:"selector,omitempty"`
+	// ApplicationSet, if set, is the name of an ApplicationSet, and every app it generated, as recorded by the apps'
+	// owner references, is synced too, like the apps matching Selector. If it generated no apps and no other app is
+	// targeted, the action succeeds without syncing anything.
+	ApplicationSet string `json:"applicationSet,omitempty"`
+	// Options is a YAML array of option=value pairs to configure the sync operation, like `[ServerSideApply=true]`, or a
+	// map, like `{ServerSideApply: true}`. https://argo-cd.readthedocs.io/en/stable/user-guide/sync-options/
 	Options string `json:"options,omitempty"`
+	// OptionsSource describes how Options should be read. Defaults to inline YAML.
+	OptionsSource ValueSource `json:"optionsSource,omitempty"`
+	// ServerSideApply, if true, adds the `ServerSideApply=true` sync option, replacing a ServerSideApply option in
+	// Options. An app's own options still take precedence.
+	ServerSideApply bool `json:"serverSideApply,omitempty"`
+	// Replace, if true, adds the `Replace=true` sync option, replacing a Replace option in Options. An app's own options
+	// still take precedence.
+	Replace bool `json:"replace,omitempty"`
+	// Revision, if set, is the revision to sync the apps to, like a commit SHA or a tag, instead of their target
+	// revisions. An app's own revision takes precedence.
+	Revision string `json:"revision,omitempty"`
+	// IncludeOperationState, if true, gets each app right after its sync is requested and outputs the operation's
+	// initial phase and start time.
+	IncludeOperationState bool `json:"includeOperationState,omitempty"`
+	// Retry, if set, retries each app's sync request. Sync requests aren't retried otherwise, since a request which
+	// failed may still have started a sync. Only the errors which the plugin's policy retries, like Unavailable, are
+	// retried; others, like NotFound, fail right away.
+	Retry *RetryStrategy `json:"retry,omitempty"`
+	// UseAppRetry, if true, gets each app before syncing it and passes the retry strategy from its
+	// `spec.syncPolicy.retry` with the sync request, so that Argo CD retries the sync operation if it fails, like it does
+	// for automated syncs. Unlike Retry, which retries the plugin's API calls, this retries the sync itself.
+	UseAppRetry bool `json:"useAppRetry,omitempty"`
+	// MaxConcurrency is the maximum number of apps synced at once. Defaults to the plugin's configured default, or 10.
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	// DryRun, if true, runs the sync without applying any changes. The action waits for each app's dry-run operation to
+	// complete and outputs its phase, message, and result for each resource. Apps whose dry run fails, for example
+	// because of invalid manifests, fail the action.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Prune, if true, deletes resources which are no longer defined in the app's source. It applies to every app in the
+	// action and may be combined with Options. Note that a `Prune=true` sync option doesn't enable pruning.
+	Prune bool `json:"prune,omitempty"`
+	// Resources, if set, restricts the sync to these resources of each app, instead of syncing the whole app.
+	Resources []ResourceRef `json:"resources,omitempty"`
+	// PruneAllowlist, if set on a dry-run sync with Prune, fails the action if any resource which would be pruned
+	// doesn't match one of these matchers.
+	PruneAllowlist []ResourceMatcher `json:"pruneAllowlist,omitempty"`
+	// AutomatedSyncPolicy, if set, gets each app before syncing it to check for an automated sync policy, and decides
+	// what to do with apps which have one. The detected policy is included in the output.
+	AutomatedSyncPolicy AutomatedSyncPolicy `json:"automatedSyncPolicy,omitempty"`
+	// ErrorConditionPolicy decides what to do with apps which have error conditions. Defaults to proceed.
+	ErrorConditionPolicy ErrorConditionPolicy `json:"errorConditionPolicy,omitempty"`
+	// ManifestsOutputDir, if set, is a directory to which each synced app's rendered target manifests are written, as
+	// {app namespace}/{app name}.yaml, with Secret values redacted. It must be relative to the plugin's output base
+	// directory. The files' contents are also returned as the `manifests` output parameter, which records what was
+	// deployed.
+	ManifestsOutputDir string `json:"manifestsOutputDir,omitempty"`
+	// MaxManifestsBytes, if positive, caps the size of each app's manifests file and of the `manifests` output
+	// parameter. A file is cut at the end of a line and marked `... (truncated, N bytes omitted)`, and files which don't
+	// fit are left out of the parameter. The `manifestsTruncated` output parameter says whether either happened. Zero
+	// uses the plugin's default diff output cap, and a negative value means no limit.
+	MaxManifestsBytes int `json:"maxManifestsBytes,omitempty"`
+	// VerifySignature, if true, refuses to sync apps whose target revision doesn't have a valid GnuPG signature. Argo CD
+	// must have GnuPG enabled, and the app's project must list the keys which are allowed to sign.
+	VerifySignature bool `json:"verifySignature,omitempty"`
+	// WaitForHealth, if true, waits after requesting each app's sync until the sync operation has completed and the app
+	// is healthy. The action fails if an app's sync fails, or names the apps which aren't healthy yet if the wait times
+	// out.
+	WaitForHealth bool `json:"waitForHealth,omitempty"`
+	// HealthTimeout limits how long to wait for each app to become healthy, counted from when its sync was requested.
+	// Defaults to no limit other than the action's timeout.
+	HealthTimeout string `json:"healthTimeout,omitempty"`
+	// SyncChildApps, if true, also waits for the child apps of each app of apps to be synced and healthy, once the app
+	// itself is healthy. Child apps are the Applications among the app's managed resources, and their own child apps are
+	// waited for too. HealthTimeout applies to each child app. Requires WaitForHealth.
+	SyncChildApps bool `json:"syncChildApps,omitempty"`
+	// WaitForSyncWindow, if true, keeps retrying the sync of an app which a sync window doesn't allow to be synced, until
+	// a window allows it or the action times out. Otherwise, the app fails right away. Either way, the
+	// `blockedBySyncWindow` output parameter says whether a window blocked any app.
+	WaitForSyncWindow bool `json:"waitForSyncWindow,omitempty"`
+	// AllowPartialSuccess, if true, lets the node succeed when some of the apps fail to sync, as long as at least one
+	// succeeds. The failed apps are reported as a warning, and the `exitCode` output parameter is still 2.
+	AllowPartialSuccess bool `json:"allowPartialSuccess,omitempty"`
+}
+
+// ErrorConditionPolicy describes what an action does with apps which have error conditions, like a ComparisonError
+// when the app's repo is unreachable or its manifests are invalid.
+type ErrorConditionPolicy string
+
+const (
+	// ErrorConditionPolicyProceed ignores error conditions. This is the default.
+	ErrorConditionPolicyProceed ErrorConditionPolicy = "proceed"
+	// ErrorConditionPolicyFail fails the action for the app, with the conditions' messages.
+	ErrorConditionPolicyFail ErrorConditionPolicy = "fail"
+	// ErrorConditionPolicySkip skips the app.
+	ErrorConditionPolicySkip ErrorConditionPolicy = "skip"
+)
+
+// RetryStrategy describes how an action retries failed API calls.
+type RetryStrategy struct {
+	// Limit is the maximum number of retries.
+	Limit int `json:"limit,omitempty"`
+	// Backoff is how long to wait before the first retry, like "1s". Defaults to the plugin's backoff for the error's
+	// code.
+	Backoff string `json:"backoff,omitempty"`
+	// Factor multiplies the backoff after each retry. Defaults to 2.
+	Factor int `json:"factor,omitempty"`
+}
+
+// DiffOutputFormat is the format of a diff action's output.
+type DiffOutputFormat string
+
+const (
+	// DiffOutputFormatText outputs the concatenated diffs of the changed resources. This is the default.
+	DiffOutputFormatText DiffOutputFormat = "text"
+	// DiffOutputFormatJSON outputs a JSON object with a summary counting the modified, added and removed resources, and
+	// a resources array with an object for each diffed resource, sorted by group, kind, namespace and name. Each object
+	// has the resource's group, kind, name and namespace, whether it's modified, and its diff, which is empty for
+	// unmodified resources. Hooks are only included if the action includes them. If resources were left out to fit the
+	// output size cap, omittedResources counts them.
+	DiffOutputFormatJSON DiffOutputFormat = "json"
+)
+
+// AutomatedSyncPolicy describes what a sync action does with apps which have automated sync enabled. A manual sync of
+// such an app may fight the controller, for example when self-heal reverts it.
+type AutomatedSyncPolicy string
+
+const (
+	// AutomatedSyncPolicyProceed syncs the app anyway, reporting its automated sync policy.
+	AutomatedSyncPolicyProceed AutomatedSyncPolicy = "proceed"
+	// AutomatedSyncPolicyWarn syncs the app anyway, reporting its automated sync policy along with a warning.
+	AutomatedSyncPolicyWarn AutomatedSyncPolicy = "warn"
+	// AutomatedSyncPolicySkip doesn't sync the app, leaving it to the controller.
+	AutomatedSyncPolicySkip AutomatedSyncPolicy = "skip"
+)
+
+// ResourceRef identifies a single resource. Group and Namespace are empty for core and cluster-scoped resources.
+type ResourceRef struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// ResourceMatcher matches resources by their identity. Empty fields match anything.
+type ResourceMatcher struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
 }
 
+// ValueSource describes where the YAML for a field is read from. Large values (like a list of hundreds of apps) may
+// exceed workflow template size limits, so they can instead be passed base64-encoded or as a path to a mounted file.
+type ValueSource string
+
+const (
+	// ValueSourceInline means the field holds the YAML itself.
+	ValueSourceInline ValueSource = "inline"
+	// ValueSourceBase64 means the field holds base64-encoded YAML.
+	ValueSourceBase64 ValueSource = "base64"
+	// ValueSourceFile means the field holds the path to a file containing the YAML.
+	ValueSourceFile ValueSource = "file"
+)
+
+// SyncApp specifies an app to be synced by a sync action.
+type SyncApp struct {
+	App `yaml:",inline"`
+	// Options are sync options for this app only. They're applied on top of the action's options: an option here
+	// replaces the action's option with the same key, for example `Replace=true` replaces `Replace=false`. Like the
+	// action's options, they may be a list or a map.
+	Options SyncOptions `json:"options,omitempty"`
+	// Revision, if set, is the revision to sync this app to. It takes precedence over the action's revision.
+	Revision string `json:"revision,omitempty"`
+}
+
+// SyncOptions are sync options as `key=value` pairs, like `ServerSideApply=true`.
+type SyncOptions []string
+
 // App specifies the app to be synced.
 type App struct {
 	// Namespace is the namespace in which the app is installed. If empty, assume the same namespace as the Argo CD
@@ -0,0 +1,297 @@
+package argocd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// Validate checks the plugin spec without contacting Argo CD. See ActionSpec.Validate.
+func (p PluginSpec) Validate() error {
+	if p.ArgoCD == nil {
+		return errors.New("plugin spec has no argocd block")
+	}
+	return p.ArgoCD.Validate()
+}
+
+// Validate checks the action without contacting Argo CD: that it has a single action type, or a diff and a sync with
+// diffThenSync, that required fields are set, and that durations, apps, and options parse. It returns all of the
+// problems it finds at once. Every action is validated before it runs, not only in validateOnly mode. Values read from
+// files aren't checked until they're read, since the files usually only exist where the plugin runs. Project defaults
+// aren't applied, so fields which they would set must be set on the action.
+func (s ActionSpec) Validate() error {
+	var errs multiError
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse timeout: %w", err))
+		}
+	}
+	if err := validateActionTypes(s.App); err != nil {
+		errs = append(errs, err)
+	}
+	if s.App != nil {
+		errs = append(errs, s.App.validate()...)
+	}
+	errs = append(errs, s.validateMessages()...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateActionTypes checks that the app block sets a single action type, or a diff and a sync with diffThenSync.
+func validateActionTypes(app *AppActionSpec) error {
+	if app == nil {
+		return errors.New("action is missing a valid action type (i.e. an 'app' block)")
+	}
+	actionTypes := appActionTypes(*app)
+	if len(actionTypes) == 0 {
+		return errors.New("app action has no action type specified (must be sync, diff, list, setRevision, create, delete, rollback, terminate, refresh, waitForSync, or version)")
+	}
+	if app.DiffThenSync {
+		if len(actionTypes) != 2 || app.Sync == nil || app.Diff == nil {
+			return errors.New("diffThenSync requires exactly a sync and a diff action")
+		}
+	} else if app.VerifyRevision {
+		return errors.New("verifyRevision requires diffThenSync")
+	} else if len(actionTypes) > 1 {
+		return fmt.Errorf("action has multiple types of action defined (%s); only diff and sync may be combined, by setting diffThenSync", strings.Join(actionTypes, " and "))
+	}
+	if app.VerifyRevision && app.Diff.Apps != "" {
+		return errors.New("verifyRevision requires a diff of a single app")
+	}
+	return nil
+}
+
+// validate checks each of the app block's actions.
+func (s AppActionSpec) validate() multiError {
+	var errs multiError
+	if s.Sync != nil {
+		errs = append(errs, s.Sync.validate()...)
+		if s.Sync.AppsSource != ValueSourceFile {
+			if _, err := readApps(*s.Sync); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if s.Sync.OptionsSource != ValueSourceFile {
+			if _, err := readSyncOptions(*s.Sync); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if s.Diff != nil {
+		errs = append(errs, s.Diff.validate()...)
+	}
+	if s.List != nil {
+		errs = append(errs, s.List.validate()...)
+	}
+	if s.SetRevision != nil {
+		errs = append(errs, s.SetRevision.validate()...)
+	}
+	if s.Create != nil {
+		if _, err := readApplication(*s.Create); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.Delete != nil {
+		errs = append(errs, s.Delete.validate()...)
+	}
+	if s.Rollback != nil {
+		errs = append(errs, s.Rollback.validate()...)
+	}
+	if s.Terminate != nil {
+		errs = append(errs, requireAppName(s.Terminate.App)...)
+	}
+	if s.Refresh != nil {
+		errs = append(errs, requireAppName(s.Refresh.App)...)
+	}
+	if s.WaitForSync != nil {
+		errs = append(errs, requireAppName(s.WaitForSync.App)...)
+	}
+	return errs
+}
+
+// requireAppName checks that an action which targets a single app names it.
+func requireAppName(app App) multiError {
+	if app.Name == "" {
+		return multiError{errors.New("app name is required")}
+	}
+	return nil
+}
+
+// validate checks the sync action's fields, other than its apps and options, which are checked when they're read.
+func (a SyncAction) validate() multiError {
+	var errs multiError
+	switch a.AutomatedSyncPolicy {
+	case "", AutomatedSyncPolicyProceed, AutomatedSyncPolicyWarn, AutomatedSyncPolicySkip:
+	default:
+		errs = append(errs, fmt.Errorf("unknown automated sync policy %q (must be proceed, warn, or skip)", a.AutomatedSyncPolicy))
+	}
+	if err := a.ErrorConditionPolicy.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if a.MaxConcurrency < 0 {
+		errs = append(errs, errors.New("maxConcurrency must not be negative"))
+	}
+	if a.Selector != "" {
+		if _, err := labels.Parse(a.Selector); err != nil {
+			errs = append(errs, fmt.Errorf("invalid selector %q: %w", a.Selector, err))
+		}
+	}
+	for i, res := range a.Resources {
+		if res.Kind == "" || res.Name == "" {
+			errs = append(errs, fmt.Errorf("resource %d must set kind and name", i))
+		}
+	}
+	if a.WaitForHealth && a.DryRun {
+		errs = append(errs, errors.New("waitForHealth can't be combined with dryRun, which doesn't change the app's health"))
+	}
+	if a.SyncChildApps && !a.WaitForHealth {
+		errs = append(errs, errors.New("syncChildApps requires waitForHealth"))
+	}
+	if a.HealthTimeout != "" {
+		if !a.WaitForHealth {
+			errs = append(errs, errors.New("healthTimeout requires waitForHealth"))
+		}
+		if _, err := time.ParseDuration(a.HealthTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse health timeout: %w", err))
+		}
+	}
+	if a.Retry != nil {
+		if _, err := a.Retry.policy(RetryPolicy{}); err != nil {
+			errs = append(errs, fmt.Errorf("invalid sync retry strategy: %w", err))
+		}
+	}
+	return errs
+}
+
+// validate checks the diff action's fields. The apps list is parsed unless it's read from a file.
+func (a DiffAction) validate() multiError {
+	var errs multiError
+	if a.Apps != "" {
+		if a.App.Name != "" {
+			errs = append(errs, errors.New("a diff action may set app or apps, but not both"))
+		}
+		if a.Resource != nil {
+			errs = append(errs, errors.New("resource can't be combined with apps, since it names a resource of a single app"))
+		}
+		if a.AppsSource != ValueSourceFile {
+			if _, err := readDiffApps(a); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	} else if a.App.Name == "" {
+		errs = append(errs, errors.New("a diff action must set app or apps"))
+	}
+	if _, err := newNormalizers(a.Normalizers); err != nil {
+		errs = append(errs, fmt.Errorf("failed to parse normalizers: %w", err))
+	}
+	if a.Resource != nil && (a.Resource.Kind == "" || a.Resource.Name == "") {
+		errs = append(errs, errors.New("resource must set kind and name"))
+	}
+	if _, err := path.Match(a.NameGlob, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid nameGlob %q: %w", a.NameGlob, err))
+	}
+	if err := a.OutputFormat.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if a.FallbackRevision != "" && a.Revision == "" {
+		errs = append(errs, errors.New("fallbackRevision requires revision"))
+	}
+	if a.RefreshIfOlderThan != "" {
+		if _, err := time.ParseDuration(a.RefreshIfOlderThan); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse refreshIfOlderThan: %w", err))
+		}
+	}
+	if err := a.ErrorConditionPolicy.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (a ListAction) validate() multiError {
+	if a.Limit < 0 || a.Offset < 0 {
+		return multiError{errors.New("limit and offset must not be negative")}
+	}
+	return nil
+}
+
+func (a SetRevisionAction) validate() multiError {
+	var errs multiError
+	if a.Name == "" {
+		errs = append(errs, errors.New("app name is required"))
+	}
+	if a.Revision == "" {
+		errs = append(errs, errors.New("revision is required"))
+	}
+	if a.SourceIndex != 0 {
+		errs = append(errs, fmt.Errorf("source index %d is not supported: only single-source apps are supported", a.SourceIndex))
+	}
+	if a.Retry != nil {
+		if _, err := a.Retry.policy(RetryPolicy{}); err != nil {
+			errs = append(errs, fmt.Errorf("invalid setRevision retry strategy: %w", err))
+		}
+	}
+	return errs
+}
+
+func (a DeleteAction) validate() multiError {
+	var errs multiError
+	if a.Name == "" {
+		errs = append(errs, errors.New("app name is required"))
+	}
+	switch a.PropagationPolicy {
+	case "", "foreground", "background":
+	default:
+		errs = append(errs, fmt.Errorf("unknown propagation policy %q (must be foreground or background)", a.PropagationPolicy))
+	}
+	if a.PropagationPolicy != "" && !a.Cascade {
+		errs = append(errs, errors.New("propagationPolicy requires cascade"))
+	}
+	return errs
+}
+
+func (a RollbackAction) validate() multiError {
+	var errs multiError
+	if a.Name == "" {
+		errs = append(errs, errors.New("app name is required"))
+	}
+	if a.ID != 0 && a.Revision != "" {
+		errs = append(errs, errors.New("only one of id and revision may be set"))
+	}
+	return errs
+}
+
+// readSyncOptions reads and unmarshals a sync action's options.
+func readSyncOptions(action SyncAction) (SyncOptions, error) {
+	optionsYAML, err := readValue(action.Options, action.OptionsSource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read options: %w", err)
+	}
+	var options SyncOptions
+	err = yaml.Unmarshal(optionsYAML, &options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal options: %w", redactYAMLError(err))
+	}
+	return options, nil
+}
+
+// readApplication unmarshals a create action's Application manifest.
+func readApplication(action CreateAction) (*v1alpha1.Application, error) {
+	app := &v1alpha1.Application{}
+	err := k8syaml.UnmarshalStrict([]byte(action.Application), app)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal application: %w", err)
+	}
+	if app.Name == "" {
+		return nil, errors.New("application name is required")
+	}
+	return app, nil
+}
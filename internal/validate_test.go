@@ -0,0 +1,173 @@
+package argocd
+
+import (
+	"context"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionSpec_Validate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		action   ActionSpec
+		expected []string
+	}{
+		{
+			name:   "valid sync",
+			action: ActionSpec{Timeout: "5m", App: &AppActionSpec{Sync: &SyncAction{Apps: "[{name: my-app}]", Options: "{Prune: true}"}}},
+		},
+		{
+			name:   "valid diff then sync",
+			action: ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "my-app"}}, Sync: &SyncAction{Apps: "[{name: my-app}]"}, DiffThenSync: true}},
+		},
+		{
+			name:   "valid sync by selector",
+			action: ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Selector: "team=payments"}}},
+		},
+		{
+			name:     "invalid selector",
+			action:   ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Selector: "team in payments"}}},
+			expected: []string{`invalid selector "team in payments"`},
+		},
+		{
+			name:   "apps read from a file aren't checked",
+			action: ActionSpec{App: &AppActionSpec{Sync: &SyncAction{Apps: "/missing.yaml", AppsSource: ValueSourceFile}}},
+		},
+		{
+			name:   "valid messages",
+			action: ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app"}}}, SuccessMessage: "refreshed ${app}", FailureMessage: "${action} of ${app} failed: ${error}"},
+		},
+		{
+			name:     "unknown message variables",
+			action:   ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{App: App{Name: "my-app"}}}, SuccessMessage: "${app} failed: ${error}", FailureMessage: "${apps} failed"},
+			expected: []string{"successMessage uses unknown variables: ${error}", "failureMessage uses unknown variables: ${apps}"},
+		},
+		{
+			name:     "no app block",
+			action:   ActionSpec{},
+			expected: []string{"action is missing a valid action type"},
+		},
+		{
+			name:     "no action type",
+			action:   ActionSpec{App: &AppActionSpec{}},
+			expected: []string{"app action has no action type specified"},
+		},
+		{
+			name:   "sync and diff without diffThenSync",
+			action: ActionSpec{App: &AppActionSpec{Diff: &DiffAction{}, Sync: &SyncAction{Apps: "[{name: my-app}]"}}},
+			expected: []string{
+				"action has multiple types of action defined (sync and diff)",
+				"a diff action must set app or apps",
+			},
+		},
+		{
+			name: "all errors at once",
+			action: ActionSpec{Timeout: "soon", App: &AppActionSpec{Sync: &SyncAction{
+				Apps:           "[{namespace: argocd}]",
+				Options:        "Prune=true",
+				MaxConcurrency: -1,
+				SyncChildApps:  true,
+				HealthTimeout:  "later",
+			}}},
+			expected: []string{
+				`failed to parse timeout: time: invalid duration "soon"`,
+				"maxConcurrency must not be negative",
+				"syncChildApps requires waitForHealth",
+				"healthTimeout requires waitForHealth",
+				`failed to parse health timeout: time: invalid duration "later"`,
+				"app 0 has no name",
+				"sync options must be a list",
+			},
+		},
+		{
+			name:     "invalid diff",
+			action:   ActionSpec{App: &AppActionSpec{Diff: &DiffAction{App: App{Name: "my-app"}, Apps: "[]", OutputFormat: "xml", NameGlob: "["}}},
+			expected: []string{"may set app or apps, but not both", "no apps to diff", "invalid nameGlob", "unknown output format"},
+		},
+		{
+			name:     "invalid delete",
+			action:   ActionSpec{App: &AppActionSpec{Delete: &DeleteAction{PropagationPolicy: "foreground"}}},
+			expected: []string{"app name is required", "propagationPolicy requires cascade"},
+		},
+		{
+			name:     "missing app names",
+			action:   ActionSpec{App: &AppActionSpec{SetRevision: &SetRevisionAction{}}},
+			expected: []string{"app name is required", "revision is required"},
+		},
+		{
+			name:     "invalid set revision retry",
+			action:   ActionSpec{App: &AppActionSpec{SetRevision: &SetRevisionAction{App: App{Name: "my-app"}, Revision: "v1", Retry: &RetryStrategy{Limit: -1}}}},
+			expected: []string{"invalid setRevision retry strategy: retry limit must not be negative"},
+		},
+		{
+			name:     "invalid create",
+			action:   ActionSpec{App: &AppActionSpec{Create: &CreateAction{Application: "metadata: {namespace: argocd}"}}},
+			expected: []string{"application name is required"},
+		},
+		{
+			name:     "invalid refresh",
+			action:   ActionSpec{App: &AppActionSpec{Refresh: &RefreshAction{}}},
+			expected: []string{"app name is required"},
+		},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			err := testCase.action.Validate()
+			if len(testCase.expected) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			var errs multiError
+			require.ErrorAs(t, err, &errs)
+			require.Len(t, errs, len(testCase.expected), err.Error())
+			for i, expected := range testCase.expected {
+				assert.Contains(t, errs[i].Error(), expected)
+			}
+		})
+	}
+}
+
+func TestPluginSpec_Validate(t *testing.T) {
+	t.Parallel()
+
+	require.EqualError(t, PluginSpec{}.Validate(), "plugin spec has no argocd block")
+	require.NoError(t, PluginSpec{ArgoCD: &ActionSpec{App: &AppActionSpec{Version: &VersionAction{}}}}.Validate())
+}
+
+func TestApiExecutor_Execute_validateOnly(t *testing.T) {
+	t.Parallel()
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		client, appClient := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"validateOnly": true, "app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, "action is valid", *reply.Node.Outputs.Result)
+		assert.Empty(t, appClient.syncRequests, "the action must not run")
+		assert.Empty(t, appClient.calls, "Argo CD must not be contacted")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"validateOnly": true, "timeout": "soon", "app": {"refresh": {}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Equal(t, `action failed: invalid action: failed to parse timeout: time: invalid duration "soon", app name is required`, reply.Node.Message)
+		assert.Equal(t, "3", parameter(t, reply, "exitCode"))
+	})
+
+	t.Run("without an API client", func(t *testing.T) {
+		t.Parallel()
+		e := NewApiExecutor(nil, "")
+		_, err := e.runAction(context.Background(), ActionSpec{ValidateOnly: true, App: &AppActionSpec{Version: &VersionAction{}}})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,115 @@
+package argocd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apiclient/version"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Version is the plugin's version. It's set at build time with
+// `-ldflags "-X github.com/crenshaw-dev/argocd-executor-plugin/internal.Version=v1.2.3"`. If it isn't, the version of
+// the module the plugin was built from is used, if it's known.
+var Version = ""
+
+// pluginVersion returns the plugin's version, or "unknown".
+func pluginVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// versionInfo is the output of a version action.
+type versionInfo struct {
+	Server serverVersionInfo `json:"server"`
+	Plugin pluginVersionInfo `json:"plugin"`
+}
+
+// serverVersionInfo describes the Argo CD API server's build.
+type serverVersionInfo struct {
+	Version          string `json:"version"`
+	BuildDate        string `json:"buildDate,omitempty"`
+	GitCommit        string `json:"gitCommit,omitempty"`
+	GitTreeState     string `json:"gitTreeState,omitempty"`
+	GoVersion        string `json:"goVersion,omitempty"`
+	Platform         string `json:"platform,omitempty"`
+	KustomizeVersion string `json:"kustomizeVersion,omitempty"`
+	HelmVersion      string `json:"helmVersion,omitempty"`
+	KubectlVersion   string `json:"kubectlVersion,omitempty"`
+}
+
+// pluginVersionInfo describes the plugin's build.
+type pluginVersionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// getServerVersion gets the Argo CD API server's version.
+func getServerVersion(ctx context.Context, versionClient version.VersionServiceClient) (serverVersionInfo, error) {
+	server, err := versionClient.Version(ctx, &emptypb.Empty{})
+	if err != nil {
+		return serverVersionInfo{}, fmt.Errorf("failed to get Argo CD server version: %w", err)
+	}
+	return serverVersionInfo{
+		Version:          server.Version,
+		BuildDate:        server.BuildDate,
+		GitCommit:        server.GitCommit,
+		GitTreeState:     server.GitTreeState,
+		GoVersion:        server.GoVersion,
+		Platform:         server.Platform,
+		KustomizeVersion: server.KustomizeVersion,
+		HelmVersion:      server.HelmVersion,
+		KubectlVersion:   server.KubectlVersion,
+	}, nil
+}
+
+// serverVersionParameter returns the `serverVersion` output parameter, which sync and diff actions set to the version
+// of the Argo CD API server they talked to.
+func serverVersionParameter(ctx context.Context, timeout string, versionClient version.VersionServiceClient) (wfv1.Parameter, error) {
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return wfv1.Parameter{}, fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	server, err := getServerVersion(ctx, versionClient)
+	if err != nil {
+		return wfv1.Parameter{}, err
+	}
+	return wfv1.Parameter{Name: "serverVersion", Value: wfv1.AnyStringPtr(server.Version)}, nil
+}
+
+// getVersions gets the versions of the Argo CD API server and of the plugin, and returns them as JSON.
+func getVersions(ctx context.Context, timeout string, versionClient version.VersionServiceClient) (versionInfo, string, error) {
+	ctx, cancel, err := durationStringToContext(ctx, timeout)
+	if err != nil {
+		return versionInfo{}, "", fmt.Errorf("failed get action context: %w", err)
+	}
+	defer cancel()
+	server, err := getServerVersion(ctx, versionClient)
+	if err != nil {
+		return versionInfo{}, "", err
+	}
+	info := versionInfo{
+		Server: server,
+		Plugin: pluginVersionInfo{
+			Version:   pluginVersion(),
+			GoVersion: runtime.Version(),
+			Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		},
+	}
+	out, err := json.Marshal(info)
+	if err != nil {
+		return versionInfo{}, "", fmt.Errorf("failed to marshal versions: %w", err)
+	}
+	return info, string(out), nil
+}
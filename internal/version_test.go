@@ -0,0 +1,72 @@
+package argocd
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"testing"
+
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApiExecutor_Execute_version(t *testing.T) {
+	t.Parallel()
+
+	t.Run("version action", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"version": {}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, testServerVersion, parameter(t, reply, "serverVersion"))
+		assert.Equal(t, pluginVersion(), parameter(t, reply, "pluginVersion"))
+		require.NotNil(t, reply.Node.Outputs.Result)
+		var info versionInfo
+		require.NoError(t, json.Unmarshal([]byte(*reply.Node.Outputs.Result), &info))
+		assert.Equal(t, testServerVersion, info.Server.Version)
+		assert.Equal(t, runtime.Version(), info.Plugin.GoVersion)
+		assert.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, info.Plugin.Platform)
+	})
+
+	t.Run("version action fails if the server can't be reached", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		client.versionClient.err = errors.New("boom")
+		reply := execute(t, client, `{"argocd": {"app": {"version": {}}}}`)
+		assert.Equal(t, wfv1.NodeFailed, reply.Node.Phase)
+		assert.Contains(t, reply.Node.Message, "failed to get Argo CD server version: boom")
+	})
+
+	t.Run("sync records the server version", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, testServerVersion, parameter(t, reply, "serverVersion"))
+	})
+
+	t.Run("diff records the server version", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		reply := execute(t, client, `{"argocd": {"app": {"diff": {"app": {"name": "my-app"}}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, testServerVersion, parameter(t, reply, "serverVersion"))
+	})
+
+	t.Run("sync warns if the server version is unknown", func(t *testing.T) {
+		t.Parallel()
+		client, _ := newTestFakes(t, nil, nil)
+		client.versionClient.err = errors.New("boom")
+		reply := execute(t, client, `{"argocd": {"app": {"sync": {"apps": "[{name: my-app}]"}}}}`)
+		assert.Equal(t, wfv1.NodeSucceeded, reply.Node.Phase)
+		assert.Equal(t, `["failed to get Argo CD server version: boom"]`, parameter(t, reply, "warnings"))
+	})
+}
+
+func Test_pluginVersion(t *testing.T) {
+	t.Parallel()
+
+	// Tests aren't built with -ldflags or from a tagged module, so the version isn't known.
+	assert.Equal(t, "unknown", pluginVersion())
+}